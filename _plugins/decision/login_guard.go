@@ -0,0 +1,57 @@
+// Decision Plugin that blocks POST requests to a login path when a
+// request body model detects an attack
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	pm "wace/pluginmanager"
+
+	lg "github.com/tilsor/ModSecIntl_logging/logging"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// loginGuard is an instance of the plugin, so several login paths can
+// be guarded with different decision IDs
+type loginGuard struct {
+	loginPath string
+	threshold float64
+}
+
+func InitPlugin(params map[string]string, meter metric.Meter) (pm.DecisionPlugin, error) {
+	g := &loginGuard{loginPath: params["path"], threshold: 0.5}
+	if g.loginPath == "" {
+		g.loginPath = "/login"
+	}
+	if stringThreshold, ok := params["threshold"]; ok {
+		var err error
+		g.threshold, err = strconv.ParseFloat(stringThreshold, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing threshold parameter: %v", err)
+		}
+	}
+	return g, nil
+}
+
+// CheckResults cannot decide without the request, it is only called by
+// the WACE versions without CheckTransaction support.
+func (g *loginGuard) CheckResults(input pm.DecisionInput) (bool, error) {
+	return false, fmt.Errorf("login_guard needs CheckTransaction support")
+}
+
+func (g *loginGuard) CheckTransaction(input pm.TransactionInput) (bool, error) {
+	logger := lg.Get()
+	if input.Request.Method != "POST" || !strings.HasPrefix(input.Request.Path, g.loginPath) {
+		return false, nil
+	}
+	for modelID, res := range input.PhaseResults["RequestBody"] {
+		logger.TPrintf(lg.DEBUG, input.TransactionId, "login_guard | %s: %v (%v)", modelID, res.ProbAttack, input.Executions[modelID].Latency)
+		if res.ProbAttack > g.threshold {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -7,84 +7,181 @@ import (
 	"fmt"
 	"strconv"
 
+	"wace/calibration"
+	pm "wace/pluginmanager"
+
 	lg "github.com/tilsor/ModSecIntl_logging/logging"
-	pm "github.com/tilsor/ModSecIntl_wace_lib/pluginmanager"
+	cf "github.com/tilsor/ModSecIntl_wace_lib/configstore"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/metric"
 )
 
-var wafWeight float64
-var threshold float64
+// Modes of using the model results in the weighted sum
+const (
+	// raw uses the results as is
+	raw = "raw"
+	// binarised uses 1 for results over the threshold of the model, and
+	// 0 otherwise
+	binarised = "binarised"
+	// clipped uses 0 for results under the threshold of the model
+	clipped = "clipped"
+	// calibrated uses the calibrated results, and needs a calibration
+	// file
+	calibrated = "calibrated"
+)
+
+// weightedSumPlugin is an instance of the plugin, so it can back several
+// decision IDs with different params
+type weightedSumPlugin struct {
+	wafWeight             float64
+	threshold             float64
+	mode                  string
+	defaultModelThreshold float64
+	calibrators           map[string]calibration.Calibrator
+}
 
-func InitPlugin(params map[string]string, meter metric.Meter) error {
+func InitPlugin(params map[string]string, meter metric.Meter) (pm.DecisionPlugin, error) {
+	w := new(weightedSumPlugin)
 	stringWafWeight, ok := params["waf_weight"]
 	if !ok {
-		return fmt.Errorf("waf_weight parameter not found")
+		return nil, fmt.Errorf("waf_weight parameter not found")
 	}
 	var err error
-	wafWeight, err = strconv.ParseFloat(stringWafWeight, 64)
+	w.wafWeight, err = strconv.ParseFloat(stringWafWeight, 64)
 	if err != nil {
-		return fmt.Errorf("error parsing waf_weight parameter: %v", err)
+		return nil, fmt.Errorf("error parsing waf_weight parameter: %v", err)
 	}
 
 	stringThreshold, ok := params["threshold"]
 	if !ok {
-		threshold = 0.5
+		w.threshold = 0.5
+	} else {
+		w.threshold, err = strconv.ParseFloat(stringThreshold, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing threshold parameter: %v", err)
+		}
+	}
+
+	w.mode, ok = params["mode"]
+	if !ok {
+		w.mode = raw
+	}
+	switch w.mode {
+	case raw, binarised, clipped, calibrated:
+	default:
+		return nil, fmt.Errorf("invalid mode %s", w.mode)
+	}
+
+	stringModelThreshold, ok := params["model_threshold"]
+	if !ok {
+		w.defaultModelThreshold = 0.5
 	} else {
-		threshold, err = strconv.ParseFloat(stringThreshold, 64)
+		w.defaultModelThreshold, err = strconv.ParseFloat(stringModelThreshold, 64)
 		if err != nil {
-			return fmt.Errorf("error parsing threshold parameter: %v", err)
+			return nil, fmt.Errorf("error parsing model_threshold parameter: %v", err)
 		}
 	}
 
+	if path, ok := params["calibration_file"]; ok {
+		w.calibrators, err = calibration.Load(path)
+		if err != nil {
+			return nil, fmt.Errorf("error loading calibration file: %v", err)
+		}
+	} else if w.mode == calibrated {
+		return nil, fmt.Errorf("calibrated mode needs the calibration_file parameter")
+	}
+
 	// Create counter for plugin register
 	ctx := context.Background()
 	pluginCounter, err := meter.Int64Counter("plugin_register")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	pluginCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("plugin_name", "weighted_sum"), attribute.String("plugin_type", "decision")))
-	return nil
+	return w, nil
+}
+
+// CheckResults decides on the inbound direction, for the WACE versions
+// without CheckTransaction support.
+func (w *weightedSumPlugin) CheckResults(decisionInput pm.DecisionInput) (bool, error) {
+	return w.check(decisionInput, pm.Inbound)
+}
+
+// CheckTransaction decides on the direction of the verdict, using the
+// inbound or outbound anomaly score of the WAF.
+func (w *weightedSumPlugin) CheckTransaction(input pm.TransactionInput) (bool, error) {
+	return w.check(input.DecisionInput, input.Direction)
+}
+
+// modelThreshold returns the threshold of the model plugin in the
+// configuration, or the model_threshold parameter if it has none.
+func (w *weightedSumPlugin) modelThreshold(modelID string) float64 {
+	if t := cf.Get().ModelPlugins[modelID].Threshold; t > 0 {
+		return t
+	}
+	return w.defaultModelThreshold
+}
+
+// score returns the score of the model result used in the weighted
+// sum: its calibrated probability if the model has a calibration, and
+// then binarised or clipped by the threshold of the model, depending
+// on the mode.
+func (w *weightedSumPlugin) score(modelID string, probAttack float64) float64 {
+	if c, ok := w.calibrators[modelID]; ok {
+		probAttack = c.Calibrate(probAttack)
+	}
+	switch w.mode {
+	case binarised:
+		if probAttack >= w.modelThreshold(modelID) {
+			return 1
+		}
+		return 0
+	case clipped:
+		if probAttack < w.modelThreshold(modelID) {
+			return 0
+		}
+	}
+	return probAttack
 }
 
-func CheckResults(decisionInput pm.DecisionInput) (bool, error) {
+func (w *weightedSumPlugin) check(decisionInput pm.DecisionInput, direction string) (bool, error) {
 	var weightedSum float64 = 0
 	var weightsSum float64 = 0
 	for key, value := range decisionInput.Results {
-		weightedSum += value.ProbAttack * decisionInput.ModelWeight[key]
+		weightedSum += w.score(key, value.ProbAttack) * decisionInput.ModelWeight[key]
 		weightsSum += decisionInput.ModelWeight[key]
 	}
 
-	stringInboundBlocking, ok := decisionInput.WAFdata["inbound_blocking"]
+	stringBlocking, ok := decisionInput.WAFdata[direction+"_blocking"]
 	if !ok {
-		return false, fmt.Errorf("inbound_blocking parameter not found")
+		return false, fmt.Errorf("%s_blocking parameter not found", direction)
 	}
-	stringInboundThreshold, ok := decisionInput.WAFdata["inbound_threshold"]
+	stringThreshold, ok := decisionInput.WAFdata[direction+"_threshold"]
 	if !ok {
-		return false, fmt.Errorf("inbound_threshold parameter not found")
+		return false, fmt.Errorf("%s_threshold parameter not found", direction)
 	}
 
-	as, err := strconv.ParseFloat(stringInboundBlocking, 64)
+	as, err := strconv.ParseFloat(stringBlocking, 64)
 	if err != nil {
 		return false, fmt.Errorf("error parsing anomaly score: %v", err)
 	}
-	it, err := strconv.ParseFloat(stringInboundThreshold, 64)
+	it, err := strconv.ParseFloat(stringThreshold, 64)
 	if err != nil {
 		return false, fmt.Errorf("error parsing anomaly score threshold: %v", err)
 	}
 
 	logger := lg.Get()
-	logger.TPrintf(lg.DEBUG, decisionInput.TransactionId, "weighted_sum | anomaly score: %v anomaly score threshold: %v", as, it)
+	logger.TPrintf(lg.DEBUG, decisionInput.TransactionId, "weighted_sum | %s anomaly score: %v anomaly score threshold: %v", direction, as, it)
 
 	if as >= it {
-		weightedSum += wafWeight
+		weightedSum += w.wafWeight
 	} else {
-		weightedSum += (as / it) * wafWeight
+		weightedSum += (as / it) * w.wafWeight
 	}
-	weightsSum += wafWeight
+	weightsSum += w.wafWeight
 
 	weightedSum /= weightsSum
 
-	logger.TPrintf(lg.DEBUG, decisionInput.TransactionId, "weighted_sum | weighted sum: %v threshold: %v", weightedSum, threshold)
-	return weightedSum > threshold, nil
+	logger.TPrintf(lg.DEBUG, decisionInput.TransactionId, "weighted_sum | weighted sum: %v threshold: %v", weightedSum, w.threshold)
+	return weightedSum > w.threshold, nil
 }
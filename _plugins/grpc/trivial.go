@@ -0,0 +1,40 @@
+/* Trivial out-of-process Model Plugin that returns a fixed probability
+   of attack (the prob_attack parameter, 0 by default). Built as an
+   executable, and configured with mode "grpc":
+
+     go build -o _plugins/grpc/trivial _plugins/grpc/trivial.go
+*/
+
+package main
+
+import (
+	"log"
+	"strconv"
+
+	pm "wace/pluginmanager"
+)
+
+type trivial struct {
+	probAttack float64
+}
+
+func newTrivial(params map[string]string) (pm.ModelPlugin, error) {
+	t := new(trivial)
+	if value, ok := params["prob_attack"]; ok {
+		var err error
+		t.probAttack, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (t *trivial) Process(input pm.ModelInput) (pm.ModelResults, error) {
+	return pm.ModelResults{ProbAttack: t.probAttack}, nil
+}
+
+func main() {
+	// The address is only used when the plugin is not launched by WACE
+	log.Fatal(pm.ServeModel("unix:///tmp/wace-trivial.sock", newTrivial))
+}
@@ -0,0 +1,48 @@
+// Model Plugin that scores payloads against a file of weighted literal
+// and regex signatures, reloading the file when it changes
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pm "wace/pluginmanager"
+	"wace/signature"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// InitPlugin loads the signature file of the file parameter. The file
+// is checked for changes every reload_interval (default 10s, "0s"
+// disables the reloads).
+func InitPlugin(params map[string]string, meter metric.Meter) (pm.ModelPlugin, error) {
+	path, ok := params["file"]
+	if !ok {
+		return nil, fmt.Errorf("file parameter not found")
+	}
+	interval := 10 * time.Second
+	if stringInterval, ok := params["reload_interval"]; ok {
+		var err error
+		interval, err = time.ParseDuration(stringInterval)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("invalid reload_interval parameter %s", stringInterval)
+		}
+	}
+	m, err := signature.NewModel(path, interval)
+	if err != nil {
+		return nil, fmt.Errorf("error loading signature file: %v", err)
+	}
+
+	// Create counter for plugin register
+	ctx := context.Background()
+	pluginCounter, err := meter.Int64Counter("plugin_register")
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	pluginCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("plugin_name", "signatures"), attribute.String("plugin_type", "model")))
+	return m, nil
+}
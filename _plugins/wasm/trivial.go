@@ -0,0 +1,55 @@
+/* Trivial WebAssembly Model Plugin that returns a fixed probability of
+   attack (the prob_attack parameter, 0 by default). Built as a WASI
+   reactor (Go 1.24 or later):
+
+     GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o _plugins/wasm/trivial.wasm _plugins/wasm/trivial.go
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"unsafe"
+)
+
+var probAttack float64
+
+// buffers keeps the inputs allocated by WACE until they are freed
+var buffers = make(map[uintptr][]byte)
+
+//go:wasmexport wace_alloc
+func alloc(size uint32) uintptr {
+	buf := make([]byte, size+1)
+	ptr := uintptr(unsafe.Pointer(&buf[0]))
+	buffers[ptr] = buf
+	return ptr
+}
+
+//go:wasmexport wace_free
+func free(ptr uintptr, size uint32) {
+	delete(buffers, ptr)
+}
+
+//go:wasmexport wace_init
+func initPlugin(ptr uintptr, size uint32) int32 {
+	var params map[string]string
+	if err := json.Unmarshal(buffers[ptr][:size], &params); err != nil {
+		return 1
+	}
+	if value, ok := params["prob_attack"]; ok {
+		var err error
+		probAttack, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+//go:wasmexport wace_process
+func process(ptr uintptr, size uint32) float64 {
+	return probAttack
+}
+
+func main() {}
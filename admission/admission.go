@@ -0,0 +1,369 @@
+/*
+Package admission implements the admission control of the calls made
+by the WAFs to WACE: it limits the number of concurrent transactions
+and the rate of calls, both globally and per client, so a single
+misbehaving client cannot starve the rest.
+*/
+package admission
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"wace/tenant"
+
+	lg "github.com/tilsor/ModSecIntl_logging/logging"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// FallbackMetadataKey is the trailer metadata key holding the verdict
+// the WAF should apply to a rejected transaction.
+const FallbackMetadataKey = "wace-fallback-verdict"
+
+// Config holds the admission limits. A zero value disables the
+// corresponding limit.
+type Config struct {
+	// MaxTransactions is the maximum number of concurrent transactions.
+	MaxTransactions int
+	// MaxClientTransactions is the maximum number of concurrent
+	// transactions of a single client.
+	MaxClientTransactions int
+	// RequestsPerSecond is the maximum rate of calls.
+	RequestsPerSecond float64
+	// ClientRequestsPerSecond is the maximum rate of calls of a single
+	// client.
+	ClientRequestsPerSecond float64
+	// Burst is the number of calls allowed over the rate limits in a
+	// burst. It defaults to one second worth of calls.
+	Burst int
+	// ClientKey identifies the clients, either by "peer" address
+	// (default) or by the common name of their TLS client "cert".
+	ClientKey string
+	// FallbackVerdict is the verdict ("allow" or "block") the WAF is
+	// told to apply when a call is rejected.
+	FallbackVerdict string
+	// TransactionTimeout is the time after the last call of an
+	// admitted transaction after which it is considered abandoned,
+	// freeing its slot, for the transactions that are never closed. It
+	// defaults to DefaultTransactionTimeout.
+	TransactionTimeout time.Duration
+}
+
+// DefaultTransactionTimeout is the default TransactionTimeout.
+const DefaultTransactionTimeout = time.Minute
+
+// Check verifies the admission configuration.
+func (c Config) Check() error {
+	if c.MaxTransactions < 0 || c.MaxClientTransactions < 0 || c.RequestsPerSecond < 0 || c.ClientRequestsPerSecond < 0 || c.Burst < 0 || c.TransactionTimeout < 0 {
+		return fmt.Errorf("admission limits cannot be negative")
+	}
+	if c.ClientKey != "" && c.ClientKey != "peer" && c.ClientKey != "cert" {
+		return fmt.Errorf("invalid client key %s, valid values are peer and cert", c.ClientKey)
+	}
+	if c.FallbackVerdict != "" && c.FallbackVerdict != "allow" && c.FallbackVerdict != "block" {
+		return fmt.Errorf("invalid fallback verdict %s, valid values are allow and block", c.FallbackVerdict)
+	}
+	return nil
+}
+
+// bucket is a token bucket of a rate limiter.
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter keyed by client.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	// buckets maps the keys to their element in idle
+	buckets map[string]*list.Element
+	// idle has the buckets, the least recently used first
+	idle *list.List
+}
+
+// maxBuckets is the maximum number of client buckets. Above it, the
+// least recently used buckets are evicted.
+const maxBuckets = 10000
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	b := float64(burst)
+	if b == 0 {
+		b = rate
+	}
+	if b < 1 {
+		b = 1
+	}
+	return &rateLimiter{rate: rate, burst: b, buckets: make(map[string]*list.Element), idle: list.New()}
+}
+
+// allow takes a token from the bucket of the key, and returns false
+// if there is none left. It must be called with the controller lock
+// held.
+func (r *rateLimiter) allow(key string, now time.Time) bool {
+	var b *bucket
+	if elem, ok := r.buckets[key]; ok {
+		b = elem.Value.(*bucket)
+		r.idle.MoveToBack(elem)
+	} else {
+		if r.idle.Len() >= maxBuckets {
+			oldest := r.idle.Front()
+			r.idle.Remove(oldest)
+			delete(r.buckets, oldest.Value.(*bucket).key)
+		}
+		b = &bucket{key: key, tokens: r.burst, last: now}
+		r.buckets[key] = r.idle.PushBack(b)
+	}
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// maxAdmitted is the maximum number of admitted transactions tracked
+// when there is no global transactions limit.
+const maxAdmitted = 100000
+
+// admittedTransaction is a transaction holding a slot.
+type admittedTransaction struct {
+	key    string
+	client string
+	// last is the time of the last call of the transaction
+	last time.Time
+}
+
+// Controller enforces the admission limits on the gRPC calls.
+type Controller struct {
+	conf Config
+
+	mutex              sync.Mutex
+	clientTransactions map[string]int
+	// admitted maps the keys of the admitted transactions to their
+	// element in idle
+	admitted map[string]*list.Element
+	// idle has the admitted transactions, the longest idle first
+	idle       *list.List
+	globalRate *rateLimiter
+	clientRate *rateLimiter
+
+	rejected metric.Int64Counter
+
+	// now returns the current time, and is replaced by the tests
+	now func() time.Time
+}
+
+// New creates a new admission Controller. The meter is used to count
+// the rejected calls, and can be nil.
+func New(conf Config, meter metric.Meter) (*Controller, error) {
+	if err := conf.Check(); err != nil {
+		return nil, err
+	}
+	c := &Controller{
+		conf:               conf,
+		clientTransactions: make(map[string]int),
+		admitted:           make(map[string]*list.Element),
+		idle:               list.New(),
+		now:                time.Now,
+	}
+	if c.conf.TransactionTimeout == 0 {
+		c.conf.TransactionTimeout = DefaultTransactionTimeout
+	}
+	if conf.RequestsPerSecond > 0 {
+		c.globalRate = newRateLimiter(conf.RequestsPerSecond, conf.Burst)
+	}
+	if conf.ClientRequestsPerSecond > 0 {
+		c.clientRate = newRateLimiter(conf.ClientRequestsPerSecond, conf.Burst)
+	}
+	if meter != nil {
+		var err error
+		c.rejected, err = meter.Int64Counter("wace.admission.rejected.total")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// clientID returns the identifier of the client making the call.
+func (c *Controller) clientID(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if c.conf.ClientKey == "cert" {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+			return "cert:" + tlsInfo.State.PeerCertificates[0].Subject.CommonName
+		}
+	}
+	if p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// transactionRequest is implemented by every request message of the
+// WACE protocol.
+type transactionRequest interface {
+	GetTransactId() string
+}
+
+// transactionKey returns the key identifying the transaction of the
+// call: its ID scoped to the tenant in the call metadata and to the
+// connection of the client, as the tenants given in the Init
+// parameters are bound to the transactions per connection.
+func transactionKey(ctx context.Context, transactionID string) string {
+	var conn string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		conn = p.Addr.String()
+	}
+	return conn + "|" + tenant.ScopeID(tenant.FromContext(ctx), transactionID)
+}
+
+// release frees the slot of the admitted transaction. It must be
+// called with the controller lock held.
+func (c *Controller) release(key string) {
+	elem, ok := c.admitted[key]
+	if !ok {
+		return
+	}
+	t := c.idle.Remove(elem).(*admittedTransaction)
+	delete(c.admitted, key)
+	c.clientTransactions[t.client]--
+	if c.clientTransactions[t.client] <= 0 {
+		delete(c.clientTransactions, t.client)
+	}
+}
+
+// expire frees the slots of the abandoned transactions, those without
+// calls for longer than the transaction timeout. It must be called
+// with the controller lock held.
+func (c *Controller) expire(now time.Time) {
+	for elem := c.idle.Front(); elem != nil; elem = c.idle.Front() {
+		t := elem.Value.(*admittedTransaction)
+		if now.Sub(t.last) < c.conf.TransactionTimeout {
+			return
+		}
+		c.release(t.key)
+	}
+}
+
+// full returns the reason the client cannot start a new transaction,
+// if any. It must be called with the controller lock held.
+func (c *Controller) full(client string) string {
+	if c.conf.MaxTransactions > 0 && len(c.admitted) >= c.conf.MaxTransactions {
+		return "transactions"
+	}
+	if c.conf.MaxClientTransactions > 0 && c.clientTransactions[client] >= c.conf.MaxClientTransactions {
+		return "client_transactions"
+	}
+	if len(c.admitted) >= maxAdmitted {
+		return "transactions"
+	}
+	return ""
+}
+
+// method returns the name of the called method, without the service.
+func method(fullMethod string) string {
+	return fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+}
+
+// admit checks whether the call can proceed, and returns the reason
+// of the rejection otherwise. The first call of a transaction (Init,
+// or any other call for the WAFs skipping it) takes a slot, freed when
+// the transaction is closed or abandoned. The transactionKey is empty
+// for the calls that are not about a transaction.
+func (c *Controller) admit(client, methodName, transactionKey string) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	c.expire(now)
+	if methodName == "Close" {
+		// Closing a transaction is always allowed, to free its resources
+		c.release(transactionKey)
+		return ""
+	}
+
+	if c.globalRate != nil && !c.globalRate.allow("", now) {
+		return "rate"
+	}
+	if c.clientRate != nil && !c.clientRate.allow(client, now) {
+		return "client_rate"
+	}
+
+	// Feedback is reported on closed transactions
+	if transactionKey == "" || methodName == "ReportFeedback" {
+		return ""
+	}
+	if elem, ok := c.admitted[transactionKey]; ok {
+		elem.Value.(*admittedTransaction).last = now
+		c.idle.MoveToBack(elem)
+		return ""
+	}
+	if c.conf.MaxTransactions == 0 && c.conf.MaxClientTransactions == 0 {
+		return ""
+	}
+	if reason := c.full(client); reason != "" {
+		return reason
+	}
+	c.admitted[transactionKey] = c.idle.PushBack(&admittedTransaction{key: transactionKey, client: client, last: now})
+	c.clientTransactions[client]++
+	return ""
+}
+
+// UnaryServerInterceptor returns the gRPC interceptor enforcing the
+// admission limits. Rejected calls get a ResourceExhausted error, with
+// the fallback verdict in the trailer metadata.
+func (c *Controller) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		client := c.clientID(ctx)
+		methodName := method(info.FullMethod)
+		var key string
+		if tr, ok := req.(transactionRequest); ok {
+			key = transactionKey(ctx, tr.GetTransactId())
+		}
+
+		reason := c.admit(client, methodName, key)
+		if reason == "" {
+			return handler(ctx, req)
+		}
+
+		verdict := c.conf.FallbackVerdict
+		if verdict == "" {
+			verdict = "allow"
+		}
+		logger := lg.Get()
+		logger.Printf(lg.WARN, "admission | %s call from %s rejected: %s limit reached", methodName, client, reason)
+		if c.rejected != nil {
+			c.rejected.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("method", methodName),
+				attribute.String("reason", reason)))
+		}
+		grpc.SetTrailer(ctx, metadata.Pairs(FallbackMetadataKey, verdict))
+		return nil, status.Errorf(codes.ResourceExhausted, "%s limit reached, fallback verdict: %s", reason, verdict)
+	}
+}
@@ -0,0 +1,218 @@
+package admission
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+type testRequest struct {
+	id string
+}
+
+func (r testRequest) GetTransactId() string {
+	return r.id
+}
+
+func peerContext(ip string) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 4000}})
+}
+
+func call(c *Controller, ctx context.Context, method, transactionID string) error {
+	interceptor := c.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/waceproto.WaceProto/" + method}
+	_, err := interceptor(ctx, testRequest{transactionID}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	return err
+}
+
+func TestCheckConfig(t *testing.T) {
+	if err := (Config{ClientKey: "header"}).Check(); err == nil {
+		t.Errorf("invalid client key accepted")
+	}
+	if err := (Config{FallbackVerdict: "maybe"}).Check(); err == nil {
+		t.Errorf("invalid fallback verdict accepted")
+	}
+	if err := (Config{MaxTransactions: -1}).Check(); err == nil {
+		t.Errorf("negative limit accepted")
+	}
+	if err := (Config{ClientKey: "cert", FallbackVerdict: "block"}).Check(); err != nil {
+		t.Errorf("valid config rejected: %v", err)
+	}
+}
+
+func TestClientTransactions(t *testing.T) {
+	c, err := New(Config{MaxClientTransactions: 1, FallbackVerdict: "block"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client1 := peerContext("10.0.0.1")
+	client2 := peerContext("10.0.0.2")
+
+	if err := call(c, client1, "Init", "1"); err != nil {
+		t.Errorf("first transaction rejected: %v", err)
+	}
+	err = call(c, client1, "Init", "2")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("second concurrent transaction not rejected: %v", err)
+	}
+	if err := call(c, client2, "Init", "1"); err != nil {
+		t.Errorf("transaction of another client rejected: %v", err)
+	}
+	if err := call(c, client1, "SendRequest", "1"); err != nil {
+		t.Errorf("call on admitted transaction rejected: %v", err)
+	}
+	if err := call(c, client1, "Close", "1"); err != nil {
+		t.Errorf("close rejected: %v", err)
+	}
+	if err := call(c, client1, "Init", "2"); err != nil {
+		t.Errorf("transaction rejected after close: %v", err)
+	}
+}
+
+func TestGlobalTransactions(t *testing.T) {
+	c, err := New(Config{MaxTransactions: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call(c, peerContext("10.0.0.1"), "Init", "1")
+	call(c, peerContext("10.0.0.2"), "Init", "1")
+	err = call(c, peerContext("10.0.0.3"), "Init", "1")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("transaction over the global limit not rejected: %v", err)
+	}
+	// Closing a rejected transaction must not free a slot
+	call(c, peerContext("10.0.0.3"), "Close", "1")
+	err = call(c, peerContext("10.0.0.3"), "Init", "2")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("closing a rejected transaction freed a slot: %v", err)
+	}
+}
+
+func TestAbandonedTransactions(t *testing.T) {
+	c, err := New(Config{MaxTransactions: 1, TransactionTimeout: time.Minute}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	// The transaction is never closed
+	call(c, peerContext("10.0.0.1"), "Init", "1")
+	now = now.Add(50 * time.Second)
+	if err := call(c, peerContext("10.0.0.1"), "SendRequest", "1"); err != nil {
+		t.Errorf("call on admitted transaction rejected: %v", err)
+	}
+	now = now.Add(50 * time.Second)
+	err = call(c, peerContext("10.0.0.2"), "Init", "1")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("transaction admitted while another one is active: %v", err)
+	}
+	now = now.Add(20 * time.Second)
+	if err := call(c, peerContext("10.0.0.2"), "Init", "1"); err != nil {
+		t.Errorf("abandoned transaction kept its slot: %v", err)
+	}
+	if len(c.admitted) != 1 || c.idle.Len() != 1 || len(c.clientTransactions) != 1 {
+		t.Errorf("abandoned transaction not forgotten: %d admitted", len(c.admitted))
+	}
+}
+
+func TestTransactionsWithoutInit(t *testing.T) {
+	c, err := New(Config{MaxClientTransactions: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := peerContext("10.0.0.1")
+	if err := call(c, client, "SendRequest", "1"); err != nil {
+		t.Errorf("first transaction rejected: %v", err)
+	}
+	err = call(c, client, "SendRequestBody", "2")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("transaction without Init skipped the limit: %v", err)
+	}
+	if err := call(c, client, "Check", "1"); err != nil {
+		t.Errorf("call on admitted transaction rejected: %v", err)
+	}
+	call(c, client, "Close", "1")
+	if err := call(c, client, "ReportFeedback", "1"); err != nil || len(c.admitted) != 0 {
+		t.Errorf("feedback on a closed transaction took a slot (%v)", err)
+	}
+}
+
+func TestTenantTransactions(t *testing.T) {
+	c, err := New(Config{MaxClientTransactions: 2}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acme := metadata.NewIncomingContext(peerContext("10.0.0.1"), metadata.Pairs("wace-tenant", "acme"))
+	other := metadata.NewIncomingContext(peerContext("10.0.0.1"), metadata.Pairs("wace-tenant", "other"))
+
+	// The same transaction ID of two tenants takes two slots
+	call(c, acme, "Init", "1")
+	call(c, other, "Init", "1")
+	err = call(c, acme, "Init", "2")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("transactions of two tenants counted once: %v", err)
+	}
+	call(c, other, "Close", "1")
+	if _, ok := c.admitted[transactionKey(acme, "1")]; !ok {
+		t.Errorf("closing the transaction of a tenant freed the other one")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(2, 2)
+	now := time.Now()
+	if !r.allow("a", now) || !r.allow("a", now) {
+		t.Errorf("calls within the burst rejected")
+	}
+	if r.allow("a", now) {
+		t.Errorf("call over the burst allowed")
+	}
+	if !r.allow("b", now) {
+		t.Errorf("call of another key rejected")
+	}
+	if !r.allow("a", now.Add(500*time.Millisecond)) {
+		t.Errorf("call rejected after the bucket refilled")
+	}
+
+	// The least recently used buckets are evicted over the maximum
+	for i := 0; i < maxBuckets; i++ {
+		r.allow(fmt.Sprintf("client%d", i), now)
+	}
+	if len(r.buckets) != maxBuckets || r.idle.Len() != maxBuckets {
+		t.Errorf("got %d buckets, expected %d", len(r.buckets), maxBuckets)
+	}
+	if _, ok := r.buckets["a"]; ok {
+		t.Errorf("least recently used bucket not evicted")
+	}
+	if _, ok := r.buckets["client0"]; !ok {
+		t.Errorf("recently used bucket evicted")
+	}
+}
+
+func TestClientRate(t *testing.T) {
+	c, err := New(Config{ClientRequestsPerSecond: 1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := call(c, peerContext("10.0.0.1"), "SendRequest", "1"); err != nil {
+		t.Errorf("first call rejected: %v", err)
+	}
+	err = call(c, peerContext("10.0.0.1"), "SendRequest", "1")
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("call over the rate not rejected: %v", err)
+	}
+	if err := call(c, peerContext("10.0.0.1"), "Close", "1"); err != nil {
+		t.Errorf("close rejected by the rate limit: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+// Package calibration maps the scores of the model plugins to
+// calibrated probabilities of attack, with Platt scaling or isotonic
+// regression tables fitted offline.
+package calibration
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// Calibration methods
+const (
+	Platt    = "platt"
+	Isotonic = "isotonic"
+)
+
+// Calibrator maps a score to a calibrated probability.
+type Calibrator interface {
+	Calibrate(score float64) float64
+}
+
+// PlattScaling is the sigmoid 1 / (1 + exp(A*score + B)).
+type PlattScaling struct {
+	A, B float64
+}
+
+// Calibrate returns the calibrated probability of the score.
+func (p PlattScaling) Calibrate(score float64) float64 {
+	return 1 / (1 + math.Exp(p.A*score+p.B))
+}
+
+// IsotonicTable is a non-decreasing step function, given by its points
+// (X sorted in increasing order). Scores between two points are
+// linearly interpolated, and scores out of the table get the value of
+// the closest point.
+type IsotonicTable struct {
+	X, Y []float64
+}
+
+// NewIsotonicTable verifies the points of the table.
+func NewIsotonicTable(x, y []float64) (IsotonicTable, error) {
+	if len(x) == 0 || len(x) != len(y) {
+		return IsotonicTable{}, fmt.Errorf("isotonic table needs the same number of x and y values, and at least one")
+	}
+	for i := 1; i < len(x); i++ {
+		if x[i] <= x[i-1] {
+			return IsotonicTable{}, fmt.Errorf("isotonic table x values must be increasing")
+		}
+		if y[i] < y[i-1] {
+			return IsotonicTable{}, fmt.Errorf("isotonic table y values must be non-decreasing")
+		}
+	}
+	return IsotonicTable{X: x, Y: y}, nil
+}
+
+// Calibrate returns the calibrated probability of the score.
+func (t IsotonicTable) Calibrate(score float64) float64 {
+	i := sort.SearchFloat64s(t.X, score)
+	switch {
+	case i == 0:
+		return t.Y[0]
+	case i == len(t.X):
+		return t.Y[len(t.Y)-1]
+	case t.X[i] == score:
+		return t.Y[i]
+	}
+	ratio := (score - t.X[i-1]) / (t.X[i] - t.X[i-1])
+	return t.Y[i-1] + ratio*(t.Y[i]-t.Y[i-1])
+}
+
+// fileData is the calibration of a model in the calibration file
+type fileData struct {
+	Method string    `json:"method"`
+	A      float64   `json:"a"`
+	B      float64   `json:"b"`
+	X      []float64 `json:"x"`
+	Y      []float64 `json:"y"`
+}
+
+// Parse parses the calibrations of the models, a JSON object keyed by
+// model ID, eg:
+//
+//	{
+//	  "trivial": {"method": "platt", "a": -4.2, "b": 2.1},
+//	  "trivial2": {"method": "isotonic", "x": [0, 0.5, 1], "y": [0, 0.2, 1]}
+//	}
+func Parse(data []byte) (map[string]Calibrator, error) {
+	var in map[string]fileData
+	if err := json.Unmarshal(data, &in); err != nil {
+		return nil, err
+	}
+	calibrators := make(map[string]Calibrator)
+	for modelID, c := range in {
+		switch c.Method {
+		case Platt:
+			calibrators[modelID] = PlattScaling{A: c.A, B: c.B}
+		case Isotonic:
+			table, err := NewIsotonicTable(c.X, c.Y)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", modelID, err)
+			}
+			calibrators[modelID] = table
+		default:
+			return nil, fmt.Errorf("%s: invalid calibration method %s", modelID, c.Method)
+		}
+	}
+	return calibrators, nil
+}
+
+// Load loads the calibrations of the models from the file.
+func Load(path string) (map[string]Calibrator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
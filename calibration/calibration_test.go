@@ -0,0 +1,79 @@
+package calibration
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlatt(t *testing.T) {
+	p := PlattScaling{A: -4, B: 2}
+	if got := p.Calibrate(0.5); got != 0.5 {
+		t.Errorf("Calibrate(0.5) = %v, expected 0.5", got)
+	}
+	if p.Calibrate(0.9) <= p.Calibrate(0.6) {
+		t.Errorf("Platt scaling with negative A is not increasing")
+	}
+}
+
+func TestIsotonic(t *testing.T) {
+	table, err := NewIsotonicTable([]float64{0.2, 0.5, 0.8}, []float64{0, 0.1, 0.9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		score    float64
+		expected float64
+	}{
+		{0, 0}, {0.2, 0}, {0.35, 0.05}, {0.5, 0.1}, {0.7, 0.6333}, {0.8, 0.9}, {1, 0.9},
+	}
+	for _, test := range tests {
+		if got := table.Calibrate(test.score); math.Abs(got-test.expected) > 0.001 {
+			t.Errorf("Calibrate(%v) = %v, expected %v", test.score, got, test.expected)
+		}
+	}
+
+	invalid := [][2][]float64{
+		{nil, nil},
+		{{0, 1}, {0}},
+		{{0.5, 0.2}, {0, 1}},
+		{{0.2, 0.5}, {1, 0}},
+	}
+	for _, points := range invalid {
+		if _, err := NewIsotonicTable(points[0], points[1]); err == nil {
+			t.Errorf("invalid table %v accepted", points)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "calibration.json")
+	data := `{
+		"a": {"method": "platt", "a": -4, "b": 2},
+		"b": {"method": "isotonic", "x": [0, 1], "y": [0.1, 0.9]}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	calibrators, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calibrators) != 2 || calibrators["a"].Calibrate(0.5) != 0.5 || calibrators["b"].Calibrate(0.5) != 0.5 {
+		t.Errorf("wrong calibrators %v", calibrators)
+	}
+
+	for _, invalid := range []string{
+		`{"a": {"method": "beta"}}`,
+		`{"a": {"method": "isotonic", "x": [1, 0], "y": [0, 1]}}`,
+		`[]`,
+	} {
+		if _, err := Parse([]byte(invalid)); err == nil {
+			t.Errorf("invalid calibration %s accepted", invalid)
+		}
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("missing file accepted")
+	}
+}
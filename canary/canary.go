@@ -0,0 +1,196 @@
+/*
+Package canary routes a percentage of the transactions to alternate
+sets of model plugins or decision plugins (variants), so new versions
+can be compared with the current ones on production traffic.
+
+Each transaction is assigned to a variant when it starts, by hashing
+its client IP or its ID, so the assignment is sticky: with the same
+configuration, a client always gets the same variant. The transactions
+not routed to any variant belong to the Control variant, which uses
+the models and decision asked by the WAF.
+*/
+package canary
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Control is the ID of the variant of the transactions not routed to
+// any configured variant.
+const Control = "control"
+
+// AttributeKey is the key of the variant attribute added to metrics.
+const AttributeKey = "variant"
+
+// Sticky keys, used to assign the transactions to the variants.
+const (
+	// ClientIP assigns the transactions of a client to the same
+	// variant. Transactions without a client IP are assigned by ID.
+	ClientIP = "client_ip"
+	// TransactionID assigns each transaction independently
+	TransactionID = "transaction_id"
+)
+
+// buckets is the number of hash buckets, so percentages have two
+// decimals
+const buckets = 10000
+
+// Variant is an alternate set of models or decision plugin receiving a
+// percentage of the transactions.
+type Variant struct {
+	ID string
+	// Percentage of the transactions routed to the variant, from 0 to
+	// 100
+	Percentage float64
+	// Models replaces the model plugins asked by the WAF, keyed by the
+	// replaced model ID
+	Models map[string]string
+	// Decision replaces the decision plugin asked by the WAF, if not
+	// empty
+	Decision string
+}
+
+// assignment is the variant of a transaction
+type assignment struct {
+	variant *Variant
+	start   time.Time
+}
+
+// Router assigns the transactions to the variants.
+type Router struct {
+	variants []Variant
+	// limits are the upper bucket of each variant, cumulated
+	limits      []int
+	sticky      string
+	assignments sync.Map
+}
+
+// New creates a router with the given variants and sticky key
+// (ClientIP by default). The percentages of the variants cannot add up
+// to more than 100.
+func New(variants []Variant, sticky string) (*Router, error) {
+	switch sticky {
+	case "":
+		sticky = ClientIP
+	case ClientIP, TransactionID:
+	default:
+		return nil, fmt.Errorf("invalid sticky key %s", sticky)
+	}
+	r := &Router{variants: variants, sticky: sticky}
+	ids := make(map[string]bool)
+	limit := 0
+	for _, v := range variants {
+		if v.ID == "" || v.ID == Control {
+			return nil, fmt.Errorf("invalid variant id %q", v.ID)
+		}
+		if ids[v.ID] {
+			return nil, fmt.Errorf("variant %s defined twice", v.ID)
+		}
+		ids[v.ID] = true
+		if v.Percentage < 0 || v.Percentage > 100 {
+			return nil, fmt.Errorf("variant %s: invalid percentage %v", v.ID, v.Percentage)
+		}
+		limit += int(v.Percentage * buckets / 100)
+		if limit > buckets {
+			return nil, fmt.Errorf("the percentages of the variants add up to more than 100")
+		}
+		r.limits = append(r.limits, limit)
+	}
+	return r, nil
+}
+
+// bucket returns the hash bucket of the key.
+func bucket(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % buckets)
+}
+
+// Assign assigns the transaction to a variant, and returns its ID.
+func (r *Router) Assign(transactionID, clientIP string) string {
+	key := transactionID
+	if r.sticky == ClientIP && clientIP != "" {
+		key = clientIP
+	}
+	a := &assignment{start: time.Now()}
+	b := bucket(key)
+	for i, limit := range r.limits {
+		if b < limit {
+			a.variant = &r.variants[i]
+			break
+		}
+	}
+	r.assignments.Store(transactionID, a)
+	if a.variant == nil {
+		return Control
+	}
+	return a.variant.ID
+}
+
+// variant returns the variant of the transaction, or nil for Control.
+func (r *Router) variant(transactionID string) *Variant {
+	value, ok := r.assignments.Load(transactionID)
+	if !ok {
+		return nil
+	}
+	return value.(*assignment).variant
+}
+
+// Variant returns the ID of the variant of the transaction.
+func (r *Router) Variant(transactionID string) string {
+	if v := r.variant(transactionID); v != nil {
+		return v.ID
+	}
+	return Control
+}
+
+// Models returns the models of the variant of the transaction: the
+// given ones, with the replaced ones changed.
+func (r *Router) Models(transactionID string, models []string) []string {
+	v := r.variant(transactionID)
+	if v == nil || len(v.Models) == 0 {
+		return models
+	}
+	replaced := make([]string, len(models))
+	for i, modelID := range models {
+		if replacement, ok := v.Models[modelID]; ok {
+			modelID = replacement
+		}
+		replaced[i] = modelID
+	}
+	return replaced
+}
+
+// Decision returns the decision plugin of the variant of the
+// transaction, or the given one if the variant does not replace it.
+func (r *Router) Decision(transactionID, decision string) string {
+	if v := r.variant(transactionID); v != nil && v.Decision != "" {
+		return v.Decision
+	}
+	return decision
+}
+
+// Elapsed returns the time since the transaction was assigned.
+func (r *Router) Elapsed(transactionID string) time.Duration {
+	value, ok := r.assignments.Load(transactionID)
+	if !ok {
+		return 0
+	}
+	return time.Since(value.(*assignment).start)
+}
+
+// Release forgets the assignment of the transaction.
+func (r *Router) Release(transactionID string) {
+	r.assignments.Delete(transactionID)
+}
+
+// Attribute returns the metric attribute for the variant of the
+// transaction.
+func (r *Router) Attribute(transactionID string) attribute.KeyValue {
+	return attribute.String(AttributeKey, r.Variant(transactionID))
+}
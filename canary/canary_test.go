@@ -0,0 +1,98 @@
+package canary
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		variants []Variant
+		sticky   string
+		valid    bool
+	}{
+		{nil, "", true},
+		{[]Variant{{ID: "a", Percentage: 60}, {ID: "b", Percentage: 40}}, TransactionID, true},
+		{[]Variant{{ID: "a", Percentage: 10}}, "cookie", false},
+		{[]Variant{{ID: "a", Percentage: 60}, {ID: "b", Percentage: 41}}, "", false},
+		{[]Variant{{ID: "a", Percentage: -1}}, "", false},
+		{[]Variant{{ID: "a"}, {ID: "a"}}, "", false},
+		{[]Variant{{ID: Control}}, "", false},
+		{[]Variant{{Percentage: 10}}, "", false},
+	}
+	for i, test := range tests {
+		if _, err := New(test.variants, test.sticky); (err == nil) != test.valid {
+			t.Errorf("test %d: expected valid %t, got %v", i, test.valid, err)
+		}
+	}
+}
+
+func TestPercentage(t *testing.T) {
+	r, err := New([]Variant{{ID: "a", Percentage: 10}, {ID: "b", Percentage: 30}}, TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	n := 20000
+	for i := 0; i < n; i++ {
+		counts[r.Assign(fmt.Sprint(i), "")]++
+	}
+	expected := map[string]float64{"a": 0.1, "b": 0.3, Control: 0.6}
+	for variant, share := range expected {
+		got := float64(counts[variant]) / float64(n)
+		if math.Abs(got-share) > 0.02 {
+			t.Errorf("variant %s got %.3f of the transactions, expected %.3f", variant, got, share)
+		}
+	}
+}
+
+func TestSticky(t *testing.T) {
+	r, err := New([]Variant{{ID: "a", Percentage: 50}}, ClientIP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		ip := fmt.Sprintf("10.0.0.%d", i)
+		first := r.Assign(fmt.Sprintf("%d-1", i), ip)
+		if second := r.Assign(fmt.Sprintf("%d-2", i), ip); second != first {
+			t.Errorf("client %s assigned to %s and %s", ip, first, second)
+		}
+	}
+}
+
+func TestRouting(t *testing.T) {
+	r, err := New([]Variant{{
+		ID:         "v2",
+		Percentage: 100,
+		Models:     map[string]string{"trivial": "trivial_v2"},
+		Decision:   "weighted_sum_v2",
+	}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variant := r.Assign("1", "10.0.0.1"); variant != "v2" {
+		t.Fatalf("expected variant v2, got %s", variant)
+	}
+	models := r.Models("1", []string{"trivial", "other"})
+	if len(models) != 2 || models[0] != "trivial_v2" || models[1] != "other" {
+		t.Errorf("unexpected models %v", models)
+	}
+	if decision := r.Decision("1", "weighted_sum"); decision != "weighted_sum_v2" {
+		t.Errorf("unexpected decision %s", decision)
+	}
+	if attr := r.Attribute("1"); attr.Value.AsString() != "v2" {
+		t.Errorf("unexpected attribute %v", attr)
+	}
+
+	r.Release("1")
+	if variant := r.Variant("1"); variant != Control {
+		t.Errorf("released transaction has variant %s", variant)
+	}
+	if models := r.Models("1", []string{"trivial"}); models[0] != "trivial" {
+		t.Errorf("control transaction models replaced: %v", models)
+	}
+	if decision := r.Decision("1", "weighted_sum"); decision != "weighted_sum" {
+		t.Errorf("control transaction decision replaced: %s", decision)
+	}
+}
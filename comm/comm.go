@@ -8,11 +8,16 @@ import (
 	"context"
 	"net"
 
+	"wace/tenant"
+	"wace/transaction"
 	pb "wace/waceproto"
 
 	lg "github.com/tilsor/ModSecIntl_logging/logging"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
 )
 
 // var port = flag.Int("port", 10000, "The server port")
@@ -26,9 +31,19 @@ type Handlers struct {
 	SendResponse           func(string, string, []string) int32
 	SendRespLineAndHeaders func(string, string, string, []string) int32
 	SendResponseBody       func(string, string, []string) int32
-	Check                  func(string, string, map[string]string) (bool, error)
-	Init                   func(string) int32
-	Close                  func(string, map[string]string) int32
+	// Binary safe variants of the handlers above
+	SendRequestBytes            func(string, transaction.Payload, []string) int32
+	SendReqLineAndHeadersBytes  func(string, transaction.Payload, transaction.Payload, []string) int32
+	SendRequestBodyBytes        func(string, transaction.Payload, []string) int32
+	SendResponseBytes           func(string, transaction.Payload, []string) int32
+	SendRespLineAndHeadersBytes func(string, transaction.Payload, transaction.Payload, []string) int32
+	SendResponseBodyBytes       func(string, transaction.Payload, []string) int32
+	Check                       func(string, string, string, map[string]string) (bool, error)
+	Init                        func(string, string) int32
+	Close                       func(string, map[string]string) int32
+	// ReportFeedback labels a closed transaction (transaction ID,
+	// label and comment), returning whether its outcome was evaluated
+	ReportFeedback func(string, string, string) (bool, error)
 }
 
 // type Result struct {
@@ -45,60 +60,202 @@ type server struct {
 
 var grpcServer *grpc.Server
 
+// maxConnBindings is the maximum number of transactions bound to a
+// tenant per connection.
+const maxConnBindings = 65536
+
+// bindingsKey is the context key of the tenant bindings of a
+// connection.
+type bindingsKey struct{}
+
+// connStats is a gRPC stats handler giving each connection its own
+// tenant bindings, so the transaction IDs given by the clients of
+// different tenants do not clash, and the bindings are dropped with the
+// connection.
+type connStats struct{}
+
+func (connStats) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return context.WithValue(ctx, bindingsKey{}, tenant.NewBindings(maxConnBindings))
+}
+
+func (connStats) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (connStats) HandleConn(context.Context, stats.ConnStats) {}
+
+func (connStats) HandleRPC(context.Context, stats.RPCStats) {}
+
+// connBindings returns the tenant bindings of the connection of the
+// call, or nil if there are none.
+func connBindings(ctx context.Context) *tenant.Bindings {
+	b, _ := ctx.Value(bindingsKey{}).(*tenant.Bindings)
+	return b
+}
+
+// transactionParams are the parameters of the calls on a transaction
+type transactionParams interface {
+	GetTransactId() string
+}
+
+// tenantParams are the parameters of the calls giving a tenant
+type tenantParams interface {
+	GetTenantId() string
+}
+
+// checkIDs is a unary interceptor rejecting the calls whose tenant
+// (in the metadata or the parameters) or transaction ID would make the
+// scoped transaction ID ambiguous, so a client cannot reach the
+// transactions of another tenant.
+func checkIDs(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ids := []string{tenant.FromContext(ctx)}
+	if params, ok := req.(transactionParams); ok {
+		ids = append(ids, params.GetTransactId())
+	}
+	if params, ok := req.(tenantParams); ok {
+		ids = append(ids, params.GetTenantId())
+	}
+	for _, id := range ids {
+		if err := tenant.CheckID(id); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	return handler(ctx, req)
+}
+
 func startTransactionLogging(transactionID string) {
 	l := lg.Get()
 	l.StartTransaction(transactionID)
 }
 
+// scopedTransactionID returns the transaction ID scoped to the tenant
+// of the call. The tenant is taken from the call metadata or, if it is
+// not present, from the tenant given when the transaction was
+// initialized on the same connection.
+func scopedTransactionID(ctx context.Context, transactionID string) string {
+	tenantID := tenant.FromContext(ctx)
+	if tenantID == "" {
+		if b := connBindings(ctx); b != nil {
+			tenantID = b.Tenant(transactionID)
+		}
+	}
+	return tenant.ScopeID(tenantID, transactionID)
+}
+
 func (s *server) SendRequest(ctx context.Context, in *pb.SendRequestParams) (*pb.SendRequestResult, error) {
-	startTransactionLogging(in.GetTransactId())
-	res := s.handlers.SendRequest(in.GetTransactId(), in.GetRequest(), in.GetModelId())
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.SendRequest(transactionID, in.GetRequest(), in.GetModelId())
 
 	return &pb.SendRequestResult{StatusCode: res}, nil
 }
 
 func (s *server) SendReqLineAndHeaders(ctx context.Context, in *pb.SendReqLineAndHeadersParams) (*pb.SendReqLineAndHeadersResult, error) {
-	startTransactionLogging(in.GetTransactId())
-	res := s.handlers.SendReqLineAndHeaders(in.GetTransactId(), in.GetReqLine(), in.GetReqHeaders(), in.GetModelId())
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.SendReqLineAndHeaders(transactionID, in.GetReqLine(), in.GetReqHeaders(), in.GetModelId())
 
 	return &pb.SendReqLineAndHeadersResult{StatusCode: res}, nil
 }
 
 func (s *server) SendRequestBody(ctx context.Context, in *pb.SendRequestBodyParams) (*pb.SendRequestBodyResult, error) {
-	startTransactionLogging(in.GetTransactId())
-	res := s.handlers.SendRequestBody(in.GetTransactId(), in.GetBody(), in.GetModelId())
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.SendRequestBody(transactionID, in.GetBody(), in.GetModelId())
 
 	return &pb.SendRequestBodyResult{StatusCode: res}, nil
 }
 
 func (s *server) SendResponse(ctx context.Context, in *pb.SendResponseParams) (*pb.SendResponseResult, error) {
-	startTransactionLogging(in.GetTransactId())
-	res := s.handlers.SendResponse(in.GetTransactId(), in.GetResponse(), in.GetModelId())
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.SendResponse(transactionID, in.GetResponse(), in.GetModelId())
 
 	return &pb.SendResponseResult{StatusCode: res}, nil
 }
 
 func (s *server) SendRespLineAndHeaders(ctx context.Context, in *pb.SendRespLineAndHeadersParams) (*pb.SendRespLineAndHeadersResult, error) {
-	startTransactionLogging(in.GetTransactId())
-	res := s.handlers.SendRespLineAndHeaders(in.GetTransactId(), in.GetStatusLine(), in.GetRespHeaders(), in.GetModelId())
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.SendRespLineAndHeaders(transactionID, in.GetStatusLine(), in.GetRespHeaders(), in.GetModelId())
 
 	return &pb.SendRespLineAndHeadersResult{StatusCode: res}, nil
 }
 
 func (s *server) SendResponseBody(ctx context.Context, in *pb.SendResponseBodyParams) (*pb.SendResponseBodyResult, error) {
-	startTransactionLogging(in.GetTransactId())
-	res := s.handlers.SendResponseBody(in.GetTransactId(), in.GetBody(), in.GetModelId())
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.SendResponseBody(transactionID, in.GetBody(), in.GetModelId())
+
+	return &pb.SendResponseBodyResult{StatusCode: res}, nil
+}
+
+// toPayload converts a payload message to the payload stored in the
+// transaction.
+func toPayload(p *pb.Payload) transaction.Payload {
+	return transaction.Payload{
+		Data:        p.GetData(),
+		ContentType: p.GetContentType(),
+		Charset:     p.GetCharset(),
+	}
+}
+
+func (s *server) SendRequestBytes(ctx context.Context, in *pb.SendRequestBytesParams) (*pb.SendRequestResult, error) {
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.SendRequestBytes(transactionID, toPayload(in.GetRequest()), in.GetModelId())
+
+	return &pb.SendRequestResult{StatusCode: res}, nil
+}
+
+func (s *server) SendReqLineAndHeadersBytes(ctx context.Context, in *pb.SendReqLineAndHeadersBytesParams) (*pb.SendReqLineAndHeadersResult, error) {
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.SendReqLineAndHeadersBytes(transactionID, toPayload(in.GetReqLine()), toPayload(in.GetReqHeaders()), in.GetModelId())
+
+	return &pb.SendReqLineAndHeadersResult{StatusCode: res}, nil
+}
+
+func (s *server) SendRequestBodyBytes(ctx context.Context, in *pb.SendRequestBodyBytesParams) (*pb.SendRequestBodyResult, error) {
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.SendRequestBodyBytes(transactionID, toPayload(in.GetBody()), in.GetModelId())
+
+	return &pb.SendRequestBodyResult{StatusCode: res}, nil
+}
+
+func (s *server) SendResponseBytes(ctx context.Context, in *pb.SendResponseBytesParams) (*pb.SendResponseResult, error) {
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.SendResponseBytes(transactionID, toPayload(in.GetResponse()), in.GetModelId())
+
+	return &pb.SendResponseResult{StatusCode: res}, nil
+}
+
+func (s *server) SendRespLineAndHeadersBytes(ctx context.Context, in *pb.SendRespLineAndHeadersBytesParams) (*pb.SendRespLineAndHeadersResult, error) {
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.SendRespLineAndHeadersBytes(transactionID, toPayload(in.GetStatusLine()), toPayload(in.GetRespHeaders()), in.GetModelId())
+
+	return &pb.SendRespLineAndHeadersResult{StatusCode: res}, nil
+}
+
+func (s *server) SendResponseBodyBytes(ctx context.Context, in *pb.SendResponseBodyBytesParams) (*pb.SendResponseBodyResult, error) {
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.SendResponseBodyBytes(transactionID, toPayload(in.GetBody()), in.GetModelId())
 
 	return &pb.SendResponseBodyResult{StatusCode: res}, nil
 }
 
 func (s *server) Check(ctx context.Context, in *pb.CheckParams) (*pb.CheckResult, error) {
 	l := lg.Get()
-	l.StartTransaction(in.GetTransactId())
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	l.StartTransaction(transactionID)
 
-	block, err := s.handlers.Check(in.GetTransactId(), in.GetDecisionId(), in.GetWafParams())
+	block, err := s.handlers.Check(transactionID, in.GetDecisionId(), in.GetDirection(), in.GetWafParams())
 
-	buf := l.EndTransaction(in.GetTransactId())
+	buf := l.EndTransaction(transactionID)
 
 	if err != nil {
 		return &pb.CheckResult{BlockTransaction: 0, Msg: string(buf) + "\nError checking transaction: " + err.Error(), StatusCode: 1}, nil
@@ -115,30 +272,50 @@ func (s *server) Check(ctx context.Context, in *pb.CheckParams) (*pb.CheckResult
 }
 
 func (s *server) Init(ctx context.Context, in *pb.InitParams) (*pb.InitResult, error) {
-	startTransactionLogging(in.GetTransactId())
-	res := s.handlers.Init(in.GetTransactId())
+	if b := connBindings(ctx); b != nil && tenant.FromContext(ctx) == "" && in.GetTenantId() != "" {
+		b.Bind(in.GetTransactId(), in.GetTenantId())
+	}
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	startTransactionLogging(transactionID)
+	res := s.handlers.Init(transactionID, in.GetClientIp())
 
 	return &pb.InitResult{StatusCode: res}, nil
 }
 
 func (s *server) Close(ctx context.Context, in *pb.CloseParams) (*pb.CloseResult, error) {
-	startTransactionLogging(in.GetTransactId())
-	res := s.handlers.Close(in.GetTransactId(), in.GetMetric())
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	if b := connBindings(ctx); b != nil {
+		b.Unbind(in.GetTransactId())
+	}
+	startTransactionLogging(transactionID)
+	res := s.handlers.Close(transactionID, in.GetMetric())
 
 	return &pb.CloseResult{StatusCode: res}, nil
 }
 
+func (s *server) ReportFeedback(ctx context.Context, in *pb.ReportFeedbackParams) (*pb.ReportFeedbackResult, error) {
+	transactionID := scopedTransactionID(ctx, in.GetTransactId())
+	evaluated, err := s.handlers.ReportFeedback(transactionID, in.GetLabel(), in.GetComment())
+	if err != nil {
+		return &pb.ReportFeedbackResult{StatusCode: 1, Msg: "Error reporting feedback: " + err.Error()}, nil
+	}
+	return &pb.ReportFeedbackResult{Evaluated: evaluated, Msg: "Feedback reported successfully!"}, nil
+}
+
 // Listen implements the main loop of the wace server. It will call
 // the appropriate registered handler when a client calls a given
-// method.
-func Listen(handlers Handlers, address string, port string) error {
+// method. The options are passed to the gRPC server (eg: TLS
+// credentials or interceptors).
+func Listen(handlers Handlers, address string, port string, opts ...grpc.ServerOption) error {
 	logger := lg.Get()
 	lis, err := net.Listen("tcp", address+":"+port)
 	if err != nil {
 		return err
 	}
 
-	grpcServer = grpc.NewServer()
+	// The IDs are checked before the interceptors of the options
+	opts = append([]grpc.ServerOption{grpc.ChainUnaryInterceptor(checkIDs), grpc.StatsHandler(connStats{})}, opts...)
+	grpcServer = grpc.NewServer(opts...)
 	s := server{handlers: handlers}
 
 	pb.RegisterWaceProtoServer(grpcServer, &s)
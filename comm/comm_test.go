@@ -10,10 +10,14 @@ import (
 	"testing"
 	"time"
 
+	"wace/transaction"
 	pb "wace/waceproto"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 func contains(array []string, str string) bool {
@@ -241,10 +245,11 @@ func TestCheck(t *testing.T) {
 	}()
 
 	handlers := Handlers{
-		Check: func(transactionID, decisionPlugin string, wafParams map[string]string) (bool, error) {
+		Check: func(transactionID, decisionPlugin, direction string, wafParams map[string]string) (bool, error) {
 			log.Println("Check")
 			if transactionID != "1" ||
-				decisionPlugin != "simple" {
+				decisionPlugin != "simple" ||
+				direction != "outbound" {
 				return false, errors.New("Invalid parameters")
 			}
 			if len(wafParams) != 2 || wafParams["anomalyscore"] != "50" || wafParams["inboundthreshold"] != "100" {
@@ -281,6 +286,7 @@ func TestCheck(t *testing.T) {
 		TransactId: "1",
 		DecisionId: "simple",
 		WafParams:  map[string]string{"anomalyscore": "50", "inboundthreshold": "100"},
+		Direction:  "outbound",
 	})
 	if err != nil {
 		t.Error(err.Error())
@@ -299,7 +305,7 @@ func TestCheck(t *testing.T) {
 
 func TestCheckBlock(t *testing.T) {
 	handlers := Handlers{
-		Check: func(transactionID, decisionPlugin string, wafParams map[string]string) (bool, error) {
+		Check: func(transactionID, decisionPlugin, direction string, wafParams map[string]string) (bool, error) {
 			return true, nil
 		},
 	}
@@ -343,7 +349,7 @@ func TestCheckBlock(t *testing.T) {
 
 func TestCheckError(t *testing.T) {
 	handlers := Handlers{
-		Check: func(transactionID, decisionPlugin string, wafParams map[string]string) (bool, error) {
+		Check: func(transactionID, decisionPlugin, direction string, wafParams map[string]string) (bool, error) {
 			return true, errors.New("check error")
 		},
 	}
@@ -388,9 +394,328 @@ func TestCheckError(t *testing.T) {
 	}
 }
 
+func TestTenantScopedTransactions(t *testing.T) {
+	var ids []string
+	handlers := Handlers{
+		Init: func(transactionID, clientIP string) int32 {
+			ids = append(ids, transactionID)
+			return 0
+		},
+		SendRequest: func(transactionID, request string, models []string) int32 {
+			ids = append(ids, transactionID)
+			return 0
+		},
+	}
+
+	go func() {
+		err := Listen(handlers, "", "50051")
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	defer func() {
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+	}()
+
+	conn, err := grpc.Dial("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		log.Printf("did not connect: %v", err)
+		return
+	}
+	c := pb.NewWaceProtoClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// Tenant given in the Init parameters
+	_, err = c.Init(ctx, &pb.InitParams{TransactId: "1", TenantId: "acme"})
+	if err != nil {
+		t.Error(err.Error())
+	}
+	_, err = c.SendRequest(ctx, &pb.SendRequestParams{TransactId: "1"})
+	if err != nil {
+		t.Error(err.Error())
+	}
+	// Tenant given in the metadata
+	mdCtx := metadata.AppendToOutgoingContext(ctx, "wace-tenant", "other")
+	_, err = c.SendRequest(mdCtx, &pb.SendRequestParams{TransactId: "1"})
+	if err != nil {
+		t.Error(err.Error())
+	}
+	// Default tenant
+	_, err = c.SendRequest(ctx, &pb.SendRequestParams{TransactId: "2"})
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	expected := []string{"acme/1", "acme/1", "other/1", "2"}
+	if strings.Join(ids, ",") != strings.Join(expected, ",") {
+		t.Errorf("wrong scoped transaction ids %v, expected %v", ids, expected)
+	}
+}
+
+func TestTenantsSharingTransactionID(t *testing.T) {
+	var ids []string
+	handlers := Handlers{
+		Init: func(transactionID, clientIP string) int32 {
+			ids = append(ids, transactionID)
+			return 0
+		},
+		SendRequest: func(transactionID, request string, models []string) int32 {
+			ids = append(ids, transactionID)
+			return 0
+		},
+		Close: func(transactionID string, metric map[string]string) int32 {
+			ids = append(ids, transactionID)
+			return 0
+		},
+	}
+
+	go func() {
+		err := Listen(handlers, "", "50051")
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	defer func() {
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+	}()
+
+	// Each tenant has its own WAF, connected on its own
+	var clients []pb.WaceProtoClient
+	for i := 0; i < 2; i++ {
+		conn, err := grpc.Dial("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+		if err != nil {
+			log.Printf("did not connect: %v", err)
+			return
+		}
+		defer conn.Close()
+		clients = append(clients, pb.NewWaceProtoClient(conn))
+	}
+	acme, other := clients[0], clients[1]
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := acme.Init(ctx, &pb.InitParams{TransactId: "1", TenantId: "acme"}); err != nil {
+		t.Error(err.Error())
+	}
+	if _, err := other.Init(ctx, &pb.InitParams{TransactId: "1", TenantId: "other"}); err != nil {
+		t.Error(err.Error())
+	}
+	if _, err := acme.SendRequest(ctx, &pb.SendRequestParams{TransactId: "1"}); err != nil {
+		t.Error(err.Error())
+	}
+	// Closing the transaction of a tenant keeps the other one bound
+	if _, err := other.Close(ctx, &pb.CloseParams{TransactId: "1"}); err != nil {
+		t.Error(err.Error())
+	}
+	if _, err := acme.SendRequest(ctx, &pb.SendRequestParams{TransactId: "1"}); err != nil {
+		t.Error(err.Error())
+	}
+	if _, err := acme.Close(ctx, &pb.CloseParams{TransactId: "1"}); err != nil {
+		t.Error(err.Error())
+	}
+
+	expected := []string{"acme/1", "other/1", "acme/1", "other/1", "acme/1", "acme/1"}
+	if strings.Join(ids, ",") != strings.Join(expected, ",") {
+		t.Errorf("wrong scoped transaction ids %v, expected %v", ids, expected)
+	}
+}
+
+func TestAmbiguousIDs(t *testing.T) {
+	var ids []string
+	handlers := Handlers{
+		Init: func(transactionID, clientIP string) int32 {
+			ids = append(ids, transactionID)
+			return 0
+		},
+		SendRequest: func(transactionID, request string, models []string) int32 {
+			ids = append(ids, transactionID)
+			return 0
+		},
+	}
+
+	go func() {
+		err := Listen(handlers, "", "50051")
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	defer func() {
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+	}()
+
+	conn, err := grpc.Dial("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		log.Printf("did not connect: %v", err)
+		return
+	}
+	defer conn.Close()
+	c := pb.NewWaceProtoClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// The transaction "1" of the "acme" tenant
+	if _, err := c.SendRequest(metadata.AppendToOutgoingContext(ctx, "wace-tenant", "acme"), &pb.SendRequestParams{TransactId: "1"}); err != nil {
+		t.Error(err.Error())
+	}
+	// The default tenant cannot reach it with the "acme/1" transaction
+	if _, err := c.SendRequest(ctx, &pb.SendRequestParams{TransactId: "acme/1"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got error %v, expected InvalidArgument", err)
+	}
+	// Nor the tenants with the separator, in the metadata or in Init
+	if _, err := c.SendRequest(metadata.AppendToOutgoingContext(ctx, "wace-tenant", "acme/x"), &pb.SendRequestParams{TransactId: "1"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got error %v, expected InvalidArgument", err)
+	}
+	if _, err := c.Init(ctx, &pb.InitParams{TransactId: "1", TenantId: "acme/x"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got error %v, expected InvalidArgument", err)
+	}
+
+	expected := []string{"acme/1"}
+	if strings.Join(ids, ",") != strings.Join(expected, ",") {
+		t.Errorf("wrong scoped transaction ids %v, expected %v", ids, expected)
+	}
+}
+
+func TestBinaryPayloads(t *testing.T) {
+	body := []byte{0x1f, 0x8b, 0x08, 0x00, 0xff, 0xfe}
+	var got transaction.Payload
+	handlers := Handlers{
+		SendRequestBodyBytes: func(transactionID string, payload transaction.Payload, models []string) int32 {
+			got = payload
+			if transactionID != "7" || len(models) != 1 || models[0] != "trivial" {
+				return 1
+			}
+			return 0
+		},
+		SendReqLineAndHeadersBytes: func(transactionID string, reqLine, reqHeaders transaction.Payload, models []string) int32 {
+			if string(reqLine.Data) != "GET / HTTP/1.1" || string(reqHeaders.Data) != "Host: caf\xe9" || reqHeaders.Charset != "latin1" {
+				return 1
+			}
+			return 0
+		},
+	}
+
+	go func() {
+		err := Listen(handlers, "", "50051")
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	defer func() {
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+	}()
+
+	conn, err := grpc.Dial("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		log.Printf("did not connect: %v", err)
+		return
+	}
+	c := pb.NewWaceProtoClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	r, err := c.SendRequestBodyBytes(ctx, &pb.SendRequestBodyBytesParams{
+		TransactId: "7",
+		Body:       &pb.Payload{Data: body, ContentType: "application/gzip"},
+		ModelId:    []string{"trivial"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if r.StatusCode != 0 {
+		t.Errorf("SendRequestBodyBytes has wrong parameters")
+	}
+	if !bytes.Equal(got.Data, body) || got.ContentType != "application/gzip" {
+		t.Errorf("binary payload not preserved: %+v", got)
+	}
+
+	rHeaders, err := c.SendReqLineAndHeadersBytes(ctx, &pb.SendReqLineAndHeadersBytesParams{
+		TransactId: "7",
+		ReqLine:    &pb.Payload{Data: []byte("GET / HTTP/1.1")},
+		ReqHeaders: &pb.Payload{Data: []byte("Host: caf\xe9"), Charset: "latin1"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if rHeaders.StatusCode != 0 {
+		t.Errorf("SendReqLineAndHeadersBytes has wrong parameters")
+	}
+}
+
 func TestListenInvalidPort(t *testing.T) {
 	err := Listen(Handlers{}, "", "invalid port")
 	if err == nil {
 		t.Error("Listen did not rise an error")
 	}
 }
+
+func TestReportFeedback(t *testing.T) {
+	type report struct{ transactionID, label, comment string }
+	var reports []report
+	handlers := Handlers{
+		ReportFeedback: func(transactionID, label, comment string) (bool, error) {
+			if label != "attack" && label != "benign" {
+				return false, errors.New("invalid label")
+			}
+			reports = append(reports, report{transactionID, label, comment})
+			return transactionID == "acme/1", nil
+		},
+	}
+
+	go func() {
+		err := Listen(handlers, "", "50051")
+		if err != nil {
+			t.Error(err.Error())
+		}
+	}()
+	defer func() {
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+	}()
+
+	conn, err := grpc.Dial("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		log.Printf("did not connect: %v", err)
+		return
+	}
+	c := pb.NewWaceProtoClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	mdCtx := metadata.AppendToOutgoingContext(ctx, "wace-tenant", "acme")
+	r, err := c.ReportFeedback(mdCtx, &pb.ReportFeedbackParams{TransactId: "1", Label: "benign", Comment: "login form"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StatusCode != 0 || !r.Evaluated {
+		t.Errorf("unexpected result %+v", r)
+	}
+	r, err = c.ReportFeedback(ctx, &pb.ReportFeedbackParams{TransactId: "2", Label: "attack"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StatusCode != 0 || r.Evaluated {
+		t.Errorf("unexpected result %+v", r)
+	}
+	r, err = c.ReportFeedback(ctx, &pb.ReportFeedbackParams{TransactId: "3", Label: "fp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.StatusCode == 0 || !strings.Contains(r.Msg, "invalid label") {
+		t.Errorf("invalid label accepted: %+v", r)
+	}
+
+	expected := []report{{"acme/1", "benign", "login form"}, {"2", "attack", ""}}
+	if len(reports) != len(expected) || reports[0] != expected[0] || reports[1] != expected[1] {
+		t.Errorf("got reports %v, expected %v", reports, expected)
+	}
+}
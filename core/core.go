@@ -0,0 +1,1053 @@
+/*
+Package core implements the analysis workflow of WACE: it keeps track
+of the transactions, calls the model plugins with the payloads sent
+by the WAF and asks the decision plugins for a verdict.
+*/
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"wace/canary"
+	"wace/decoding"
+	"wace/feedback"
+	"wace/payloadlimit"
+	pm "wace/pluginmanager"
+	"wace/recorder"
+	"wace/tenant"
+	"wace/transaction"
+	"wace/workerpool"
+
+	cf "github.com/tilsor/ModSecIntl_wace_lib/configstore"
+
+	lg "github.com/tilsor/ModSecIntl_logging/logging"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+var plugins *pm.PluginManager
+var ctx = context.Background()
+var meter metric.Meter
+var payloadLimits map[string]payloadlimit.Limit
+var maxDecodedSize int
+var shadowDecisions []string
+var shadowTimeout time.Duration
+var router *canary.Router
+var transactionRecorder *recorder.Recorder
+var outcomes *feedback.Store
+var openTransactions = newActivity(DefaultTransactionTimeout)
+var keepPayloads bool
+
+// Options holds the configuration of the WACE core.
+type Options struct {
+	// ModelOptions configures the execution of each model plugin
+	ModelOptions map[string]pm.ModelOptions
+	// PayloadLimits limits the size of the payloads of each phase
+	// (model plugin type)
+	PayloadLimits map[string]payloadlimit.Limit
+	// MaxDecodedSize limits the size of the decoded payloads analyzed
+	// by the model plugins with normalized input
+	MaxDecodedSize int
+	// Decisions are the built-in decisions (eg: declarative rules),
+	// keyed by decision ID
+	Decisions map[string]func(pm.TransactionInput) (bool, error)
+	// ShadowDecisions are evaluated next to the decision plugin of
+	// each verdict, without influencing it, considering the results of
+	// the shadow model plugins too. Their disagreements with the
+	// active decision are logged and counted in the metrics.
+	ShadowDecisions []string
+	// ShadowTimeout is the maximum time the shadow model plugins
+	// analyzing a payload are awaited, in the background, before they
+	// are recorded as timed out. Defaults to DefaultShadowTimeout.
+	ShadowTimeout time.Duration
+	// Canary routes a percentage of the transactions to alternate
+	// models or decision plugins. Nil means no routing.
+	Canary *canary.Router
+	// Recorder records the transactions when they are closed. Nil
+	// means no recording.
+	Recorder *recorder.Recorder
+	// FeedbackTransactions is the number of closed transactions whose
+	// outcome is kept to evaluate the labels reported on them. Zero
+	// means the labels are only recorded.
+	FeedbackTransactions int
+	// TransactionTimeout is the time after its last call from which a
+	// transaction never closed is closed by WACE, dropping its state.
+	// Defaults to DefaultTransactionTimeout.
+	TransactionTimeout time.Duration
+}
+
+// transactionSync is a struct to syncronize the analysis of a given
+// transaction. Each time callPlugins is executed, the counter is
+// incremented. At the end of each callPlugins execution, a message is
+// sent through the channel, to signal CheckTransaction that it has
+// finished analyzing the request. CheckTransaction waits for Counter
+// number of messages in the channel, before calling the decision
+// plugin and sending the result to the client.
+type transactionSync struct {
+	Channel chan string
+	Counter int64
+
+	// shadowRuns are closed once the shadow work done in the
+	// background (the shadow model plugins called in a phase, or the
+	// shadow decisions of a verdict) finishes
+	shadowMutex sync.Mutex
+	shadowRuns  []chan struct{}
+}
+
+// DefaultShadowTimeout is the default Options.ShadowTimeout.
+const DefaultShadowTimeout = 5 * time.Second
+
+// addShadowRun adds a run of shadow work to the transaction, which
+// is closed once it finishes. It returns the runs added before it.
+func addShadowRun(transactionID string, done chan struct{}) []chan struct{} {
+	value, _ := analysisMap.LoadOrStore(transactionID, &transactionSync{Channel: make(chan string)})
+	tSync := value.(*transactionSync)
+	tSync.shadowMutex.Lock()
+	defer tSync.shadowMutex.Unlock()
+	previous := tSync.shadowRuns
+	tSync.shadowRuns = append(tSync.shadowRuns[:len(tSync.shadowRuns):len(tSync.shadowRuns)], done)
+	return previous
+}
+
+// shadowRunsOf returns the runs of shadow work of the transaction
+// started so far.
+func shadowRunsOf(transactionID string) []chan struct{} {
+	value, ok := analysisMap.Load(transactionID)
+	if !ok {
+		return nil
+	}
+	tSync := value.(*transactionSync)
+	tSync.shadowMutex.Lock()
+	defer tSync.shadowMutex.Unlock()
+	return tSync.shadowRuns
+}
+
+// shadowRunsDone returns whether the runs of shadow work finished.
+func shadowRunsDone(runs []chan struct{}) bool {
+	for _, done := range runs {
+		select {
+		case <-done:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// waitShadowRuns waits for the runs of shadow work.
+func waitShadowRuns(runs []chan struct{}) {
+	for _, done := range runs {
+		<-done
+	}
+}
+
+// backgroundPrintf logs a line of the transaction like TPrintf, but
+// without adding it to the logging buffer of the transaction, which
+// may be gone when the work done in the background logs.
+func backgroundPrintf(level lg.LogLevel, transactionID, format string, v ...interface{}) {
+	lg.Get().Printf(level, "| "+transactionID+" | "+format, v...)
+}
+
+var (
+	// Sync map with channels to receive a notification when all plugins
+	// finish processing a transaction
+	analysisMap sync.Map
+	// Transactions being closed in the background, once their shadow
+	// work finishes
+	backgroundCloses sync.WaitGroup
+)
+
+// addTransactionAnalysis adds a transaction to the analysis map. If the
+// transaction already exists, it increments the counter of the transaction
+// by one.
+func addTransactionAnalysis(transactionID string) {
+	tSync := transactionSync{
+		Channel: make(chan string),
+		Counter: 1,
+	}
+	value, loaded := analysisMap.LoadOrStore(transactionID, &tSync)
+	if loaded {
+		atomic.AddInt64(&value.(*transactionSync).Counter, 1)
+	}
+}
+
+// recordModelDuration records the time it took the model plugin to
+// analyze the transaction.
+func recordModelDuration(transactionID string, status pm.ModelStatus, mode string, startTime time.Time) {
+	logger := lg.Get()
+	histogramMeter, err := meter.Int64Histogram("wace.model.duration.nanoseconds")
+	if err != nil {
+		logger.TPrintf(lg.WARN, transactionID, "core | failed to record duration metric: %v", err.Error())
+		return
+	}
+	histogramMeter.Record(ctx, time.Since(startTime).Nanoseconds(), metric.WithAttributes(
+		attribute.String("model_id", status.ModelID),
+		attribute.String("model_mode", mode),
+		attribute.Float64("attack_probability", status.ProbAttack),
+		tenant.Attribute(transactionID),
+		router.Attribute(transactionID)))
+}
+
+// recordPayloadLimit counts in the metrics a payload exceeding its
+// size limit.
+func recordPayloadLimit(transactionID, phase, modelID, policy string) {
+	logger := lg.Get()
+	counter, err := meter.Int64Counter("wace.payload.limited.total")
+	if err != nil {
+		logger.TPrintf(lg.WARN, transactionID, "core | failed to record payload limit metric: %v", err.Error())
+		return
+	}
+	counter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("phase", phase),
+		attribute.String("model_id", modelID),
+		attribute.String("policy", policy),
+		tenant.Attribute(transactionID)))
+}
+
+// modelExecutionStatus returns the execution status of a model plugin
+// that finished with the given error.
+func modelExecutionStatus(err error) string {
+	switch {
+	case err == nil:
+		return transaction.ModelDone
+	case errors.Is(err, workerpool.ErrQueueTimeout):
+		return transaction.ModelTimeout
+	case errors.Is(err, workerpool.ErrQueueFull), errors.Is(err, payloadlimit.ErrTooLarge):
+		return transaction.ModelRejected
+	}
+	return transaction.ModelFailed
+}
+
+// recordModelExecution records in the transaction the execution of
+// the model plugin, so the decision plugins can take it into account.
+func recordModelExecution(transactionID, modelID string, t cf.ModelPluginType, status string, startTime time.Time, err error) {
+	tx, ok := transaction.Get(transactionID)
+	if !ok {
+		return
+	}
+	execution := transaction.ModelExecution{Phase: t.String(), Status: status, Shadow: plugins.Shadow(modelID)}
+	if status != transaction.ModelPending {
+		execution.Latency = time.Since(startTime)
+	}
+	if err != nil {
+		execution.Err = err.Error()
+	}
+	tx.SetModelExecution(modelID, execution)
+}
+
+// setTruncated records in the transaction that its payload was
+// truncated.
+func setTruncated(transactionID, phase, modelID string) {
+	if tx, ok := transaction.Get(transactionID); ok {
+		tx.SetTruncated(phase, modelID)
+	}
+}
+
+// modelPayload applies the payload limit of the model plugin to the
+// input. It returns false if the model must not analyze the payload.
+func modelPayload(input string, modelID string, t cf.ModelPluginType, transactionID string) (string, bool) {
+	logger := lg.Get()
+	limit := plugins.PayloadLimit(modelID).WithDefaultPolicy()
+	if !limit.Exceeded(input) {
+		return input, true
+	}
+	recordPayloadLimit(transactionID, t.String(), modelID, limit.Policy)
+	switch limit.Policy {
+	case payloadlimit.Reject:
+		logger.TPrintf(lg.WARN, transactionID, "%s | payload size %d exceeds the maximum %d, model rejected", modelID, len(input), limit.MaxSize)
+		plugins.RejectModel(transactionID, modelID, payloadlimit.ErrTooLarge)
+		recordModelExecution(transactionID, modelID, t, transaction.ModelRejected, time.Now(), payloadlimit.ErrTooLarge)
+		return input, false
+	case payloadlimit.Skip:
+		logger.TPrintf(lg.WARN, transactionID, "%s | payload size %d exceeds the maximum %d, model skipped", modelID, len(input), limit.MaxSize)
+		recordModelExecution(transactionID, modelID, t, transaction.ModelSkipped, time.Now(), nil)
+		return input, false
+	}
+	logger.TPrintf(lg.DEBUG, transactionID, "%s | payload size %d exceeds the maximum %d, truncated", modelID, len(input), limit.MaxSize)
+	truncated, _ := limit.Truncate(input)
+	setTruncated(transactionID, t.String(), modelID)
+	return truncated, true
+}
+
+// splitShadowModels splits the models into the ones awaited by the
+// verdicts, and the shadow model plugins called in the background.
+func splitShadowModels(models []string) ([]string, []string) {
+	var active, shadows []string
+	for _, id := range models {
+		if plugins.Shadow(id) {
+			shadows = append(shadows, id)
+		} else {
+			active = append(active, id)
+		}
+	}
+	return active, shadows
+}
+
+// withShadowModels returns the models with the shadow model plugins of
+// the phase added, if they are not in the list.
+func withShadowModels(models []string, t cf.ModelPluginType) []string {
+	shadowModels := plugins.ShadowModels(t)
+	if len(shadowModels) == 0 {
+		return models
+	}
+	listed := make(map[string]bool)
+	for _, id := range models {
+		listed[id] = true
+	}
+	all := append([]string{}, models...)
+	for _, id := range shadowModels {
+		if !listed[id] {
+			all = append(all, id)
+		}
+	}
+	return all
+}
+
+// callPlugins calls the model plugins in the given list, with the given input
+// (or its normalized version, for the model plugins with normalized input).
+// It waits for all the synchronous model plugins to finish, and sends the
+// result to the client. The asynchronous model plugins are executed in parallel
+func callPlugins(input, normalized string, models []string, t cf.ModelPluginType, transactionID string) {
+	logger := lg.Get()
+
+	// channel to receive the status of the execution of the analysis
+	// of all the model plugins executed
+	modelPlugStatus := make(chan pm.ModelStatus)
+	asyncModelPlugStatus := make(chan pm.ModelStatus)
+
+	plugins.AddModelChannel(transactionID, t, asyncModelPlugStatus, "async")
+	plugins.AddModelChannel(transactionID, t, modelPlugStatus, "sync")
+
+	conf := cf.Get()
+
+	syncCounter := 0
+	asyncCounter := 0
+
+	startTime := time.Now()
+
+	for _, id := range models {
+		logger.TPrintf(lg.DEBUG, transactionID, "%s | calling from core", id)
+		if _, ok := conf.ModelPlugins[id]; !ok {
+			logger.TPrintf(lg.ERROR, transactionID, "core | model plugin %s not found", id)
+		} else if conf.ModelPlugins[id].PluginType != t {
+			logger.TPrintf(lg.ERROR, transactionID, "core | model plugin %s is not of type %s", id, t)
+		} else if payload, ok := modelPayload(modelInput(id, input, normalized), id, t, transactionID); !ok {
+			continue
+		} else if conf.IsAsync(id) {
+			recordModelExecution(transactionID, id, t, transaction.ModelPending, startTime, nil)
+			asyncCounter++
+			go plugins.AddToQueue(id, transactionID, payload)
+		} else {
+			recordModelExecution(transactionID, id, t, transaction.ModelPending, startTime, nil)
+			if conf.ModelPlugins[id].Remote {
+				go plugins.AddToQueue(id, transactionID, payload)
+			} else {
+				go plugins.Process(id, transactionID, payload, t, modelPlugStatus)
+			}
+			syncCounter++
+		}
+	}
+
+	// The async model plugins are awaited in the background, if any
+	if asyncCounter == 0 {
+		plugins.RemoveAsyncModelChannel(transactionID, t)
+	} else {
+		go func() {
+			logger.TPrintf(lg.DEBUG, transactionID, "core | waiting for %d async model plugins to finish", asyncCounter)
+			for i := 0; i < asyncCounter; i++ {
+				// Await for the execution of the async model plugins
+				logger.TPrintf(lg.DEBUG, transactionID, "core | Waiting for async model plugin %d...", i+1)
+				status := <-asyncModelPlugStatus
+				recordModelExecution(transactionID, status.ModelID, t, modelExecutionStatus(status.Err), startTime, status.Err)
+				if status.Err == nil {
+					logger.TPrintf(lg.DEBUG, transactionID, "%s async | success. Result: %.5f", status.ModelID, status.ProbAttack)
+					recordModelDuration(transactionID, status, "async", startTime)
+				} else {
+					logger.TPrintf(lg.WARN, transactionID, "%s | %v", status.ModelID, status.Err)
+				}
+			}
+			plugins.RemoveAsyncModelChannel(transactionID, t)
+		}()
+	}
+
+	logger.TPrintf(lg.DEBUG, transactionID, "core | waiting for %d sync model plugins to finish", syncCounter)
+	for i := 0; i < syncCounter; i++ {
+		// Await for the execution of the model plugins
+		logger.TPrintf(lg.DEBUG, transactionID, "core | Waiting for sync model plugin %d...", i+1)
+		status := <-modelPlugStatus
+		recordModelExecution(transactionID, status.ModelID, t, modelExecutionStatus(status.Err), startTime, status.Err)
+		if status.Err == nil {
+			logger.TPrintf(lg.DEBUG, transactionID, "%s sync | success. Result: %.5f", status.ModelID, status.ProbAttack)
+			recordModelDuration(transactionID, status, "sync", startTime)
+		} else {
+			logger.TPrintf(lg.WARN, transactionID, "%s | %v", status.ModelID, status.Err)
+		}
+	}
+
+	value, ok := analysisMap.Load(transactionID)
+	if !ok {
+		logger.TPrintf(lg.ERROR, transactionID, "core | could not find transaction %s in analysis map", transactionID)
+		return
+	}
+	analysisChan := value.(*transactionSync).Channel
+	analysisChan <- "done"
+}
+
+// callShadowPlugins calls the shadow model plugins in the background,
+// so the verdicts do not wait for them, including the async and remote
+// ones called through NATS. They are awaited at most the shadow
+// timeout, after which the ones still running are recorded as timed
+// out.
+func callShadowPlugins(input, normalized string, models []string, t cf.ModelPluginType, transactionID string) {
+	p := plugins
+	conf := cf.Get()
+	timeout := shadowTimeout
+	// The status channel is buffered for all the models, so the late
+	// results do not block
+	status := make(chan pm.ModelStatus, len(models))
+	p.AddModelChannel(transactionID, t, status, "shadow")
+	startTime := time.Now()
+	pending := make(map[string]bool)
+	for _, id := range models {
+		if conf.ModelPlugins[id].PluginType != t {
+			backgroundPrintf(lg.ERROR, transactionID, "core | model plugin %s is not of type %s", id, t)
+			continue
+		}
+		payload, ok := modelPayload(modelInput(id, input, normalized), id, t, transactionID)
+		if !ok {
+			continue
+		}
+		recordModelExecution(transactionID, id, t, transaction.ModelPending, startTime, nil)
+		pending[id] = true
+		if conf.IsAsync(id) || conf.ModelPlugins[id].Remote {
+			go func(id, payload string) {
+				if err := p.AddToQueue(id, transactionID, payload); err != nil {
+					status <- pm.ModelStatus{ModelID: id, Err: err}
+				}
+			}(id, payload)
+		} else {
+			go p.Process(id, transactionID, payload, t, status)
+		}
+	}
+	if len(pending) == 0 {
+		p.RemoveShadowModelChannel(transactionID, t, status)
+		return
+	}
+
+	done := make(chan struct{})
+	addShadowRun(transactionID, done)
+	go func() {
+		defer close(done)
+		defer p.RemoveShadowModelChannel(transactionID, t, status)
+		record := func(modelID, status string, err error) {
+			if tx, ok := transaction.Get(transactionID); ok {
+				execution := transaction.ModelExecution{Phase: t.String(), Status: status, Shadow: true, Latency: time.Since(startTime)}
+				if err != nil {
+					execution.Err = err.Error()
+				}
+				tx.SetModelExecution(modelID, execution)
+			}
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for len(pending) > 0 {
+			select {
+			case s := <-status:
+				delete(pending, s.ModelID)
+				record(s.ModelID, modelExecutionStatus(s.Err), s.Err)
+				if s.Err == nil {
+					backgroundPrintf(lg.DEBUG, transactionID, "%s shadow | success. Result: %.5f", s.ModelID, s.ProbAttack)
+				} else {
+					backgroundPrintf(lg.WARN, transactionID, "%s | %v", s.ModelID, s.Err)
+				}
+			case <-timer.C:
+				for modelID := range pending {
+					backgroundPrintf(lg.WARN, transactionID, "%s | shadow model timed out after %v", modelID, timeout)
+					record(modelID, transaction.ModelTimeout, fmt.Errorf("timed out after %v", timeout))
+				}
+				return
+			}
+		}
+	}()
+}
+
+// InitTransaction initializes a transaction with the given id and
+// client IP address (which may be empty)
+func InitTransaction(transactionID, clientIP string) {
+	touchTransaction(transactionID)
+	logger := lg.Get()
+	logger.StartTransaction(transactionID)
+	logger.TPrintf(lg.DEBUG, transactionID, "core | initializing transaction")
+	tSync := transactionSync{
+		Channel: make(chan string),
+		Counter: 0,
+	}
+	analysisMap.Store(transactionID, &tSync)
+	transaction.New(transactionID).SetClientIP(clientIP)
+	variant := router.Assign(transactionID, clientIP)
+	logger.TPrintf(lg.DEBUG, transactionID, "core | transaction assigned to variant %s", variant)
+	plugins.InitTransaction(transactionID)
+}
+
+// Analyze calls the model plugins with the given payload and models
+// (replaced by the ones of the variant of the transaction, if any), and
+// the shadow model plugins of the phase. The shadow model plugins are
+// called in the background, so CheckTransaction does not wait for them.
+// It returns an error if the payload exceeds the size limit of the
+// phase and the limit policy is rejecting it.
+func Analyze(modelsTypeAsString, transactionID, payload string, models []string) error {
+	return AnalyzePayload(modelsTypeAsString, transactionID, transaction.Payload{Data: []byte(payload)}, models)
+}
+
+// AnalyzePayload is like Analyze, but receives the binary safe payload
+// sent by the WAF. The payload is stored in the transaction if the
+// recorder or the feedback needs it, and its head is parsed into the
+// HTTP request or response of the transaction.
+// The payload is only decoded if a model plugin analyzing it has
+// normalized input (see decodePayload).
+func AnalyzePayload(modelsTypeAsString, transactionID string, p transaction.Payload, models []string) error {
+	logger := lg.Get()
+	modelsType, err := cf.StringToPluginType(modelsTypeAsString)
+	if err != nil {
+		logger.TPrintf(lg.ERROR, transactionID, "core | %s is not a valid type", modelsTypeAsString)
+		return err
+	}
+	touchTransaction(transactionID)
+	tx := transaction.New(transactionID)
+	if keepPayloads {
+		tx.SetPayload(modelsTypeAsString, p)
+	}
+	parseHead(tx, modelsType, p)
+	models, shadows := splitShadowModels(withShadowModels(router.Models(transactionID, models), modelsType))
+	if len(models) > 0 || len(shadows) > 0 {
+		payload := string(p.Data)
+		limit := payloadLimits[modelsTypeAsString].WithDefaultPolicy()
+		if limit.Exceeded(payload) {
+			recordPayloadLimit(transactionID, modelsTypeAsString, "", limit.Policy)
+			switch limit.Policy {
+			case payloadlimit.Reject:
+				logger.TPrintf(lg.WARN, transactionID, "core | %s payload size %d exceeds the maximum %d, rejected", modelsTypeAsString, len(payload), limit.MaxSize)
+				return fmt.Errorf("%s payload size %d exceeds the maximum %d", modelsTypeAsString, len(payload), limit.MaxSize)
+			case payloadlimit.Skip:
+				logger.TPrintf(lg.WARN, transactionID, "core | %s payload size %d exceeds the maximum %d, skipped", modelsTypeAsString, len(payload), limit.MaxSize)
+				return nil
+			}
+			logger.TPrintf(lg.DEBUG, transactionID, "core | %s payload size %d exceeds the maximum %d, truncated", modelsTypeAsString, len(payload), limit.MaxSize)
+			payload, _ = limit.Truncate(payload)
+			setTruncated(transactionID, modelsTypeAsString, "")
+		}
+		var normalized string
+		if wantsNormalized(models) || wantsNormalized(shadows) {
+			var truncated bool
+			normalized, truncated = limit.Truncate(decodePayload(transactionID, modelsType, p).Text)
+			// The decoded payload may exceed the limit on its own
+			for _, id := range append(append([]string{}, models...), shadows...) {
+				if truncated && plugins.Input(id) == decoding.Normalized {
+					setTruncated(transactionID, modelsTypeAsString, id)
+				}
+			}
+		}
+		logger.TPrintf(lg.DEBUG, transactionID, "core | analyzing %s: [%s...]", modelsTypeAsString, strings.Split(payload, "\n")[0])
+		callShadowPlugins(payload, normalized, shadows, modelsType, transactionID)
+		if len(models) > 0 {
+			addTransactionAnalysis(transactionID)
+			go callPlugins(payload, normalized, models, modelsType, transactionID)
+		}
+	}
+	return nil
+}
+
+// SetRequestHead parses the request line and headers sent by the WAF
+// into the HTTP request of the transaction.
+func SetRequestHead(transactionID, requestLine, headers string) {
+	touchTransaction(transactionID)
+	transaction.New(transactionID).SetRequestHead(requestLine, decoding.ParseHeader(headers))
+}
+
+// SetResponseHead parses the status line and headers sent by the WAF
+// into the HTTP response of the transaction.
+func SetResponseHead(transactionID, statusLine, headers string) {
+	touchTransaction(transactionID)
+	transaction.New(transactionID).SetResponseHead(statusLine, decoding.ParseHeader(headers))
+}
+
+// bodyHeader returns the headers used to decode a body: the ones of
+// the message, with the content type and charset of the payload if it
+// has them.
+func bodyHeader(header http.Header, p transaction.Payload) http.Header {
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if p.ContentType != "" {
+		header.Set("Content-Type", p.ContentType)
+	}
+	if p.Charset != "" {
+		if mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+			params["charset"] = p.Charset
+			header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+		}
+	}
+	return header
+}
+
+// wantsNormalized returns true if any of the model plugins analyzes
+// the normalized payload.
+func wantsNormalized(models []string) bool {
+	for _, id := range models {
+		if plugins.Input(id) == decoding.Normalized {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHead adds the head of the whole request or response of the
+// phase to the HTTP request or response of the transaction. Parsing the
+// head is cheap, unlike decoding the body, so it is always done.
+func parseHead(tx *transaction.Transaction, t cf.ModelPluginType, p transaction.Payload) {
+	switch t {
+	case cf.AllRequest:
+		head, _ := decoding.SplitMessage(p.Data)
+		tx.SetRequestHead(decoding.ParseHead(head))
+	case cf.AllResponse:
+		head, _ := decoding.SplitMessage(p.Data)
+		tx.SetResponseHead(decoding.ParseHead(head))
+	}
+}
+
+// decodePayload decodes the payload of the phase, and adds its body
+// arguments to the HTTP request or response of the transaction. The
+// decoded payload is stored in the transaction, so the plugins can get
+// its parsed arguments, and its normalized text is analyzed by the
+// model plugins with normalized input. Decoding may inflate compressed
+// bodies, so it is only done for these plugins. On decoding errors,
+// the result holds what could be decoded.
+func decodePayload(transactionID string, t cf.ModelPluginType, p transaction.Payload) *decoding.Result {
+	logger := lg.Get()
+	tx := transaction.New(transactionID)
+	var res *decoding.Result
+	var err error
+	switch t {
+	case cf.RequestBody:
+		res, err = decoding.Decode(p.Data, bodyHeader(tx.Request().Header, p), maxDecodedSize)
+		tx.SetRequestBody(res)
+	case cf.ResponseBody:
+		res, err = decoding.Decode(p.Data, bodyHeader(tx.Response().Header, p), maxDecodedSize)
+		tx.SetResponseBody(res)
+	case cf.AllRequest:
+		res, err = decoding.DecodeMessage(p.Data, maxDecodedSize)
+		tx.SetRequestBody(res)
+	case cf.AllResponse:
+		res, err = decoding.DecodeMessage(p.Data, maxDecodedSize)
+		tx.SetResponseBody(res)
+	default:
+		// The heads are added to the transaction by SetRequestHead
+		// and SetResponseHead
+		res = &decoding.Result{Body: p.Data, Text: decoding.Normalize(string(p.Data))}
+	}
+	if err != nil {
+		logger.TPrintf(lg.WARN, transactionID, "core | decoding %s payload: %v", t, err)
+	}
+	tx.SetDecoded(t.String(), res)
+	return res
+}
+
+// modelInput returns the payload the model plugin analyzes, according
+// to its input mode.
+func modelInput(modelID, raw, normalized string) string {
+	if plugins.Input(modelID) == decoding.Normalized {
+		return normalized
+	}
+	return raw
+}
+
+// CheckTransaction checks the result of the analysis of the transaction
+// with the given id and decision plugin (replaced by the one of the
+// variant of the transaction, if any), in the given direction
+// (pm.Inbound if empty, or pm.Outbound)
+func CheckTransaction(transactionID, decisionPlugin, direction string, wafParams map[string]string) (bool, error) {
+	logger := lg.Get()
+	if direction == "" {
+		direction = pm.Inbound
+	}
+	touchTransaction(transactionID)
+	decisionPlugin = router.Decision(transactionID, decisionPlugin)
+	logger.TPrintf(lg.DEBUG, transactionID, "core | checking transaction (%s)", direction)
+	if err := pm.CheckDirection(direction); err != nil {
+		return false, err
+	}
+
+	value, exists := analysisMap.Load(transactionID)
+	if !exists {
+		return false, fmt.Errorf("transaction with id %s does not exist", transactionID)
+	}
+
+	tSync := value.(*transactionSync)
+
+	logger.TPrintln(lg.DEBUG, transactionID, "core | waiting for all models to finish...")
+
+	for i := 0; i < int(atomic.LoadInt64(&tSync.Counter)); i++ {
+		<-tSync.Channel
+	}
+	atomic.StoreInt64(&tSync.Counter, 0)
+
+	logger.TPrintln(lg.DEBUG, transactionID, "core | done, checking data...")
+	res, err := plugins.CheckResult(transactionID, decisionPlugin, direction, wafParams)
+	if err == nil {
+		if len(shadowDecisions) > 0 {
+			// The shadow decisions consider the results of the shadow
+			// model plugins, which are awaited in the background
+			done := make(chan struct{})
+			runs := addShadowRun(transactionID, done)
+			go func() {
+				defer close(done)
+				waitShadowRuns(runs)
+				compareShadowVerdicts(transactionID, decisionPlugin, direction, res, checkShadowDecisions(transactionID, decisionPlugin, direction, wafParams))
+			}()
+		}
+		recordVariantVerdict(transactionID, direction, res)
+		if tx, ok := transaction.Get(transactionID); ok {
+			tx.SetVerdict(direction, transaction.Verdict{Decision: decisionPlugin, Block: res, WAFParams: wafParams})
+		}
+	}
+
+	if err == nil {
+		logger.TPrintf(lg.DEBUG, transactionID, "core | transaction checked successfully. Blocking transaction: %t", res)
+
+		if res {
+			counter, err := meter.Int64Counter("wace.client.request.blocked.total", metric.WithDescription(decisionPlugin))
+			if err != nil {
+				logger.TPrintf(lg.WARN, transactionID, "core | failed to record blocked request metric: %v", err.Error())
+			} else {
+				counter.Add(ctx, 1, metric.WithAttributes(
+					attribute.String("direction", direction),
+					tenant.Attribute(transactionID),
+					router.Attribute(transactionID)))
+			}
+		}
+	} else {
+		logger.TPrintf(lg.ERROR, transactionID, "core | could not check transaction: %v", err)
+	}
+	return res, err
+}
+
+// recordVariantVerdict counts the verdict in the metrics of the
+// variant of the transaction, and records the time since the
+// transaction started.
+func recordVariantVerdict(transactionID, direction string, block bool) {
+	logger := lg.Get()
+	attrs := []attribute.KeyValue{
+		attribute.String("direction", direction),
+		tenant.Attribute(transactionID),
+		router.Attribute(transactionID),
+	}
+	counter, err := meter.Int64Counter("wace.variant.verdict.total")
+	if err != nil {
+		logger.TPrintf(lg.WARN, transactionID, "core | failed to record variant verdict metric: %v", err.Error())
+	} else {
+		counter.Add(ctx, 1, metric.WithAttributes(append(attrs, attribute.Bool("block", block))...))
+	}
+	histogramMeter, err := meter.Int64Histogram("wace.variant.verdict.duration.nanoseconds")
+	if err != nil {
+		logger.TPrintf(lg.WARN, transactionID, "core | failed to record variant duration metric: %v", err.Error())
+		return
+	}
+	histogramMeter.Record(ctx, router.Elapsed(transactionID).Nanoseconds(), metric.WithAttributes(attrs...))
+}
+
+// shadowVerdict is the verdict of a shadow decision
+type shadowVerdict struct {
+	decisionID string
+	block      bool
+	err        error
+}
+
+// checkShadowDecisions evaluates the shadow decisions other than the
+// active one in parallel, and returns a channel receiving their
+// verdicts, closed once all of them are received.
+func checkShadowDecisions(transactionID, activeDecision, direction string, wafParams map[string]string) <-chan shadowVerdict {
+	verdicts := make(chan shadowVerdict, len(shadowDecisions))
+	var wg sync.WaitGroup
+	for _, decisionID := range shadowDecisions {
+		if decisionID == activeDecision {
+			continue
+		}
+		wg.Add(1)
+		go func(decisionID string) {
+			defer wg.Done()
+			block, err := plugins.CheckShadowResult(transactionID, decisionID, direction, wafParams)
+			verdicts <- shadowVerdict{decisionID, block, err}
+		}(decisionID)
+	}
+	go func() {
+		wg.Wait()
+		close(verdicts)
+	}()
+	return verdicts
+}
+
+// compareShadowVerdicts waits for the verdicts of the shadow decisions
+// and compares them with the active one, logging and counting their
+// disagreements. It is run in the background.
+func compareShadowVerdicts(transactionID, activeDecision, direction string, block bool, verdicts <-chan shadowVerdict) {
+	verdictCounter, err := meter.Int64Counter("wace.shadow.verdict.total")
+	if err != nil {
+		backgroundPrintf(lg.WARN, transactionID, "core | failed to record shadow verdict metric: %v", err.Error())
+	}
+	disagreementCounter, err := meter.Int64Counter("wace.shadow.disagreement.total")
+	if err != nil {
+		backgroundPrintf(lg.WARN, transactionID, "core | failed to record shadow disagreement metric: %v", err.Error())
+	}
+	for verdict := range verdicts {
+		if verdict.err != nil {
+			backgroundPrintf(lg.WARN, transactionID, "%s | could not check transaction in shadow: %v", verdict.decisionID, verdict.err)
+			continue
+		}
+		attrs := metric.WithAttributes(
+			attribute.String("decision_id", verdict.decisionID),
+			attribute.String("active_decision_id", activeDecision),
+			attribute.String("direction", direction),
+			attribute.Bool("block", verdict.block),
+			tenant.Attribute(transactionID))
+		if verdictCounter != nil {
+			verdictCounter.Add(ctx, 1, attrs)
+		}
+		if verdict.block == block {
+			continue
+		}
+		backgroundPrintf(lg.INFO, transactionID, "%s | shadow decision disagrees with %s: block %t, active block %t",
+			verdict.decisionID, activeDecision, verdict.block, block)
+		if disagreementCounter != nil {
+			disagreementCounter.Add(ctx, 1, attrs)
+		}
+	}
+}
+
+// CloseTransaction closes the transaction with the given id
+// removing the transaction sync model results, after recording it if
+// there is a recorder and keeping its outcome for the feedback. If
+// shadow work is still running in the background, the transaction is
+// closed once it finishes, so it considers the shadow results.
+func CloseTransaction(transactionID string) {
+	runs := shadowRunsOf(transactionID)
+	if shadowRunsDone(runs) {
+		closeTransaction(transactionID)
+		return
+	}
+	backgroundCloses.Add(1)
+	go func() {
+		defer backgroundCloses.Done()
+		waitShadowRuns(runs)
+		closeTransaction(transactionID)
+	}()
+}
+
+// closeTransaction closes the transaction, once its shadow work
+// finished.
+func closeTransaction(transactionID string) {
+	openTransactions.forget(transactionID)
+	if tx, ok := transaction.Get(transactionID); ok {
+		results := plugins.Results(transactionID)
+		if transactionRecorder != nil {
+			transactionRecorder.Record(recorder.FromTransaction(tx, results, router.Variant(transactionID)))
+		}
+		if outcomes != nil {
+			outcomes.Add(transactionID, transactionOutcome(tx, results))
+		}
+	}
+	plugins.CloseTransaction(transactionID)
+	value, ok := analysisMap.Load(transactionID)
+	logger := lg.Get()
+
+	if !ok {
+		logger.TPrintf(lg.ERROR, transactionID, "Analysis for transaction %s not found", transactionID)
+	} else {
+		close(value.(*transactionSync).Channel)
+		for range value.(*transactionSync).Channel {
+		}
+		analysisMap.Delete(transactionID)
+	}
+	router.Release(transactionID)
+	transaction.Delete(transactionID)
+}
+
+// analyzedPayload returns the payload the model plugin analyzed in the
+// phase of the transaction, applying the payload limits again.
+func analyzedPayload(tx *transaction.Transaction, modelID, phase string) string {
+	p, _ := tx.Payload(phase)
+	limit := payloadLimits[phase].WithDefaultPolicy()
+	raw, _ := limit.Truncate(string(p.Data))
+	var normalized string
+	if decoded, ok := tx.Decoded(phase); ok {
+		normalized, _ = limit.Truncate(decoded.Text)
+	}
+	payload, _ := plugins.PayloadLimit(modelID).WithDefaultPolicy().Truncate(modelInput(modelID, raw, normalized))
+	return payload
+}
+
+// transactionOutcome returns the outcome of the closed transaction:
+// the results of the model plugins that finished, and the verdicts.
+// The payloads are kept for the model plugins receiving the feedback.
+func transactionOutcome(tx *transaction.Transaction, results map[string]pm.ModelResults) feedback.Outcome {
+	conf := cf.Get()
+	o := feedback.Outcome{Models: make(map[string]feedback.Model), Verdicts: tx.Verdicts()}
+	for modelID, execution := range tx.ModelExecutions() {
+		res, ok := results[modelID]
+		if !ok || execution.Status != transaction.ModelDone {
+			continue
+		}
+		m := feedback.Model{ProbAttack: res.ProbAttack, Threshold: feedback.DefaultModelThreshold, Shadow: execution.Shadow}
+		if data, ok := conf.ModelPlugins[modelID]; ok && data.Threshold > 0 {
+			m.Threshold = data.Threshold
+		}
+		if plugins.AcceptsFeedback(modelID) {
+			m.Payload = analyzedPayload(tx, modelID, execution.Phase)
+		}
+		o.Models[modelID] = m
+	}
+	return o
+}
+
+// ReportFeedback labels the closed transaction with the given id as an
+// attack or benign. The label is recorded if there is a recorder and,
+// if the outcome of the transaction is still kept, the errors of its
+// model and decision plugins are counted in the metrics and the label
+// is forwarded to the model plugins accepting feedback. It returns
+// whether the outcome was evaluated. The outcome is evaluated with the
+// first label only: relabelling the transaction records the new label,
+// but it is not evaluated again, so the errors are counted once.
+func ReportFeedback(transactionID, label, comment string) (bool, error) {
+	l := recorder.Label{TransactionID: transactionID, Time: time.Now(), Label: label, Comment: comment}
+	if err := l.Check(); err != nil {
+		return false, err
+	}
+	if transactionRecorder != nil {
+		if err := transactionRecorder.RecordLabel(l); err != nil {
+			backgroundPrintf(lg.WARN, transactionID, "core | failed to record label: %v", err)
+		}
+	}
+	if outcomes == nil {
+		return false, nil
+	}
+	o, ok := outcomes.Take(transactionID)
+	if !ok {
+		backgroundPrintf(lg.DEBUG, transactionID, "core | outcome of transaction %s not kept (evicted or already evaluated), feedback not evaluated", transactionID)
+		return false, nil
+	}
+	recordFeedback(transactionID, label, o)
+
+	for modelID, m := range o.Models {
+		if !plugins.AcceptsFeedback(modelID) {
+			continue
+		}
+		input := pm.FeedbackInput{TransactionID: transactionID, Label: label, Comment: comment, Payload: m.Payload, ProbAttack: m.ProbAttack}
+		go func(modelID string) {
+			if err := plugins.Feedback(modelID, input); err != nil {
+				backgroundPrintf(lg.WARN, transactionID, "%s | feedback failed: %v", modelID, err)
+			}
+		}(modelID)
+	}
+	return true, nil
+}
+
+// recordFeedback counts the labelled transaction, and the false
+// positives and false negatives of its model and decision plugins.
+func recordFeedback(transactionID, label string, o feedback.Outcome) {
+	counter, err := meter.Int64Counter("wace.feedback.total")
+	if err != nil {
+		backgroundPrintf(lg.WARN, transactionID, "core | failed to record feedback metric: %v", err.Error())
+	} else {
+		counter.Add(ctx, 1, metric.WithAttributes(attribute.String("label", label), tenant.Attribute(transactionID)))
+	}
+	modelCounter, err := meter.Int64Counter("wace.feedback.model.errors.total")
+	if err != nil {
+		backgroundPrintf(lg.WARN, transactionID, "core | failed to record model errors metric: %v", err.Error())
+	} else {
+		for _, e := range o.ModelErrors(label) {
+			modelCounter.Add(ctx, 1, metric.WithAttributes(
+				attribute.String("model_id", e.ID),
+				attribute.String("kind", e.Kind),
+				attribute.Bool("shadow", e.Shadow),
+				tenant.Attribute(transactionID)))
+		}
+	}
+	decisionCounter, err := meter.Int64Counter("wace.feedback.decision.errors.total")
+	if err != nil {
+		backgroundPrintf(lg.WARN, transactionID, "core | failed to record decision errors metric: %v", err.Error())
+		return
+	}
+	for _, e := range o.DecisionErrors(label) {
+		backgroundPrintf(lg.INFO, transactionID, "%s | %s verdict reported as %s", e.ID, e.Direction, e.Kind)
+		decisionCounter.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("decision_id", e.ID),
+			attribute.String("direction", e.Direction),
+			attribute.String("kind", e.Kind),
+			tenant.Attribute(transactionID)))
+	}
+}
+
+// Close stops the plugins, once the transactions being closed in the
+// background are closed. The core cannot be used after closing it.
+func Close() {
+	backgroundCloses.Wait()
+	plugins.Close()
+}
+
+// Init initializes the WACE core with the given metric meter and
+// options. The logger must be already loaded. It waits for the
+// transactions being closed in the background with the previous
+// options.
+func Init(met metric.Meter, opts Options) {
+	backgroundCloses.Wait()
+	logger := lg.Get()
+	meter = met
+	payloadLimits = opts.PayloadLimits
+	maxDecodedSize = opts.MaxDecodedSize
+	shadowDecisions = opts.ShadowDecisions
+	shadowTimeout = opts.ShadowTimeout
+	if shadowTimeout == 0 {
+		shadowTimeout = DefaultShadowTimeout
+	}
+	router = opts.Canary
+	transactionRecorder = opts.Recorder
+	outcomes = nil
+	if opts.FeedbackTransactions > 0 {
+		outcomes = feedback.NewStore(opts.FeedbackTransactions)
+	}
+	if router == nil {
+		router, _ = canary.New(nil, "")
+	}
+	timeout := opts.TransactionTimeout
+	if timeout == 0 {
+		timeout = DefaultTransactionTimeout
+	}
+	openTransactions = newActivity(timeout)
+
+	logger.Println(lg.DEBUG, "Loading plugin manager...")
+	plugins = pm.New(met, opts.ModelOptions)
+	for decisionID, check := range opts.Decisions {
+		err := plugins.RegisterDecision(decisionID, check)
+		if err != nil {
+			logger.Printf(lg.WARN, "| %s | cannot register decision: %v", decisionID, err)
+			continue
+		}
+		logger.Printf(lg.INFO, "| %s | decision registered", decisionID)
+	}
+	// The payloads are only kept for the recorder, and for the model
+	// plugins receiving the feedback
+	keepPayloads = transactionRecorder != nil
+	for modelID := range cf.Get().ModelPlugins {
+		keepPayloads = keepPayloads || (outcomes != nil && plugins.AcceptsFeedback(modelID))
+	}
+	logger.Println(lg.DEBUG, "Plugin manager loaded")
+}
@@ -0,0 +1,613 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"wace/canary"
+	"wace/payloadlimit"
+	pm "wace/pluginmanager"
+	"wace/recorder"
+	"wace/transaction"
+
+	cf "github.com/tilsor/ModSecIntl_wace_lib/configstore"
+
+	lg "github.com/tilsor/ModSecIntl_logging/logging"
+	"go.opentelemetry.io/otel/metric/noop"
+	"gopkg.in/yaml.v3"
+)
+
+var requestLine = "POST /cgi-bin/process.cgi HTTP/1.1"
+var requestHeaders = `User-Agent: Mozilla/4.0 (compatible; MSIE5.01; Windows NT)
+Host: www.tutorialspoint.com
+Content-Type: application/x-www-form-urlencoded
+Accept-Language: en-us
+Connection: Keep-Alive
+`
+
+var requestBody = "licenseID=string&content=string&/paramsXML=string\n"
+var wholeRequest = requestLine + "\n" + requestHeaders + "\n" + requestBody
+
+var responseLine = "HTTP/1.1 200 OK"
+var responseHeaders = `Date: Mon, 27 Jul 2009 12:28:53 GMT
+Server: Apache/2.2.14 (Win32)
+Content-Type: text/html
+Connection: Closed
+`
+var responseBody = `<html>
+<body>
+<h1>Hello, World!</h1>
+</body>
+</html>
+`
+var wholeResponse = responseLine + "\n" + responseHeaders + "\n" + responseBody
+
+// testModel is a native model scoring the payloads with the word
+// "attack" as attacks
+var testModel = `{
+  "type": "logistic",
+  "vectorizer": {"analyzer": "word", "lowercase": true, "vocabulary": {"attack": 0}},
+  "intercept": -5,
+  "coef": [10]
+}`
+
+// testConfig has a model of each phase, all of them with the test
+// model. The %[1]s verb is the path of the model.
+var testConfig = `---
+logpath: "/dev/null"
+loglevel: "ERROR"
+modelplugins:
+  - id: "requestHeaders"
+    plugintype: RequestHeaders
+    path: "%[1]s"
+    weight: 1
+    mode: sync
+  - id: "requestBody"
+    plugintype: RequestBody
+    path: "%[1]s"
+    weight: 1
+    mode: sync
+  - id: "allRequest"
+    plugintype: AllRequest
+    path: "%[1]s"
+    weight: 1
+    mode: sync
+  - id: "normalized"
+    plugintype: RequestBody
+    path: "%[1]s"
+    weight: 1
+    mode: sync
+  - id: "responseHeaders"
+    plugintype: ResponseHeaders
+    path: "%[1]s"
+    weight: 1
+    mode: sync
+  - id: "responseBody"
+    plugintype: ResponseBody
+    path: "%[1]s"
+    weight: 1
+    mode: sync
+  - id: "allResponse"
+    plugintype: AllResponse
+    path: "%[1]s"
+    weight: 1
+    mode: sync
+`
+
+func init() {
+	logger := lg.Get()
+	logger.LoadLoggerWriter(io.Discard, lg.ERROR)
+}
+
+// anyAttack is a decision blocking the transactions with a model
+// result over 0.5
+func anyAttack(input pm.TransactionInput) (bool, error) {
+	for _, res := range input.Results {
+		if res.ProbAttack > 0.5 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// initCore initializes the core with the test configuration and the
+// options. The "any" decision is added to the decisions of the
+// options, and the "normalized" model analyzes the normalized
+// payloads, unless the options configure it.
+func initCore(t *testing.T, opts Options) {
+	t.Helper()
+	initCoreModels(t, "", opts)
+}
+
+// initCoreModels is initCore with the models of the test
+// configuration followed by the given ones (with the same %[1]s
+// verb).
+func initCoreModels(t *testing.T, models string, opts Options) {
+	t.Helper()
+	modelPath := filepath.Join(t.TempDir(), "model.json")
+	if err := os.WriteFile(modelPath, []byte(testModel), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var inConf cf.ConfigFileData
+	if err := yaml.Unmarshal([]byte(fmt.Sprintf(testConfig+models, modelPath)), &inConf); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Get().SetConfig(inConf); err != nil {
+		t.Fatal(err)
+	}
+	if opts.Decisions == nil {
+		opts.Decisions = make(map[string]func(pm.TransactionInput) (bool, error))
+	}
+	opts.Decisions["any"] = anyAttack
+	if opts.ModelOptions == nil {
+		opts.ModelOptions = make(map[string]pm.ModelOptions)
+	}
+	if _, ok := opts.ModelOptions["normalized"]; !ok {
+		opts.ModelOptions["normalized"] = pm.ModelOptions{Input: "normalized"}
+	}
+	Init(noop.NewMeterProvider().Meter("test"), opts)
+}
+
+func TestAnalyzeRequestInParts(t *testing.T) {
+	initCore(t, Options{})
+	transactionID := "request-parts"
+	InitTransaction(transactionID, "192.0.2.1")
+	defer CloseTransaction(transactionID)
+
+	SetRequestHead(transactionID, requestLine, requestHeaders)
+	if err := Analyze("RequestHeaders", transactionID, requestLine+"\n"+requestHeaders, []string{"requestHeaders"}); err != nil {
+		t.Errorf("Analyze RequestHeaders: %v", err)
+	}
+	if err := Analyze("RequestBody", transactionID, requestBody, []string{"requestBody"}); err != nil {
+		t.Errorf("Analyze RequestBody: %v", err)
+	}
+	block, err := CheckTransaction(transactionID, "any", "", nil)
+	if err != nil || block {
+		t.Errorf("CheckTransaction got %t (%v), expected the transaction allowed", block, err)
+	}
+
+	tx, _ := transaction.Get(transactionID)
+	if req := tx.Request(); req.Method != "POST" || req.Path != "/cgi-bin/process.cgi" || req.Header.Get("Host") != "www.tutorialspoint.com" {
+		t.Errorf("request not parsed: %+v", req)
+	}
+	if tx.ClientIP() != "192.0.2.1" {
+		t.Errorf("client IP %q not kept", tx.ClientIP())
+	}
+	executions := tx.ModelExecutions()
+	for _, modelID := range []string{"requestHeaders", "requestBody"} {
+		if executions[modelID].Status != transaction.ModelDone {
+			t.Errorf("%s execution %+v, expected done", modelID, executions[modelID])
+		}
+	}
+}
+
+func TestAnalyzeWholeRequest(t *testing.T) {
+	initCore(t, Options{})
+	transactionID := "request-whole"
+	InitTransaction(transactionID, "")
+	defer CloseTransaction(transactionID)
+
+	if err := Analyze("AllRequest", transactionID, wholeRequest, []string{"allRequest"}); err != nil {
+		t.Errorf("Analyze AllRequest: %v", err)
+	}
+	if _, err := CheckTransaction(transactionID, "any", "", nil); err != nil {
+		t.Errorf("CheckTransaction: %v", err)
+	}
+	tx, _ := transaction.Get(transactionID)
+	if req := tx.Request(); req.Method != "POST" || req.Header.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		t.Errorf("request head not parsed from the whole request: %+v", req)
+	}
+}
+
+func TestAnalyzeResponseInParts(t *testing.T) {
+	initCore(t, Options{})
+	transactionID := "response-parts"
+	InitTransaction(transactionID, "")
+	defer CloseTransaction(transactionID)
+
+	SetResponseHead(transactionID, responseLine, responseHeaders)
+	if err := Analyze("ResponseHeaders", transactionID, responseLine+"\n"+responseHeaders, []string{"responseHeaders"}); err != nil {
+		t.Errorf("Analyze ResponseHeaders: %v", err)
+	}
+	if err := Analyze("ResponseBody", transactionID, responseBody, []string{"responseBody"}); err != nil {
+		t.Errorf("Analyze ResponseBody: %v", err)
+	}
+	if _, err := CheckTransaction(transactionID, "any", pm.Outbound, nil); err != nil {
+		t.Errorf("CheckTransaction: %v", err)
+	}
+	tx, _ := transaction.Get(transactionID)
+	if resp := tx.Response(); resp.Status != 200 || resp.Header.Get("Server") != "Apache/2.2.14 (Win32)" {
+		t.Errorf("response not parsed: %+v", resp)
+	}
+}
+
+func TestAnalyzeWholeResponse(t *testing.T) {
+	initCore(t, Options{})
+	transactionID := "response-whole"
+	InitTransaction(transactionID, "")
+	defer CloseTransaction(transactionID)
+
+	if err := Analyze("AllResponse", transactionID, wholeResponse, []string{"allResponse"}); err != nil {
+		t.Errorf("Analyze AllResponse: %v", err)
+	}
+	if _, err := CheckTransaction(transactionID, "any", pm.Outbound, nil); err != nil {
+		t.Errorf("CheckTransaction: %v", err)
+	}
+}
+
+func TestCheckInvalidTransaction(t *testing.T) {
+	initCore(t, Options{})
+	if _, err := CheckTransaction("INEXISTENT", "any", "", nil); err == nil {
+		t.Errorf("CheckTransaction with inexistent transaction does not raise an error")
+	}
+	transactionID := "invalid-direction"
+	InitTransaction(transactionID, "")
+	defer CloseTransaction(transactionID)
+	if _, err := CheckTransaction(transactionID, "any", "sideways", nil); err == nil {
+		t.Errorf("CheckTransaction with an invalid direction does not raise an error")
+	}
+}
+
+func TestCheckAttackTransaction(t *testing.T) {
+	initCore(t, Options{})
+	transactionID := "attack"
+	InitTransaction(transactionID, "")
+	defer CloseTransaction(transactionID)
+
+	// Unknown models are ignored
+	if err := Analyze("AllRequest", transactionID, "GET /?q=attack HTTP/1.1\n\n", []string{"allRequest", "missing"}); err != nil {
+		t.Errorf("Analyze AllRequest: %v", err)
+	}
+	block, err := CheckTransaction(transactionID, "any", "", nil)
+	if err != nil || !block {
+		t.Errorf("CheckTransaction got %t (%v), expected the transaction blocked", block, err)
+	}
+	tx, _ := transaction.Get(transactionID)
+	if verdict := tx.Verdicts()[pm.Inbound]; verdict.Decision != "any" || !verdict.Block {
+		t.Errorf("verdict %+v not kept in the transaction", verdict)
+	}
+}
+
+func TestDirections(t *testing.T) {
+	initCore(t, Options{})
+	transactionID := "directions"
+	InitTransaction(transactionID, "")
+	defer CloseTransaction(transactionID)
+
+	// The attack in the response does not block the inbound verdict
+	if err := Analyze("AllRequest", transactionID, wholeRequest, []string{"allRequest"}); err != nil {
+		t.Errorf("Analyze AllRequest: %v", err)
+	}
+	if err := Analyze("AllResponse", transactionID, "HTTP/1.1 200 OK\n\nattack", []string{"allResponse"}); err != nil {
+		t.Errorf("Analyze AllResponse: %v", err)
+	}
+	for direction, expected := range map[string]bool{pm.Inbound: false, pm.Outbound: true} {
+		block, err := CheckTransaction(transactionID, "any", direction, nil)
+		if err != nil || block != expected {
+			t.Errorf("%s verdict %t (%v), expected %t", direction, block, err, expected)
+		}
+	}
+}
+
+func TestPayloadLimits(t *testing.T) {
+	initCore(t, Options{
+		PayloadLimits: map[string]payloadlimit.Limit{
+			"RequestBody": {MaxSize: 8, Policy: "reject"},
+			"AllRequest":  {MaxSize: 16},
+		},
+	})
+	transactionID := "limits"
+	InitTransaction(transactionID, "")
+	defer CloseTransaction(transactionID)
+
+	if err := Analyze("RequestBody", transactionID, requestBody, []string{"requestBody"}); err == nil {
+		t.Errorf("payload over the reject limit accepted")
+	}
+	// The attack is truncated out of the payload
+	if err := Analyze("AllRequest", transactionID, "GET / HTTP/1.1\n\nattack", []string{"allRequest"}); err != nil {
+		t.Errorf("Analyze AllRequest: %v", err)
+	}
+	block, err := CheckTransaction(transactionID, "any", "", nil)
+	if err != nil || block {
+		t.Errorf("CheckTransaction got %t (%v), expected the truncated attack allowed", block, err)
+	}
+	tx, _ := transaction.Get(transactionID)
+	if !tx.Truncated("AllRequest", "") {
+		t.Errorf("truncated payload not flagged")
+	}
+}
+
+func TestDecodingOnDemand(t *testing.T) {
+	initCore(t, Options{
+		PayloadLimits: map[string]payloadlimit.Limit{
+			"ResponseBody": {MaxSize: 8, Policy: "reject"},
+		},
+	})
+	transactionID := "decoding"
+	InitTransaction(transactionID, "")
+	defer CloseTransaction(transactionID)
+
+	// Neither the phases without models, nor the models with raw input,
+	// nor the payloads over the reject limit are decoded
+	if err := Analyze("RequestHeaders", transactionID, requestLine+"\n"+requestHeaders, nil); err != nil {
+		t.Errorf("Analyze RequestHeaders: %v", err)
+	}
+	if err := Analyze("RequestBody", transactionID, requestBody, []string{"requestBody"}); err != nil {
+		t.Errorf("Analyze RequestBody: %v", err)
+	}
+	if err := Analyze("ResponseBody", transactionID, responseBody, []string{"normalized"}); err == nil {
+		t.Errorf("payload over the reject limit accepted")
+	}
+	tx, _ := transaction.Get(transactionID)
+	for _, phase := range []string{"RequestHeaders", "RequestBody", "ResponseBody"} {
+		if _, ok := tx.Decoded(phase); ok {
+			t.Errorf("%s decoded without a model asking for it", phase)
+		}
+	}
+	if args := tx.Request().BodyArgs; len(args) != 0 {
+		t.Errorf("body arguments %v parsed without a model asking for them", args)
+	}
+
+	if err := Analyze("RequestBody", transactionID, requestBody, []string{"normalized"}); err != nil {
+		t.Errorf("Analyze RequestBody: %v", err)
+	}
+	if _, ok := tx.Decoded("RequestBody"); !ok {
+		t.Errorf("RequestBody not decoded for a model with normalized input")
+	}
+	if _, err := CheckTransaction(transactionID, "any", "", nil); err != nil {
+		t.Errorf("CheckTransaction: %v", err)
+	}
+}
+
+func TestCanary(t *testing.T) {
+	router, err := canary.New([]canary.Variant{{
+		ID:         "strict",
+		Percentage: 100,
+		Models:     map[string]string{"requestBody": "normalized"},
+		Decision:   "always",
+	}}, canary.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	always := func(pm.TransactionInput) (bool, error) { return true, nil }
+	initCore(t, Options{
+		Canary:    router,
+		Decisions: map[string]func(pm.TransactionInput) (bool, error){"always": always},
+	})
+	transactionID := "canary"
+	InitTransaction(transactionID, "")
+	defer CloseTransaction(transactionID)
+
+	if err := Analyze("RequestBody", transactionID, requestBody, []string{"requestBody"}); err != nil {
+		t.Errorf("Analyze RequestBody: %v", err)
+	}
+	block, err := CheckTransaction(transactionID, "any", "", nil)
+	if err != nil || !block {
+		t.Errorf("decision of the variant not used: %t (%v)", block, err)
+	}
+	tx, _ := transaction.Get(transactionID)
+	executions := tx.ModelExecutions()
+	if _, ok := executions["normalized"]; !ok || len(executions) != 1 {
+		t.Errorf("model of the variant not used: %+v", executions)
+	}
+}
+
+func TestRecordTransaction(t *testing.T) {
+	dir := t.TempDir()
+	rec, err := recorder.New(recorder.Config{Dir: dir, SampleRate: 1, BlockSampleRate: 1}, noop.NewMeterProvider().Meter("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	initCore(t, Options{Recorder: rec})
+	transactionID := "recorded"
+	InitTransaction(transactionID, "")
+	if err := Analyze("AllRequest", transactionID, "GET /?q=attack HTTP/1.1\n\n", []string{"allRequest"}); err != nil {
+		t.Errorf("Analyze AllRequest: %v", err)
+	}
+	if _, err := CheckTransaction(transactionID, "any", "", nil); err != nil {
+		t.Errorf("CheckTransaction: %v", err)
+	}
+	CloseTransaction(transactionID)
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "wace-*.jsonl"))
+	var records []recorder.Record
+	for _, path := range files {
+		if err := recorder.ReadFile(path, func(r recorder.Record) error {
+			records = append(records, r)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(records) != 1 || records[0].TransactionID != transactionID || !records[0].Verdicts[pm.Inbound].Block {
+		t.Fatalf("unexpected records %+v", records)
+	}
+	if m := records[0].Models["allRequest"]; m.ProbAttack < 0.5 || !strings.Contains(string(records[0].Phases[0].Payload), "attack") {
+		t.Errorf("model result or payload not recorded: %+v", records[0])
+	}
+}
+
+// blockingModel is a model plugin whose calls block until release is
+// closed.
+type blockingModel struct {
+	release chan struct{}
+}
+
+func (m *blockingModel) Process(input pm.ModelInput) (pm.ModelResults, error) {
+	<-m.release
+	return pm.ModelResults{ProbAttack: 1}, nil
+}
+
+func TestSlowShadowModel(t *testing.T) {
+	slow := &blockingModel{release: make(chan struct{})}
+	defer close(slow.release)
+	address := "unix://" + filepath.Join(t.TempDir(), "model.sock")
+	go pm.ServeModel(address, func(map[string]string) (pm.ModelPlugin, error) { return slow, nil })
+
+	shadowModel := `  - id: "slow"
+    plugintype: RequestHeaders
+    path: "%[1]s"
+    weight: 1
+    mode: grpc
+`
+	initCoreModels(t, shadowModel, Options{
+		ModelOptions: map[string]pm.ModelOptions{
+			"slow": {Shadow: true, GRPC: pm.GRPCOptions{Address: address, Timeout: time.Minute, StartTimeout: 5 * time.Second}},
+		},
+		ShadowTimeout: 200 * time.Millisecond,
+	})
+	transactionID := "slow-shadow"
+	InitTransaction(transactionID, "192.0.2.1")
+	defer CloseTransaction(transactionID)
+
+	start := time.Now()
+	if err := Analyze("RequestHeaders", transactionID, requestLine+"\n"+requestHeaders, []string{"requestHeaders"}); err != nil {
+		t.Fatalf("Analyze RequestHeaders: %v", err)
+	}
+	if _, err := CheckTransaction(transactionID, "any", "", nil); err != nil {
+		t.Fatalf("CheckTransaction: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("the shadow model delayed CheckTransaction %v", elapsed)
+	}
+
+	tx, ok := transaction.Get(transactionID)
+	if !ok {
+		t.Fatal("transaction not found")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for tx.ModelExecutions()["slow"].Status == transaction.ModelPending && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	execution := tx.ModelExecutions()["slow"]
+	if execution.Status != transaction.ModelTimeout || !execution.Shadow {
+		t.Errorf("unexpected shadow execution %+v", execution)
+	}
+	if execution := tx.ModelExecutions()["requestHeaders"]; execution.Status != transaction.ModelDone {
+		t.Errorf("unexpected execution %+v", execution)
+	}
+}
+
+func TestReportFeedback(t *testing.T) {
+	initCore(t, Options{FeedbackTransactions: 10})
+	transactionID := "feedback"
+	InitTransaction(transactionID, "192.0.2.1")
+	if err := Analyze("RequestHeaders", transactionID, requestLine+"\n"+requestHeaders, []string{"requestHeaders"}); err != nil {
+		t.Fatalf("Analyze RequestHeaders: %v", err)
+	}
+	if _, err := CheckTransaction(transactionID, "any", "", nil); err != nil {
+		t.Fatalf("CheckTransaction: %v", err)
+	}
+	CloseTransaction(transactionID)
+
+	if _, err := ReportFeedback(transactionID, "unknown", ""); err == nil {
+		t.Errorf("invalid label accepted")
+	}
+	if evaluated, err := ReportFeedback(transactionID, "attack", ""); err != nil || !evaluated {
+		t.Errorf("first label not evaluated (%v)", err)
+	}
+	// Relabelling the transaction does not evaluate it again
+	if evaluated, err := ReportFeedback(transactionID, "benign", "wrong label"); err != nil || evaluated {
+		t.Errorf("relabelled transaction evaluated again (%v)", err)
+	}
+}
+
+func TestAbandonedTransactions(t *testing.T) {
+	initCore(t, Options{TransactionTimeout: time.Minute})
+	now := time.Now()
+	openTransactions.now = func() time.Time { return now }
+
+	InitTransaction("abandoned", "192.0.2.1")
+	if err := Analyze("RequestHeaders", "abandoned", requestLine+"\n"+requestHeaders, []string{"requestHeaders"}); err != nil {
+		t.Fatalf("Analyze RequestHeaders: %v", err)
+	}
+	if _, err := CheckTransaction("abandoned", "any", "", nil); err != nil {
+		t.Fatalf("CheckTransaction: %v", err)
+	}
+	tx, ok := transaction.Get("abandoned")
+	if !ok {
+		t.Fatal("transaction not found")
+	}
+	// Without recorder nor feedback, the payloads are not kept
+	if _, ok := tx.Payload("RequestHeaders"); ok {
+		t.Errorf("payload kept without recorder nor feedback")
+	}
+
+	// The transaction is expired by the calls of the later ones
+	now = now.Add(59 * time.Second)
+	InitTransaction("active", "192.0.2.1")
+	if _, ok := transaction.Get("abandoned"); !ok {
+		t.Errorf("transaction expired before the timeout")
+	}
+	now = now.Add(2 * time.Second)
+	InitTransaction("next", "192.0.2.1")
+	defer CloseTransaction("next")
+	defer CloseTransaction("active")
+	if _, ok := transaction.Get("abandoned"); ok {
+		t.Errorf("abandoned transaction not expired")
+	}
+	if _, ok := analysisMap.Load("abandoned"); ok {
+		t.Errorf("sync state of the abandoned transaction kept")
+	}
+	if results := plugins.Results("abandoned"); len(results) != 0 {
+		t.Errorf("results of the abandoned transaction kept: %v", results)
+	}
+	if n := openTransactions.len(); n != 2 {
+		t.Errorf("%d open transactions, expected 2", n)
+	}
+}
+
+func TestRemoteShadowModel(t *testing.T) {
+	remoteModel := `  - id: "remote"
+    plugintype: RequestHeaders
+    path: "%[1]s"
+    weight: 1
+    mode: sync
+    remote: true
+`
+	initCoreModels(t, remoteModel, Options{
+		ModelOptions:  map[string]pm.ModelOptions{"remote": {Shadow: true}},
+		ShadowTimeout: 200 * time.Millisecond,
+	})
+	transactionID := "remote-shadow"
+	InitTransaction(transactionID, "192.0.2.1")
+	defer CloseTransaction(transactionID)
+
+	if err := Analyze("RequestHeaders", transactionID, requestLine+"\n"+requestHeaders, []string{"requestHeaders"}); err != nil {
+		t.Fatalf("Analyze RequestHeaders: %v", err)
+	}
+	// The verdict does not wait for the remote shadow model, called
+	// through NATS
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := CheckTransaction(transactionID, "any", "", nil); err != nil {
+			t.Errorf("CheckTransaction: %v", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the remote shadow model delayed CheckTransaction")
+	}
+
+	tx, ok := transaction.Get(transactionID)
+	if !ok {
+		t.Fatal("transaction not found")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for tx.ModelExecutions()["remote"].Status == transaction.ModelPending && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if execution := tx.ModelExecutions()["remote"]; execution.Status == transaction.ModelPending || !execution.Shadow {
+		t.Errorf("unexpected shadow execution %+v", execution)
+	}
+}
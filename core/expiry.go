@@ -0,0 +1,93 @@
+package core
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	lg "github.com/tilsor/ModSecIntl_logging/logging"
+)
+
+// DefaultTransactionTimeout is the default Options.TransactionTimeout.
+const DefaultTransactionTimeout = time.Minute
+
+// openTransaction is a transaction not closed yet, with the time of
+// its last call.
+type openTransaction struct {
+	id   string
+	last time.Time
+}
+
+// activity tracks the last call of the open transactions, so the ones
+// the WAF never closes (eg: when it crashes or loses the connection)
+// are expired instead of keeping their payloads, results and sync
+// state forever. It is safe for concurrent use.
+type activity struct {
+	mutex   sync.Mutex
+	timeout time.Duration
+	now     func() time.Time
+	open    map[string]*list.Element
+	// idle has the open transactions, the longest idle first
+	idle *list.List
+}
+
+// newActivity creates an activity expiring the transactions idle for
+// longer than the timeout.
+func newActivity(timeout time.Duration) *activity {
+	return &activity{timeout: timeout, now: time.Now, open: make(map[string]*list.Element), idle: list.New()}
+}
+
+// touch records a call of the transaction. It returns the transactions
+// idle for longer than the timeout, which are forgotten.
+func (a *activity) touch(transactionID string) []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	now := a.now()
+	var expired []string
+	for elem := a.idle.Front(); elem != nil; elem = a.idle.Front() {
+		t := elem.Value.(*openTransaction)
+		if now.Sub(t.last) < a.timeout {
+			break
+		}
+		a.idle.Remove(elem)
+		delete(a.open, t.id)
+		expired = append(expired, t.id)
+	}
+	if elem, ok := a.open[transactionID]; ok {
+		elem.Value.(*openTransaction).last = now
+		a.idle.MoveToBack(elem)
+	} else {
+		a.open[transactionID] = a.idle.PushBack(&openTransaction{id: transactionID, last: now})
+	}
+	return expired
+}
+
+// forget forgets the closed transaction.
+func (a *activity) forget(transactionID string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if elem, ok := a.open[transactionID]; ok {
+		a.idle.Remove(elem)
+		delete(a.open, transactionID)
+	}
+}
+
+// len returns the number of open transactions.
+func (a *activity) len() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.idle.Len()
+}
+
+// touchTransaction records a call of the transaction, and closes the
+// transactions idle for longer than the transaction timeout.
+func touchTransaction(transactionID string) {
+	for _, id := range openTransactions.touch(transactionID) {
+		backgroundPrintf(lg.WARN, id, "core | transaction not closed after %v, expired", openTransactions.timeout)
+		CloseTransaction(id)
+		// The logging buffer started by the calls of the transaction
+		logger := lg.Get()
+		logger.StartTransaction(id)
+		logger.EndTransaction(id)
+	}
+}
@@ -0,0 +1,517 @@
+/*
+Package decoding implements the pre-processing of the payloads before
+they are analyzed by the model plugins: it removes the transfer and
+content encodings, decodes the charset, parses url-encoded, multipart,
+JSON and XML bodies and normalizes the text of the payload.
+*/
+package decoding
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httputil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Input modes of the model plugins.
+const (
+	// Raw is the payload as sent by the WAF
+	Raw = "raw"
+	// Normalized is the payload decoded and normalized
+	Normalized = "normalized"
+)
+
+// DefaultMaxSize is the default maximum size in bytes of a decoded
+// payload.
+const DefaultMaxSize = 16 * 1024 * 1024
+
+// ErrTooLarge is returned when the decoded payload exceeds the
+// maximum size. The result holds the payload truncated to it.
+var ErrTooLarge = errors.New("decoded payload too large")
+
+// CheckInput verifies that the input mode is valid.
+func CheckInput(mode string) error {
+	switch mode {
+	case "", Raw, Normalized:
+		return nil
+	}
+	return fmt.Errorf("invalid input mode %s", mode)
+}
+
+// Arg is an argument parsed from a payload. The names of JSON and XML
+// arguments are the path of the value in the document, with its
+// components separated by dots.
+type Arg struct {
+	Name  string
+	Value string
+}
+
+// File is a file uploaded in a multipart payload.
+type File struct {
+	Field       string
+	Filename    string
+	ContentType string
+	Size        int
+}
+
+// Result is the decoded payload.
+type Result struct {
+	// Body is the payload without its transfer and content encodings
+	Body []byte
+	// Args are the arguments parsed from the body
+	Args []Arg
+	// Files are the files uploaded in a multipart body
+	Files []File
+	// Text is the normalized text of the payload
+	Text string
+}
+
+// ContentDecoder returns a reader decoding a content encoding.
+type ContentDecoder func(io.Reader) (io.Reader, error)
+
+var (
+	decodersMutex   sync.RWMutex
+	contentDecoders = map[string]ContentDecoder{
+		"gzip":    gzipDecoder,
+		"x-gzip":  gzipDecoder,
+		"deflate": deflateDecoder,
+		"br":      brotliDecoder,
+	}
+)
+
+// RegisterContentDecoder registers the decoder of a content encoding
+// (eg: "zstd"), or replaces the decoder of a supported one.
+func RegisterContentDecoder(name string, decoder ContentDecoder) {
+	decodersMutex.Lock()
+	defer decodersMutex.Unlock()
+	contentDecoders[strings.ToLower(name)] = decoder
+}
+
+func gzipDecoder(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+func brotliDecoder(r io.Reader) (io.Reader, error) {
+	return brotli.NewReader(r), nil
+}
+
+// deflateDecoder decodes both zlib wrapped (as the RFC says) and raw
+// (as some servers send) deflate streams.
+func deflateDecoder(r io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if zr, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+		return zr, nil
+	}
+	return flate.NewReader(bytes.NewReader(data)), nil
+}
+
+// readLimited reads at most maxSize bytes of r.
+func readLimited(r io.Reader, maxSize int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if len(data) > maxSize {
+		return data[:maxSize], ErrTooLarge
+	}
+	return data, err
+}
+
+// headerList returns the comma separated values of a header.
+func headerList(header http.Header, name string) []string {
+	var values []string
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// decodeEncodings removes the transfer and content encodings of the
+// body.
+func decodeEncodings(data []byte, header http.Header, maxSize int) ([]byte, error) {
+	for _, te := range headerList(header, "Transfer-Encoding") {
+		if te != "chunked" {
+			continue
+		}
+		// The WAF may already have removed the chunked encoding, in
+		// which case the body is left as it is
+		if dechunked, err := readLimited(httputil.NewChunkedReader(bytes.NewReader(data)), maxSize); err == nil {
+			data = dechunked
+		}
+	}
+
+	encodings := headerList(header, "Content-Encoding")
+	// The encodings are listed in the order they were applied
+	for i := len(encodings) - 1; i >= 0; i-- {
+		if encodings[i] == "identity" {
+			continue
+		}
+		decodersMutex.RLock()
+		decoder, ok := contentDecoders[encodings[i]]
+		decodersMutex.RUnlock()
+		if !ok {
+			return data, fmt.Errorf("unsupported content encoding %s", encodings[i])
+		}
+		r, err := decoder(bytes.NewReader(data))
+		if err != nil {
+			return data, fmt.Errorf("decoding %s: %v", encodings[i], err)
+		}
+		decoded, err := readLimited(r, maxSize)
+		if err != nil && err != ErrTooLarge {
+			return data, fmt.Errorf("decoding %s: %v", encodings[i], err)
+		}
+		data = decoded
+		if err == ErrTooLarge {
+			return data, err
+		}
+	}
+	if len(data) > maxSize {
+		return data[:maxSize], ErrTooLarge
+	}
+	return data, nil
+}
+
+// toUTF8 decodes the data from the charset to UTF-8. Data with an
+// unknown charset is returned unchanged.
+func toUTF8(data []byte, charset string) string {
+	if charset == "" {
+		return string(data)
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return string(data)
+	}
+	text, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return string(data)
+	}
+	return string(text)
+}
+
+// Decode removes the transfer and content encodings of the body of an
+// HTTP message with the given header, parses its arguments according
+// to its content type and normalizes its text. The decoded body is
+// limited to maxSize bytes (DefaultMaxSize if it is not positive). On
+// error, the result holds what could be decoded.
+func Decode(data []byte, header http.Header, maxSize int) (*Result, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	res := &Result{}
+	body, err := decodeEncodings(data, header, maxSize)
+	res.Body = body
+
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	var parseErr error
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		res.Args, parseErr = parseForm(toUTF8(body, params["charset"]))
+	case strings.HasPrefix(mediaType, "multipart/"):
+		res.Args, res.Files, parseErr = parseMultipart(body, params["boundary"])
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		res.Args, parseErr = parseJSON(toUTF8(body, params["charset"]))
+	case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+		res.Args, parseErr = parseXML(body)
+	}
+
+	if res.Args != nil || res.Files != nil {
+		res.Text = argsText(res.Args, res.Files)
+	} else {
+		res.Text = Normalize(toUTF8(body, params["charset"]))
+	}
+
+	if err == nil {
+		err = parseErr
+	}
+	return res, err
+}
+
+// DecodeMessage decodes a whole HTTP message (start line, headers and
+// body), as Decode does with its body. The normalized text holds the
+// start line and headers followed by the body.
+func DecodeMessage(data []byte, maxSize int) (*Result, error) {
+	head, body := SplitMessage(data)
+	_, header := ParseHead(head)
+	res, err := Decode(body, header, maxSize)
+	res.Text = Normalize(string(head)) + "\n\n" + res.Text
+	return res, err
+}
+
+// ParseHead parses the head of an HTTP message, returning its start
+// line and its headers.
+func ParseHead(head []byte) (string, http.Header) {
+	line, headers, _ := strings.Cut(string(head), "\n")
+	return strings.TrimRight(line, "\r"), ParseHeader(headers)
+}
+
+// SplitMessage splits an HTTP message in its head (start line and
+// headers) and its body.
+func SplitMessage(data []byte) ([]byte, []byte) {
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		return data[:i], data[i+4:]
+	}
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 {
+		return data[:i], data[i+2:]
+	}
+	return data, nil
+}
+
+// ParseHeader parses header lines ("Name: value"). Lines without a
+// colon are ignored.
+func ParseHeader(headers string) http.Header {
+	header := http.Header{}
+	for _, line := range strings.Split(headers, "\n") {
+		name, value, ok := strings.Cut(strings.TrimRight(line, "\r"), ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			continue
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	return header
+}
+
+// argsText returns the normalized text of the arguments and files,
+// one "name=value" per line. The names and values are already decoded,
+// so they are not URL decoded again.
+func argsText(args []Arg, files []File) string {
+	var b strings.Builder
+	for _, arg := range args {
+		b.WriteString(normalizeUnicode(arg.Name))
+		b.WriteByte('=')
+		b.WriteString(normalizeUnicode(arg.Value))
+		b.WriteByte('\n')
+	}
+	for _, file := range files {
+		b.WriteString(normalizeUnicode(file.Field))
+		b.WriteByte('=')
+		b.WriteString(normalizeUnicode(file.Filename))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// ParseQuery parses the arguments of a query string or url-encoded
+// body. Unlike url.ParseQuery, it keeps the order of the arguments and
+// does not fail on invalid escapes.
+func ParseQuery(query string) []Arg {
+	args, _ := parseForm(query)
+	return args
+}
+
+func parseForm(body string) ([]Arg, error) {
+	var args []Arg
+	for _, pair := range strings.Split(body, "&") {
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		args = append(args, Arg{Name: URLDecode(name), Value: URLDecode(value)})
+	}
+	return args, nil
+}
+
+func parseMultipart(body []byte, boundary string) ([]Arg, []File, error) {
+	if boundary == "" {
+		return nil, nil, fmt.Errorf("multipart body without boundary")
+	}
+	var args []Arg
+	var files []File
+	r := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			return args, files, nil
+		}
+		if err != nil {
+			return args, files, err
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return args, files, err
+		}
+		if part.FileName() != "" {
+			files = append(files, File{
+				Field:       part.FormName(),
+				Filename:    part.FileName(),
+				ContentType: part.Header.Get("Content-Type"),
+				Size:        len(data),
+			})
+			continue
+		}
+		_, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		args = append(args, Arg{Name: part.FormName(), Value: toUTF8(data, params["charset"])})
+	}
+}
+
+func parseJSON(body string) ([]Arg, error) {
+	d := json.NewDecoder(strings.NewReader(body))
+	d.UseNumber()
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	var args []Arg
+	flattenJSON("", doc, &args)
+	return args, nil
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func flattenJSON(path string, value interface{}, args *[]Arg) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			flattenJSON(joinPath(path, k), v[k], args)
+		}
+	case []interface{}:
+		for i, e := range v {
+			flattenJSON(joinPath(path, strconv.Itoa(i)), e, args)
+		}
+	case string:
+		*args = append(*args, Arg{Name: path, Value: v})
+	case json.Number:
+		*args = append(*args, Arg{Name: path, Value: v.String()})
+	case bool:
+		*args = append(*args, Arg{Name: path, Value: strconv.FormatBool(v)})
+	case nil:
+		*args = append(*args, Arg{Name: path, Value: ""})
+	}
+}
+
+func parseXML(body []byte) ([]Arg, error) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	d.Strict = false
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	}
+	var args []Arg
+	var path []string
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return args, nil
+		}
+		if err != nil {
+			return args, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			for _, attr := range t.Attr {
+				args = append(args, Arg{Name: strings.Join(path, ".") + "@" + attr.Name.Local, Value: attr.Value})
+			}
+		case xml.EndElement:
+			if len(path) > 0 {
+				path = path[:len(path)-1]
+			}
+		case xml.CharData:
+			if text := strings.TrimSpace(string(t)); text != "" {
+				args = append(args, Arg{Name: strings.Join(path, "."), Value: text})
+			}
+		}
+	}
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// URLDecode decodes the percent encoded sequences (including the
+// non-standard %uXXXX ones) and the plus signs of s. Unlike
+// url.QueryUnescape, invalid sequences are kept as they are instead of
+// failing.
+func URLDecode(s string) string {
+	if !strings.ContainsAny(s, "%+") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '+':
+			b.WriteByte(' ')
+			continue
+		case '%':
+			if i+5 < len(s) && (s[i+1] == 'u' || s[i+1] == 'U') {
+				if r, err := strconv.ParseUint(s[i+2:i+6], 16, 16); err == nil {
+					b.WriteRune(rune(r))
+					i += 5
+					continue
+				}
+			}
+			if i+2 < len(s) {
+				hi, ok1 := unhex(s[i+1])
+				lo, ok2 := unhex(s[i+2])
+				if ok1 && ok2 {
+					b.WriteByte(hi<<4 | lo)
+					i += 2
+					continue
+				}
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// Normalize URL decodes s, replaces its invalid UTF-8 sequences with
+// the Unicode replacement character and applies the Unicode NFKC
+// normalization, so equivalent characters (eg: fullwidth forms) are
+// analyzed as the same.
+func Normalize(s string) string {
+	return normalizeUnicode(URLDecode(s))
+}
+
+// normalizeUnicode replaces the invalid UTF-8 sequences of s with the
+// Unicode replacement character and applies the Unicode NFKC
+// normalization.
+func normalizeUnicode(s string) string {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "�")
+	}
+	return norm.NFKC.String(s)
+}
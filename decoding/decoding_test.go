@@ -0,0 +1,233 @@
+package decoding
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func gzipData(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func brotliData(t *testing.T, data string) []byte {
+	var buf bytes.Buffer
+	w := brotli.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestCheckInput(t *testing.T) {
+	for _, mode := range []string{"", Raw, Normalized} {
+		if err := CheckInput(mode); err != nil {
+			t.Errorf("valid input mode %s rejected: %v", mode, err)
+		}
+	}
+	if err := CheckInput("decoded"); err == nil {
+		t.Errorf("invalid input mode accepted")
+	}
+}
+
+func TestDecodeEncodings(t *testing.T) {
+	var zbuf bytes.Buffer
+	zw := zlib.NewWriter(&zbuf)
+	zw.Write([]byte("a=1"))
+	zw.Close()
+
+	tests := []struct {
+		name   string
+		data   []byte
+		header http.Header
+	}{
+		{"gzip", gzipData(t, "a=1"), http.Header{"Content-Encoding": {"gzip"}}},
+		{"deflate", zbuf.Bytes(), http.Header{"Content-Encoding": {"deflate"}}},
+		{"br", brotliData(t, "a=1"), http.Header{"Content-Encoding": {"br"}}},
+		{"gzip and br", brotliData(t, string(gzipData(t, "a=1"))), http.Header{"Content-Encoding": {"gzip, br"}}},
+		{"chunked", []byte("3\r\na=1\r\n0\r\n\r\n"), http.Header{"Transfer-Encoding": {"chunked"}}},
+		{"already dechunked", []byte("a=1"), http.Header{"Transfer-Encoding": {"chunked"}}},
+		{"identity", []byte("a=1"), http.Header{"Content-Encoding": {"identity"}}},
+	}
+	for _, test := range tests {
+		res, err := Decode(test.data, test.header, 0)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if string(res.Body) != "a=1" {
+			t.Errorf("%s: got body %q", test.name, res.Body)
+		}
+	}
+}
+
+func TestDecodeUnsupportedEncoding(t *testing.T) {
+	res, err := Decode([]byte("data"), http.Header{"Content-Encoding": {"zz"}}, 0)
+	if err == nil {
+		t.Errorf("unsupported encoding accepted")
+	}
+	if string(res.Body) != "data" {
+		t.Errorf("body not kept on error: %q", res.Body)
+	}
+
+	RegisterContentDecoder("ZZ", func(r io.Reader) (io.Reader, error) {
+		data, _ := io.ReadAll(r)
+		return strings.NewReader(strings.ToUpper(string(data))), nil
+	})
+	res, err = Decode([]byte("data"), http.Header{"Content-Encoding": {"zz"}}, 0)
+	if err != nil || string(res.Body) != "DATA" {
+		t.Errorf("registered decoder not used: %q, %v", res.Body, err)
+	}
+}
+
+func TestDecodeTooLarge(t *testing.T) {
+	res, err := Decode(gzipData(t, strings.Repeat("a", 100)), http.Header{"Content-Encoding": {"gzip"}}, 10)
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("decompression limit not applied: %v", err)
+	}
+	if len(res.Body) != 10 {
+		t.Errorf("body not truncated to the limit: %d", len(res.Body))
+	}
+
+	res, err = Decode(brotliData(t, strings.Repeat("a", 100)), http.Header{"Content-Encoding": {"br"}}, 10)
+	if !errors.Is(err, ErrTooLarge) || len(res.Body) != 10 {
+		t.Errorf("decompression limit not applied to br: %d bytes (%v)", len(res.Body), err)
+	}
+}
+
+func TestDecodeBodies(t *testing.T) {
+	multipartBody := "--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"name\"\r\n\r\n" +
+		"value\r\n" +
+		"--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"upload\"; filename=\"a.php\"\r\n" +
+		"Content-Type: application/x-php\r\n\r\n" +
+		"<?php ?>\r\n" +
+		"--xyz--\r\n"
+
+	tests := []struct {
+		contentType string
+		body        string
+		args        []Arg
+		text        string
+	}{
+		{"application/x-www-form-urlencoded", "a=1+2&b=%27or%201%3D1", []Arg{{"a", "1 2"}, {"b", "'or 1=1"}}, "a=1 2\nb='or 1=1\n"},
+		{"application/x-www-form-urlencoded", "%2527=%2527", []Arg{{"%27", "%27"}}, "%27=%27\n"},
+		{"application/x-www-form-urlencoded; charset=latin1", "a=caf\xe9", []Arg{{"a", "café"}}, "a=café\n"},
+		{"application/json", `{"b":[1,"x"],"a":{"c":null,"d":true}}`, []Arg{{"a.c", ""}, {"a.d", "true"}, {"b.0", "1"}, {"b.1", "x"}}, "a.c=\na.d=true\nb.0=1\nb.1=x\n"},
+		{"application/vnd.api+json", `"<script>"`, []Arg{{"", "<script>"}}, "=<script>\n"},
+		{"text/xml", `<a x="1"><b>text</b><b>more</b></a>`, []Arg{{"a@x", "1"}, {"a.b", "text"}, {"a.b", "more"}}, "a@x=1\na.b=text\na.b=more\n"},
+		{"multipart/form-data; boundary=xyz", multipartBody, []Arg{{"name", "value"}}, "name=value\nupload=a.php\n"},
+		{"text/plain", "%3Cscript%3E", nil, "<script>"},
+	}
+	for _, test := range tests {
+		res, err := Decode([]byte(test.body), http.Header{"Content-Type": {test.contentType}}, 0)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.contentType, err)
+			continue
+		}
+		if len(res.Args) != len(test.args) {
+			t.Errorf("%s: got args %v, expected %v", test.contentType, res.Args, test.args)
+		} else {
+			for i := range test.args {
+				if res.Args[i] != test.args[i] {
+					t.Errorf("%s: got arg %v, expected %v", test.contentType, res.Args[i], test.args[i])
+				}
+			}
+		}
+		if res.Text != test.text {
+			t.Errorf("%s: got text %q, expected %q", test.contentType, res.Text, test.text)
+		}
+	}
+}
+
+func TestDecodeFiles(t *testing.T) {
+	body := "--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"upload\"; filename=\"a.bin\"\r\n" +
+		"Content-Type: application/octet-stream\r\n\r\n" +
+		"\x00\x01\x02\r\n" +
+		"--xyz--\r\n"
+	res, err := Decode([]byte(body), http.Header{"Content-Type": {"multipart/form-data; boundary=xyz"}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := File{Field: "upload", Filename: "a.bin", ContentType: "application/octet-stream", Size: 3}
+	if len(res.Files) != 1 || res.Files[0] != expected {
+		t.Errorf("got files %v, expected %v", res.Files, expected)
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	msg := "POST /a%20b HTTP/1.1\r\nHost: x\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Encoding: gzip\r\n\r\n"
+	data := append([]byte(msg), gzipData(t, "q=%3Cx%3E")...)
+	res, err := DecodeMessage(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Args) != 1 || res.Args[0] != (Arg{"q", "<x>"}) {
+		t.Errorf("wrong args %v", res.Args)
+	}
+	if !strings.HasPrefix(res.Text, "POST /a b HTTP/1.1") || !strings.HasSuffix(res.Text, "\n\nq=<x>\n") {
+		t.Errorf("wrong text %q", res.Text)
+	}
+}
+
+func TestParseHead(t *testing.T) {
+	line, h := ParseHead([]byte("GET / HTTP/1.1\r\nHost: x"))
+	if line != "GET / HTTP/1.1" || h.Get("Host") != "x" {
+		t.Errorf("wrong head %q %v", line, h)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	args := ParseQuery("b=2&a=%ZZ&&c")
+	expected := []Arg{{"b", "2"}, {"a", "%ZZ"}, {"c", ""}}
+	if len(args) != len(expected) {
+		t.Fatalf("got %v, expected %v", args, expected)
+	}
+	for i := range expected {
+		if args[i] != expected[i] {
+			t.Errorf("got %v, expected %v", args[i], expected[i])
+		}
+	}
+}
+
+func TestParseHeader(t *testing.T) {
+	h := ParseHeader("Host: example.com\r\nAccept: a\nAccept: b\ninvalid\n: empty\n")
+	if h.Get("Host") != "example.com" || len(h.Values("Accept")) != 2 || len(h) != 2 {
+		t.Errorf("wrong header %v", h)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"%3Cscript%3E", "<script>"},
+		{"%u003Cscript%u003E", "<script>"},
+		{"%zz%4", "%zz%4"},
+		{"a+b", "a b"},
+		{"＜script＞", "<script>"},
+		{"caf%e9", "caf�"},
+	}
+	for _, test := range tests {
+		if got := Normalize(test.input); got != test.expected {
+			t.Errorf("Normalize(%q) = %q, expected %q", test.input, got, test.expected)
+		}
+	}
+}
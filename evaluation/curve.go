@@ -0,0 +1,122 @@
+package evaluation
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Point is the performance of a threshold: the transactions with a
+// score greater than the threshold are blocked.
+type Point struct {
+	Threshold float64 `json:"threshold"`
+	// TPR (true positive rate) is also the recall
+	TPR       float64 `json:"tpr"`
+	FPR       float64 `json:"fpr"`
+	Precision float64 `json:"precision"`
+}
+
+// Curve is the ROC and precision-recall curve of the scores of the
+// samples, from the highest threshold (nothing blocked) to the lowest
+// (everything blocked).
+type Curve struct {
+	Points []Point `json:"points"`
+	// ROCAUC is the area under the ROC curve
+	ROCAUC float64 `json:"roc_auc"`
+	// AveragePrecision summarizes the precision-recall curve, as the
+	// mean of the precisions weighted by the recall increase
+	AveragePrecision float64 `json:"average_precision"`
+}
+
+// scored is the score of a sample
+type scored struct {
+	score  float64
+	attack bool
+}
+
+// NewCurve returns the curve of the scores, where attacks[i] is true if
+// the sample of scores[i] is an attack. The thresholds are halfway
+// between consecutive scores.
+func NewCurve(scores []float64, attacks []bool) Curve {
+	samples := make([]scored, len(scores))
+	positives, negatives := 0, 0
+	for i := range scores {
+		samples[i] = scored{scores[i], attacks[i]}
+		if attacks[i] {
+			positives++
+		} else {
+			negatives++
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].score > samples[j].score })
+
+	var c Curve
+	if len(samples) == 0 {
+		return c
+	}
+	c.Points = append(c.Points, Point{Threshold: samples[0].score, Precision: 1})
+	tp, fp := 0, 0
+	for i := 0; i < len(samples); {
+		// All the samples with the same score are blocked together
+		score := samples[i].score
+		for ; i < len(samples) && samples[i].score == score; i++ {
+			if samples[i].attack {
+				tp++
+			} else {
+				fp++
+			}
+		}
+		threshold := math.Nextafter(score, math.Inf(-1))
+		if i < len(samples) {
+			threshold = (score + samples[i].score) / 2
+		}
+		p := Point{
+			Threshold: threshold,
+			TPR:       ratio(tp, positives),
+			FPR:       ratio(fp, negatives),
+			Precision: ratio(tp, tp+fp),
+		}
+		last := c.Points[len(c.Points)-1]
+		c.ROCAUC += (p.FPR - last.FPR) * (p.TPR + last.TPR) / 2
+		c.AveragePrecision += (p.TPR - last.TPR) * p.Precision
+		c.Points = append(c.Points, p)
+	}
+	return c
+}
+
+// ratio returns n/total, or zero if total is zero.
+func ratio(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// Best returns the point with the highest TPR whose FPR does not
+// exceed maxFPR, the one with the highest threshold among equals.
+func (c Curve) Best(maxFPR float64) Point {
+	var best Point
+	for i, p := range c.Points {
+		if p.FPR > maxFPR {
+			break
+		}
+		if i == 0 || p.TPR > best.TPR {
+			best = p
+		}
+	}
+	return best
+}
+
+// WriteCSV writes the points of the curve in CSV format, with a header.
+func (c Curve) WriteCSV(w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "threshold,fpr,tpr,precision"); err != nil {
+		return err
+	}
+	for _, p := range c.Points {
+		if _, err := fmt.Fprintf(w, "%g,%g,%g,%g\n", p.Threshold, p.FPR, p.TPR, p.Precision); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+/*
+Package evaluation evaluates the weighted_sum decision on a labelled
+dataset, to tune its params and the weights of the model plugins
+instead of guessing them.
+
+The model plugins analyze each transaction of the dataset once, and
+their scores are kept as samples (which can be cached in a file).
+The params are then swept on the samples, without running the models
+again, giving the ROC and precision-recall curve of each combination
+of weights, and the best threshold for a target false positive rate.
+*/
+package evaluation
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	pm "wace/pluginmanager"
+	"wace/recorder"
+)
+
+// Input is the input of a verdict of a transaction.
+type Input struct {
+	// Scores are the results of the model plugins, keyed by model ID
+	Scores map[string]float64 `json:"scores"`
+	// AnomalyScore is the CRS anomaly score sent by the WAF
+	// (<direction>_blocking param), and AnomalyThreshold its blocking
+	// threshold (<direction>_threshold param)
+	AnomalyScore     float64 `json:"anomaly_score"`
+	AnomalyThreshold float64 `json:"anomaly_threshold"`
+}
+
+// Sample holds the scores of a labelled transaction.
+type Sample struct {
+	TransactionID string `json:"transaction_id"`
+	// Label is recorder.Attack or recorder.Benign
+	Label string `json:"label"`
+	// Inputs are the inputs of the verdicts of the transaction, keyed
+	// by direction
+	Inputs map[string]Input `json:"inputs"`
+}
+
+// Attack returns true if the sample is labelled as an attack.
+func (s Sample) Attack() bool {
+	return s.Label == recorder.Attack
+}
+
+// Models returns the IDs of the models scoring any of the samples,
+// sorted.
+func Models(samples []Sample) []string {
+	found := make(map[string]bool)
+	for _, s := range samples {
+		for _, in := range s.Inputs {
+			for modelID := range in.Scores {
+				found[modelID] = true
+			}
+		}
+	}
+	models := make([]string, 0, len(found))
+	for modelID := range found {
+		models = append(models, modelID)
+	}
+	sort.Strings(models)
+	return models
+}
+
+// Collector collects the inputs of the verdicts of the transactions,
+// registered as a decision that allows every transaction, so all the
+// phases of the transactions are analyzed.
+type Collector struct {
+	mutex  sync.Mutex
+	inputs map[string]map[string]Input
+}
+
+// NewCollector creates an empty collector.
+func NewCollector() *Collector {
+	return &Collector{inputs: make(map[string]map[string]Input)}
+}
+
+// Decide collects the input of the verdict and allows the transaction.
+// As the weighted_sum decision plugin, it fails if the WAF does not
+// send the anomaly score and threshold of the direction.
+func (c *Collector) Decide(input pm.TransactionInput) (bool, error) {
+	in := Input{Scores: make(map[string]float64)}
+	var err error
+	for _, p := range []struct {
+		name string
+		out  *float64
+	}{
+		{input.Direction + "_blocking", &in.AnomalyScore},
+		{input.Direction + "_threshold", &in.AnomalyThreshold},
+	} {
+		value, ok := input.WAFdata[p.name]
+		if !ok {
+			return false, fmt.Errorf("%s parameter not found", p.name)
+		}
+		*p.out, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false, fmt.Errorf("error parsing %s parameter: %v", p.name, err)
+		}
+	}
+	for modelID, res := range input.Results {
+		in.Scores[modelID] = res.ProbAttack
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.inputs[input.TransactionId] == nil {
+		c.inputs[input.TransactionId] = make(map[string]Input)
+	}
+	c.inputs[input.TransactionId][input.Direction] = in
+	return false, nil
+}
+
+// Sample returns the sample of the transaction with the collected
+// inputs, and forgets them. It returns false if no input was collected.
+func (c *Collector) Sample(transactionID, label string) (Sample, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	inputs, ok := c.inputs[transactionID]
+	delete(c.inputs, transactionID)
+	return Sample{TransactionID: transactionID, Label: label, Inputs: inputs}, ok
+}
+
+// WriteSamples writes the samples as JSON lines.
+func WriteSamples(w io.Writer, samples []Sample) error {
+	encoder := json.NewEncoder(w)
+	for _, s := range samples {
+		if err := encoder.Encode(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadSamples reads the samples written by WriteSamples.
+func ReadSamples(r io.Reader) ([]Sample, error) {
+	var samples []Sample
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var s Sample
+		err := decoder.Decode(&s)
+		if err == io.EOF {
+			return samples, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if s.Label != recorder.Attack && s.Label != recorder.Benign {
+			return nil, fmt.Errorf("transaction %s: invalid label %s", s.TransactionID, s.Label)
+		}
+		samples = append(samples, s)
+	}
+}
+
+// ReadSamplesFile reads the samples of the file.
+func ReadSamplesFile(path string) ([]Sample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	samples, err := ReadSamples(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return samples, nil
+}
+
+// WriteSamplesFile writes the samples to the file.
+func WriteSamplesFile(path string, samples []Sample) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := WriteSamples(f, samples); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,224 @@
+package evaluation
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	pm "wace/pluginmanager"
+	"wace/recorder"
+
+	lpm "github.com/tilsor/ModSecIntl_wace_lib/pluginmanager"
+	"gopkg.in/yaml.v3"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector()
+	input := pm.TransactionInput{
+		DecisionInput: lpm.DecisionInput{
+			TransactionId: "tx1",
+			Results:       map[string]lpm.ModelResults{"m1": {ProbAttack: 0.75}},
+			WAFdata:       map[string]string{"inbound_blocking": "3", "inbound_threshold": "5"},
+		},
+		Direction: pm.Inbound,
+	}
+	block, err := c.Decide(input)
+	if block || err != nil {
+		t.Fatalf("Decide returned %t, %v", block, err)
+	}
+	input.Direction = pm.Outbound
+	if _, err := c.Decide(input); err == nil || !strings.Contains(err.Error(), "outbound_blocking") {
+		t.Errorf("expected missing outbound_blocking error, got %v", err)
+	}
+
+	s, ok := c.Sample("tx1", recorder.Attack)
+	expected := Sample{
+		TransactionID: "tx1",
+		Label:         recorder.Attack,
+		Inputs:        map[string]Input{pm.Inbound: {Scores: map[string]float64{"m1": 0.75}, AnomalyScore: 3, AnomalyThreshold: 5}},
+	}
+	if !ok || !reflect.DeepEqual(s, expected) {
+		t.Errorf("unexpected sample %+v", s)
+	}
+	if _, ok := c.Sample("tx1", recorder.Attack); ok {
+		t.Errorf("sample not forgotten")
+	}
+}
+
+func TestSamples(t *testing.T) {
+	samples := []Sample{
+		{TransactionID: "a", Label: recorder.Attack, Inputs: map[string]Input{"inbound": {Scores: map[string]float64{"m1": 1, "m2": 0}, AnomalyScore: 10, AnomalyThreshold: 5}}},
+		{TransactionID: "b", Label: recorder.Benign, Inputs: map[string]Input{"outbound": {Scores: map[string]float64{"m3": 0.5}, AnomalyThreshold: 4}}},
+	}
+	var buf bytes.Buffer
+	if err := WriteSamples(&buf, samples); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadSamples(&buf)
+	if err != nil || !reflect.DeepEqual(read, samples) {
+		t.Errorf("read samples %+v, %v", read, err)
+	}
+	if models := Models(samples); !reflect.DeepEqual(models, []string{"m1", "m2", "m3"}) {
+		t.Errorf("unexpected models %v", models)
+	}
+	if _, err := ReadSamples(strings.NewReader(`{"transaction_id":"c"}`)); err == nil {
+		t.Errorf("expected invalid label error")
+	}
+}
+
+func TestWeightedSum(t *testing.T) {
+	in := Input{Scores: map[string]float64{"m1": 0.8, "m2": 0.2}, AnomalyScore: 2, AnomalyThreshold: 4}
+	weights := map[string]float64{"m1": 1, "m2": 0.5}
+	tests := []struct {
+		params   map[string]string
+		expected float64
+	}{
+		// (0.8*1 + 0.2*0.5 + 2/4*0.5) / 2
+		{map[string]string{"waf_weight": "0.5"}, 0.575},
+		// (1*1 + 0*0.5 + 0.25) / 2
+		{map[string]string{"waf_weight": "0.5", "mode": "binarised"}, 0.625},
+		// (0.8*1 + 0*0.5 + 0.25) / 2, with the threshold of m2 in the
+		// configuration
+		{map[string]string{"waf_weight": "0.5", "mode": "clipped", "model_threshold": "0.9"}, 0.525},
+	}
+	for _, test := range tests {
+		w, err := NewWeightedSum(test.params, map[string]float64{"m1": 0.5, "m2": 0.3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Score(in, weights, w.WAFWeight); math.Abs(got-test.expected) > 1e-9 {
+			t.Errorf("%v: score %v, expected %v", test.params, got, test.expected)
+		}
+	}
+
+	w, _ := NewWeightedSum(map[string]string{"waf_weight": "1"}, nil)
+	if got := w.Score(Input{AnomalyScore: 7, AnomalyThreshold: 5}, nil, 1); got != 1 {
+		t.Errorf("anomaly score over its threshold: score %v, expected 1", got)
+	}
+	if got := w.Score(in, nil, 0); got != 0 {
+		t.Errorf("zero weights: score %v, expected 0", got)
+	}
+
+	invalid := []map[string]string{
+		{},
+		{"waf_weight": "x"},
+		{"waf_weight": "1", "mode": "average"},
+		{"waf_weight": "1", "mode": "calibrated"},
+	}
+	for _, params := range invalid {
+		if _, err := NewWeightedSum(params, nil); err == nil {
+			t.Errorf("%v: expected error", params)
+		}
+	}
+}
+
+func TestCurve(t *testing.T) {
+	c := NewCurve([]float64{0.1, 0.9, 0.7, 0.8}, []bool{false, true, true, false})
+	expected := []Point{
+		{Threshold: 0.9, TPR: 0, FPR: 0, Precision: 1},
+		{Threshold: 0.85, TPR: 0.5, FPR: 0, Precision: 1},
+		{Threshold: 0.75, TPR: 0.5, FPR: 0.5, Precision: 0.5},
+		{Threshold: 0.4, TPR: 1, FPR: 0.5, Precision: 2.0 / 3},
+		{Threshold: math.Nextafter(0.1, math.Inf(-1)), TPR: 1, FPR: 1, Precision: 0.5},
+	}
+	if len(c.Points) != len(expected) {
+		t.Fatalf("unexpected points %+v", c.Points)
+	}
+	for i, p := range c.Points {
+		if math.Abs(p.Threshold-expected[i].Threshold) > 1e-9 || p.TPR != expected[i].TPR || p.FPR != expected[i].FPR || math.Abs(p.Precision-expected[i].Precision) > 1e-9 {
+			t.Errorf("point %d: %+v, expected %+v", i, p, expected[i])
+		}
+	}
+	if c.ROCAUC != 0.75 || math.Abs(c.AveragePrecision-(0.5+0.5*2/3)) > 1e-9 {
+		t.Errorf("ROC AUC %v, average precision %v", c.ROCAUC, c.AveragePrecision)
+	}
+	if best := c.Best(0); math.Abs(best.Threshold-0.85) > 1e-9 {
+		t.Errorf("best for FPR 0: %+v", best)
+	}
+	if best := c.Best(0.5); math.Abs(best.Threshold-0.4) > 1e-9 || best.TPR != 1 {
+		t.Errorf("best for FPR 0.5: %+v", best)
+	}
+
+	var buf bytes.Buffer
+	c.WriteCSV(&buf)
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 6 || lines[1] != "0.9,0,0,1" {
+		t.Errorf("unexpected CSV %q", buf.String())
+	}
+}
+
+func TestSweep(t *testing.T) {
+	// The "good" model separates the attacks, the "noisy" one does not,
+	// and the anomaly score misses an attack
+	var samples []Sample
+	for i, good := range []float64{0.9, 0.8, 0.7, 0.3, 0.2, 0.1} {
+		label := recorder.Benign
+		if i < 3 {
+			label = recorder.Attack
+		}
+		samples = append(samples, Sample{
+			TransactionID: string(rune('a' + i)),
+			Label:         label,
+			Inputs: map[string]Input{"inbound": {
+				Scores:           map[string]float64{"good": good, "noisy": float64(i%2) * 0.9},
+				AnomalyScore:     float64(i%3) * 5,
+				AnomalyThreshold: 5,
+			}},
+		})
+	}
+	w, _ := NewWeightedSum(map[string]string{"waf_weight": "0.5", "threshold": "0.5"}, nil)
+	weights := map[string]float64{"good": 0.5, "noisy": 0.5}
+
+	candidates, err := w.Sweep(samples, weights, Grid{WAFWeights: []float64{0, 1}, ModelWeights: []float64{0, 1}}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 WAF weights * 2 * 2 model weights, without the zero weights one
+	if len(candidates) != 7 {
+		t.Fatalf("expected 7 candidates, got %d", len(candidates))
+	}
+	best := candidates[0]
+	if best.WAFWeight != 0 || best.ModelWeights["good"] != 1 || best.ModelWeights["noisy"] != 0 || best.Best.TPR != 1 || best.ROCAUC != 1 {
+		t.Errorf("unexpected best candidate %+v", best)
+	}
+
+	// The current weights for the values missing from the grid
+	candidates, _ = w.Sweep(samples, weights, Grid{}, 0)
+	if len(candidates) != 1 || candidates[0].WAFWeight != 0.5 || candidates[0].ModelWeights["good"] != 0.5 {
+		t.Errorf("unexpected candidates %+v", candidates)
+	}
+	if p := w.Evaluate(samples, map[string]float64{"good": 1}, 0); p != (Point{Threshold: 0.5, TPR: 1, FPR: 0, Precision: 1}) {
+		t.Errorf("unexpected evaluation %+v", p)
+	}
+
+	many := make([]float64, 100)
+	if _, err := w.Sweep(samples, weights, Grid{WAFWeights: many, ModelWeights: many}, 0); err == nil {
+		t.Errorf("expected too many combinations error")
+	}
+
+	snippet, err := best.Snippet("weighted_sum", map[string]string{"mode": "raw", "threshold": "0.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conf struct {
+		Modelplugins []struct {
+			ID     string
+			Weight float64
+		}
+		Decisionplugins []struct {
+			ID     string
+			Params map[string]string
+		}
+	}
+	if err := yaml.Unmarshal(snippet, &conf); err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.Modelplugins) != 2 || conf.Modelplugins[0].ID != "good" || conf.Modelplugins[0].Weight != 1 {
+		t.Errorf("unexpected models in snippet:\n%s", snippet)
+	}
+	params := map[string]string{"mode": "raw", "waf_weight": "0", "threshold": "0.5"}
+	if len(conf.Decisionplugins) != 1 || !reflect.DeepEqual(conf.Decisionplugins[0].Params, params) {
+		t.Errorf("unexpected decision in snippet:\n%s", snippet)
+	}
+}
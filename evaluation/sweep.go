@@ -0,0 +1,178 @@
+package evaluation
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxCombinations limits the number of combinations of a sweep
+const maxCombinations = 100000
+
+// Grid holds the values swept for the weights. The weights without
+// values keep their current value.
+type Grid struct {
+	WAFWeights []float64
+	// ModelWeights are the values of the weight of each model plugin
+	ModelWeights []float64
+}
+
+// Candidate is a combination of weights, with the summary of its
+// curve.
+type Candidate struct {
+	WAFWeight    float64            `json:"waf_weight"`
+	ModelWeights map[string]float64 `json:"model_weights"`
+	ROCAUC       float64            `json:"roc_auc"`
+	// AveragePrecision summarizes the precision-recall curve
+	AveragePrecision float64 `json:"average_precision"`
+	// Best is the best point of the curve for the target false
+	// positive rate
+	Best Point `json:"best"`
+}
+
+// Curve returns the curve of the samples with the weights.
+func (w WeightedSum) Curve(samples []Sample, weights map[string]float64, wafWeight float64) Curve {
+	scores := make([]float64, len(samples))
+	attacks := make([]bool, len(samples))
+	for i, s := range samples {
+		scores[i] = w.SampleScore(s, weights, wafWeight)
+		attacks[i] = s.Attack()
+	}
+	return NewCurve(scores, attacks)
+}
+
+// Evaluate returns the point of the threshold of the weighted sum, with
+// the weights.
+func (w WeightedSum) Evaluate(samples []Sample, weights map[string]float64, wafWeight float64) Point {
+	tp, fp, positives, negatives := 0, 0, 0, 0
+	for _, s := range samples {
+		block := w.SampleScore(s, weights, wafWeight) > w.Threshold
+		if s.Attack() {
+			positives++
+			if block {
+				tp++
+			}
+		} else {
+			negatives++
+			if block {
+				fp++
+			}
+		}
+	}
+	return Point{Threshold: w.Threshold, TPR: ratio(tp, positives), FPR: ratio(fp, negatives), Precision: ratio(tp, tp+fp)}
+}
+
+// Sweep evaluates the combinations of weights of the grid, with the
+// current weights of the models for the ones without values, and
+// returns them sorted from the best: the highest TPR for the target
+// FPR, then the lowest FPR and the highest ROC AUC. The combinations
+// with all the weights zero are skipped.
+func (w WeightedSum) Sweep(samples []Sample, weights map[string]float64, grid Grid, maxFPR float64) ([]Candidate, error) {
+	models := Models(samples)
+	wafValues := grid.WAFWeights
+	if len(wafValues) == 0 {
+		wafValues = []float64{w.WAFWeight}
+	}
+	values := make([][]float64, len(models))
+	combinations := len(wafValues)
+	for i, modelID := range models {
+		values[i] = grid.ModelWeights
+		if len(values[i]) == 0 {
+			values[i] = []float64{weights[modelID]}
+		}
+		combinations *= len(values[i])
+		if combinations > maxCombinations {
+			return nil, fmt.Errorf("more than %d combinations of weights", maxCombinations)
+		}
+	}
+
+	var candidates []Candidate
+	indexes := make([]int, len(models))
+	for {
+		modelWeights := make(map[string]float64, len(models))
+		total := 0.0
+		for i, modelID := range models {
+			modelWeights[modelID] = values[i][indexes[i]]
+			total += modelWeights[modelID]
+		}
+		for _, wafWeight := range wafValues {
+			if total+wafWeight == 0 {
+				continue
+			}
+			c := w.Curve(samples, modelWeights, wafWeight)
+			candidates = append(candidates, Candidate{
+				WAFWeight:        wafWeight,
+				ModelWeights:     modelWeights,
+				ROCAUC:           c.ROCAUC,
+				AveragePrecision: c.AveragePrecision,
+				Best:             c.Best(maxFPR),
+			})
+		}
+
+		// Next combination of the model weights
+		i := 0
+		for ; i < len(models); i++ {
+			indexes[i]++
+			if indexes[i] < len(values[i]) {
+				break
+			}
+			indexes[i] = 0
+		}
+		if i == len(models) {
+			break
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.Best.TPR != b.Best.TPR {
+			return a.Best.TPR > b.Best.TPR
+		}
+		if a.Best.FPR != b.Best.FPR {
+			return a.Best.FPR < b.Best.FPR
+		}
+		return a.ROCAUC > b.ROCAUC
+	})
+	return candidates, nil
+}
+
+// snippetModel is a model plugin of a config snippet
+type snippetModel struct {
+	ID     string  `yaml:"id"`
+	Weight float64 `yaml:"weight"`
+}
+
+// snippetDecision is a decision plugin of a config snippet
+type snippetDecision struct {
+	ID     string            `yaml:"id"`
+	Params map[string]string `yaml:"params"`
+}
+
+// Snippet returns the configuration of the candidate as a snippet of
+// waceconfig.yaml: the weights of the model plugins, and the params of
+// the decision plugin with the WAF weight and the threshold of the
+// best point.
+func (c Candidate) Snippet(decisionID string, params map[string]string) ([]byte, error) {
+	var conf struct {
+		Modelplugins    []snippetModel    `yaml:"modelplugins"`
+		Decisionplugins []snippetDecision `yaml:"decisionplugins"`
+	}
+	models := make([]string, 0, len(c.ModelWeights))
+	for modelID := range c.ModelWeights {
+		models = append(models, modelID)
+	}
+	sort.Strings(models)
+	for _, modelID := range models {
+		conf.Modelplugins = append(conf.Modelplugins, snippetModel{modelID, c.ModelWeights[modelID]})
+	}
+	decision := snippetDecision{ID: decisionID, Params: make(map[string]string)}
+	for name, value := range params {
+		decision.Params[name] = value
+	}
+	decision.Params["waf_weight"] = strconv.FormatFloat(c.WAFWeight, 'g', -1, 64)
+	decision.Params["threshold"] = strconv.FormatFloat(c.Best.Threshold, 'g', -1, 64)
+	conf.Decisionplugins = append(conf.Decisionplugins, decision)
+	return yaml.Marshal(conf)
+}
@@ -0,0 +1,136 @@
+package evaluation
+
+import (
+	"fmt"
+	"strconv"
+
+	"wace/calibration"
+)
+
+// Modes of the weighted_sum decision plugin
+const (
+	Raw        = "raw"
+	Binarised  = "binarised"
+	Clipped    = "clipped"
+	Calibrated = "calibrated"
+)
+
+// WeightedSum computes the score of the weighted_sum decision plugin
+// (_plugins/decision/weighted_sum.go), which blocks the verdicts whose
+// score is greater than its threshold param.
+type WeightedSum struct {
+	WAFWeight float64
+	Threshold float64
+	Mode      string
+	// ModelThreshold is the threshold of the models without a
+	// threshold in the configuration (model_threshold param)
+	ModelThreshold float64
+	// ModelThresholds are the thresholds of the model plugins in the
+	// configuration, keyed by model ID
+	ModelThresholds map[string]float64
+	// Calibrators are loaded from the calibration_file param
+	Calibrators map[string]calibration.Calibrator
+}
+
+// NewWeightedSum parses the params of the weighted_sum decision plugin,
+// with the thresholds of the model plugins in the configuration.
+func NewWeightedSum(params map[string]string, thresholds map[string]float64) (WeightedSum, error) {
+	w := WeightedSum{Threshold: 0.5, Mode: Raw, ModelThreshold: 0.5, ModelThresholds: thresholds}
+	var err error
+	if _, ok := params["waf_weight"]; !ok {
+		return w, fmt.Errorf("waf_weight parameter not found")
+	}
+	for _, p := range []struct {
+		name string
+		out  *float64
+	}{
+		{"waf_weight", &w.WAFWeight},
+		{"threshold", &w.Threshold},
+		{"model_threshold", &w.ModelThreshold},
+	} {
+		value, ok := params[p.name]
+		if !ok {
+			continue
+		}
+		*p.out, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return w, fmt.Errorf("error parsing %s parameter: %v", p.name, err)
+		}
+	}
+	if mode, ok := params["mode"]; ok {
+		w.Mode = mode
+	}
+	switch w.Mode {
+	case Raw, Binarised, Clipped, Calibrated:
+	default:
+		return w, fmt.Errorf("invalid mode %s", w.Mode)
+	}
+	if path, ok := params["calibration_file"]; ok {
+		w.Calibrators, err = calibration.Load(path)
+		if err != nil {
+			return w, fmt.Errorf("error loading calibration file: %v", err)
+		}
+	} else if w.Mode == Calibrated {
+		return w, fmt.Errorf("calibrated mode needs the calibration_file parameter")
+	}
+	return w, nil
+}
+
+// modelThreshold returns the threshold of the model plugin.
+func (w WeightedSum) modelThreshold(modelID string) float64 {
+	if t := w.ModelThresholds[modelID]; t > 0 {
+		return t
+	}
+	return w.ModelThreshold
+}
+
+// modelScore returns the score of a model result in the weighted sum,
+// according to the mode.
+func (w WeightedSum) modelScore(modelID string, probAttack float64) float64 {
+	if c, ok := w.Calibrators[modelID]; ok {
+		probAttack = c.Calibrate(probAttack)
+	}
+	switch w.Mode {
+	case Binarised:
+		if probAttack >= w.modelThreshold(modelID) {
+			return 1
+		}
+		return 0
+	case Clipped:
+		if probAttack < w.modelThreshold(modelID) {
+			return 0
+		}
+	}
+	return probAttack
+}
+
+// Score returns the weighted sum of the input, with the weights of the
+// model plugins and the WAF weight, normalized by the sum of the
+// weights. It returns 0 if all the weights are 0.
+func (w WeightedSum) Score(in Input, weights map[string]float64, wafWeight float64) float64 {
+	var sum, weightsSum float64
+	for modelID, probAttack := range in.Scores {
+		sum += w.modelScore(modelID, probAttack) * weights[modelID]
+		weightsSum += weights[modelID]
+	}
+	if in.AnomalyScore >= in.AnomalyThreshold {
+		sum += wafWeight
+	} else {
+		sum += in.AnomalyScore / in.AnomalyThreshold * wafWeight
+	}
+	weightsSum += wafWeight
+	if weightsSum == 0 {
+		return 0
+	}
+	return sum / weightsSum
+}
+
+// SampleScore returns the highest score of the verdicts of the sample,
+// as the transaction is blocked if any verdict blocks it.
+func (w WeightedSum) SampleScore(s Sample, weights map[string]float64, wafWeight float64) float64 {
+	score := 0.0
+	for _, in := range s.Inputs {
+		score = max(score, w.Score(in, weights, wafWeight))
+	}
+	return score
+}
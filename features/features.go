@@ -0,0 +1,88 @@
+/*
+Package features extracts features from the payloads for the model
+plugins: SQL, JavaScript and shell lexers, n-grams, entropy and
+character class statistics, and URL and form parsing. It is used by
+the built-in models, and can be imported by the plugins in
+_plugins/model (as "wace/features"), so they do not need to parse the
+payloads themselves.
+*/
+package features
+
+import (
+	"math"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Entropy returns the Shannon entropy of the bytes of s, in bits per
+// byte (between 0 and 8). Encoded or obfuscated payloads usually have
+// a higher entropy than plain text.
+func Entropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	var entropy float64
+	n := float64(len(s))
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / n
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// Stats are the counts of the character classes of a payload, in
+// runes. Invalid UTF-8 bytes count as non-ASCII runes.
+type Stats struct {
+	Runes       int
+	Letters     int
+	Upper       int
+	Digits      int
+	Spaces      int
+	Punctuation int
+	Control     int
+	NonASCII    int
+	// Entropy is the entropy of the payload, in bits per byte
+	Entropy float64
+}
+
+// ComputeStats returns the statistics of the payload.
+func ComputeStats(s string) Stats {
+	stats := Stats{Entropy: Entropy(s)}
+	for _, r := range s {
+		stats.Runes++
+		if r >= utf8.RuneSelf {
+			stats.NonASCII++
+		}
+		switch {
+		case unicode.IsLetter(r):
+			stats.Letters++
+			if unicode.IsUpper(r) {
+				stats.Upper++
+			}
+		case unicode.IsDigit(r):
+			stats.Digits++
+		case unicode.IsSpace(r):
+			stats.Spaces++
+		case unicode.IsControl(r):
+			stats.Control++
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			stats.Punctuation++
+		}
+	}
+	return stats
+}
+
+// Ratio returns the count divided by the number of runes of the
+// payload, or 0 for empty payloads.
+func (s Stats) Ratio(count int) float64 {
+	if s.Runes == 0 {
+		return 0
+	}
+	return float64(count) / float64(s.Runes)
+}
@@ -0,0 +1,168 @@
+package features
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"wace/decoding"
+)
+
+func TestEntropy(t *testing.T) {
+	tests := map[string]float64{
+		"":         0,
+		"aaaa":     0,
+		"abab":     1,
+		"abcdefgh": 3,
+	}
+	for s, expected := range tests {
+		if got := Entropy(s); math.Abs(got-expected) > 1e-9 {
+			t.Errorf("Entropy(%q) = %v, expected %v", s, got, expected)
+		}
+	}
+}
+
+func TestComputeStats(t *testing.T) {
+	got := ComputeStats("Ab1 <é>\x01")
+	expected := Stats{Runes: 8, Letters: 3, Upper: 1, Digits: 1, Spaces: 1, Punctuation: 2, Control: 1, NonASCII: 1, Entropy: got.Entropy}
+	if got != expected {
+		t.Errorf("got %+v, expected %+v", got, expected)
+	}
+	if got.Ratio(got.Letters) != 3.0/8 || (Stats{}).Ratio(1) != 0 {
+		t.Errorf("wrong ratios")
+	}
+}
+
+func TestNGrams(t *testing.T) {
+	if got, expected := CharNGrams("añb", 1, 2), []string{"a", "ñ", "b", "añ", "ñb"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+	if got := CharNGrams("ab", 3, 3); got != nil {
+		t.Errorf("got %v for a short string, expected none", got)
+	}
+	words := Words("1 UNION/**/SELECT user_name")
+	if expected := []string{"1", "UNION", "SELECT", "user_name"}; !reflect.DeepEqual(words, expected) {
+		t.Errorf("got words %v, expected %v", words, expected)
+	}
+	if got, expected := WordNGrams(words, 2, 3), []string{"1 UNION", "UNION SELECT", "SELECT user_name", "1 UNION SELECT", "UNION SELECT user_name"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+	if got, expected := ShapeNGrams(SQLTokens("1 OR 1=1"), 3, 3), []string{"1k1", "k1o", "1o1"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+}
+
+// tokens formats the tokens as type:value, separated by spaces
+func tokens(ts []Token) string {
+	var parts []string
+	for _, t := range ts {
+		parts = append(parts, t.Type.String()+":"+t.Value)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestLexers(t *testing.T) {
+	tests := []struct {
+		lexer    func(string) []Token
+		payload  string
+		expected string
+		shape    string
+	}{
+		{SQLTokens, "' OR 1=1 --", "string:' OR 1=1 --", "s"},
+		{SQLTokens, "1' OR '1'='1", "number:1 string:' OR ' number:1 string:'=' number:1", "1s1s1"},
+		{SQLTokens, "x' UNION/**/SELECT @@version, 0x41#", "identifier:x string:' UNION/**/SELECT @@version, 0x41#", "ns"},
+		{SQLTokens, "1 UNION/**/SELECT @@version, 0x41 # comment",
+			"number:1 keyword:UNION comment:/**/ keyword:SELECT variable:@@version punctuation:, number:0x41 comment:# comment",
+			"1kckv,1c"},
+		{SQLTokens, "name='it''s' AND id>=2", "identifier:name operator:= string:'it''s' keyword:AND identifier:id operator:>= number:2", "noskno1"},
+		{JSTokens, `<script>alert(document.cookie)</script>`,
+			"operator:< identifier:script operator:> keyword:alert punctuation:( keyword:document punctuation:. keyword:cookie punctuation:) operator:< operator:/ identifier:script operator:>",
+			"onok(k.k)oono"},
+		{JSTokens, `x = "a\"b" // end`, `identifier:x operator:= string:"a\"b" comment:// end`, "nosc"},
+		{ShellTokens, "; cat /etc/passwd #x", "operator:; keyword:cat identifier:/etc/passwd comment:#x", "oknc"},
+		{ShellTokens, "a#b $(id) ${HOME}|nc -e sh", "identifier:a#b operator:$( keyword:id punctuation:) variable:${HOME} operator:| keyword:nc identifier:-e keyword:sh", "nok)voknk"},
+	}
+	for _, test := range tests {
+		got := test.lexer(test.payload)
+		if tokens(got) != test.expected {
+			t.Errorf("tokens of %q:\n got %s\nexpected %s", test.payload, tokens(got), test.expected)
+		}
+		if Shape(got) != test.shape {
+			t.Errorf("shape of %q = %s, expected %s", test.payload, Shape(got), test.shape)
+		}
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	got := ParseURL("http://example.com/a%20b/../INDEX.PHP+?id=1%27&x#frag%21")
+	expected := URL{
+		Path:      "/a b/../INDEX.PHP+",
+		Segments:  []string{"a b", "..", "INDEX.PHP+"},
+		Extension: "php+",
+		Args:      []decoding.Arg{{Name: "id", Value: "1'"}, {Name: "x", Value: ""}},
+		Fragment:  "frag!",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got %+v, expected %+v", got, expected)
+	}
+	if got := ParseURL("/"); got.Path != "/" || got.Segments != nil || got.Args != nil {
+		t.Errorf("got %+v for the root", got)
+	}
+	if got := ParseForm("a=1+2&b=%zz"); !reflect.DeepEqual(got, []decoding.Arg{{Name: "a", Value: "1 2"}, {Name: "b", Value: "%zz"}}) {
+		t.Errorf("got form %+v", got)
+	}
+}
+
+// benchmarkPayload is a typical attack payload
+var benchmarkPayload = strings.Repeat("id=1 UNION SELECT username, password FROM users WHERE name LIKE 'a%' <script>alert(1)</script> ", 10)
+
+func BenchmarkSQLTokens(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkPayload)))
+	for i := 0; i < b.N; i++ {
+		SQLTokens(benchmarkPayload)
+	}
+}
+
+func BenchmarkJSTokens(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkPayload)))
+	for i := 0; i < b.N; i++ {
+		JSTokens(benchmarkPayload)
+	}
+}
+
+func BenchmarkShellTokens(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkPayload)))
+	for i := 0; i < b.N; i++ {
+		ShellTokens(benchmarkPayload)
+	}
+}
+
+func BenchmarkCharNGrams(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkPayload)))
+	for i := 0; i < b.N; i++ {
+		ForEachCharNGram(benchmarkPayload, 1, 3, func(string) {})
+	}
+}
+
+func BenchmarkWordNGrams(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkPayload)))
+	for i := 0; i < b.N; i++ {
+		ForEachWordNGram(Words(benchmarkPayload), 1, 2, func(string) {})
+	}
+}
+
+func BenchmarkComputeStats(b *testing.B) {
+	b.SetBytes(int64(len(benchmarkPayload)))
+	for i := 0; i < b.N; i++ {
+		ComputeStats(benchmarkPayload)
+	}
+}
+
+func BenchmarkParseURL(b *testing.B) {
+	url := "/search/results.php?q=" + benchmarkPayload[:200] + "&page=2&sort=desc"
+	b.SetBytes(int64(len(url)))
+	for i := 0; i < b.N; i++ {
+		ParseURL(url)
+	}
+}
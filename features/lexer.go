@@ -0,0 +1,313 @@
+package features
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TokenType is the type of a token of the lexers.
+type TokenType int
+
+// Token types, with their symbol in the shape of the tokens
+const (
+	Keyword     TokenType = iota // k
+	Identifier                   // n
+	Number                       // 1
+	String                       // s
+	Variable                     // v
+	Operator                     // o
+	Punctuation                  // (, ), ;, ...: the character itself
+	Comment                      // c
+)
+
+var tokenTypeNames = [...]string{"keyword", "identifier", "number", "string", "variable", "operator", "punctuation", "comment"}
+
+// String returns the name of the token type.
+func (t TokenType) String() string {
+	if int(t) < len(tokenTypeNames) {
+		return tokenTypeNames[t]
+	}
+	return "unknown"
+}
+
+// Token is a token of a payload.
+type Token struct {
+	Type  TokenType
+	Value string
+}
+
+// symbol returns the symbol of the token in the shape.
+func (t Token) symbol() byte {
+	switch t.Type {
+	case Keyword:
+		return 'k'
+	case Identifier:
+		return 'n'
+	case Number:
+		return '1'
+	case String:
+		return 's'
+	case Variable:
+		return 'v'
+	case Operator:
+		return 'o'
+	case Comment:
+		return 'c'
+	}
+	return t.Value[0]
+}
+
+// Shape returns the shape of the tokens, a symbol for each token (eg:
+// "sk1o1" for the SQL tokens of "'a' OR 1=1"), similar to the
+// fingerprints of libinjection.
+func Shape(tokens []Token) string {
+	shape := make([]byte, len(tokens))
+	for i, token := range tokens {
+		shape[i] = token.symbol()
+	}
+	return string(shape)
+}
+
+// language is the syntax of a lexer
+type language struct {
+	// keywords in lower case
+	keywords map[string]bool
+	// lineComments start comments until the end of the line
+	lineComments []string
+	// blockComments are the /* */ comments
+	blockComments bool
+	// quotes start strings, which can escape characters with a
+	// backslash
+	quotes string
+	// doubledQuotes escape quotes by doubling them ('it''s')
+	doubledQuotes bool
+	// variables start variables (@var, $var)
+	variables string
+	// operators, longest first, and the bytes they start with
+	operators     []string
+	operatorStart [256]bool
+	// wordRune returns true for the runes of identifiers and keywords
+	wordRune func(rune) bool
+	// commentAfterSpace only starts line comments after a space or at
+	// the start of the payload (# in shell)
+	commentAfterSpace bool
+}
+
+// newLanguage sorts the operators and sets the keywords.
+func newLanguage(l language, keywords string, operators string) *language {
+	l.keywords = make(map[string]bool)
+	for _, keyword := range strings.Fields(keywords) {
+		l.keywords[keyword] = true
+	}
+	l.operators = strings.Fields(operators)
+	sort.SliceStable(l.operators, func(i, j int) bool {
+		return len(l.operators[i]) > len(l.operators[j])
+	})
+	for _, op := range l.operators {
+		l.operatorStart[op[0]] = true
+	}
+	return &l
+}
+
+// isWordRune returns true for letters, digits, underscores and
+// non-ASCII runes.
+func isWordRune(r rune) bool {
+	return r == '_' || r >= utf8.RuneSelf || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+var sql = newLanguage(language{
+	lineComments:  []string{"--", "#"},
+	blockComments: true,
+	quotes:        "'\"`",
+	doubledQuotes: true,
+	variables:     "@",
+	wordRune:      isWordRune,
+}, `select union insert update delete drop create alter truncate from where and or not
+	xor like rlike regexp in is null having group by order limit offset into values set
+	join inner outer left right on exec execute declare case when then else end as all
+	distinct sleep benchmark waitfor delay char concat load_file outfile dumpfile
+	information_schema table database version user`,
+	`|| && != <> <= >= := = < > + - * / % | & ^ ~ !`)
+
+var js = newLanguage(language{
+	lineComments:  []string{"//"},
+	blockComments: true,
+	quotes:        "'\"`",
+	variables:     "$",
+	wordRune:      isWordRune,
+}, `function return var let const new this typeof instanceof delete void if else for
+	while do switch case break continue try catch finally throw in of class extends
+	import export eval alert prompt confirm document window location cookie
+	settimeout setinterval constructor prototype fromcharcode atob`,
+	`=== !== >>> ** == != <= >= && || ?? => ++ -- += -= *= /= = < > + - * / % ! ~ ^ & | ?`)
+
+var shell = newLanguage(language{
+	lineComments: []string{"#"},
+	quotes:       "'\"",
+	variables:    "$",
+	wordRune: func(r rune) bool {
+		return isWordRune(r) || strings.ContainsRune("./-+,:=~%#", r)
+	},
+	commentAfterSpace: true,
+}, `cat ls id whoami uname wget curl nc ncat netcat bash sh zsh python perl php ruby
+	echo printf rm chmod chown mv cp touch ping nslookup dig sleep kill base64 eval
+	exec sudo su passwd env export`,
+	`&& || >> << |& $( ${ | & ; > < `+"`")
+
+// SQLTokens splits the payload in SQL tokens.
+func SQLTokens(s string) []Token {
+	return sql.tokenize(s)
+}
+
+// JSTokens splits the payload in JavaScript tokens.
+func JSTokens(s string) []Token {
+	return js.tokenize(s)
+}
+
+// ShellTokens splits the payload in shell tokens.
+func ShellTokens(s string) []Token {
+	return shell.tokenize(s)
+}
+
+// tokenize splits s in tokens. It never fails: unterminated strings
+// and comments end at the end of s.
+func (l *language) tokenize(s string) []Token {
+	var tokens []Token
+	i := 0
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if unicode.IsSpace(r) {
+			i += size
+			continue
+		}
+		start := i
+		typ, end := l.next(s, i)
+		tokens = append(tokens, Token{Type: typ, Value: s[start:end]})
+		i = end
+	}
+	return tokens
+}
+
+// next returns the type and end of the token starting at i.
+func (l *language) next(s string, i int) (TokenType, int) {
+	rest := s[i:]
+	if l.blockComments && strings.HasPrefix(rest, "/*") {
+		if end := strings.Index(rest[2:], "*/"); end >= 0 {
+			return Comment, i + 2 + end + 2
+		}
+		return Comment, len(s)
+	}
+	for _, prefix := range l.lineComments {
+		if !strings.HasPrefix(rest, prefix) {
+			continue
+		}
+		if l.commentAfterSpace && i > 0 && !unicode.IsSpace(rune(s[i-1])) {
+			continue
+		}
+		if end := strings.IndexByte(rest, '\n'); end >= 0 {
+			return Comment, i + end
+		}
+		return Comment, len(s)
+	}
+
+	c := s[i]
+	if strings.IndexByte(l.quotes, c) >= 0 {
+		return String, l.stringEnd(s, i)
+	}
+	if strings.IndexByte(l.variables, c) >= 0 && i+1 < len(s) {
+		if s[i+1] == '{' {
+			if end := strings.IndexByte(rest, '}'); end >= 0 {
+				return Variable, i + end + 1
+			}
+			return Variable, len(s)
+		}
+		// System variables have a doubled prefix (@@version)
+		start := i + 1
+		if s[start] == c {
+			start++
+		}
+		if end := l.wordEnd(s, start); end > start {
+			return Variable, end
+		}
+	}
+	if c >= '0' && c <= '9' {
+		end := i + 1
+		for end < len(s) && (isHexDigit(s[end]) || s[end] == '.' || s[end] == 'x' || s[end] == 'X') {
+			end++
+		}
+		// Numbers followed by letters are identifiers (eg: 1abc)
+		if wordEnd := l.wordEnd(s, end); wordEnd == end {
+			return Number, end
+		}
+	}
+	if l.operatorStart[c] {
+		for _, op := range l.operators {
+			if strings.HasPrefix(rest, op) {
+				return Operator, i + len(op)
+			}
+		}
+	}
+	if end := l.wordEnd(s, i); end > i {
+		if l.isKeyword(s[i:end]) {
+			return Keyword, end
+		}
+		return Identifier, end
+	}
+	_, size := utf8.DecodeRuneInString(rest)
+	return Punctuation, i + size
+}
+
+// isKeyword returns true if the word is a keyword, ignoring the case.
+func (l *language) isKeyword(word string) bool {
+	// The keywords are short and ASCII, so the word is lowered in a
+	// buffer without allocating memory
+	var buf [24]byte
+	if len(word) > len(buf) {
+		return false
+	}
+	for i := 0; i < len(word); i++ {
+		c := word[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		buf[i] = c
+	}
+	return l.keywords[string(buf[:len(word)])]
+}
+
+// wordEnd returns the end of the word starting at i.
+func (l *language) wordEnd(s string, i int) int {
+	for i < len(s) {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !l.wordRune(r) {
+			break
+		}
+		i += size
+	}
+	return i
+}
+
+// stringEnd returns the end of the string starting at i, after its
+// closing quote.
+func (l *language) stringEnd(s string, i int) int {
+	quote := s[i]
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			j++
+		case quote:
+			if l.doubledQuotes && j+1 < len(s) && s[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
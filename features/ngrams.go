@@ -0,0 +1,72 @@
+package features
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ForEachCharNGram calls fn with each n-gram of runes of s, for n from
+// minN to maxN. The n-grams are substrings of s, so no memory is
+// allocated for them.
+func ForEachCharNGram(s string, minN, maxN int, fn func(string)) {
+	// Byte offsets of the runes, and the end of s
+	offsets := make([]int, 0, len(s)+1)
+	for i := range s {
+		offsets = append(offsets, i)
+	}
+	offsets = append(offsets, len(s))
+	runes := len(offsets) - 1
+	for n := minN; n <= maxN; n++ {
+		for i := 0; i+n <= runes; i++ {
+			fn(s[offsets[i]:offsets[i+n]])
+		}
+	}
+}
+
+// CharNGrams returns the n-grams of runes of s, for n from minN to maxN.
+func CharNGrams(s string, minN, maxN int) []string {
+	var ngrams []string
+	ForEachCharNGram(s, minN, maxN, func(ngram string) {
+		ngrams = append(ngrams, ngram)
+	})
+	return ngrams
+}
+
+// Words returns the words of s: its sequences of letters, digits and
+// underscores.
+func Words(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+	})
+}
+
+// ForEachWordNGram calls fn with each n-gram of the words, joined by a
+// space, for n from minN to maxN.
+func ForEachWordNGram(words []string, minN, maxN int, fn func(string)) {
+	for n := minN; n <= maxN; n++ {
+		for i := 0; i+n <= len(words); i++ {
+			if n == 1 {
+				fn(words[i])
+				continue
+			}
+			fn(strings.Join(words[i:i+n], " "))
+		}
+	}
+}
+
+// WordNGrams returns the n-grams of the words, joined by a space, for
+// n from minN to maxN.
+func WordNGrams(words []string, minN, maxN int) []string {
+	var ngrams []string
+	ForEachWordNGram(words, minN, maxN, func(ngram string) {
+		ngrams = append(ngrams, ngram)
+	})
+	return ngrams
+}
+
+// ShapeNGrams returns the n-grams of the shape of the tokens (see
+// Shape), for n from minN to maxN, which describe the structure of the
+// payload regardless of its identifiers and literals.
+func ShapeNGrams(tokens []Token, minN, maxN int) []string {
+	return CharNGrams(Shape(tokens), minN, maxN)
+}
@@ -0,0 +1,58 @@
+package features
+
+import (
+	"path"
+	"strings"
+
+	"wace/decoding"
+)
+
+// URL is a parsed URL or request target.
+type URL struct {
+	// Path is the URL decoded path
+	Path string
+	// Segments are the non-empty segments of the path
+	Segments []string
+	// Extension is the extension of the last segment, in lower case
+	// and without the dot (eg: "php")
+	Extension string
+	// Args are the URL decoded arguments of the query string
+	Args []decoding.Arg
+	// Fragment is the URL decoded fragment
+	Fragment string
+}
+
+// ParseURL parses a URL or request target (eg: "/a/b.php?id=1").
+// Unlike url.Parse, it never fails: invalid escapes are kept as they
+// are.
+func ParseURL(rawURL string) URL {
+	var u URL
+	rawURL, fragment, _ := strings.Cut(rawURL, "#")
+	u.Fragment = decoding.URLDecode(fragment)
+	rawPath, query, _ := strings.Cut(rawURL, "?")
+	// Skip the scheme and host of absolute URLs
+	if _, rest, ok := strings.Cut(rawPath, "://"); ok {
+		if slash := strings.IndexByte(rest, '/'); slash >= 0 {
+			rawPath = rest[slash:]
+		} else {
+			rawPath = "/"
+		}
+	}
+	// The plus signs of the path are not spaces
+	u.Path = decoding.URLDecode(strings.ReplaceAll(rawPath, "+", "%2B"))
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment != "" {
+			u.Segments = append(u.Segments, segment)
+		}
+	}
+	if len(u.Segments) > 0 {
+		u.Extension = strings.ToLower(strings.TrimPrefix(path.Ext(u.Segments[len(u.Segments)-1]), "."))
+	}
+	u.Args = decoding.ParseQuery(query)
+	return u
+}
+
+// ParseForm parses the arguments of a url-encoded form body.
+func ParseForm(body string) []decoding.Arg {
+	return decoding.ParseQuery(body)
+}
@@ -0,0 +1,168 @@
+/*
+Package feedback evaluates the labels given to the transactions once
+closed (eg: by the analysts triaging the blocked transactions): it
+keeps the outcome of the last closed transactions, so the verdicts of
+their decision plugins and the results of their model plugins can be
+compared with the labels, to count their false positives and false
+negatives.
+*/
+package feedback
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+
+	"wace/recorder"
+	"wace/transaction"
+)
+
+// Kinds of errors of the plugins
+const (
+	// FalsePositive is a benign transaction detected as an attack
+	FalsePositive = "false_positive"
+	// FalseNegative is an attack not detected
+	FalseNegative = "false_negative"
+)
+
+// DefaultMaxTransactions is the default number of closed transactions
+// whose outcome is kept
+const DefaultMaxTransactions = 10000
+
+// DefaultModelThreshold is the threshold of the model plugins without
+// a threshold in the configuration
+const DefaultModelThreshold = 0.5
+
+// Model is the result of a model plugin in a transaction.
+type Model struct {
+	ProbAttack float64
+	// Threshold is the probability of attack from which the model
+	// detects an attack
+	Threshold float64
+	Shadow    bool
+	// Payload is the payload analyzed by the model plugin, kept only
+	// for the plugins receiving the feedback
+	Payload string
+}
+
+// Outcome is the result of the analysis of a closed transaction.
+type Outcome struct {
+	// Models are the results of the model plugins, keyed by model ID
+	Models map[string]Model
+	// Verdicts are keyed by direction (inbound or outbound)
+	Verdicts map[string]transaction.Verdict
+}
+
+// Error is a false positive or false negative of a plugin.
+type Error struct {
+	// ID is the model or decision ID
+	ID string
+	// Direction is the direction of the verdict, for the decisions
+	Direction string
+	// Kind is FalsePositive or FalseNegative
+	Kind string
+	// Shadow is true for the shadow model plugins
+	Shadow bool
+}
+
+// ErrorKind returns the kind of error of a plugin detecting (or not)
+// an attack in a transaction with the label, or an empty string if it
+// is right.
+func ErrorKind(label string, detected bool) string {
+	switch {
+	case label == recorder.Benign && detected:
+		return FalsePositive
+	case label == recorder.Attack && !detected:
+		return FalseNegative
+	}
+	return ""
+}
+
+// ModelErrors returns the errors of the model plugins of the outcome,
+// sorted by model ID.
+func (o Outcome) ModelErrors(label string) []Error {
+	var errs []Error
+	for modelID, m := range o.Models {
+		if kind := ErrorKind(label, m.ProbAttack >= m.Threshold); kind != "" {
+			errs = append(errs, Error{ID: modelID, Kind: kind, Shadow: m.Shadow})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].ID < errs[j].ID })
+	return errs
+}
+
+// DecisionErrors returns the errors of the verdicts of the outcome,
+// sorted by direction: a verdict blocking a benign transaction is a
+// false positive, and a verdict allowing an attack a false negative.
+func (o Outcome) DecisionErrors(label string) []Error {
+	var errs []Error
+	for direction, verdict := range o.Verdicts {
+		if kind := ErrorKind(label, verdict.Block); kind != "" {
+			errs = append(errs, Error{ID: verdict.Decision, Direction: direction, Kind: kind})
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Direction < errs[j].Direction })
+	return errs
+}
+
+// entry is a kept outcome
+type entry struct {
+	transactionID string
+	outcome       Outcome
+}
+
+// Store keeps the outcome of the last closed transactions, safe for
+// concurrent use.
+type Store struct {
+	size     int
+	mutex    sync.Mutex
+	outcomes map[string]*list.Element
+	// order has the oldest outcomes first
+	order *list.List
+}
+
+// NewStore creates a store keeping the outcome of the last size
+// transactions.
+func NewStore(size int) *Store {
+	return &Store{size: size, outcomes: make(map[string]*list.Element), order: list.New()}
+}
+
+// Add keeps the outcome of the transaction, forgetting the oldest one
+// if the store is full.
+func (s *Store) Add(transactionID string, o Outcome) {
+	if s.size <= 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if elem, ok := s.outcomes[transactionID]; ok {
+		s.order.Remove(elem)
+	}
+	s.outcomes[transactionID] = s.order.PushBack(&entry{transactionID, o})
+	for s.order.Len() > s.size {
+		oldest := s.order.Front()
+		s.order.Remove(oldest)
+		delete(s.outcomes, oldest.Value.(*entry).transactionID)
+	}
+}
+
+// Take returns the outcome of the transaction and forgets it, so the
+// feedback on a transaction is evaluated once.
+func (s *Store) Take(transactionID string) (Outcome, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	elem, ok := s.outcomes[transactionID]
+	if !ok {
+		return Outcome{}, false
+	}
+	s.order.Remove(elem)
+	delete(s.outcomes, transactionID)
+	return elem.Value.(*entry).outcome, true
+}
+
+// Len returns the number of kept outcomes.
+func (s *Store) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.order.Len()
+}
@@ -0,0 +1,83 @@
+package feedback
+
+import (
+	"reflect"
+	"testing"
+
+	"wace/recorder"
+	"wace/transaction"
+)
+
+func testOutcome() Outcome {
+	return Outcome{
+		Models: map[string]Model{
+			"sqli":   {ProbAttack: 0.9, Threshold: 0.5},
+			"xss":    {ProbAttack: 0.2, Threshold: 0.5},
+			"canary": {ProbAttack: 0.7, Threshold: 0.8, Shadow: true},
+		},
+		Verdicts: map[string]transaction.Verdict{
+			"inbound":  {Decision: "weighted_sum", Block: true},
+			"outbound": {Decision: "leaks", Block: false},
+		},
+	}
+}
+
+func TestErrors(t *testing.T) {
+	o := testOutcome()
+
+	expected := []Error{{ID: "sqli", Kind: FalsePositive}}
+	if errs := o.ModelErrors(recorder.Benign); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("benign model errors %+v, expected %+v", errs, expected)
+	}
+	expected = []Error{{ID: "canary", Kind: FalseNegative, Shadow: true}, {ID: "xss", Kind: FalseNegative}}
+	if errs := o.ModelErrors(recorder.Attack); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("attack model errors %+v, expected %+v", errs, expected)
+	}
+
+	expected = []Error{{ID: "weighted_sum", Direction: "inbound", Kind: FalsePositive}}
+	if errs := o.DecisionErrors(recorder.Benign); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("benign decision errors %+v, expected %+v", errs, expected)
+	}
+	expected = []Error{{ID: "leaks", Direction: "outbound", Kind: FalseNegative}}
+	if errs := o.DecisionErrors(recorder.Attack); !reflect.DeepEqual(errs, expected) {
+		t.Errorf("attack decision errors %+v, expected %+v", errs, expected)
+	}
+
+	if kind := ErrorKind("", true); kind != "" {
+		t.Errorf("unlabelled transaction counted as %s", kind)
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := NewStore(2)
+	s.Add("tx1", testOutcome())
+	s.Add("tx2", Outcome{})
+	s.Add("tx3", Outcome{})
+	if s.Len() != 2 {
+		t.Errorf("expected 2 outcomes, got %d", s.Len())
+	}
+	if _, ok := s.Take("tx1"); ok {
+		t.Errorf("oldest outcome not forgotten")
+	}
+	if _, ok := s.Take("tx2"); !ok {
+		t.Errorf("outcome not kept")
+	}
+	if _, ok := s.Take("tx2"); ok {
+		t.Errorf("outcome taken twice")
+	}
+
+	// Adding a kept transaction again makes it the newest
+	s.Add("tx3", testOutcome())
+	s.Add("tx4", Outcome{})
+	s.Add("tx3", testOutcome())
+	s.Add("tx5", Outcome{})
+	if o, ok := s.Take("tx3"); !ok || len(o.Models) != 3 {
+		t.Errorf("unexpected outcome %+v (%t)", o, ok)
+	}
+
+	disabled := NewStore(0)
+	disabled.Add("tx1", testOutcome())
+	if disabled.Len() != 0 {
+		t.Errorf("store without size kept an outcome")
+	}
+}
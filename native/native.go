@@ -0,0 +1,215 @@
+// Package native scores payloads in pure Go with simple ML models
+// trained offline (logistic regression, naive Bayes and gradient
+// boosted trees over n-grams), serialized in JSON, so they can be used
+// as model plugins without compiling one for each trained model.
+package native
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// Model types
+const (
+	Logistic   = "logistic"
+	NaiveBayes = "naive_bayes"
+	GBT        = "gbt"
+)
+
+// Model is a trained model.
+type Model interface {
+	// Score returns the probability of the payload being an attack.
+	Score(payload string) float64
+}
+
+// fileData is a model in the model file
+type fileData struct {
+	Type       string     `json:"type"`
+	Vectorizer Vectorizer `json:"vectorizer"`
+	// Logistic regression
+	Intercept float64   `json:"intercept"`
+	Coef      []float64 `json:"coef"`
+	// Multinomial naive Bayes, with the benign class first and the
+	// attack class second
+	ClassLogPrior  []float64   `json:"class_log_prior"`
+	FeatureLogProb [][]float64 `json:"feature_log_prob"`
+	// Gradient boosted trees
+	BaseScore float64 `json:"base_score"`
+	Trees     []Tree  `json:"trees"`
+}
+
+// sigmoid maps a log-odds to a probability.
+func sigmoid(x float64) float64 {
+	return 1 / (1 + math.Exp(-x))
+}
+
+// LogisticModel is a logistic regression over the features of the
+// payload.
+type LogisticModel struct {
+	Vectorizer Vectorizer
+	Intercept  float64
+	Coef       []float64
+}
+
+// Score returns the probability of the payload being an attack.
+func (m *LogisticModel) Score(payload string) float64 {
+	z := m.Intercept
+	for i, x := range m.Vectorizer.Transform(payload) {
+		z += m.Coef[i] * x
+	}
+	return sigmoid(z)
+}
+
+// NaiveBayesModel is a multinomial naive Bayes classifier over the
+// features of the payload, with a benign and an attack class.
+type NaiveBayesModel struct {
+	Vectorizer     Vectorizer
+	ClassLogPrior  [2]float64
+	FeatureLogProb [2][]float64
+}
+
+// Score returns the probability of the payload being an attack.
+func (m *NaiveBayesModel) Score(payload string) float64 {
+	benign, attack := m.ClassLogPrior[0], m.ClassLogPrior[1]
+	for i, x := range m.Vectorizer.Transform(payload) {
+		benign += x * m.FeatureLogProb[0][i]
+		attack += x * m.FeatureLogProb[1][i]
+	}
+	// P(attack) = 1 / (1 + exp(benign - attack))
+	return sigmoid(attack - benign)
+}
+
+// Node is a node of a tree: a split, going to the Left node if the
+// feature is less than the threshold and to the Right one otherwise,
+// or a leaf with its value. The features missing in the payload are 0.
+type Node struct {
+	Feature   int      `json:"feature"`
+	Threshold float64  `json:"threshold"`
+	Left      int      `json:"left"`
+	Right     int      `json:"right"`
+	Leaf      *float64 `json:"leaf"`
+}
+
+// Tree is a regression tree, with its root in the first node.
+type Tree struct {
+	Nodes []Node `json:"nodes"`
+}
+
+// check verifies the tree. The children of a node must come after it,
+// so the evaluation always ends.
+func (t Tree) check(size int) error {
+	if len(t.Nodes) == 0 {
+		return fmt.Errorf("empty tree")
+	}
+	for i, node := range t.Nodes {
+		if node.Leaf != nil {
+			continue
+		}
+		if node.Feature < 0 || node.Feature >= size {
+			return fmt.Errorf("node %d: feature %d out of range", i, node.Feature)
+		}
+		for _, child := range []int{node.Left, node.Right} {
+			if child <= i || child >= len(t.Nodes) {
+				return fmt.Errorf("node %d: invalid child %d", i, child)
+			}
+		}
+	}
+	return nil
+}
+
+// value returns the value of the leaf of the features.
+func (t Tree) value(features map[int]float64) float64 {
+	node := t.Nodes[0]
+	for node.Leaf == nil {
+		if features[node.Feature] < node.Threshold {
+			node = t.Nodes[node.Left]
+		} else {
+			node = t.Nodes[node.Right]
+		}
+	}
+	return *node.Leaf
+}
+
+// GBTModel is an ensemble of gradient boosted trees, whose values are
+// added to the base score as log-odds.
+type GBTModel struct {
+	Vectorizer Vectorizer
+	BaseScore  float64
+	Trees      []Tree
+}
+
+// Score returns the probability of the payload being an attack.
+func (m *GBTModel) Score(payload string) float64 {
+	features := m.Vectorizer.Transform(payload)
+	z := m.BaseScore
+	for _, tree := range m.Trees {
+		z += tree.value(features)
+	}
+	return sigmoid(z)
+}
+
+// Parse parses a model, a JSON object with its type, the vectorizer of
+// the payloads and its parameters, eg:
+//
+//	{
+//	  "type": "logistic",
+//	  "vectorizer": {"analyzer": "char", "min_n": 1, "max_n": 3, "lowercase": true, "hash_size": 4096},
+//	  "intercept": -2.5,
+//	  "coef": [0.1, -0.3, ...]
+//	}
+//
+// Naive Bayes models have the "class_log_prior" and "feature_log_prob"
+// of the benign and attack classes (in that order), and gradient
+// boosted trees a "base_score" and their "trees", eg:
+//
+//	{"nodes": [{"feature": 7, "threshold": 0.5, "left": 1, "right": 2}, {"leaf": -0.2}, {"leaf": 0.8}]}
+func Parse(data []byte) (Model, error) {
+	var in fileData
+	if err := json.Unmarshal(data, &in); err != nil {
+		return nil, err
+	}
+	if err := in.Vectorizer.check(); err != nil {
+		return nil, fmt.Errorf("vectorizer: %v", err)
+	}
+	size := in.Vectorizer.Size()
+	switch in.Type {
+	case Logistic:
+		if len(in.Coef) != size {
+			return nil, fmt.Errorf("%d coefficients for %d features", len(in.Coef), size)
+		}
+		return &LogisticModel{Vectorizer: in.Vectorizer, Intercept: in.Intercept, Coef: in.Coef}, nil
+	case NaiveBayes:
+		if len(in.ClassLogPrior) != 2 || len(in.FeatureLogProb) != 2 {
+			return nil, fmt.Errorf("naive Bayes models need a benign and an attack class")
+		}
+		m := &NaiveBayesModel{Vectorizer: in.Vectorizer}
+		for c := range m.ClassLogPrior {
+			if len(in.FeatureLogProb[c]) != size {
+				return nil, fmt.Errorf("%d feature probabilities for %d features", len(in.FeatureLogProb[c]), size)
+			}
+			m.ClassLogPrior[c] = in.ClassLogPrior[c]
+			m.FeatureLogProb[c] = in.FeatureLogProb[c]
+		}
+		return m, nil
+	case GBT:
+		for i, tree := range in.Trees {
+			if err := tree.check(size); err != nil {
+				return nil, fmt.Errorf("tree %d: %v", i, err)
+			}
+		}
+		return &GBTModel{Vectorizer: in.Vectorizer, BaseScore: in.BaseScore, Trees: in.Trees}, nil
+	default:
+		return nil, fmt.Errorf("invalid model type %q", in.Type)
+	}
+}
+
+// Load loads the model from the file.
+func Load(path string) (Model, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
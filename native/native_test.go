@@ -0,0 +1,199 @@
+package native
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		v        Vectorizer
+		payload  string
+		expected map[int]float64
+	}{
+		{
+			Vectorizer{Analyzer: Char, MinN: 1, MaxN: 2, Vocabulary: map[string]int{"a": 0, "b": 1, "ab": 2}},
+			"abab",
+			map[int]float64{0: 2, 1: 2, 2: 2},
+		},
+		{
+			Vectorizer{Analyzer: Char, Lowercase: true, Binary: true, Vocabulary: map[string]int{"a": 0, "b": 1}},
+			"AAc",
+			map[int]float64{0: 1},
+		},
+		{
+			Vectorizer{Analyzer: Word, MinN: 1, MaxN: 2, Vocabulary: map[string]int{"union": 0, "select": 1, "union select": 2}},
+			"1 UNION SELECT password, union_all",
+			map[int]float64{2: 0},
+		},
+		{
+			Vectorizer{Analyzer: Word, MinN: 1, MaxN: 2, Lowercase: true, Vocabulary: map[string]int{"union": 0, "select": 1, "union select": 2}},
+			"1 UNION/**/SELECT password",
+			map[int]float64{0: 1, 1: 1, 2: 1},
+		},
+		{
+			Vectorizer{Analyzer: Char, Norm: "l2", Vocabulary: map[string]int{"a": 0, "b": 1}},
+			"aaab",
+			map[int]float64{0: 3 / math.Sqrt(10), 1: 1 / math.Sqrt(10)},
+		},
+		{
+			Vectorizer{Analyzer: Char, Norm: "l1", Vocabulary: map[string]int{"a": 0, "b": 1}},
+			"aaab",
+			map[int]float64{0: 0.75, 1: 0.25},
+		},
+	}
+	for _, test := range tests {
+		if err := test.v.check(); err != nil {
+			t.Fatal(err)
+		}
+		got := test.v.Transform(test.payload)
+		// Entries with 0 only document n-grams that must not match
+		for i, x := range test.expected {
+			if x == 0 {
+				delete(test.expected, i)
+			}
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("Transform(%q) = %v, expected %v", test.payload, got, test.expected)
+		}
+	}
+
+	hashed := Vectorizer{Analyzer: Char, MinN: 3, HashSize: 8}
+	if err := hashed.check(); err != nil {
+		t.Fatal(err)
+	}
+	features := hashed.Transform("<script>")
+	var count float64
+	for i, x := range features {
+		if i < 0 || i >= 8 {
+			t.Errorf("hashed feature %d out of range", i)
+		}
+		count += x
+	}
+	if count != 6 {
+		t.Errorf("got %v hashed 3-grams, expected 6", count)
+	}
+}
+
+func TestVectorizerCheck(t *testing.T) {
+	invalid := []Vectorizer{
+		{Analyzer: "byte", HashSize: 8},
+		{Analyzer: Char, MinN: 3, MaxN: 2, HashSize: 8},
+		{Analyzer: Char, HashSize: 8, Norm: "max"},
+		{Analyzer: Char},
+		{Analyzer: Char, HashSize: 8, Vocabulary: map[string]int{"a": 0}},
+		{Analyzer: Char, Vocabulary: map[string]int{"a": 1}},
+	}
+	for _, v := range invalid {
+		if err := v.check(); err == nil {
+			t.Errorf("invalid vectorizer %+v accepted", v)
+		}
+	}
+}
+
+const vectorizer = `"vectorizer": {"analyzer": "word", "lowercase": true, "vocabulary": {"select": 0, "union": 1, "hello": 2}}`
+
+func TestLogistic(t *testing.T) {
+	m, err := Parse([]byte(`{"type": "logistic", ` + vectorizer + `, "intercept": -2, "coef": [1.5, 1.5, -1]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Score("1 union select 2"); math.Abs(got-sigmoid(1)) > 1e-9 {
+		t.Errorf("got %v, expected %v", got, sigmoid(1))
+	}
+	if got := m.Score("hello"); math.Abs(got-sigmoid(-3)) > 1e-9 {
+		t.Errorf("got %v, expected %v", got, sigmoid(-3))
+	}
+}
+
+func TestNaiveBayes(t *testing.T) {
+	m, err := Parse([]byte(`{"type": "naive_bayes", ` + vectorizer + `,
+		"class_log_prior": [-0.1, -2.3],
+		"feature_log_prob": [[-3, -3, -0.1], [-0.7, -0.7, -4]]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// log P(attack) - log P(benign) = (-2.3 - 1.4) - (-0.1 - 6) = 2.4
+	if got := m.Score("UNION SELECT"); math.Abs(got-sigmoid(2.4)) > 1e-9 {
+		t.Errorf("got %v for an attack, expected %v", got, sigmoid(2.4))
+	}
+	if got := m.Score("hello"); got > 0.01 {
+		t.Errorf("got %v for a benign payload, expected under 0.01", got)
+	}
+	// Without features, the prior decides
+	if got := m.Score(""); math.Abs(got-sigmoid(-2.2)) > 1e-9 {
+		t.Errorf("got %v, expected %v", got, sigmoid(-2.2))
+	}
+}
+
+func TestGBT(t *testing.T) {
+	m, err := Parse([]byte(`{"type": "gbt", ` + vectorizer + `, "base_score": -1, "trees": [
+		{"nodes": [{"feature": 1, "threshold": 0.5, "left": 1, "right": 2}, {"leaf": -0.5},
+			{"feature": 0, "threshold": 0.5, "left": 3, "right": 4}, {"leaf": 0.5}, {"leaf": 2}]},
+		{"nodes": [{"leaf": 0.25}]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]float64{
+		"hello":        sigmoid(-1 - 0.5 + 0.25),
+		"union":        sigmoid(-1 + 0.5 + 0.25),
+		"union select": sigmoid(-1 + 2 + 0.25),
+	}
+	for payload, expected := range tests {
+		if got := m.Score(payload); math.Abs(got-expected) > 1e-9 {
+			t.Errorf("Score(%q) = %v, expected %v", payload, got, expected)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	invalid := []string{
+		`[]`,
+		`{"type": "svm", ` + vectorizer + `}`,
+		`{"type": "logistic", "vectorizer": {"analyzer": "char"}, "coef": []}`,
+		`{"type": "logistic", ` + vectorizer + `, "coef": [1, 2]}`,
+		`{"type": "naive_bayes", ` + vectorizer + `, "class_log_prior": [0], "feature_log_prob": [[0, 0, 0]]}`,
+		`{"type": "naive_bayes", ` + vectorizer + `, "class_log_prior": [0, 0], "feature_log_prob": [[0, 0, 0], [0]]}`,
+		`{"type": "gbt", ` + vectorizer + `, "trees": [{"nodes": []}]}`,
+		`{"type": "gbt", ` + vectorizer + `, "trees": [{"nodes": [{"feature": 3, "left": 1, "right": 1}, {"leaf": 0}]}]}`,
+		`{"type": "gbt", ` + vectorizer + `, "trees": [{"nodes": [{"feature": 0, "left": 0, "right": 1}, {"leaf": 0}]}]}`,
+		`{"type": "gbt", ` + vectorizer + `, "trees": [{"nodes": [{"feature": 0, "left": 1, "right": 2}, {"leaf": 0}]}]}`,
+	}
+	for _, data := range invalid {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("invalid model %s accepted", data)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model.json")
+	data := `{"type": "logistic", ` + vectorizer + `, "coef": [0, 0, 0]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Score("anything"); got != 0.5 {
+		t.Errorf("got %v, expected 0.5", got)
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("missing file accepted")
+	}
+}
+
+func TestShapeAnalyzer(t *testing.T) {
+	m, err := Parse([]byte(`{"type": "logistic", "vectorizer": {"analyzer": "sql", "min_n": 3, "vocabulary": {"k1o": 0}}, "intercept": -1, "coef": [2]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Score("1 OR 1=1"); math.Abs(got-sigmoid(1)) > 1e-9 {
+		t.Errorf("got %v, expected %v", got, sigmoid(1))
+	}
+}
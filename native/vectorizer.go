@@ -0,0 +1,151 @@
+package native
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+
+	"wace/features"
+)
+
+// Analyzers of the vectorizer
+const (
+	// Char splits the payload in character n-grams
+	Char = "char"
+	// Word splits the payload in n-grams of words (sequences of
+	// letters, digits and underscores), joined by a space
+	Word = "word"
+	// SQL, JS and Shell split the shape of the tokens of the payload
+	// (see features.Shape) in n-grams
+	SQL   = "sql"
+	JS    = "js"
+	Shell = "shell"
+)
+
+// Vectorizer turns a payload in the sparse vector of features of a
+// model: the counts of its n-grams, with the index of each n-gram in
+// the vocabulary, or its hash modulo HashSize if there is no
+// vocabulary. Unknown n-grams are ignored.
+type Vectorizer struct {
+	Analyzer   string         `json:"analyzer"`
+	MinN       int            `json:"min_n"`
+	MaxN       int            `json:"max_n"`
+	Lowercase  bool           `json:"lowercase"`
+	Vocabulary map[string]int `json:"vocabulary"`
+	HashSize   int            `json:"hash_size"`
+	// Binary uses 1 for the n-grams in the payload, instead of their
+	// counts
+	Binary bool `json:"binary"`
+	// Norm normalizes the vector, "l1", "l2" or "" (none)
+	Norm string `json:"norm"`
+}
+
+// check verifies the vectorizer, setting the defaults of the n-gram
+// range (1 to 1).
+func (v *Vectorizer) check() error {
+	switch v.Analyzer {
+	case Char, Word, SQL, JS, Shell:
+	default:
+		return fmt.Errorf("invalid analyzer %q", v.Analyzer)
+	}
+	if v.MinN == 0 {
+		v.MinN = 1
+	}
+	if v.MaxN == 0 {
+		v.MaxN = v.MinN
+	}
+	if v.MinN < 1 || v.MaxN < v.MinN {
+		return fmt.Errorf("invalid n-gram range %d to %d", v.MinN, v.MaxN)
+	}
+	switch v.Norm {
+	case "", "l1", "l2":
+	default:
+		return fmt.Errorf("invalid norm %q", v.Norm)
+	}
+	switch {
+	case len(v.Vocabulary) > 0 && v.HashSize > 0:
+		return fmt.Errorf("vocabulary and hash size are exclusive")
+	case len(v.Vocabulary) > 0:
+		for ngram, index := range v.Vocabulary {
+			if index < 0 || index >= len(v.Vocabulary) {
+				return fmt.Errorf("index %d of %q out of the vocabulary", index, ngram)
+			}
+		}
+	case v.HashSize <= 0:
+		return fmt.Errorf("vocabulary or hash size needed")
+	}
+	return nil
+}
+
+// Size returns the number of features.
+func (v *Vectorizer) Size() int {
+	if len(v.Vocabulary) > 0 {
+		return len(v.Vocabulary)
+	}
+	return v.HashSize
+}
+
+// index returns the feature index of the n-gram, or false if it is
+// not in the vocabulary.
+func (v *Vectorizer) index(ngram string) (int, bool) {
+	if len(v.Vocabulary) > 0 {
+		i, ok := v.Vocabulary[ngram]
+		return i, ok
+	}
+	h := fnv.New32a()
+	h.Write([]byte(ngram))
+	return int(h.Sum32() % uint32(v.HashSize)), true
+}
+
+// ngrams calls add with each n-gram of the payload.
+func (v *Vectorizer) ngrams(payload string, add func(string)) {
+	if v.Lowercase {
+		payload = strings.ToLower(payload)
+	}
+	switch v.Analyzer {
+	case Char:
+		features.ForEachCharNGram(payload, v.MinN, v.MaxN, add)
+	case Word:
+		features.ForEachWordNGram(features.Words(payload), v.MinN, v.MaxN, add)
+	case SQL:
+		features.ForEachCharNGram(features.Shape(features.SQLTokens(payload)), v.MinN, v.MaxN, add)
+	case JS:
+		features.ForEachCharNGram(features.Shape(features.JSTokens(payload)), v.MinN, v.MaxN, add)
+	case Shell:
+		features.ForEachCharNGram(features.Shape(features.ShellTokens(payload)), v.MinN, v.MaxN, add)
+	}
+}
+
+// Transform returns the features of the payload, keyed by index.
+func (v *Vectorizer) Transform(payload string) map[int]float64 {
+	vector := make(map[int]float64)
+	v.ngrams(payload, func(ngram string) {
+		if i, ok := v.index(ngram); ok {
+			if v.Binary {
+				vector[i] = 1
+			} else {
+				vector[i]++
+			}
+		}
+	})
+
+	var norm float64
+	switch v.Norm {
+	case "l1":
+		for _, x := range vector {
+			norm += math.Abs(x)
+		}
+	case "l2":
+		for _, x := range vector {
+			norm += x * x
+		}
+		norm = math.Sqrt(norm)
+	}
+	if norm > 0 {
+		for i := range vector {
+			vector[i] /= norm
+		}
+	}
+	return vector
+}
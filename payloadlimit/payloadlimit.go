@@ -0,0 +1,99 @@
+/*
+Package payloadlimit implements the size limits of the payloads
+analyzed by the model plugins, and the policies applied to the
+payloads exceeding them.
+*/
+package payloadlimit
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Policies applied to a payload exceeding the maximum size.
+const (
+	// Reject rejects the payload
+	Reject = "reject"
+	// TruncateHead keeps the first bytes of the payload
+	TruncateHead = "truncate_head"
+	// TruncateHeadTail keeps the first and the last bytes of the payload
+	TruncateHeadTail = "truncate_head_tail"
+	// Skip skips the analysis of the payload
+	Skip = "skip"
+)
+
+// ErrTooLarge is the reason of the models rejected for exceeding their
+// payload limit.
+var ErrTooLarge = errors.New("payload too large")
+
+// Limit is the maximum size of a payload, and the policy applied to
+// the payloads exceeding it. A zero MaxSize means unlimited.
+type Limit struct {
+	MaxSize int
+	Policy  string
+}
+
+// Check verifies that the limit is valid.
+func (l Limit) Check() error {
+	if l.MaxSize < 0 {
+		return fmt.Errorf("maximum payload size cannot be negative")
+	}
+	switch l.Policy {
+	case "", Reject, TruncateHead, TruncateHeadTail, Skip:
+		return nil
+	}
+	return fmt.Errorf("invalid payload policy %s", l.Policy)
+}
+
+// Exceeded returns true if the payload exceeds the limit.
+func (l Limit) Exceeded(payload string) bool {
+	return l.MaxSize > 0 && len(payload) > l.MaxSize
+}
+
+// Truncate returns the payload truncated to the maximum size according
+// to the policy, and whether it was truncated. Payloads within the
+// limit, or whose policy is not a truncation one, are returned
+// unchanged. The payload is not cut in the middle of a UTF-8 encoded
+// character, so the truncated payload may be a few bytes shorter.
+func (l Limit) Truncate(payload string) (string, bool) {
+	if !l.Exceeded(payload) {
+		return payload, false
+	}
+	switch l.Policy {
+	case TruncateHead:
+		head, _ := cutRune(payload, l.MaxSize)
+		return payload[:head], true
+	case TruncateHeadTail:
+		head, _ := cutRune(payload, l.MaxSize-l.MaxSize/2)
+		_, tail := cutRune(payload, len(payload)-l.MaxSize/2)
+		return payload[:head] + payload[tail:], true
+	}
+	return payload, false
+}
+
+// cutRune returns the offsets of the start and the end of the UTF-8
+// encoded character of the payload cut at the offset i, or i twice if
+// no valid character is cut there (eg: in binary payloads).
+func cutRune(payload string, i int) (int, int) {
+	for j := i - 1; j >= 0 && j > i-utf8.UTFMax; j-- {
+		if !utf8.RuneStart(payload[j]) {
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(payload[j:])
+		if (r != utf8.RuneError || size > 1) && j+size > i {
+			return j, j + size
+		}
+		break
+	}
+	return i, i
+}
+
+// WithDefaultPolicy returns the limit with the default policy
+// (TruncateHead) if it has none.
+func (l Limit) WithDefaultPolicy() Limit {
+	if l.Policy == "" {
+		l.Policy = TruncateHead
+	}
+	return l
+}
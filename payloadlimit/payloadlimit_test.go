@@ -0,0 +1,54 @@
+package payloadlimit
+
+import "testing"
+
+func TestCheck(t *testing.T) {
+	if err := (Limit{MaxSize: -1}).Check(); err == nil {
+		t.Errorf("negative size accepted")
+	}
+	if err := (Limit{MaxSize: 10, Policy: "truncate_tail"}).Check(); err == nil {
+		t.Errorf("invalid policy accepted")
+	}
+	for _, policy := range []string{"", Reject, TruncateHead, TruncateHeadTail, Skip} {
+		if err := (Limit{MaxSize: 10, Policy: policy}).Check(); err != nil {
+			t.Errorf("valid policy %s rejected: %v", policy, err)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		limit     Limit
+		payload   string
+		expected  string
+		truncated bool
+	}{
+		{Limit{}, "0123456789", "0123456789", false},
+		{Limit{MaxSize: 20, Policy: TruncateHead}, "0123456789", "0123456789", false},
+		{Limit{MaxSize: 4, Policy: TruncateHead}, "0123456789", "0123", true},
+		{Limit{MaxSize: 4, Policy: TruncateHeadTail}, "0123456789", "0189", true},
+		{Limit{MaxSize: 5, Policy: TruncateHeadTail}, "0123456789", "01289", true},
+		// Multibyte characters are not cut
+		{Limit{MaxSize: 2, Policy: TruncateHead}, "aññ", "a", true},
+		{Limit{MaxSize: 3, Policy: TruncateHead}, "aññ", "añ", true},
+		{Limit{MaxSize: 4, Policy: TruncateHeadTail}, "ñaaañ", "ññ", true},
+		{Limit{MaxSize: 3, Policy: TruncateHeadTail}, "ñaaañ", "ñ", true},
+		// Binary payloads are cut at the limit
+		{Limit{MaxSize: 2, Policy: TruncateHead}, "\x80\x80\x80\x80\x80\x80", "\x80\x80", true},
+		{Limit{MaxSize: 4, Policy: Reject}, "0123456789", "0123456789", false},
+		{Limit{MaxSize: 4, Policy: Skip}, "0123456789", "0123456789", false},
+	}
+	for _, test := range tests {
+		res, truncated := test.limit.WithDefaultPolicy().Truncate(test.payload)
+		if res != test.expected || truncated != test.truncated {
+			t.Errorf("%+v: got %q (%t), expected %q (%t)", test.limit, res, truncated, test.expected, test.truncated)
+		}
+	}
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	l := Limit{MaxSize: 4}
+	if l.WithDefaultPolicy().Policy != TruncateHead {
+		t.Errorf("default policy is not truncating the head")
+	}
+}
@@ -0,0 +1,490 @@
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	mpb "wace/modelpluginproto"
+
+	lg "github.com/tilsor/ModSecIntl_logging/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCMode is the mode of the out-of-process model plugins, called
+// over gRPC with the protocol of modelplugin.proto.
+const GRPCMode = "grpc"
+
+// AddressEnv is the environment variable with the address the
+// launched gRPC model plugins must listen on.
+const AddressEnv = "WACE_PLUGIN_ADDRESS"
+
+// Defaults of the gRPC model plugin options
+const (
+	DefaultGRPCTimeout        = time.Second
+	DefaultGRPCHealthInterval = 5 * time.Second
+	DefaultGRPCStartTimeout   = 10 * time.Second
+	maxRestartDelay           = 30 * time.Second
+)
+
+// GRPCOptions configures an out-of-process model plugin.
+type GRPCOptions struct {
+	// Address of an already running plugin ("host:port" or
+	// "unix:///path"). If empty, the plugin path is connected to if it
+	// is a unix socket, or launched otherwise.
+	Address string
+	// Args are the arguments of the launched plugin
+	Args []string
+	// Timeout of each call to the plugin
+	Timeout time.Duration
+	// HealthInterval is the interval between health checks
+	HealthInterval time.Duration
+	// StartTimeout is the maximum time the plugin has to start and
+	// answer the Init call
+	StartTimeout time.Duration
+}
+
+// withDefaults returns the options with the defaults of the empty
+// ones.
+func (o GRPCOptions) withDefaults() GRPCOptions {
+	if o.Timeout == 0 {
+		o.Timeout = DefaultGRPCTimeout
+	}
+	if o.HealthInterval == 0 {
+		o.HealthInterval = DefaultGRPCHealthInterval
+	}
+	if o.StartTimeout == 0 {
+		o.StartTimeout = DefaultGRPCStartTimeout
+	}
+	return o
+}
+
+// grpcModel is the instance of an out-of-process model plugin. It
+// launches the plugin (or connects to it), checks its health, and
+// restarts it if it crashes.
+type grpcModel struct {
+	modelID    string
+	path       string
+	pluginType string
+	params     map[string]string
+	opts       GRPCOptions
+
+	mutex  sync.RWMutex
+	conn   *grpc.ClientConn
+	client mpb.ModelPluginClient
+	health healthpb.HealthClient
+	cmd    *exec.Cmd
+	// exited is closed when the launched plugin exits
+	exited chan struct{}
+	// closed is closed by Close, and stopped when the plugin is stopped
+	closed  chan struct{}
+	stopped chan struct{}
+	// dir is the private directory of the socket of the launched plugin
+	dir string
+}
+
+// newGRPCModel starts the out-of-process model plugin, and monitors it
+// until the process ends.
+func newGRPCModel(modelID, path, pluginType string, params map[string]string, opts GRPCOptions) (*grpcModel, error) {
+	m := &grpcModel{
+		modelID:    modelID,
+		path:       path,
+		pluginType: pluginType,
+		params:     params,
+		opts:       opts.withDefaults(),
+		closed:     make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+	err := m.start()
+	if err != nil && m.launched() {
+		m.stop()
+		m.removeDir()
+		return nil, err
+	}
+	if err != nil {
+		// The running plugin is initialized when it becomes healthy
+		lg.Get().Printf(lg.WARN, "| %s | plugin not available: %v", modelID, err)
+	}
+	go m.monitor(err == nil)
+	return m, nil
+}
+
+// launched returns true if WACE launches the plugin, instead of
+// connecting to a running one.
+func (m *grpcModel) launched() bool {
+	if m.opts.Address != "" {
+		return false
+	}
+	info, err := os.Stat(m.path)
+	return err != nil || info.Mode()&os.ModeSocket == 0
+}
+
+// target returns the address to connect to, launching the plugin if
+// needed.
+func (m *grpcModel) target() (string, error) {
+	if m.opts.Address != "" {
+		return m.opts.Address, nil
+	}
+	if !m.launched() {
+		return "unix://" + m.path, nil
+	}
+
+	// The socket is in a directory only accessible by WACE, created once
+	// and kept for the restarts of the plugin
+	m.mutex.Lock()
+	if m.dir == "" {
+		dir, err := os.MkdirTemp("", "wace-plugin-")
+		if err != nil {
+			m.mutex.Unlock()
+			return "", fmt.Errorf("cannot create socket directory: %v", err)
+		}
+		m.dir = dir
+	}
+	socket := filepath.Join(m.dir, "plugin.sock")
+	m.mutex.Unlock()
+	os.Remove(socket)
+	address := "unix://" + socket
+	cmd := exec.Command(m.path, m.opts.Args...)
+	cmd.Env = append(os.Environ(), AddressEnv+"="+address)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = pluginProcAttr()
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("cannot launch plugin: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	m.mutex.Lock()
+	m.cmd = cmd
+	m.exited = exited
+	m.mutex.Unlock()
+	return address, nil
+}
+
+// start launches or connects to the plugin, and initializes it.
+func (m *grpcModel) start() error {
+	address, err := m.target()
+	if err != nil {
+		return err
+	}
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("cannot connect to plugin: %v", err)
+	}
+	m.mutex.Lock()
+	m.conn = conn
+	m.client = mpb.NewModelPluginClient(conn)
+	m.health = healthpb.NewHealthClient(conn)
+	m.mutex.Unlock()
+
+	// Retry until the plugin listens and answers, or the start
+	// timeout expires
+	deadline := time.Now().Add(m.opts.StartTimeout)
+	for {
+		err = m.init()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("plugin did not start: %v", err)
+		}
+		m.mutex.RLock()
+		exited := m.exited
+		m.mutex.RUnlock()
+		select {
+		case <-exited:
+			return fmt.Errorf("plugin exited while starting")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// init sends the params of the model to the plugin.
+func (m *grpcModel) init() error {
+	m.mutex.RLock()
+	client := m.client
+	m.mutex.RUnlock()
+	if client == nil {
+		return fmt.Errorf("plugin not running")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+	defer cancel()
+	_, err := client.Init(ctx, &mpb.InitRequest{ModelId: m.modelID, PluginType: m.pluginType, Params: m.params}, grpc.WaitForReady(true))
+	return err
+}
+
+// stop closes the connection and kills the launched plugin.
+func (m *grpcModel) stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+		m.client = nil
+	}
+	if m.cmd != nil {
+		m.cmd.Process.Kill()
+		<-m.exited
+		m.cmd = nil
+		m.exited = nil
+	}
+}
+
+// healthy checks the health of the plugin. The plugins without the
+// health service are healthy if they answer.
+func (m *grpcModel) healthy() bool {
+	m.mutex.RLock()
+	client := m.health
+	m.mutex.RUnlock()
+	if client == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+	defer cancel()
+	res, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) == codes.Unimplemented {
+		return true
+	}
+	return err == nil && res.Status == healthpb.HealthCheckResponse_SERVING
+}
+
+// restart stops and starts the plugin, retrying with an increasing
+// delay until it starts.
+func (m *grpcModel) restart() {
+	logger := lg.Get()
+	delay := 100 * time.Millisecond
+	for {
+		m.stop()
+		err := m.start()
+		if err == nil {
+			logger.Printf(lg.INFO, "| %s | plugin restarted", m.modelID)
+			return
+		}
+		logger.Printf(lg.ERROR, "| %s | cannot restart plugin: %v", m.modelID, err)
+		select {
+		case <-m.closed:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRestartDelay)
+	}
+}
+
+// monitor restarts the launched plugin when it exits or is not
+// healthy. For the plugins WACE connects to, it initializes them again
+// when they become healthy, as they may have been restarted. It stops
+// the plugin when it is closed.
+func (m *grpcModel) monitor(wasHealthy bool) {
+	logger := lg.Get()
+	ticker := time.NewTicker(m.opts.HealthInterval)
+	defer ticker.Stop()
+	for {
+		m.mutex.RLock()
+		exited := m.exited
+		m.mutex.RUnlock()
+		select {
+		case <-m.closed:
+			m.stop()
+			close(m.stopped)
+			return
+		case <-exited:
+			logger.Printf(lg.ERROR, "| %s | plugin exited, restarting it", m.modelID)
+			m.restart()
+			continue
+		case <-ticker.C:
+		}
+		isHealthy := m.healthy()
+		switch {
+		case !isHealthy && m.launched():
+			logger.Printf(lg.ERROR, "| %s | plugin not healthy, restarting it", m.modelID)
+			m.restart()
+			isHealthy = true
+		case !isHealthy && wasHealthy:
+			logger.Printf(lg.ERROR, "| %s | plugin not healthy", m.modelID)
+		case isHealthy && !wasHealthy:
+			logger.Printf(lg.INFO, "| %s | plugin healthy again", m.modelID)
+			if err := m.init(); err != nil {
+				logger.Printf(lg.ERROR, "| %s | cannot initialize plugin: %v", m.modelID, err)
+				isHealthy = false
+			}
+		}
+		wasHealthy = isHealthy
+	}
+}
+
+// Close stops monitoring the plugin, and stops it.
+func (m *grpcModel) Close() {
+	close(m.closed)
+	<-m.stopped
+	m.removeDir()
+}
+
+// removeDir removes the socket directory of the launched plugin.
+func (m *grpcModel) removeDir() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.dir != "" {
+		os.RemoveAll(m.dir)
+		m.dir = ""
+	}
+}
+
+// Process sends the payload to the plugin, waiting for its result at
+// most the timeout of the plugin.
+func (m *grpcModel) Process(input ModelInput) (ModelResults, error) {
+	m.mutex.RLock()
+	client := m.client
+	m.mutex.RUnlock()
+	if client == nil {
+		return ModelResults{}, fmt.Errorf("plugin not running")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+	defer cancel()
+	res, err := client.Process(ctx, &mpb.ProcessRequest{TransactionId: input.TransactionId, Payload: []byte(input.Payload), Truncated: input.Truncated})
+	if err != nil {
+		return ModelResults{}, err
+	}
+	results := ModelResults{ProbAttack: res.ProbAttack}
+	if res.Data != "" {
+		if err := json.Unmarshal([]byte(res.Data), &results.Data); err != nil {
+			return ModelResults{}, fmt.Errorf("invalid plugin data: %v", err)
+		}
+	}
+	return results, nil
+}
+
+// Feedback sends the label given to a transaction to the plugin.
+func (m *grpcModel) Feedback(input FeedbackInput) error {
+	m.mutex.RLock()
+	client := m.client
+	m.mutex.RUnlock()
+	if client == nil {
+		return fmt.Errorf("plugin not running")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.opts.Timeout)
+	defer cancel()
+	_, err := client.Feedback(ctx, &mpb.FeedbackRequest{
+		TransactionId: input.TransactionID,
+		Label:         input.Label,
+		Comment:       input.Comment,
+		Payload:       []byte(input.Payload),
+		ProbAttack:    input.ProbAttack,
+	})
+	if status.Code(err) == codes.Unimplemented {
+		return fmt.Errorf("plugin does not implement Feedback")
+	}
+	return err
+}
+
+// modelPluginServer serves a model plugin instance with the protocol
+// of modelplugin.proto.
+type modelPluginServer struct {
+	mpb.UnimplementedModelPluginServer
+	newInstance func(params map[string]string) (ModelPlugin, error)
+	mutex       sync.RWMutex
+	instance    ModelPlugin
+}
+
+func (s *modelPluginServer) Init(ctx context.Context, in *mpb.InitRequest) (*mpb.InitResponse, error) {
+	// A failed initialization leaves the plugin uninitialized, instead
+	// of processing with the previous params
+	instance, err := s.newInstance(in.GetParams())
+	s.mutex.Lock()
+	s.instance = instance
+	s.mutex.Unlock()
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &mpb.InitResponse{}, nil
+}
+
+func (s *modelPluginServer) Process(ctx context.Context, in *mpb.ProcessRequest) (*mpb.ProcessResponse, error) {
+	s.mutex.RLock()
+	instance := s.instance
+	s.mutex.RUnlock()
+	if instance == nil {
+		return nil, status.Error(codes.FailedPrecondition, "plugin not initialized")
+	}
+	res, err := instance.Process(ModelInput{TransactionId: in.GetTransactionId(), Payload: string(in.GetPayload()), Truncated: in.GetTruncated()})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	out := &mpb.ProcessResponse{ProbAttack: res.ProbAttack}
+	if len(res.Data) > 0 {
+		data, err := json.Marshal(res.Data)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		out.Data = string(data)
+	}
+	return out, nil
+}
+
+func (s *modelPluginServer) Feedback(ctx context.Context, in *mpb.FeedbackRequest) (*mpb.FeedbackResponse, error) {
+	s.mutex.RLock()
+	instance := s.instance
+	s.mutex.RUnlock()
+	if instance == nil {
+		return nil, status.Error(codes.FailedPrecondition, "plugin not initialized")
+	}
+	fbInstance, ok := instance.(FeedbackModelPlugin)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "plugin does not implement Feedback")
+	}
+	err := fbInstance.Feedback(FeedbackInput{
+		TransactionID: in.GetTransactionId(),
+		Label:         in.GetLabel(),
+		Comment:       in.GetComment(),
+		Payload:       string(in.GetPayload()),
+		ProbAttack:    in.GetProbAttack(),
+	})
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &mpb.FeedbackResponse{}, nil
+}
+
+// listen listens on the address, "unix:///path" or "host:port".
+func listen(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix://"); ok {
+		os.Remove(path)
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", address)
+}
+
+// ServeModel serves a model plugin over gRPC, so it runs out of the
+// WACE process (mode "grpc"). The instance is created by newInstance
+// with the params of the model when WACE initializes the plugin. The
+// address is the one in the WACE_PLUGIN_ADDRESS environment variable
+// if the plugin is launched by WACE, or the given one otherwise. The
+// instances implementing FeedbackModelPlugin receive the Feedback
+// calls.
+func ServeModel(address string, newInstance func(params map[string]string) (ModelPlugin, error)) error {
+	if env := os.Getenv(AddressEnv); env != "" {
+		address = env
+	}
+	lis, err := listen(address)
+	if err != nil {
+		return err
+	}
+	server := grpc.NewServer()
+	mpb.RegisterModelPluginServer(server, &modelPluginServer{newInstance: newInstance})
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	return server.Serve(lis)
+}
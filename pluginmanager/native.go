@@ -0,0 +1,28 @@
+package pluginmanager
+
+import (
+	"wace/native"
+)
+
+// NativeSuffix is the suffix of the paths of the models scored by WACE
+// itself, without a plugin (see the native package).
+const NativeSuffix = ".json"
+
+// nativeModel is a model plugin scoring the payloads with a model of
+// the native package.
+type nativeModel struct {
+	model native.Model
+}
+
+// newNativeModel loads the model from the file.
+func newNativeModel(path string) (*nativeModel, error) {
+	model, err := native.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	return &nativeModel{model}, nil
+}
+
+func (m *nativeModel) Process(input ModelInput) (ModelResults, error) {
+	return ModelResults{ProbAttack: m.model.Score(input.Payload)}, nil
+}
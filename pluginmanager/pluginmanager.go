@@ -0,0 +1,1172 @@
+/*
+Package pluginmanager handles the communication with the model and
+decision plugins.
+
+The types exchanged with the plugins are the ones of the WACE library
+plugin manager, so existing plugins keep working unchanged. The only
+exception is ModelInput, which extends the one of the library; the Go
+plugins using the library one are still supported.
+*/
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"plugin"
+	"sort"
+	"strings"
+	"sync"
+
+	"wace/decoding"
+	"wace/payloadlimit"
+	"wace/resultcache"
+	"wace/tenant"
+	"wace/transaction"
+	"wace/workerpool"
+
+	cf "github.com/tilsor/ModSecIntl_wace_lib/configstore"
+	lpm "github.com/tilsor/ModSecIntl_wace_lib/pluginmanager"
+
+	"github.com/nats-io/nats.go"
+	lg "github.com/tilsor/ModSecIntl_logging/logging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// ModelResults stores the result of the analysis of a model plugin.
+type ModelResults = lpm.ModelResults
+
+// ModelInput is the struct that contains the input data for the model
+// plugin. It has the same JSON encoding as the ModelInput of the WACE
+// library, so remote plugins can decode it with either.
+type ModelInput struct {
+	TransactionId string `json:"transactionId"`
+	Payload       string `json:"payload"`
+	// Truncated is true if the payload was truncated to fit the
+	// payload limit of the phase or of the model plugin
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// libProcess adapts the process function of the plugins using the
+// ModelInput of the WACE library.
+func libProcess(process func(lpm.ModelInput) (ModelResults, error)) func(ModelInput) (ModelResults, error) {
+	return func(input ModelInput) (ModelResults, error) {
+		return process(lpm.ModelInput{TransactionId: input.TransactionId, Payload: input.Payload})
+	}
+}
+
+// DecisionInput is the struct that contains the input data for the decision plugin
+type DecisionInput = lpm.DecisionInput
+
+// ModelTransmitionResults is the struct that contains the results of the model plugin
+type ModelTransmitionResults = lpm.ModelTransmitionResults
+
+// TransactionInput is the input of the decision plugins exporting a
+// CheckTransaction function instead of CheckResults. On top of the
+// DecisionInput, it has the results of each phase, the execution of
+// each model plugin (of both directions) and the HTTP request and
+// response of the transaction.
+type TransactionInput struct {
+	DecisionInput
+	// Direction is the direction of the verdict (Inbound or Outbound).
+	// The Results of the DecisionInput only hold the results of the
+	// model plugins of the phases in the direction.
+	Direction string
+	// PhaseResults are the results of the model plugins, keyed by
+	// phase (model plugin type) and model ID
+	PhaseResults map[string]map[string]ModelResults
+	// Executions are the executions of the model plugins requested
+	// for the transaction, keyed by model ID. Models without a result
+	// can be found here, eg: with a timeout status.
+	Executions map[string]transaction.ModelExecution
+	ClientIP   string
+	Request    transaction.Request
+	Response   transaction.Response
+}
+
+// Reject policies, indicating what a model rejected by its worker pool
+// contributes to the decision.
+const (
+	// RejectIgnore leaves the model out of the decision
+	RejectIgnore = "ignore"
+	// RejectAttack counts the model as detecting an attack
+	RejectAttack = "attack"
+	// RejectBenign counts the model as not detecting an attack
+	RejectBenign = "benign"
+)
+
+// ModelOptions holds the execution options of a model plugin.
+type ModelOptions struct {
+	// Pool limits the concurrent executions of the model plugin
+	Pool workerpool.Config
+	// RejectPolicy is the reject policy applied when the worker pool
+	// rejects an execution. Defaults to RejectIgnore.
+	RejectPolicy string
+	// PayloadLimit limits the size of the payloads analyzed by the
+	// model plugin
+	PayloadLimit payloadlimit.Limit
+	// Input is the input mode of the model plugin (decoding.Raw or
+	// decoding.Normalized). Defaults to decoding.Raw.
+	Input string
+	// GRPC configures the model plugin in GRPCMode
+	GRPC GRPCOptions
+	// Cache caches the results of the model plugin for repeated
+	// payloads
+	Cache resultcache.Config
+	// CachePhases are the phases (model plugin types) whose results
+	// are cached. Empty means all phases.
+	CachePhases []string
+	// CacheResults overrides CachePhases for the model plugin: true
+	// caches its results whatever its phase (in a cache of
+	// resultcache.DefaultSize results if Cache has no size), and false
+	// disables its cache. Nil follows CachePhases.
+	CacheResults *bool
+	// Shadow runs the model plugin on the transactions without
+	// influencing their verdict: its results are only considered by
+	// the shadow decisions (see CheckShadowResult)
+	Shadow bool
+	// Feedback forwards the labels given to the transactions to the
+	// model plugin, if it implements the Feedback hook
+	Feedback bool
+}
+
+// Directions of the verdicts of the decision plugins.
+const (
+	// Inbound verdicts are asked after the request phases, and
+	// consider the results of the request model plugins
+	Inbound = "inbound"
+	// Outbound verdicts are asked after the response phases, and
+	// consider the results of the response model plugins
+	Outbound = "outbound"
+)
+
+// CheckDirection verifies that the direction is valid.
+func CheckDirection(direction string) error {
+	switch direction {
+	case Inbound, Outbound:
+		return nil
+	}
+	return fmt.Errorf("invalid direction %s", direction)
+}
+
+// PhaseDirection returns the direction of the verdicts considering
+// the results of the phase (model plugin type).
+func PhaseDirection(t cf.ModelPluginType) string {
+	switch t {
+	case cf.RequestHeaders, cf.RequestBody, cf.AllRequest:
+		return Inbound
+	}
+	return Outbound
+}
+
+// CheckRejectPolicy verifies that the reject policy is valid.
+func CheckRejectPolicy(policy string) error {
+	switch policy {
+	case "", RejectIgnore, RejectAttack, RejectBenign:
+		return nil
+	}
+	return fmt.Errorf("invalid reject policy %s", policy)
+}
+
+// ModelPlugin is an instance of a model plugin. The plugins with
+// per-instance state export an InitPlugin function returning a new
+// instance configured by the params:
+//
+//	func InitPlugin(params map[string]string, meter metric.Meter) (pm.ModelPlugin, error)
+//
+// so the same plugin file can back several model IDs with different
+// params. The plugins exporting InitPlugin without a result, and
+// Process (or InitPluginAsync), are still supported.
+type ModelPlugin interface {
+	Process(ModelInput) (ModelResults, error)
+}
+
+// DecisionPlugin is an instance of a decision plugin, returned by the
+// InitPlugin function of the decision plugins with per-instance state:
+//
+//	func InitPlugin(params map[string]string, meter metric.Meter) (pm.DecisionPlugin, error)
+type DecisionPlugin interface {
+	CheckResults(DecisionInput) (bool, error)
+}
+
+// TransactionDecisionPlugin is a DecisionPlugin deciding with the
+// whole transaction. Its CheckTransaction method is called instead of
+// CheckResults.
+type TransactionDecisionPlugin interface {
+	DecisionPlugin
+	CheckTransaction(TransactionInput) (bool, error)
+}
+
+// FeedbackInput is the label given to a transaction once closed,
+// forwarded to the model plugins implementing the Feedback hook.
+type FeedbackInput struct {
+	TransactionID string
+	// Label is "attack" or "benign"
+	Label   string
+	Comment string
+	// Payload is the payload the model plugin analyzed in the
+	// transaction
+	Payload string
+	// ProbAttack is the result of the model plugin in the transaction
+	ProbAttack float64
+}
+
+// FeedbackModelPlugin is a ModelPlugin learning from the labels given
+// to the transactions (online learning). Its Feedback method is called
+// with each label, when the feedback option of the model is enabled.
+// The plugins without instances export the Feedback function instead:
+//
+//	func Feedback(pm.FeedbackInput) error
+type FeedbackModelPlugin interface {
+	ModelPlugin
+	Feedback(FeedbackInput) error
+}
+
+// modelPlugin is the struct that stores the model plugin and its type
+type modelPlugin struct {
+	p          *plugin.Plugin
+	pluginType cf.ModelPluginType
+}
+
+// decisionPlugin is the struct that stores the decision plugin
+type decisionPlugin struct {
+	p *plugin.Plugin
+}
+
+// ModelStatus stores whether there was an error while processing a
+// request (response) by the modelID model plugin
+type ModelStatus struct {
+	ModelID    string
+	ProbAttack float64
+	Err        error
+}
+
+// PluginManager is the main plugin struct storing information of
+// every plugin execution.
+type PluginManager struct {
+	modelPlugins        map[string]modelPlugin
+	modelProcessFunc    map[string]func(ModelInput) (ModelResults, error)
+	modelFeedbackFunc   map[string]func(FeedbackInput) error
+	decisionCheckFunc   map[string]func(DecisionInput) (bool, error)
+	decisionTxFunc      map[string]func(TransactionInput) (bool, error)
+	decisionPlugins     map[string]decisionPlugin
+	modelOptions        map[string]ModelOptions
+	modelPools          map[string]*workerpool.Pool
+	modelCaches         map[string]*resultcache.Cache
+	results             sync.Map
+	syncModelsChannels  sync.Map
+	asyncModelsChannels sync.Map
+	natConn             *nats.Conn
+	rejected            metric.Int64Counter
+	cacheHits           metric.Int64Counter
+	cacheMisses         metric.Int64Counter
+	// closers stop the gRPC plugins and release the WebAssembly ones
+	closers []func()
+	// shadowChannels receive the results of the shadow model plugins
+	// called through NATS, awaited in the background
+	shadowChannels sync.Map
+}
+
+// New creates a new PluginManager instance. The options configure the
+// execution of each model plugin, and can be nil.
+func New(meter metric.Meter, options map[string]ModelOptions) *PluginManager {
+	pm := new(PluginManager)
+	conf := cf.Get()
+	logger := lg.Get()
+	logger.Printf(lg.DEBUG, "Connecting to NATS server at %s", conf.NatsURL)
+
+	nc, err := nats.Connect(conf.NatsURL)
+	if err != nil {
+		logger.Printf(lg.ERROR, "Failed to connect to NATS server")
+	}
+	pm.natConn = nc
+
+	pm.initModelPools(meter, options)
+
+	// Loading of model plugins
+	pm.modelPlugins = make(map[string]modelPlugin)
+	pm.modelProcessFunc = make(map[string]func(ModelInput) (ModelResults, error))
+	pm.modelFeedbackFunc = make(map[string]func(FeedbackInput) error)
+	// Paths of the loaded plugins without instances, which share their
+	// package state between the IDs they back
+	sharedPaths := make(map[string]string)
+	for _, data := range conf.ModelPlugins {
+		if data.Mode == GRPCMode {
+			instance, err := newGRPCModel(data.ID, data.Path, data.PluginType.String(), data.Params, options[data.ID].GRPC)
+			if err != nil {
+				logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+				continue
+			}
+			pm.addModelInstance(data.ID, instance, false)
+			pm.modelPlugins[data.ID] = modelPlugin{nil, data.PluginType}
+			pm.closers = append(pm.closers, instance.Close)
+			logger.Printf(lg.INFO, "| %s | gRPC plugin loaded", data.ID)
+			continue
+		}
+		async := data.Mode == "async" || data.Remote
+		if strings.HasSuffix(data.Path, WasmSuffix) {
+			instance, err := newWasmModel(data.Path, data.Params)
+			if err != nil {
+				logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+				continue
+			}
+			pm.addModelInstance(data.ID, instance, async)
+			pm.modelPlugins[data.ID] = modelPlugin{nil, data.PluginType}
+			pm.closers = append(pm.closers, instance.Close)
+			logger.Printf(lg.INFO, "| %s | WebAssembly plugin loaded", data.ID)
+			continue
+		}
+		if strings.HasSuffix(data.Path, NativeSuffix) {
+			instance, err := newNativeModel(data.Path)
+			if err != nil {
+				logger.Printf(lg.WARN, "| %s | cannot load model: %v", data.ID, err)
+				continue
+			}
+			pm.addModelInstance(data.ID, instance, async)
+			pm.modelPlugins[data.ID] = modelPlugin{nil, data.PluginType}
+			logger.Printf(lg.INFO, "| %s | native model loaded", data.ID)
+			continue
+		}
+		tp, err := plugin.Open(data.Path)
+		if err != nil {
+			logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+			continue
+		}
+		if f, err := tp.Lookup("InitPlugin"); err == nil {
+			if initPlugin, ok := f.(func(map[string]string, metric.Meter) (ModelPlugin, error)); ok {
+				instance, err := initPlugin(data.Params, meter)
+				if err != nil {
+					logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+					continue
+				}
+				pm.addModelInstance(data.ID, instance, async)
+				pm.modelPlugins[data.ID] = modelPlugin{tp, data.PluginType}
+				logger.Printf(lg.INFO, "| %s | plugin instance loaded", data.ID)
+				continue
+			}
+		}
+		if sharedID, ok := sharedPaths[data.Path]; ok {
+			logger.Printf(lg.WARN, "| %s | plugin %s does not return instances, it shares its params with %s", data.ID, data.Path, sharedID)
+		}
+		if async {
+			f, err := tp.Lookup("InitPluginAsync")
+			if err != nil {
+				logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+				continue
+			}
+			modelID := data.ID
+			handler := func(modelProcess func(ModelInput) (ModelResults, error)) {
+				ModelProcessHandler(modelID, pm.modelProcess(modelID, modelProcess))
+			}
+			switch initPlugin := f.(type) {
+			case func(map[string]string, metric.Meter, func(func(ModelInput) (ModelResults, error))) error:
+				err = initPlugin(data.Params, meter, handler)
+			case func(map[string]string, metric.Meter, func(func(lpm.ModelInput) (ModelResults, error))) error:
+				err = initPlugin(data.Params, meter, func(modelProcess func(lpm.ModelInput) (ModelResults, error)) {
+					handler(libProcess(modelProcess))
+				})
+			default:
+				logger.Printf(lg.WARN, "| %s | cannot load plugin: invalid InitPluginAsync function type", data.ID)
+				continue
+			}
+			if err != nil {
+				logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+				continue
+			}
+			go pm.ModelResultsHandler(data.ID)
+		} else {
+			f, err := tp.Lookup("InitPlugin")
+			if err != nil {
+				logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+				continue
+			}
+			initPlugin, ok := f.(func(map[string]string, metric.Meter) error)
+			if !ok {
+				logger.Printf(lg.WARN, "| %s | cannot load plugin: invalid InitPlugin function type", data.ID)
+				continue
+			}
+			err = initPlugin(data.Params, meter)
+			if err != nil {
+				logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+				continue
+			}
+			procFunc, err := tp.Lookup("Process")
+			if err != nil {
+				logger.Printf(lg.WARN, "| %s | cannot load plugin: cannot load Process function", data.ID)
+				continue
+			}
+			switch process := procFunc.(type) {
+			case func(ModelInput) (ModelResults, error):
+				pm.modelProcessFunc[data.ID] = process
+			case func(lpm.ModelInput) (ModelResults, error):
+				pm.modelProcessFunc[data.ID] = libProcess(process)
+			default:
+				logger.Printf(lg.WARN, "| %s | cannot load plugin: invalid Process function type", data.ID)
+				continue
+			}
+		}
+		if fb, err := tp.Lookup("Feedback"); err == nil {
+			feedback, ok := fb.(func(FeedbackInput) error)
+			if !ok {
+				logger.Printf(lg.WARN, "| %s | invalid Feedback function type, feedback disabled", data.ID)
+			} else {
+				pm.modelFeedbackFunc[data.ID] = feedback
+			}
+		}
+		sharedPaths[data.Path] = data.ID
+		pm.modelPlugins[data.ID] = modelPlugin{tp, data.PluginType}
+		logger.Printf(lg.INFO, "| %s | plugin loaded", data.ID)
+	}
+
+	pm.decisionPlugins = make(map[string]decisionPlugin)
+	pm.decisionCheckFunc = make(map[string]func(DecisionInput) (bool, error))
+	pm.decisionTxFunc = make(map[string]func(TransactionInput) (bool, error))
+	sharedPaths = make(map[string]string)
+	// Loading of decision plugins
+	for _, data := range conf.DecisionPlugins {
+		if strings.HasSuffix(data.Path, WasmSuffix) {
+			instance, err := newWasmDecision(data.Path, data.Params)
+			if err != nil {
+				logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+				continue
+			}
+			pm.addDecisionInstance(data.ID, instance)
+			pm.decisionPlugins[data.ID] = decisionPlugin{nil}
+			pm.closers = append(pm.closers, instance.Close)
+			logger.Printf(lg.INFO, "| %s | WebAssembly plugin loaded", data.ID)
+			continue
+		}
+		tp, err := plugin.Open(data.Path)
+		if err != nil {
+			logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+			continue
+		}
+		f, err := tp.Lookup("InitPlugin")
+		if err != nil {
+			logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+			continue
+		}
+		if initInstance, ok := f.(func(map[string]string, metric.Meter) (DecisionPlugin, error)); ok {
+			instance, err := initInstance(data.Params, meter)
+			if err != nil {
+				logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+				continue
+			}
+			pm.addDecisionInstance(data.ID, instance)
+			pm.decisionPlugins[data.ID] = decisionPlugin{tp}
+			logger.Printf(lg.INFO, "| %s | plugin instance loaded", data.ID)
+			continue
+		}
+		initPlugin, ok := f.(func(map[string]string, metric.Meter) error)
+		if !ok {
+			logger.Printf(lg.WARN, "| %s | cannot load plugin: invalid InitPlugin function type", data.ID)
+			continue
+		}
+		if sharedID, ok := sharedPaths[data.Path]; ok {
+			logger.Printf(lg.WARN, "| %s | plugin %s does not return instances, it shares its params with %s", data.ID, data.Path, sharedID)
+		}
+		err = initPlugin(data.Params, meter)
+		if err != nil {
+			logger.Printf(lg.WARN, "| %s | cannot load plugin: %v", data.ID, err)
+			continue
+		}
+		sharedPaths[data.Path] = data.ID
+		if cT, err := tp.Lookup("CheckTransaction"); err == nil {
+			checkTransaction, ok := cT.(func(TransactionInput) (bool, error))
+			if !ok {
+				logger.Printf(lg.ERROR, "| %s | CheckTransaction lookup failed for plugin: invalid function type", data.ID)
+				continue
+			}
+			pm.decisionTxFunc[data.ID] = checkTransaction
+			pm.decisionPlugins[data.ID] = decisionPlugin{tp}
+			continue
+		}
+		cR, err := tp.Lookup("CheckResults")
+		if err != nil {
+			logger.Printf(lg.ERROR, "| %s | cannot load plugin check results function: %v", data.ID, err)
+			continue
+		}
+		checkResults, ok := cR.(func(DecisionInput) (bool, error))
+		if !ok {
+			logger.Printf(lg.ERROR, "| %s | CheckResults lookup failed for plugin: invalid function type", data.ID)
+			continue
+		}
+		pm.decisionCheckFunc[data.ID] = checkResults
+		pm.decisionPlugins[data.ID] = decisionPlugin{tp}
+	}
+	return pm
+}
+
+// addModelInstance registers the instance of a model plugin for the
+// model ID. Async instances process the payloads received from NATS.
+func (p *PluginManager) addModelInstance(modelID string, instance ModelPlugin, async bool) {
+	if fbInstance, ok := instance.(FeedbackModelPlugin); ok {
+		p.modelFeedbackFunc[modelID] = fbInstance.Feedback
+	}
+	if async {
+		ModelProcessHandler(modelID, p.modelProcess(modelID, instance.Process))
+		go p.ModelResultsHandler(modelID)
+		return
+	}
+	p.modelProcessFunc[modelID] = instance.Process
+}
+
+// Close stops the gRPC model plugins (killing the launched ones) and
+// releases the WebAssembly plugins. The plugin manager cannot be used
+// after closing it.
+func (p *PluginManager) Close() {
+	for _, c := range p.closers {
+		c()
+	}
+	p.closers = nil
+}
+
+// addDecisionInstance registers the instance of a decision plugin for
+// the decision ID, using CheckTransaction if the instance implements
+// it.
+func (p *PluginManager) addDecisionInstance(decisionID string, instance DecisionPlugin) {
+	if txInstance, ok := instance.(TransactionDecisionPlugin); ok {
+		p.decisionTxFunc[decisionID] = txInstance.CheckTransaction
+		return
+	}
+	p.decisionCheckFunc[decisionID] = instance.CheckResults
+}
+
+// RegisterDecision registers a built-in decision, called as the
+// decision plugins exporting CheckTransaction. The ID cannot be the one
+// of a loaded decision plugin.
+func (p *PluginManager) RegisterDecision(decisionID string, check func(TransactionInput) (bool, error)) error {
+	_, isResults := p.decisionCheckFunc[decisionID]
+	_, isTransaction := p.decisionTxFunc[decisionID]
+	if isResults || isTransaction {
+		return fmt.Errorf("decision %s already registered", decisionID)
+	}
+	p.decisionTxFunc[decisionID] = check
+	return nil
+}
+
+// initModelPools creates the worker pools and result caches of the
+// model plugins, and registers their metrics.
+func (p *PluginManager) initModelPools(meter metric.Meter, options map[string]ModelOptions) {
+	logger := lg.Get()
+	conf := cf.Get()
+	p.modelOptions = options
+	p.modelPools = make(map[string]*workerpool.Pool)
+	p.modelCaches = make(map[string]*resultcache.Cache)
+	for modelID, opts := range options {
+		p.modelPools[modelID] = workerpool.New(opts.Pool)
+		cached := opts.Cache.Size > 0 && cacheablePhase(opts.CachePhases, conf.ModelPlugins[modelID].PluginType)
+		if opts.CacheResults != nil {
+			cached = *opts.CacheResults
+			if cached && opts.Cache.Size == 0 {
+				opts.Cache.Size = resultcache.DefaultSize
+			}
+		}
+		if cached {
+			p.modelCaches[modelID] = resultcache.New(opts.Cache)
+		}
+	}
+
+	var err error
+	p.rejected, err = meter.Int64Counter("wace.model.rejected.total")
+	if err != nil {
+		logger.Printf(lg.WARN, "cannot create model rejections metric: %v", err)
+	}
+	_, err = meter.Int64ObservableGauge("wace.model.queue.depth",
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			for modelID, pool := range p.modelPools {
+				o.Observe(pool.QueueDepth(), metric.WithAttributes(attribute.String("model_id", modelID)))
+			}
+			return nil
+		}))
+	if err != nil {
+		logger.Printf(lg.WARN, "cannot create model queue depth metric: %v", err)
+	}
+	p.cacheHits, err = meter.Int64Counter("wace.model.cache.hits.total")
+	if err != nil {
+		logger.Printf(lg.WARN, "cannot create model cache hits metric: %v", err)
+	}
+	p.cacheMisses, err = meter.Int64Counter("wace.model.cache.misses.total")
+	if err != nil {
+		logger.Printf(lg.WARN, "cannot create model cache misses metric: %v", err)
+	}
+}
+
+// cacheablePhase returns true if the results of the phase are cached,
+// that is, if phases is empty or has the phase.
+func cacheablePhase(phases []string, t cf.ModelPluginType) bool {
+	if len(phases) == 0 {
+		return true
+	}
+	for _, phase := range phases {
+		if phase == t.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// modelProcess returns the process function of the model plugin
+// executed in the worker pool of the model, reusing the cached results
+// of repeated payloads.
+func (p *PluginManager) modelProcess(modelID string, process func(ModelInput) (ModelResults, error)) func(ModelInput) (ModelResults, error) {
+	return p.cachedProcess(modelID, p.pooledProcess(modelID, process))
+}
+
+// cachedProcess returns the process function of the model plugin
+// returning the cached result of the payload, if any. Otherwise the
+// plugin is called, and its result is cached unless it failed.
+func (p *PluginManager) cachedProcess(modelID string, process func(ModelInput) (ModelResults, error)) func(ModelInput) (ModelResults, error) {
+	cache, ok := p.modelCaches[modelID]
+	if !ok {
+		return process
+	}
+	attrs := metric.WithAttributes(attribute.String("model_id", modelID))
+	return func(input ModelInput) (ModelResults, error) {
+		key := resultcache.KeyOf(input.Payload, input.Truncated)
+		if res, ok := cache.Get(key); ok {
+			if p.cacheHits != nil {
+				p.cacheHits.Add(context.Background(), 1, attrs)
+			}
+			return res, nil
+		}
+		if p.cacheMisses != nil {
+			p.cacheMisses.Add(context.Background(), 1, attrs)
+		}
+		res, err := process(input)
+		if err == nil {
+			cache.Add(key, res)
+		}
+		return res, err
+	}
+}
+
+// pooledProcess returns the process function of the model plugin
+// executed in the worker pool of the model. If the pool rejects the
+// execution, the result given by the reject policy of the model is
+// returned along with the error.
+func (p *PluginManager) pooledProcess(modelID string, process func(ModelInput) (ModelResults, error)) func(ModelInput) (ModelResults, error) {
+	pool, ok := p.modelPools[modelID]
+	if !ok {
+		return process
+	}
+	return func(input ModelInput) (ModelResults, error) {
+		var res ModelResults
+		var err error
+		poolErr := pool.Run(func() {
+			res, err = process(input)
+		})
+		if poolErr != nil {
+			p.countRejection(modelID, poolErr)
+			return p.rejectedResult(modelID), poolErr
+		}
+		return res, err
+	}
+}
+
+// countRejection counts a rejected execution of the model plugin in
+// the metrics.
+func (p *PluginManager) countRejection(modelID string, reason error) {
+	if p.rejected != nil {
+		p.rejected.Add(context.Background(), 1, metric.WithAttributes(
+			attribute.String("model_id", modelID),
+			attribute.String("reason", reason.Error())))
+	}
+}
+
+// rejectedStatus stores the result a rejected model contributes to the
+// decision for the transaction, if any, and returns its status.
+func (p *PluginManager) rejectedStatus(transactionID, modelID string, reason error) ModelStatus {
+	policy := p.modelOptions[modelID].RejectPolicy
+	if policy != RejectAttack && policy != RejectBenign {
+		return ModelStatus{ModelID: modelID, Err: reason}
+	}
+	res := p.rejectedResult(modelID)
+	if err := p.storeResult(transactionID, modelID, res); err != nil {
+		return ModelStatus{ModelID: modelID, Err: err}
+	}
+	return ModelStatus{ModelID: modelID, ProbAttack: res.ProbAttack, Err: reason}
+}
+
+// RejectModel rejects the execution of the model plugin for the
+// transaction, applying its reject policy.
+func (p *PluginManager) RejectModel(transactionID, modelID string, reason error) ModelStatus {
+	p.countRejection(modelID, reason)
+	return p.rejectedStatus(transactionID, modelID, reason)
+}
+
+// Shadow returns true if the model plugin is a shadow one.
+func (p *PluginManager) Shadow(modelID string) bool {
+	return p.modelOptions[modelID].Shadow
+}
+
+// AcceptsFeedback returns true if the labels given to the transactions
+// are forwarded to the model plugin: its feedback option is enabled and
+// it implements the Feedback hook.
+func (p *PluginManager) AcceptsFeedback(modelID string) bool {
+	_, ok := p.modelFeedbackFunc[modelID]
+	return ok && p.modelOptions[modelID].Feedback
+}
+
+// Feedback forwards the label given to a transaction to the model
+// plugin, or to its instance for the tenant of the transaction.
+func (p *PluginManager) Feedback(modelID string, input FeedbackInput) error {
+	instanceID := p.modelInstance(modelID, input.TransactionID)
+	if !p.AcceptsFeedback(instanceID) {
+		return fmt.Errorf("model %s does not accept feedback", modelID)
+	}
+	return p.modelFeedbackFunc[instanceID](input)
+}
+
+// modelInstance returns the ID of the instance of the model plugin
+// analyzing the payloads of the transaction: the model ID scoped to the
+// tenant of the transaction if the tenant overrides the params of the
+// plugin, or the model ID otherwise. The results are stored with the
+// model ID in both cases.
+func (p *PluginManager) modelInstance(modelID, transactionID string) string {
+	if tenantID, _ := tenant.SplitID(transactionID); tenantID != "" {
+		instanceID := tenant.ScopeID(tenantID, modelID)
+		if _, ok := p.modelPlugins[instanceID]; ok {
+			return instanceID
+		}
+	}
+	return modelID
+}
+
+// decisionInstance returns the ID of the instance of the decision
+// plugin checking the transaction, as modelInstance.
+func (p *PluginManager) decisionInstance(decisionID, transactionID string) string {
+	if tenantID, _ := tenant.SplitID(transactionID); tenantID != "" {
+		instanceID := tenant.ScopeID(tenantID, decisionID)
+		if _, ok := p.decisionPlugins[instanceID]; ok {
+			return instanceID
+		}
+	}
+	return decisionID
+}
+
+// ShadowModels returns the IDs of the loaded shadow model plugins of
+// the phase (model plugin type), sorted.
+func (p *PluginManager) ShadowModels(t cf.ModelPluginType) []string {
+	var models []string
+	for modelID, opts := range p.modelOptions {
+		if mp, ok := p.modelPlugins[modelID]; ok && opts.Shadow && mp.pluginType == t {
+			models = append(models, modelID)
+		}
+	}
+	sort.Strings(models)
+	return models
+}
+
+// PayloadLimit returns the payload limit of the model plugin.
+func (p *PluginManager) PayloadLimit(modelID string) payloadlimit.Limit {
+	return p.modelOptions[modelID].PayloadLimit
+}
+
+// Input returns the input mode of the model plugin.
+func (p *PluginManager) Input(modelID string) string {
+	if input := p.modelOptions[modelID].Input; input != "" {
+		return input
+	}
+	return decoding.Raw
+}
+
+// rejectedResult returns the result a rejected model contributes to
+// the decision, according to its reject policy.
+func (p *PluginManager) rejectedResult(modelID string) ModelResults {
+	res := ModelResults{Data: map[string]interface{}{"rejected": true}}
+	if p.modelOptions[modelID].RejectPolicy == RejectAttack {
+		res.ProbAttack = 1
+	}
+	return res
+}
+
+// InitTransaction initializes the transaction with the given ID
+func (p *PluginManager) InitTransaction(transactionID string) {
+	p.results.Store(transactionID, new(sync.Map))
+}
+
+// CloseTransaction closes the transaction with the given ID
+// removing all sync model data
+func (p *PluginManager) CloseTransaction(transactionID string) {
+	logger := lg.Get()
+	transactionMap, ok := p.syncModelsChannels.Load(transactionID)
+	if !ok {
+		logger.TPrintf(lg.ERROR, transactionID, "Transaction %s not found", transactionID)
+	} else {
+		transactionMap.(*sync.Map).Range(func(key, value interface{}) bool {
+			ch := value.(chan ModelStatus)
+			close(ch)
+			for range ch {
+			}
+			transactionMap.(*sync.Map).Delete(key)
+			return true
+		})
+		p.syncModelsChannels.Delete(transactionID)
+		p.shadowChannels.Delete(transactionID)
+		resultsMap, ok := p.results.Load(transactionID)
+		if !ok {
+			logger.TPrintf(lg.ERROR, transactionID, "Results for transaction %s not found", transactionID)
+		} else {
+			resultsMap.(*sync.Map).Range(func(key, value interface{}) bool {
+				resultsMap.(*sync.Map).Delete(key)
+				return true
+			})
+		}
+		p.results.Delete(transactionID)
+	}
+}
+
+// AddModelChannel adds a channel to result channel map
+func (p *PluginManager) AddModelChannel(transactionID string, t cf.ModelPluginType, modelPlugStatus chan ModelStatus, modelType string) {
+	typeModel := new(sync.Map)
+	var value interface{}
+	switch modelType {
+	case "sync":
+		value, _ = p.syncModelsChannels.LoadOrStore(transactionID, typeModel)
+	case "shadow":
+		value, _ = p.shadowChannels.LoadOrStore(transactionID, typeModel)
+	default:
+		value, _ = p.asyncModelsChannels.LoadOrStore(transactionID, typeModel)
+	}
+	value.(*sync.Map).Store(t.String(), modelPlugStatus)
+}
+
+// RemoveShadowModelChannel removes the channel of the shadow model
+// plugins of the phase, if it was not replaced by a later analysis of
+// the phase. The channel is not closed, as late results may still be
+// sent to it: it must be buffered for all the shadow model plugins.
+func (p *PluginManager) RemoveShadowModelChannel(transactionID string, t cf.ModelPluginType, modelPlugStatus chan ModelStatus) {
+	if typeModel, ok := p.shadowChannels.Load(transactionID); ok {
+		typeModel.(*sync.Map).CompareAndDelete(t.String(), modelPlugStatus)
+	}
+}
+
+// RemoveAsyncModelChannel removes a channel from the result channel map
+func (p *PluginManager) RemoveAsyncModelChannel(transactionID string, t cf.ModelPluginType) {
+	typeModel, ok := p.asyncModelsChannels.Load(transactionID)
+	if !ok {
+		logger := lg.Get()
+		logger.TPrintf(lg.ERROR, transactionID, "Transaction %s not found when trying to remove async model channel", transactionID)
+		return
+	}
+	channelMap := typeModel.(*sync.Map)
+	ch, channelOk := channelMap.Load(t.String())
+	if channelOk {
+		close(ch.(chan ModelStatus))
+		for range ch.(chan ModelStatus) {
+		}
+		channelMap.Delete(t.String())
+	}
+
+	remainChannels := 0
+	channelMap.Range(func(key, value interface{}) bool {
+		remainChannels++
+		return true
+	})
+	if remainChannels == 0 {
+		p.asyncModelsChannels.Delete(transactionID)
+	}
+}
+
+// truncated returns true if the payload of the transaction analyzed by
+// the model plugin was truncated.
+func truncated(transactionID, modelID string) bool {
+	tx, ok := transaction.Get(transactionID)
+	return ok && tx.Truncated(cf.Get().ModelPlugins[modelID].PluginType.String(), modelID)
+}
+
+// AddToQueue adds a payload to the model queue
+func (p *PluginManager) AddToQueue(modelID, transactionID, payload string) error {
+	if p.natConn == nil {
+		return fmt.Errorf("not connected to NATS server")
+	}
+	payloadToSend := &ModelInput{
+		TransactionId: transactionID,
+		Payload:       payload,
+		Truncated:     truncated(transactionID, modelID),
+	}
+
+	jsonPayload, err := json.Marshal(payloadToSend)
+	if err != nil {
+		return err
+	}
+
+	return p.natConn.Publish(modelID, jsonPayload)
+}
+
+// storeResult stores the result of the model plugin for the
+// transaction.
+func (p *PluginManager) storeResult(transactionID, modelID string, res ModelResults) error {
+	resultSyncMap, ok := p.results.Load(transactionID)
+	if !ok {
+		return fmt.Errorf("transaction results not found")
+	}
+	resultSyncMap.(*sync.Map).Store(modelID, res)
+	return nil
+}
+
+// Results returns the results of the model plugins for the
+// transaction, keyed by model ID.
+func (p *PluginManager) Results(transactionID string) map[string]ModelResults {
+	results := make(map[string]ModelResults)
+	if resultSyncMap, ok := p.results.Load(transactionID); ok {
+		resultSyncMap.(*sync.Map).Range(func(key, value interface{}) bool {
+			results[key.(string)] = value.(ModelResults)
+			return true
+		})
+	}
+	return results
+}
+
+// Process is in charge of calling the model plugin with id modelID, or
+// its instance for the tenant of the transaction. The plugin is
+// executed in the worker pool of the model: if the pool rejects the
+// execution, the result given by the reject policy of the model is
+// stored and the error is reported in the status. Payloads found in
+// the result cache of the model are not analyzed again.
+func (p *PluginManager) Process(modelID, transactionID, payload string, t cf.ModelPluginType, modelPlugStatus chan ModelStatus) {
+	conf := cf.Get()
+
+	mp, exists := p.modelPlugins[modelID]
+	if !exists {
+		modelPlugStatus <- ModelStatus{ModelID: modelID, Err: fmt.Errorf("model plugin not found")}
+		return
+	}
+
+	// check if the plugin is capable of analyzing the indicated part of the transaction
+	if mp.pluginType != t {
+		modelPlugStatus <- ModelStatus{ModelID: modelID,
+			Err: fmt.Errorf("plugin type %v cannot process a request with incompatible type %v", mp.pluginType, t)}
+		return
+	}
+
+	if conf.ModelPlugins[modelID].Mode == "async" {
+		modelPlugStatus <- ModelStatus{ModelID: modelID, Err: fmt.Errorf("model plugin is async")}
+		return
+	}
+
+	instanceID := p.modelInstance(modelID, transactionID)
+	process := p.modelProcess(instanceID, p.modelProcessFunc[instanceID])
+	res, err := process(ModelInput{TransactionId: transactionID, Payload: payload, Truncated: truncated(transactionID, modelID)})
+	if err == workerpool.ErrQueueFull || err == workerpool.ErrQueueTimeout {
+		modelPlugStatus <- p.rejectedStatus(transactionID, modelID, err)
+		return
+	}
+	if err != nil {
+		modelPlugStatus <- ModelStatus{ModelID: modelID, Err: err}
+		return
+	}
+	// store the results
+	if err := p.storeResult(transactionID, modelID, res); err != nil {
+		modelPlugStatus <- ModelStatus{ModelID: modelID, Err: err}
+		return
+	}
+	modelPlugStatus <- ModelStatus{ModelID: modelID, ProbAttack: res.ProbAttack, Err: nil}
+}
+
+// transactionInput returns the input of the decision plugins
+// exporting CheckTransaction, with the results of all the model
+// plugins in its phase results.
+func (p *PluginManager) transactionInput(input DecisionInput, direction string, results map[string]ModelResults) TransactionInput {
+	configStore := cf.Get()
+	txInput := TransactionInput{
+		DecisionInput: input,
+		Direction:     direction,
+		PhaseResults:  make(map[string]map[string]ModelResults),
+	}
+	for modelID, res := range results {
+		phase := configStore.ModelPlugins[modelID].PluginType.String()
+		if txInput.PhaseResults[phase] == nil {
+			txInput.PhaseResults[phase] = make(map[string]ModelResults)
+		}
+		txInput.PhaseResults[phase][modelID] = res
+	}
+	if tx, ok := transaction.Get(input.TransactionId); ok {
+		txInput.Executions = tx.ModelExecutions()
+		txInput.ClientIP = tx.ClientIP()
+		txInput.Request = tx.Request()
+		txInput.Response = tx.Response()
+	}
+	return txInput
+}
+
+// CheckResult is in charge of calling the decision plugin with id decisionID over the
+// transaction with id transactID, considering the results of the model plugins
+// of the given direction. The results of the shadow model plugins are left out.
+func (p *PluginManager) CheckResult(transactionID, decisionID, direction string, wafParams map[string]string) (bool, error) {
+	return p.checkResult(transactionID, decisionID, direction, wafParams, false)
+}
+
+// CheckShadowResult is like CheckResult, but the decision plugin also
+// considers the results of the shadow model plugins. It is used to
+// evaluate the shadow decisions next to the active one.
+func (p *PluginManager) CheckShadowResult(transactionID, decisionID, direction string, wafParams map[string]string) (bool, error) {
+	return p.checkResult(transactionID, decisionID, direction, wafParams, true)
+}
+
+// checkResult calls the decision plugin, or its instance for the
+// tenant of the transaction, considering the results of the shadow
+// model plugins if shadow is true.
+func (p *PluginManager) checkResult(transactionID, decisionID, direction string, wafParams map[string]string, shadow bool) (bool, error) {
+	logger := lg.Get()
+
+	instanceID := p.decisionInstance(decisionID, transactionID)
+	checkResults, isResults := p.decisionCheckFunc[instanceID]
+	checkTransaction, isTransaction := p.decisionTxFunc[instanceID]
+	if !isResults && !isTransaction {
+		return false, fmt.Errorf("decision plugin not found")
+	}
+
+	transactionResults, ok := p.results.Load(transactionID)
+	if !ok {
+		return false, fmt.Errorf("transaction results not found")
+	}
+
+	configStore := cf.Get()
+
+	modelResultMap := make(map[string]ModelResults)
+	modelWeightMap := make(map[string]float64)
+	allResults := make(map[string]ModelResults)
+	transactionResults.(*sync.Map).Range(func(key, value interface{}) bool {
+		if !shadow && p.Shadow(key.(string)) {
+			return true
+		}
+		allResults[key.(string)] = value.(ModelResults)
+		if PhaseDirection(configStore.ModelPlugins[key.(string)].PluginType) != direction {
+			return true
+		}
+		modelResultMap[key.(string)] = value.(ModelResults)
+		modelWeightMap[key.(string)] = configStore.ModelPlugins[key.(string)].Weight
+		return true
+	})
+
+	input := DecisionInput{TransactionId: transactionID, Results: modelResultMap, ModelWeight: modelWeightMap, WAFdata: wafParams}
+	var res bool
+	var err error
+	if isTransaction {
+		res, err = checkTransaction(p.transactionInput(input, direction, allResults))
+	} else {
+		res, err = checkResults(input)
+	}
+	if shadow {
+		// Shadow decisions are checked in the background, once the
+		// logging buffer of the transaction may be gone
+		logger.Printf(lg.INFO, "| %s | %s | transaction checked in shadow. Block: %t ", transactionID, decisionID, res)
+	} else {
+		logger.TPrintf(lg.INFO, transactionID, "%s | transaction checked. Block: %t ", decisionID, res)
+	}
+
+	return res, err
+}
+
+// ModelResultsHandler listens for messages on the model results queue
+func (p *PluginManager) ModelResultsHandler(modelID string) {
+	logger := lg.Get()
+	conf := cf.Get()
+
+	if p.natConn == nil {
+		logger.Printf(lg.ERROR, "Model: %s | Not connected to NATS server", modelID)
+		return
+	}
+
+	sub, err := p.natConn.Subscribe(modelID+"/results", func(msg *nats.Msg) {
+		go func(msg nats.Msg) {
+			data := &ModelTransmitionResults{}
+			err := json.Unmarshal(msg.Data, data)
+			if err != nil {
+				logger.Printf(lg.ERROR, "Model: %s | Failed to parse JSON payload", modelID)
+				return
+			}
+			var channel interface{}
+			var ok bool
+			if p.Shadow(modelID) {
+				channel, ok = p.shadowChannels.Load(data.TransactionId)
+			} else if conf.ModelPlugins[modelID].Mode == "async" {
+				channel, ok = p.asyncModelsChannels.Load(data.TransactionId)
+			} else {
+				channel, ok = p.syncModelsChannels.Load(data.TransactionId)
+			}
+			if !ok {
+				logger.TPrintf(lg.ERROR, data.TransactionId, " Model %s | Transaction not found", modelID)
+				return
+			}
+			modelChannel, ok := channel.(*sync.Map).Load(conf.ModelPlugins[modelID].PluginType.String())
+			if !ok {
+				logger.Printf(lg.ERROR, "Model %s not found", modelID)
+				return
+			}
+			if data.Error != nil {
+				modelChannel.(chan ModelStatus) <- ModelStatus{ModelID: modelID, Err: data.Error}
+				return
+			}
+			if conf.ModelPlugins[modelID].Mode != "async" {
+				// store the results
+				modelResult := ModelResults{ProbAttack: data.ProbAttack, Data: data.Data}
+				if err := p.storeResult(data.TransactionId, modelID, modelResult); err != nil {
+					modelChannel.(chan ModelStatus) <- ModelStatus{ModelID: modelID, Err: err}
+					return
+				}
+			}
+			modelChannel.(chan ModelStatus) <- ModelStatus{ModelID: modelID, ProbAttack: data.ProbAttack, Err: nil}
+		}(*msg)
+	})
+
+	if err != nil {
+		logger.Printf(lg.ERROR, "Model: %s | Failed to subscribe to model queue | %s", modelID, err.Error())
+		return
+	}
+
+	logger.Printf(lg.INFO, "Model: %s | Listening for messages on model results queue", modelID)
+
+	defer sub.Unsubscribe()
+	defer p.natConn.Drain()
+
+	select {}
+}
+
+// ModelProcessHandler listens for messages on the model queue
+func ModelProcessHandler(modelID string, modelProcess func(ModelInput) (ModelResults, error)) {
+	logger := lg.Get()
+	logger.Printf(lg.INFO, "Model: %s | Starting model process handler", modelID)
+	conf := cf.Get()
+
+	nc, err := nats.Connect(conf.NatsURL)
+	if err != nil {
+		logger.Printf(lg.ERROR, "Model: %s | Failed to connect to NATS server", modelID)
+		return
+	}
+
+	_, err = nc.Subscribe(modelID, func(msg *nats.Msg) {
+		go func(msg nats.Msg) {
+			data := &ModelInput{}
+			err := json.Unmarshal(msg.Data, data)
+			if err != nil {
+				logger.Printf(lg.ERROR, "Model: %s | Failed to parse JSON payload", modelID)
+				return
+			}
+			res, err := modelProcess(*data)
+			payloadToSend := &ModelTransmitionResults{
+				TransactionId: data.TransactionId,
+				ModelResults:  ModelResults{ProbAttack: res.ProbAttack, Data: res.Data},
+				Error:         err,
+			}
+
+			jsonPayload, err := json.Marshal(payloadToSend)
+			if err != nil {
+				logger.Printf(lg.ERROR, "Model: %s | Failed to parse JSON payload", modelID)
+				return
+			}
+
+			nc.Publish(modelID+"/results", jsonPayload)
+		}(*msg)
+	})
+
+	if err != nil {
+		logger.Printf(lg.ERROR, "Model: %s | Failed to subscribe to model queue | %s", modelID, err.Error())
+		return
+	}
+
+	logger.Printf(lg.INFO, "Model: %s | Listening for messages on model queue", modelID)
+}
@@ -0,0 +1,933 @@
+package pluginmanager
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"wace/decoding"
+	"wace/resultcache"
+	"wace/transaction"
+	"wace/workerpool"
+
+	cf "github.com/tilsor/ModSecIntl_wace_lib/configstore"
+
+	lg "github.com/tilsor/ModSecIntl_logging/logging"
+	"go.opentelemetry.io/otel/metric/noop"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+// Plugin paths must exist for the configstore to accept them, but the
+// plugins are never opened in these tests.
+var testConfig = []byte(`---
+logpath: "/dev/null"
+loglevel: "ERROR"
+modelplugins:
+  - id: "slow"
+    path: "pluginmanager_test.go"
+    weight: 1
+    plugintype: "AllRequest"
+    mode: sync
+  - id: "fast"
+    path: "pluginmanager_test.go"
+    weight: 2
+    plugintype: "AllRequest"
+    mode: sync
+  - id: "leak"
+    path: "pluginmanager_test.go"
+    weight: 1
+    plugintype: "ResponseBody"
+    mode: sync
+`)
+
+func init() {
+	logger := lg.Get()
+	logger.LoadLoggerWriter(io.Discard, lg.ERROR)
+
+	var inConf cf.ConfigFileData
+	if err := yaml.Unmarshal(testConfig, &inConf); err != nil {
+		panic(err)
+	}
+	if err := cf.Get().SetConfig(inConf); err != nil {
+		panic(err)
+	}
+}
+
+// newTestManager creates a plugin manager with the given model process
+// functions, without loading any plugin.
+func newTestManager(models map[string]func(ModelInput) (ModelResults, error), options map[string]ModelOptions) *PluginManager {
+	p := new(PluginManager)
+	p.modelPlugins = make(map[string]modelPlugin)
+	p.modelProcessFunc = make(map[string]func(ModelInput) (ModelResults, error))
+	p.modelFeedbackFunc = make(map[string]func(FeedbackInput) error)
+	p.decisionCheckFunc = make(map[string]func(DecisionInput) (bool, error))
+	p.decisionTxFunc = make(map[string]func(TransactionInput) (bool, error))
+	p.decisionPlugins = make(map[string]decisionPlugin)
+	for id, process := range models {
+		p.modelPlugins[id] = modelPlugin{nil, cf.AllRequest}
+		p.modelProcessFunc[id] = process
+	}
+	p.initModelPools(noop.NewMeterProvider().Meter("test"), options)
+	return p
+}
+
+func TestProcess(t *testing.T) {
+	p := newTestManager(map[string]func(ModelInput) (ModelResults, error){
+		"fast": func(input ModelInput) (ModelResults, error) {
+			return ModelResults{ProbAttack: 0.7}, nil
+		},
+	}, nil)
+	p.InitTransaction("1")
+
+	status := make(chan ModelStatus)
+	go p.Process("fast", "1", "payload", cf.AllRequest, status)
+	s := <-status
+	if s.Err != nil || s.ProbAttack != 0.7 {
+		t.Errorf("unexpected status %+v", s)
+	}
+
+	go p.Process("fast", "1", "payload", cf.RequestBody, status)
+	if s := <-status; s.Err == nil {
+		t.Errorf("model processed a payload of an incompatible type")
+	}
+}
+
+func TestProcessTruncated(t *testing.T) {
+	var inputs []ModelInput
+	p := newTestManager(map[string]func(ModelInput) (ModelResults, error){
+		"fast": func(input ModelInput) (ModelResults, error) {
+			inputs = append(inputs, input)
+			return ModelResults{}, nil
+		},
+	}, nil)
+	tx := transaction.New("tx")
+	defer transaction.Delete("tx")
+	p.InitTransaction("tx")
+
+	status := make(chan ModelStatus)
+	go p.Process("fast", "tx", "payload", cf.AllRequest, status)
+	<-status
+	tx.SetTruncated("AllRequest", "fast")
+	go p.Process("fast", "tx", "payl", cf.AllRequest, status)
+	<-status
+	if len(inputs) != 2 || inputs[0].Truncated || !inputs[1].Truncated {
+		t.Errorf("truncated payload not flagged in the inputs %+v", inputs)
+	}
+}
+
+func TestCheckTransaction(t *testing.T) {
+	p := newTestManager(map[string]func(ModelInput) (ModelResults, error){
+		"fast": func(input ModelInput) (ModelResults, error) {
+			return ModelResults{ProbAttack: 0.9, Data: map[string]interface{}{"rule": "sqli"}}, nil
+		},
+	}, nil)
+	tx := transaction.New("tx")
+	defer transaction.Delete("tx")
+	tx.SetClientIP("192.0.2.1")
+	tx.SetRequestHead("POST /login HTTP/1.1", nil)
+	tx.SetModelExecution("fast", transaction.ModelExecution{Phase: "AllRequest", Status: transaction.ModelDone})
+	tx.SetModelExecution("slow", transaction.ModelExecution{Phase: "AllRequest", Status: transaction.ModelTimeout})
+	p.InitTransaction("tx")
+
+	status := make(chan ModelStatus)
+	go p.Process("fast", "tx", "payload", cf.AllRequest, status)
+	<-status
+
+	// Block only if a request model fires on a POST to /login
+	login := func(in TransactionInput) (bool, error) {
+		res, ok := in.PhaseResults["AllRequest"]["fast"]
+		if !ok || res.Data["rule"] != "sqli" {
+			t.Errorf("wrong phase results %v", in.PhaseResults)
+		}
+		if in.Executions["slow"].Status != transaction.ModelTimeout {
+			t.Errorf("wrong executions %v", in.Executions)
+		}
+		if in.ClientIP != "192.0.2.1" || in.WAFdata["score"] != "5" {
+			t.Errorf("wrong transaction input %+v", in)
+		}
+		return in.Request.Method == "POST" && in.Request.Path == "/login" && res.ProbAttack > 0.5, nil
+	}
+	if err := p.RegisterDecision("login", login); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.RegisterDecision("login", login); err == nil {
+		t.Errorf("duplicated decision registered")
+	}
+	block, err := p.CheckResult("tx", "login", Inbound, map[string]string{"score": "5"})
+	if err != nil || !block {
+		t.Errorf("transaction not blocked: %v", err)
+	}
+
+	if _, err := p.CheckResult("tx", "missing", Inbound, nil); err == nil {
+		t.Errorf("missing decision plugin did not fail")
+	}
+}
+
+func TestDirection(t *testing.T) {
+	p := newTestManager(nil, nil)
+	p.InitTransaction("dir")
+	p.storeResult("dir", "fast", ModelResults{ProbAttack: 0.1})
+	p.storeResult("dir", "leak", ModelResults{ProbAttack: 0.9})
+
+	var input DecisionInput
+	p.decisionCheckFunc["test"] = func(in DecisionInput) (bool, error) {
+		input = in
+		return false, nil
+	}
+	for direction, model := range map[string]string{Inbound: "fast", Outbound: "leak"} {
+		if _, err := p.CheckResult("dir", "test", direction, nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := input.Results[model]; !ok || len(input.Results) != 1 || len(input.ModelWeight) != 1 {
+			t.Errorf("%s: wrong results %v", direction, input.Results)
+		}
+	}
+
+	var txInput TransactionInput
+	p.decisionTxFunc["tx"] = func(in TransactionInput) (bool, error) {
+		txInput = in
+		return false, nil
+	}
+	if _, err := p.CheckResult("dir", "tx", Outbound, nil); err != nil {
+		t.Fatal(err)
+	}
+	if txInput.Direction != Outbound || len(txInput.Results) != 1 || len(txInput.PhaseResults) != 2 {
+		t.Errorf("wrong transaction input %+v", txInput)
+	}
+}
+
+func TestCheckDirection(t *testing.T) {
+	for _, direction := range []string{Inbound, Outbound} {
+		if err := CheckDirection(direction); err != nil {
+			t.Errorf("valid direction %s rejected: %v", direction, err)
+		}
+	}
+	if err := CheckDirection("both"); err == nil {
+		t.Errorf("invalid direction accepted")
+	}
+	if PhaseDirection(cf.RequestBody) != Inbound || PhaseDirection(cf.ResponseHeaders) != Outbound {
+		t.Errorf("wrong phase direction")
+	}
+}
+
+func TestInput(t *testing.T) {
+	p := newTestManager(nil, map[string]ModelOptions{
+		"normalized": {Input: decoding.Normalized},
+	})
+	if p.Input("normalized") != decoding.Normalized {
+		t.Errorf("wrong input mode of normalized model")
+	}
+	if p.Input("other") != decoding.Raw {
+		t.Errorf("input mode does not default to raw")
+	}
+}
+
+func TestRejectPolicy(t *testing.T) {
+	for _, policy := range []string{RejectIgnore, RejectAttack, RejectBenign} {
+		release := make(chan struct{})
+		started := make(chan struct{})
+		p := newTestManager(map[string]func(ModelInput) (ModelResults, error){
+			"slow": func(input ModelInput) (ModelResults, error) {
+				close(started)
+				<-release
+				return ModelResults{ProbAttack: 0.5}, nil
+			},
+		}, map[string]ModelOptions{
+			"slow": {Pool: workerpool.Config{MaxConcurrency: 1}, RejectPolicy: policy},
+		})
+		p.InitTransaction("1")
+		p.InitTransaction("2")
+
+		status1 := make(chan ModelStatus)
+		go p.Process("slow", "1", "payload", cf.AllRequest, status1)
+		<-started
+
+		status2 := make(chan ModelStatus)
+		go p.Process("slow", "2", "payload", cf.AllRequest, status2)
+		if s := <-status2; s.Err != workerpool.ErrQueueFull {
+			t.Errorf("%s: expected rejection, got %+v", policy, s)
+		}
+		close(release)
+		<-status1
+
+		var input DecisionInput
+		p.decisionCheckFunc["test"] = func(in DecisionInput) (bool, error) {
+			input = in
+			return false, nil
+		}
+		if _, err := p.CheckResult("2", "test", Inbound, nil); err != nil {
+			t.Fatal(err)
+		}
+		res, found := input.Results["slow"]
+		switch policy {
+		case RejectIgnore:
+			if found {
+				t.Errorf("ignored rejected model has a result")
+			}
+		case RejectAttack:
+			if !found || res.ProbAttack != 1 {
+				t.Errorf("rejected model with attack policy has result %+v", res)
+			}
+		case RejectBenign:
+			if !found || res.ProbAttack != 0 {
+				t.Errorf("rejected model with benign policy has result %+v", res)
+			}
+		}
+	}
+}
+
+func TestCheckRejectPolicy(t *testing.T) {
+	if err := CheckRejectPolicy("maybe"); err == nil {
+		t.Errorf("invalid reject policy accepted")
+	}
+	if err := CheckRejectPolicy(""); err != nil {
+		t.Errorf("default reject policy rejected: %v", err)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	calls := 0
+	enabled, disabled := true, false
+	models := map[string]func(ModelInput) (ModelResults, error){
+		"fast": func(input ModelInput) (ModelResults, error) {
+			calls++
+			if input.Payload == "error" {
+				return ModelResults{}, fmt.Errorf("cannot analyze")
+			}
+			return ModelResults{ProbAttack: float64(len(input.Payload)) / 10}, nil
+		},
+	}
+	tests := []struct {
+		name    string
+		options ModelOptions
+		calls   int
+	}{
+		{"disabled", ModelOptions{}, 4},
+		{"all phases", ModelOptions{Cache: resultcache.Config{Size: 10}}, 3},
+		{"cached phase", ModelOptions{Cache: resultcache.Config{Size: 10}, CachePhases: []string{"AllRequest"}}, 3},
+		{"other phase", ModelOptions{Cache: resultcache.Config{Size: 10}, CachePhases: []string{"RequestBody"}}, 4},
+		{"model enabled", ModelOptions{CachePhases: []string{"RequestBody"}, CacheResults: &enabled}, 3},
+		{"model disabled", ModelOptions{Cache: resultcache.Config{Size: 10}, CacheResults: &disabled}, 4},
+	}
+	for _, test := range tests {
+		calls = 0
+		p := newTestManager(models, map[string]ModelOptions{"fast": test.options})
+		p.InitTransaction("1")
+		status := make(chan ModelStatus)
+		// Errors are not cached, so the second error calls the model
+		for _, payload := range []string{"payload", "payload", "error", "error"} {
+			go p.Process("fast", "1", payload, cf.AllRequest, status)
+			s := <-status
+			if (s.Err != nil) != (payload == "error") {
+				t.Errorf("%s: unexpected status %+v for %s", test.name, s, payload)
+			}
+			if s.Err == nil && s.ProbAttack != 0.7 {
+				t.Errorf("%s: expected 0.7, got %v", test.name, s.ProbAttack)
+			}
+		}
+		if calls != test.calls {
+			t.Errorf("%s: expected %d calls, got %d", test.name, test.calls, calls)
+		}
+		p.CloseTransaction("1")
+	}
+
+	// The result of a truncated payload is not reused for the complete
+	// one
+	calls = 0
+	p := newTestManager(models, map[string]ModelOptions{"fast": {Cache: resultcache.Config{Size: 10}}})
+	process := p.cachedProcess("fast", models["fast"])
+	for _, truncated := range []bool{true, false, true, false} {
+		process(ModelInput{Payload: "payload", Truncated: truncated})
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls for the truncated and complete payloads, got %d", calls)
+	}
+}
+
+func TestShadow(t *testing.T) {
+	p := newTestManager(map[string]func(ModelInput) (ModelResults, error){
+		"fast": func(input ModelInput) (ModelResults, error) {
+			return ModelResults{ProbAttack: 0.2}, nil
+		},
+		"slow": func(input ModelInput) (ModelResults, error) {
+			return ModelResults{ProbAttack: 0.9}, nil
+		},
+	}, map[string]ModelOptions{"slow": {Shadow: true}})
+	if !p.Shadow("slow") || p.Shadow("fast") {
+		t.Errorf("unexpected shadow models")
+	}
+	if models := p.ShadowModels(cf.AllRequest); len(models) != 1 || models[0] != "slow" {
+		t.Errorf("expected shadow model slow, got %v", models)
+	}
+	if models := p.ShadowModels(cf.RequestBody); len(models) != 0 {
+		t.Errorf("unexpected shadow models %v in another phase", models)
+	}
+
+	p.InitTransaction("1")
+	status := make(chan ModelStatus)
+	for _, id := range []string{"fast", "slow"} {
+		go p.Process(id, "1", "payload", cf.AllRequest, status)
+		<-status
+	}
+	var results map[string]ModelResults
+	p.decisionTxFunc["test"] = func(in TransactionInput) (bool, error) {
+		results = in.Results
+		if _, ok := in.PhaseResults["AllRequest"]["slow"]; ok != (len(results) == 2) {
+			t.Errorf("phase results do not match the results")
+		}
+		return in.Results["slow"].ProbAttack > 0.5, nil
+	}
+	block, err := p.CheckResult("1", "test", Inbound, nil)
+	if err != nil || block || len(results) != 1 {
+		t.Errorf("shadow model considered by the active decision: %t (%v), results %v", block, err, results)
+	}
+	block, err = p.CheckShadowResult("1", "test", Inbound, nil)
+	if err != nil || !block || len(results) != 2 {
+		t.Errorf("shadow model not considered by the shadow decision: %t (%v), results %v", block, err, results)
+	}
+}
+
+// scaledModel is a model plugin instance with its own state
+type scaledModel struct {
+	scale float64
+}
+
+func (m *scaledModel) Process(input ModelInput) (ModelResults, error) {
+	return ModelResults{ProbAttack: m.scale * float64(len(input.Payload)) / 10}, nil
+}
+
+// thresholdDecision is a decision plugin instance deciding with the
+// model results only
+type thresholdDecision struct {
+	threshold float64
+}
+
+func (d *thresholdDecision) CheckResults(input DecisionInput) (bool, error) {
+	return input.Results["fast"].ProbAttack > d.threshold, nil
+}
+
+// methodDecision is a decision plugin instance deciding with the whole
+// transaction
+type methodDecision struct {
+	thresholdDecision
+	method string
+}
+
+func (d *methodDecision) CheckTransaction(input TransactionInput) (bool, error) {
+	return input.Request.Method == d.method, nil
+}
+
+func TestInstances(t *testing.T) {
+	p := newTestManager(nil, nil)
+	// The same plugin backs two model IDs with different params
+	for id, scale := range map[string]float64{"fast": 1, "slow": 0.5} {
+		p.modelPlugins[id] = modelPlugin{nil, cf.AllRequest}
+		p.addModelInstance(id, &scaledModel{scale: scale}, false)
+	}
+	p.InitTransaction("tx2")
+	defer p.CloseTransaction("tx2")
+	tx := transaction.New("tx2")
+	defer transaction.Delete("tx2")
+	tx.SetRequestHead("PUT / HTTP/1.1", nil)
+
+	status := make(chan ModelStatus)
+	for _, id := range []string{"fast", "slow"} {
+		go p.Process(id, "tx2", "12345678", cf.AllRequest, status)
+		s := <-status
+		expected := map[string]float64{"fast": 0.8, "slow": 0.4}[id]
+		if s.Err != nil || s.ProbAttack != expected {
+			t.Errorf("%s instance got %+v, expected %v", id, s, expected)
+		}
+	}
+
+	p.addDecisionInstance("strict", &thresholdDecision{threshold: 0.5})
+	p.addDecisionInstance("lenient", &thresholdDecision{threshold: 0.9})
+	p.addDecisionInstance("put", &methodDecision{method: "PUT"})
+	for decisionID, expected := range map[string]bool{"strict": true, "lenient": false, "put": true} {
+		block, err := p.CheckResult("tx2", decisionID, Inbound, nil)
+		if err != nil || block != expected {
+			t.Errorf("%s instance got %t (%v), expected %t", decisionID, block, err, expected)
+		}
+	}
+	if _, ok := p.decisionTxFunc["put"]; !ok {
+		t.Errorf("CheckTransaction of the instance not used")
+	}
+}
+
+func TestTenantInstances(t *testing.T) {
+	p := newTestManager(nil, map[string]ModelOptions{"fast": {Feedback: true}, "acme/fast": {Feedback: true}})
+	// The acme tenant overrides the params of the plugins
+	acme := &learningModel{scaledModel: scaledModel{scale: 0.5}}
+	p.modelPlugins["fast"] = modelPlugin{nil, cf.AllRequest}
+	p.modelPlugins["acme/fast"] = modelPlugin{nil, cf.AllRequest}
+	p.addModelInstance("fast", &learningModel{scaledModel: scaledModel{scale: 1}}, false)
+	p.addModelInstance("acme/fast", acme, false)
+	for id, threshold := range map[string]float64{"threshold": 0.5, "acme/threshold": 0.9} {
+		p.decisionPlugins[id] = decisionPlugin{nil}
+		p.addDecisionInstance(id, &thresholdDecision{threshold: threshold})
+	}
+
+	status := make(chan ModelStatus)
+	for txID, expected := range map[string]float64{"tx3": 0.8, "acme/tx3": 0.4, "other/tx3": 0.8} {
+		p.InitTransaction(txID)
+		defer p.CloseTransaction(txID)
+		go p.Process("fast", txID, "12345678", cf.AllRequest, status)
+		s := <-status
+		if s.Err != nil || s.ProbAttack != expected {
+			t.Errorf("%s: got %+v, expected %v", txID, s, expected)
+		}
+		if res, ok := p.Results(txID)["fast"]; !ok || res.ProbAttack != expected {
+			t.Errorf("%s: result not stored with the model ID: %v", txID, p.Results(txID))
+		}
+		// 0.8 is blocked by the threshold of the plugin, but not by the
+		// one of acme
+		block, err := p.CheckResult(txID, "threshold", Inbound, nil)
+		if err != nil || block != (txID != "acme/tx3") {
+			t.Errorf("%s: got block %t (%v)", txID, block, err)
+		}
+	}
+
+	input := FeedbackInput{TransactionID: "acme/tx3", Label: "benign"}
+	if err := p.Feedback("fast", input); err != nil || len(acme.feedback) != 1 {
+		t.Errorf("feedback not sent to the tenant instance: %v", err)
+	}
+}
+
+// learningModel is a model plugin instance implementing the Feedback
+// hook
+type learningModel struct {
+	scaledModel
+	feedback []FeedbackInput
+}
+
+func (m *learningModel) Feedback(input FeedbackInput) error {
+	m.feedback = append(m.feedback, input)
+	return nil
+}
+
+func TestFeedback(t *testing.T) {
+	p := newTestManager(nil, map[string]ModelOptions{
+		"learning": {Feedback: true},
+		"fast":     {Feedback: true},
+	})
+	learning := &learningModel{scaledModel: scaledModel{scale: 1}}
+	p.addModelInstance("learning", learning, false)
+	p.addModelInstance("fast", &scaledModel{scale: 1}, false)
+	p.addModelInstance("disabled", &learningModel{}, false)
+
+	for modelID, expected := range map[string]bool{"learning": true, "fast": false, "disabled": false, "missing": false} {
+		if accepts := p.AcceptsFeedback(modelID); accepts != expected {
+			t.Errorf("%s accepts feedback %t, expected %t", modelID, accepts, expected)
+		}
+	}
+
+	input := FeedbackInput{TransactionID: "tx", Label: "benign", Payload: "12345678", ProbAttack: 0.8}
+	if err := p.Feedback("learning", input); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(learning.feedback) != 1 || learning.feedback[0] != input {
+		t.Errorf("got feedback %+v, expected %+v", learning.feedback, input)
+	}
+	if err := p.Feedback("fast", input); err == nil {
+		t.Errorf("feedback sent to a model without the Feedback hook")
+	}
+}
+
+// TestMain serves the grpc test plugin when the test binary is
+// launched as a plugin by TestGRPCRestart.
+func TestMain(m *testing.M) {
+	if os.Getenv(AddressEnv) != "" {
+		if err := ServeModel("", newGRPCTestModel); err != nil {
+			os.Exit(2)
+		}
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// grpcTestModel is the model served by the grpc test plugin. It exits
+// on the "crash" payload, and sleeps on the "sleep" one.
+type grpcTestModel struct {
+	scaledModel
+}
+
+func newGRPCTestModel(params map[string]string) (ModelPlugin, error) {
+	scale, err := strconv.ParseFloat(params["scale"], 64)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcTestModel{scaledModel{scale: scale}}, nil
+}
+
+func (m *grpcTestModel) Feedback(input FeedbackInput) error {
+	if input.Label != "attack" && input.Label != "benign" {
+		return fmt.Errorf("invalid label")
+	}
+	return nil
+}
+
+func (m *grpcTestModel) Process(input ModelInput) (ModelResults, error) {
+	switch input.Payload {
+	case "crash":
+		os.Exit(1)
+	case "sleep":
+		time.Sleep(time.Second)
+	case "error":
+		return ModelResults{}, fmt.Errorf("invalid payload")
+	}
+	res, err := m.scaledModel.Process(input)
+	res.Data = map[string]interface{}{"payload": input.Payload, "truncated": input.Truncated}
+	return res, err
+}
+
+func TestGRPCModel(t *testing.T) {
+	address := "unix://" + filepath.Join(t.TempDir(), "model.sock")
+	go ServeModel(address, newGRPCTestModel)
+
+	opts := GRPCOptions{Address: address, Timeout: 200 * time.Millisecond, StartTimeout: 5 * time.Second}
+	m, err := newGRPCModel("grpc", "", cf.AllRequest.String(), map[string]string{"scale": "0.5"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	res, err := m.Process(ModelInput{TransactionId: "tx", Payload: "12345678"})
+	if err != nil || res.ProbAttack != 0.4 || res.Data["payload"] != "12345678" || res.Data["truncated"] != false {
+		t.Errorf("got %+v (%v), expected 0.4 with the payload in the data", res, err)
+	}
+	if res, err := m.Process(ModelInput{Payload: "1234", Truncated: true}); err != nil || res.Data["truncated"] != true {
+		t.Errorf("truncated payload not flagged to the plugin: %+v (%v)", res, err)
+	}
+	// Binary payloads, not valid UTF-8, reach the plugin unchanged
+	binary := "\x1f\x8b\x08\xff"
+	if res, err := m.Process(ModelInput{TransactionId: "tx", Payload: binary}); err != nil || res.ProbAttack != 0.2 {
+		t.Errorf("binary payload got %+v (%v), expected 0.2", res, err)
+	}
+	if _, err := m.Process(ModelInput{Payload: "error"}); status.Code(err) != codes.Internal {
+		t.Errorf("got error %v, expected an internal error", err)
+	}
+	if _, err := m.Process(ModelInput{Payload: "sleep"}); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("got error %v, expected the call to time out", err)
+	}
+
+	if err := m.Feedback(FeedbackInput{TransactionID: "tx", Label: "attack", Payload: binary}); err != nil {
+		t.Errorf("unexpected feedback error %v", err)
+	}
+	if err := m.Feedback(FeedbackInput{TransactionID: "tx", Label: "x"}); status.Code(err) != codes.Internal {
+		t.Errorf("got feedback error %v, expected an internal error", err)
+	}
+
+	// Plugins not learning leave Feedback unimplemented
+	scaledAddress := "unix://" + filepath.Join(t.TempDir(), "scaled.sock")
+	go ServeModel(scaledAddress, func(map[string]string) (ModelPlugin, error) { return &scaledModel{scale: 1}, nil })
+	scaled, err := newGRPCModel("scaled", "", cf.AllRequest.String(), nil, GRPCOptions{Address: scaledAddress, Timeout: 200 * time.Millisecond, StartTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer scaled.Close()
+	if err := scaled.Feedback(FeedbackInput{TransactionID: "tx", Label: "attack"}); err == nil {
+		t.Errorf("feedback accepted by a plugin without the Feedback hook")
+	}
+
+	opts.StartTimeout = 100 * time.Millisecond
+	invalid, err := newGRPCModel("invalid", "", cf.AllRequest.String(), map[string]string{"scale": "x"}, opts)
+	if err != nil {
+		t.Fatalf("running plugin not initialized should not fail: %v", err)
+	}
+	defer invalid.Close()
+	if _, err := invalid.Process(ModelInput{Payload: "12345"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got error %v, expected the plugin not to be initialized", err)
+	}
+}
+
+func TestGRPCRestart(t *testing.T) {
+	opts := GRPCOptions{Args: []string{"-test.run=^$"}, HealthInterval: 50 * time.Millisecond, StartTimeout: 5 * time.Second}
+	m, err := newGRPCModel("restart", os.Args[0], cf.AllRequest.String(), map[string]string{"scale": "1"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if res, err := m.Process(ModelInput{Payload: "12345"}); err != nil || res.ProbAttack != 0.5 {
+		t.Fatalf("got %+v (%v), expected 0.5", res, err)
+	}
+	if _, err := m.Process(ModelInput{Payload: "crash"}); err == nil {
+		t.Errorf("crashed plugin answered")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, err := m.Process(ModelInput{Payload: "12345"})
+		if err == nil && res.ProbAttack == 0.5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("plugin not restarted: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, err := newGRPCModel("missing", filepath.Join(t.TempDir(), "missing"), cf.AllRequest.String(), nil, opts); err == nil {
+		t.Errorf("missing plugin executable accepted")
+	}
+}
+
+func TestClose(t *testing.T) {
+	opts := GRPCOptions{Args: []string{"-test.run=^$"}, StartTimeout: 5 * time.Second}
+	m, err := newGRPCModel("close", os.Args[0], cf.AllRequest.String(), map[string]string{"scale": "1"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.mutex.RLock()
+	exited := m.exited
+	dir := m.dir
+	m.mutex.RUnlock()
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("got socket directory %v (%v), expected a private directory", info, err)
+	}
+
+	p := newTestManager(nil, nil)
+	p.closers = append(p.closers, m.Close)
+	p.Close()
+	select {
+	case <-exited:
+	default:
+		t.Errorf("plugin still running after closing the plugin manager")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("socket directory not removed after closing the plugin: %v", err)
+	}
+}
+
+// uleb128 encodes the unsigned integer for the wasm binary format
+func uleb128(v uint32) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+// wasmVector encodes the items as a wasm vector
+func wasmVector(items ...[]byte) []byte {
+	out := uleb128(uint32(len(items)))
+	for _, item := range items {
+		out = append(out, item...)
+	}
+	return out
+}
+
+// wasmSized prefixes the content with its size
+func wasmSized(id []byte, content []byte) []byte {
+	return append(append(id, uleb128(uint32(len(content)))...), content...)
+}
+
+// wasmF64 encodes an f64.const instruction
+func wasmF64(v float64) []byte {
+	return binary.LittleEndian.AppendUint64([]byte{0x44}, math.Float64bits(v))
+}
+
+// testWasm returns a plugin module with the given initial memory, in
+// the wasm binary format. In the text format:
+//
+//	(module
+//	  (memory (export "memory") <pages>)
+//	  (func (export "wace_alloc") (param i32) (result i32)
+//	    i32.const 1024)
+//	  ;; fails with more than 64 bytes of params
+//	  (func (export "wace_init") (param i32 i32) (result i32)
+//	    local.get 1
+//	    i32.const 64
+//	    i32.gt_u)
+//	  ;; loops forever on empty payloads, fails on payloads starting
+//	  ;; with "e", and returns the length of the payload / 10 otherwise
+//	  (func (export "wace_process") (param i32 i32) (result f64)
+//	    local.get 1
+//	    i32.eqz
+//	    if
+//	      loop
+//	        br 0
+//	      end
+//	    end
+//	    local.get 0
+//	    i32.load8_u
+//	    i32.const 101
+//	    i32.eq
+//	    if
+//	      f64.const -1
+//	      return
+//	    end
+//	    local.get 1
+//	    f64.convert_i32_u
+//	    f64.const 10
+//	    f64.div)
+//	  ;; blocks inputs longer than 300 bytes
+//	  (func (export "wace_check") (param i32 i32) (result i32)
+//	    local.get 1
+//	    i32.const 300
+//	    i32.gt_u))
+func testWasm(pages uint32) []byte {
+	const i32, f64 = 0x7f, 0x7c
+	types := wasmVector(
+		[]byte{0x60, 1, i32, 1, i32},
+		[]byte{0x60, 2, i32, i32, 1, i32},
+		[]byte{0x60, 2, i32, i32, 1, f64},
+	)
+	functions := wasmVector([]byte{0}, []byte{1}, []byte{2}, []byte{1})
+	memory := wasmVector(append([]byte{0}, uleb128(pages)...))
+	export := func(name string, kind, index byte) []byte {
+		return append(wasmSized(nil, []byte(name)), kind, index)
+	}
+	exports := wasmVector(
+		export("memory", 2, 0),
+		export("wace_alloc", 0, 0),
+		export("wace_init", 0, 1),
+		export("wace_process", 0, 2),
+		export("wace_check", 0, 3),
+	)
+	body := func(code ...[]byte) []byte {
+		content := []byte{0}
+		for _, c := range code {
+			content = append(content, c...)
+		}
+		return wasmSized(nil, append(content, 0x0b))
+	}
+	codes := wasmVector(
+		body([]byte{0x41, 0x80, 0x08}),
+		body([]byte{0x20, 1, 0x41, 0xc0, 0x00, 0x4b}),
+		body(
+			[]byte{0x20, 1, 0x45, 0x04, 0x40, 0x03, 0x40, 0x0c, 0, 0x0b, 0x0b},
+			[]byte{0x20, 0, 0x2d, 0, 0, 0x41, 0xe5, 0x00, 0x46, 0x04, 0x40},
+			wasmF64(-1),
+			[]byte{0x0f, 0x0b, 0x20, 1, 0xb8},
+			wasmF64(10),
+			[]byte{0xa3},
+		),
+		body([]byte{0x20, 1, 0x41, 0xac, 0x02, 0x4b}),
+	)
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 1, 0, 0, 0}
+	for _, section := range []struct {
+		id      byte
+		content []byte
+	}{{1, types}, {3, functions}, {5, memory}, {7, exports}, {10, codes}} {
+		module = append(module, wasmSized([]byte{section.id}, section.content)...)
+	}
+	return module
+}
+
+func TestWasmModel(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model.wasm")
+	if err := os.WriteFile(path, testWasm(1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := newWasmModel(path, map[string]string{WasmTimeoutParam: "50ms", WasmInstancesParam: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res, err := m.Process(ModelInput{Payload: "12345"}); err != nil || res.ProbAttack != 0.5 {
+				t.Errorf("got %+v (%v), expected 0.5", res, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := m.Process(ModelInput{Payload: "error"}); err == nil {
+		t.Errorf("negative result accepted")
+	}
+	if _, err := m.Process(ModelInput{Payload: "12345678901"}); err == nil {
+		t.Errorf("result over 1 accepted")
+	}
+	if _, err := m.Process(ModelInput{Payload: ""}); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("got error %v, expected the call to time out", err)
+	}
+	if res, err := m.Process(ModelInput{Payload: "1"}); err != nil || res.ProbAttack != 0.1 {
+		t.Errorf("got %+v (%v) after a timeout, expected 0.1", res, err)
+	}
+
+	// The calls wait for a free instance once all are in use
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	busy, err := m.instance(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.instance(ctx); err == nil || !strings.Contains(err.Error(), "no instance available") {
+		t.Errorf("got error %v, expected no instance to be available", err)
+	}
+	m.release(busy, true)
+	if res, err := m.Process(ModelInput{Payload: "1"}); err != nil || res.ProbAttack != 0.1 {
+		t.Errorf("got %+v (%v) after releasing the instance, expected 0.1", res, err)
+	}
+
+	invalid := []map[string]string{
+		{"param": strings.Repeat("x", 64)},
+		{WasmTimeoutParam: "0s"},
+		{WasmMemoryLimitParam: "x"},
+		{WasmInstancesParam: "0"},
+	}
+	for _, params := range invalid {
+		if m, err := newWasmModel(path, params); err == nil {
+			m.Close()
+			t.Errorf("plugin with params %v loaded", params)
+		}
+	}
+
+	// The module needs 32 pages (2 MiB) of memory
+	large := filepath.Join(t.TempDir(), "large.wasm")
+	if err := os.WriteFile(large, testWasm(32), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := newWasmModel(large, map[string]string{WasmMemoryLimitParam: "1"}); err == nil {
+		m.Close()
+		t.Errorf("module over the memory limit loaded")
+	}
+	if m, err := newWasmModel(large, map[string]string{WasmMemoryLimitParam: "2"}); err != nil {
+		t.Errorf("module within the memory limit not loaded: %v", err)
+	} else {
+		m.Close()
+	}
+}
+
+func TestWasmDecision(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "decision.wasm")
+	if err := os.WriteFile(path, testWasm(1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newWasmDecision(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	input := TransactionInput{DecisionInput: DecisionInput{TransactionId: "tx"}, Direction: Inbound}
+	if block, err := d.CheckTransaction(input); err != nil || block {
+		t.Errorf("got %t (%v), expected to allow", block, err)
+	}
+	input.Request.Header = map[string][]string{"User-Agent": {strings.Repeat("x", 300)}}
+	if block, err := d.CheckTransaction(input); err != nil || !block {
+		t.Errorf("got %t (%v), expected to block", block, err)
+	}
+	if _, err := newWasmModule(path, nil, "wace_missing"); err == nil {
+		t.Errorf("module without the plugin function loaded")
+	}
+}
@@ -0,0 +1,9 @@
+package pluginmanager
+
+import "syscall"
+
+// pluginProcAttr returns the attributes of the launched gRPC plugins,
+// which are killed when WACE exits, even if it does not stop them.
+func pluginProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package pluginmanager
+
+import "syscall"
+
+// pluginProcAttr returns the attributes of the launched gRPC plugins.
+// Outside Linux, they are only killed when WACE stops them.
+func pluginProcAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -0,0 +1,377 @@
+package pluginmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+/*
+WebAssembly plugins are loaded from the plugin paths ending in
+WasmSuffix, and run sandboxed in an embedded runtime, without access to
+the file system or the network. The modules export (the integers are
+i32):
+
+  - memory: the memory of the module.
+  - wace_alloc(size) -> ptr: allocates size bytes in the memory, where
+    WACE writes the input of the calls.
+  - wace_free(ptr, size) (optional): frees the input of a call, after
+    the call.
+  - wace_init(ptr, size) -> code (optional): initializes the module
+    with the params of the plugin, as a JSON object of strings. A code
+    other than 0 is an error.
+  - wace_process(ptr, size) -> f64 (model plugins): analyzes the
+    payload, returning the probability of attack (between 0 and 1), or
+    a negative value on errors.
+  - wace_check(ptr, size) -> code (decision plugins): decides with the
+    JSON of a wasmDecisionInput, returning 1 to block, 0 to allow, or a
+    negative value on errors.
+
+The modules can import WASI (wasi_snapshot_preview1), but the WASI
+commands are not run: the modules should be WASI reactors, which are
+initialized with their _initialize function.
+*/
+
+// WasmSuffix is the suffix of the paths of the WebAssembly plugins.
+const WasmSuffix = ".wasm"
+
+// Params of the WebAssembly plugins handled by WACE
+const (
+	// WasmMemoryLimitParam is the memory limit of each instance of
+	// the module, in MiB
+	WasmMemoryLimitParam = "wasm_memory_limit"
+	// WasmTimeoutParam is the maximum execution time of each call
+	WasmTimeoutParam = "wasm_timeout"
+	// WasmInstancesParam is the maximum number of instances of the
+	// module, which are kept for the next calls. Each call uses an
+	// instance, so concurrent calls create more instances up to the
+	// maximum, and then wait for a free one within the timeout.
+	WasmInstancesParam = "wasm_instances"
+)
+
+// Defaults of the WebAssembly plugin params
+const (
+	DefaultWasmMemoryLimit = 64
+	DefaultWasmTimeout     = 100 * time.Millisecond
+	DefaultWasmInstances   = 4
+	// wasmPagesPerMiB is the number of 64 KiB memory pages in a MiB
+	wasmPagesPerMiB = 16
+)
+
+// wasmOptions are the limits of a WebAssembly plugin
+type wasmOptions struct {
+	memoryLimitPages uint32
+	timeout          time.Duration
+	instances        int
+}
+
+// parseWasmOptions parses the WebAssembly params, with the defaults
+// of the missing ones.
+func parseWasmOptions(params map[string]string) (wasmOptions, error) {
+	opts := wasmOptions{
+		memoryLimitPages: DefaultWasmMemoryLimit * wasmPagesPerMiB,
+		timeout:          DefaultWasmTimeout,
+		instances:        DefaultWasmInstances,
+	}
+	if value, ok := params[WasmMemoryLimitParam]; ok {
+		limit, err := strconv.ParseUint(value, 10, 32)
+		// wasm32 memories have at most 4 GiB
+		if err != nil || limit == 0 || limit > 4096 {
+			return opts, fmt.Errorf("invalid %s %s", WasmMemoryLimitParam, value)
+		}
+		opts.memoryLimitPages = uint32(limit) * wasmPagesPerMiB
+	}
+	if value, ok := params[WasmTimeoutParam]; ok {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return opts, fmt.Errorf("invalid %s %s", WasmTimeoutParam, value)
+		}
+		opts.timeout = timeout
+	}
+	if value, ok := params[WasmInstancesParam]; ok {
+		instances, err := strconv.Atoi(value)
+		if err != nil || instances < 1 {
+			return opts, fmt.Errorf("invalid %s %s", WasmInstancesParam, value)
+		}
+		opts.instances = instances
+	}
+	return opts, nil
+}
+
+// wasmModule is a compiled WebAssembly plugin, with the instances
+// available for the next calls. The instances are not safe for
+// concurrent use, so each call takes one.
+type wasmModule struct {
+	runtime   wazero.Runtime
+	compiled  wazero.CompiledModule
+	params    []byte
+	opts      wasmOptions
+	instances chan api.Module
+	// slots bounds the live instances, so the memory of the plugin is
+	// at most its memory limit times its instances
+	slots chan struct{}
+}
+
+// newWasmModule compiles the WebAssembly plugin, verifying that it
+// exports the function of its kind, and initializes a first instance.
+func newWasmModule(path string, params map[string]string, function string) (*wasmModule, error) {
+	opts, err := parseWasmOptions(params)
+	if err != nil {
+		return nil, err
+	}
+	code, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	jsonParams, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	config := wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(opts.memoryLimitPages).
+		WithCloseOnContextDone(true)
+	w := &wasmModule{
+		runtime:   wazero.NewRuntimeWithConfig(ctx, config),
+		params:    jsonParams,
+		opts:      opts,
+		instances: make(chan api.Module, opts.instances),
+		slots:     make(chan struct{}, opts.instances),
+	}
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, w.runtime); err != nil {
+		w.Close()
+		return nil, err
+	}
+	w.compiled, err = w.runtime.CompileModule(ctx, code)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	exports := w.compiled.ExportedFunctions()
+	for _, name := range []string{"wace_alloc", function} {
+		if _, ok := exports[name]; !ok {
+			w.Close()
+			return nil, fmt.Errorf("module does not export %s", name)
+		}
+	}
+	if _, ok := w.compiled.ExportedMemories()["memory"]; !ok {
+		w.Close()
+		return nil, fmt.Errorf("module does not export its memory")
+	}
+
+	// Verify that the module can be instantiated with its params
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+	instance, err := w.instance(ctx)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	w.release(instance, true)
+	return w, nil
+}
+
+// instance returns an available instance, or a new one initialized
+// with the params of the plugin. If the plugin has its maximum of live
+// instances, it waits for one to be released until the context is
+// done. The instance must be released after using it.
+func (w *wasmModule) instance(ctx context.Context) (api.Module, error) {
+	select {
+	case w.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no instance available: %v", ctx.Err())
+	}
+	select {
+	case instance := <-w.instances:
+		return instance, nil
+	default:
+	}
+	// Anonymous modules, so the runtime can have several instances
+	config := wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize")
+	instance, err := w.runtime.InstantiateModule(ctx, w.compiled, config)
+	if err != nil {
+		<-w.slots
+		return nil, fmt.Errorf("cannot instantiate module: %v", err)
+	}
+	if instance.ExportedFunction("wace_init") != nil {
+		res, err := w.call(ctx, instance, "wace_init", w.params)
+		if err == nil && int32(res) != 0 {
+			err = fmt.Errorf("error code %d", int32(res))
+		}
+		if err != nil {
+			instance.Close(ctx)
+			<-w.slots
+			return nil, fmt.Errorf("cannot initialize module: %v", err)
+		}
+	}
+	return instance, nil
+}
+
+// release makes the instance available for the next calls, or closes
+// it if the call failed (its state may be inconsistent) or there are
+// enough available instances.
+func (w *wasmModule) release(instance api.Module, ok bool) {
+	defer func() { <-w.slots }()
+	if ok {
+		select {
+		case w.instances <- instance:
+			return
+		default:
+		}
+	}
+	instance.Close(context.Background())
+}
+
+// call writes the input in the memory of the instance, and calls the
+// function with it.
+func (w *wasmModule) call(ctx context.Context, instance api.Module, function string, input []byte) (uint64, error) {
+	res, err := instance.ExportedFunction("wace_alloc").Call(ctx, uint64(len(input)))
+	if err != nil {
+		return 0, err
+	}
+	ptr := uint32(res[0])
+	if !instance.Memory().Write(ptr, input) {
+		return 0, fmt.Errorf("input out of the module memory")
+	}
+	res, err = instance.ExportedFunction(function).Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return 0, err
+	}
+	if len(res) != 1 {
+		return 0, fmt.Errorf("%s must return one value", function)
+	}
+	if free := instance.ExportedFunction("wace_free"); free != nil {
+		if _, err := free.Call(ctx, uint64(ptr), uint64(len(input))); err != nil {
+			return 0, err
+		}
+	}
+	return res[0], nil
+}
+
+// run calls the function of an instance with the input, within the
+// timeout of the plugin.
+func (w *wasmModule) run(function string, input []byte) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.opts.timeout)
+	defer cancel()
+	instance, err := w.instance(ctx)
+	if err != nil {
+		return 0, err
+	}
+	res, err := w.call(ctx, instance, function, input)
+	w.release(instance, err == nil)
+	if err != nil && ctx.Err() != nil {
+		return 0, fmt.Errorf("plugin timed out after %v", w.opts.timeout)
+	}
+	return res, err
+}
+
+// Close releases the runtime of the plugin, with its instances.
+func (w *wasmModule) Close() {
+	w.runtime.Close(context.Background())
+}
+
+// wasmModel is a WebAssembly model plugin.
+type wasmModel struct {
+	*wasmModule
+}
+
+// newWasmModel loads the WebAssembly model plugin.
+func newWasmModel(path string, params map[string]string) (*wasmModel, error) {
+	w, err := newWasmModule(path, params, "wace_process")
+	if err != nil {
+		return nil, err
+	}
+	return &wasmModel{w}, nil
+}
+
+func (m *wasmModel) Process(input ModelInput) (ModelResults, error) {
+	res, err := m.run("wace_process", []byte(input.Payload))
+	if err != nil {
+		return ModelResults{}, err
+	}
+	probAttack := api.DecodeF64(res)
+	if math.IsNaN(probAttack) || probAttack < 0 || probAttack > 1 {
+		return ModelResults{}, fmt.Errorf("plugin returned %v", probAttack)
+	}
+	return ModelResults{ProbAttack: probAttack}, nil
+}
+
+// wasmDecisionInput is the input of the WebAssembly decision plugins,
+// in JSON.
+type wasmDecisionInput struct {
+	TransactionID string                  `json:"transaction_id"`
+	Direction     string                  `json:"direction"`
+	Results       map[string]ModelResults `json:"results"`
+	ModelWeight   map[string]float64      `json:"model_weight"`
+	WAFData       map[string]string       `json:"waf_data"`
+	ClientIP      string                  `json:"client_ip"`
+	Request       struct {
+		Method string      `json:"method"`
+		URI    string      `json:"uri"`
+		Header http.Header `json:"header"`
+	} `json:"request"`
+	Response struct {
+		Status int         `json:"status"`
+		Header http.Header `json:"header"`
+	} `json:"response"`
+}
+
+// wasmDecision is a WebAssembly decision plugin.
+type wasmDecision struct {
+	*wasmModule
+}
+
+// newWasmDecision loads the WebAssembly decision plugin.
+func newWasmDecision(path string, params map[string]string) (*wasmDecision, error) {
+	w, err := newWasmModule(path, params, "wace_check")
+	if err != nil {
+		return nil, err
+	}
+	return &wasmDecision{w}, nil
+}
+
+func (d *wasmDecision) CheckResults(input DecisionInput) (bool, error) {
+	return d.CheckTransaction(TransactionInput{DecisionInput: input, Direction: Inbound})
+}
+
+func (d *wasmDecision) CheckTransaction(input TransactionInput) (bool, error) {
+	in := wasmDecisionInput{
+		TransactionID: input.TransactionId,
+		Direction:     input.Direction,
+		Results:       input.Results,
+		ModelWeight:   input.ModelWeight,
+		WAFData:       input.WAFdata,
+		ClientIP:      input.ClientIP,
+	}
+	in.Request.Method = input.Request.Method
+	in.Request.URI = input.Request.URI
+	in.Request.Header = input.Request.Header
+	in.Response.Status = input.Response.Status
+	in.Response.Header = input.Response.Header
+	data, err := json.Marshal(in)
+	if err != nil {
+		return false, err
+	}
+	res, err := d.run("wace_check", data)
+	if err != nil {
+		return false, err
+	}
+	switch code := int32(res); code {
+	case 0:
+		return false, nil
+	case 1:
+		return true, nil
+	default:
+		return false, fmt.Errorf("plugin returned error code %d", code)
+	}
+}
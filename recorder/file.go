@@ -0,0 +1,130 @@
+package recorder
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// filePrefix is the prefix of the names of the recorded files, which
+// are followed by their creation time, so they sort by age
+const filePrefix = "wace-"
+
+// timeFormat is the format of the creation time in the file names
+const timeFormat = "20060102T150405.000000000"
+
+// rotatingFile writes to the files of a directory, starting a new file
+// when the current one reaches the maximum size, and removing the
+// oldest ones beyond the maximum number of files.
+type rotatingFile struct {
+	dir      string
+	ext      string
+	maxSize  int64
+	maxFiles int
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+// newRotatingFile creates the directory, if needed, and opens a new
+// file in it.
+func newRotatingFile(dir, ext string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f := &rotatingFile{dir: dir, ext: ext, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.rotate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write writes the data to the current file, rotating it first if the
+// data would exceed its maximum size. The data of a write is never
+// split between files.
+func (f *rotatingFile) Write(data []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return fmt.Errorf("recorder file closed")
+	}
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(data)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(data)
+	f.size += int64(n)
+	return err
+}
+
+// rotate closes the current file, opens a new one and removes the
+// oldest files.
+func (f *rotatingFile) rotate() error {
+	if f.file != nil {
+		if err := f.file.Close(); err != nil {
+			return err
+		}
+		f.file = nil
+	}
+	name := filepath.Join(f.dir, filePrefix+time.Now().UTC().Format(timeFormat)+f.ext)
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.size = 0
+	return f.removeOldest()
+}
+
+// files returns the recorded files of the directory, oldest first.
+func (f *rotatingFile) files() ([]string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, filePrefix) && strings.HasSuffix(name, f.ext) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// removeOldest removes the oldest files beyond the maximum number of
+// files.
+func (f *rotatingFile) removeOldest() error {
+	if f.maxFiles <= 0 {
+		return nil
+	}
+	names, err := f.files()
+	if err != nil {
+		return err
+	}
+	for len(names) > f.maxFiles {
+		if err := os.Remove(filepath.Join(f.dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Close closes the current file.
+func (f *rotatingFile) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,261 @@
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	pb "wace/recordproto"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+)
+
+// maxLineSize is the maximum size of a JSONL record read
+const maxLineSize = 64 << 20
+
+// jsonPhase is the JSON form of a Phase: the payload is a string if it
+// is valid UTF-8, and base64 encoded otherwise.
+type jsonPhase struct {
+	Phase       string `json:"phase"`
+	Payload     string `json:"payload"`
+	Base64      bool   `json:"base64,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Charset     string `json:"charset,omitempty"`
+}
+
+// MarshalJSON encodes the phase, with its payload as a string.
+func (p Phase) MarshalJSON() ([]byte, error) {
+	jp := jsonPhase{Phase: p.Phase, ContentType: p.ContentType, Charset: p.Charset}
+	if utf8.Valid(p.Payload) {
+		jp.Payload = string(p.Payload)
+	} else {
+		jp.Payload = base64.StdEncoding.EncodeToString(p.Payload)
+		jp.Base64 = true
+	}
+	return json.Marshal(jp)
+}
+
+// UnmarshalJSON decodes the phase.
+func (p *Phase) UnmarshalJSON(data []byte) error {
+	var jp jsonPhase
+	if err := json.Unmarshal(data, &jp); err != nil {
+		return err
+	}
+	*p = Phase{Phase: jp.Phase, Payload: []byte(jp.Payload), ContentType: jp.ContentType, Charset: jp.Charset}
+	if jp.Base64 {
+		payload, err := base64.StdEncoding.DecodeString(jp.Payload)
+		if err != nil {
+			return fmt.Errorf("invalid base64 payload of phase %s: %v", jp.Phase, err)
+		}
+		p.Payload = payload
+	}
+	return nil
+}
+
+// extension returns the file extension of the format.
+func extension(format string) string {
+	if format == Protobuf {
+		return ".pb"
+	}
+	return ".jsonl"
+}
+
+// encode returns the record encoded in the format.
+func encode(format string, rec Record) ([]byte, error) {
+	if format == Protobuf {
+		msg, err := toProto(rec)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if _, err := protodelim.MarshalTo(&buf, msg); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// toProto converts the record to its protobuf message.
+func toProto(rec Record) (*pb.TransactionRecord, error) {
+	msg := &pb.TransactionRecord{
+		TransactionId:   rec.TransactionID,
+		Time:            rec.Time.UnixNano(),
+		ClientIp:        rec.ClientIP,
+		Variant:         rec.Variant,
+		RequestLine:     rec.RequestLine,
+		RequestHeaders:  toProtoHeader(rec.RequestHeader),
+		StatusLine:      rec.StatusLine,
+		ResponseHeaders: toProtoHeader(rec.ResponseHeader),
+		Models:          make(map[string]*pb.Model),
+		Verdicts:        make(map[string]*pb.Verdict),
+		Label:           rec.Label,
+	}
+	for _, p := range rec.Phases {
+		msg.Phases = append(msg.Phases, &pb.Phase{Phase: p.Phase, Payload: p.Payload, ContentType: p.ContentType, Charset: p.Charset})
+	}
+	for modelID, m := range rec.Models {
+		model := &pb.Model{
+			Phase:      m.Phase,
+			Status:     m.Status,
+			LatencyNs:  m.Latency.Nanoseconds(),
+			ProbAttack: m.ProbAttack,
+			Error:      m.Err,
+			Shadow:     m.Shadow,
+		}
+		if m.Data != nil {
+			data, err := json.Marshal(m.Data)
+			if err != nil {
+				return nil, fmt.Errorf("model %s data: %v", modelID, err)
+			}
+			model.DataJson = string(data)
+		}
+		msg.Models[modelID] = model
+	}
+	for direction, v := range rec.Verdicts {
+		msg.Verdicts[direction] = &pb.Verdict{Decision: v.Decision, Block: v.Block, WafParams: v.WAFParams}
+	}
+	return msg, nil
+}
+
+// toProtoHeader converts the header, sorted by name.
+func toProtoHeader(header http.Header) []*pb.Header {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var headers []*pb.Header
+	for _, name := range names {
+		for _, value := range header[name] {
+			headers = append(headers, &pb.Header{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+// fromProto converts the protobuf message to a record.
+func fromProto(msg *pb.TransactionRecord) (Record, error) {
+	rec := Record{
+		TransactionID:  msg.TransactionId,
+		Time:           time.Unix(0, msg.Time),
+		ClientIP:       msg.ClientIp,
+		Variant:        msg.Variant,
+		RequestLine:    msg.RequestLine,
+		RequestHeader:  fromProtoHeader(msg.RequestHeaders),
+		StatusLine:     msg.StatusLine,
+		ResponseHeader: fromProtoHeader(msg.ResponseHeaders),
+		Models:         make(map[string]Model),
+		Verdicts:       make(map[string]Verdict),
+		Label:          msg.Label,
+	}
+	for _, p := range msg.Phases {
+		rec.Phases = append(rec.Phases, Phase{Phase: p.Phase, Payload: p.Payload, ContentType: p.ContentType, Charset: p.Charset})
+	}
+	for modelID, m := range msg.Models {
+		model := Model{
+			Phase:      m.Phase,
+			Status:     m.Status,
+			Latency:    time.Duration(m.LatencyNs),
+			ProbAttack: m.ProbAttack,
+			Err:        m.Error,
+			Shadow:     m.Shadow,
+		}
+		if m.DataJson != "" {
+			if err := json.Unmarshal([]byte(m.DataJson), &model.Data); err != nil {
+				return rec, fmt.Errorf("model %s data: %v", modelID, err)
+			}
+		}
+		rec.Models[modelID] = model
+	}
+	for direction, v := range msg.Verdicts {
+		rec.Verdicts[direction] = Verdict{Decision: v.Decision, Block: v.Block, WAFParams: v.WafParams}
+	}
+	return rec, nil
+}
+
+// fromProtoHeader converts the protobuf headers.
+func fromProtoHeader(headers []*pb.Header) http.Header {
+	if len(headers) == 0 {
+		return nil
+	}
+	header := make(http.Header)
+	for _, h := range headers {
+		header[h.Name] = append(header[h.Name], h.Value)
+	}
+	return header
+}
+
+// Read calls fn with each record read from r, in the format, until the
+// end of r or an error of fn.
+func Read(r io.Reader, format string, fn func(Record) error) error {
+	if format == Protobuf {
+		br := bufio.NewReader(r)
+		for {
+			msg := new(pb.TransactionRecord)
+			err := protodelim.UnmarshalFrom(br, msg)
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			rec, err := fromProto(msg)
+			if err != nil {
+				return err
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// ReadFile calls fn with each record of the file, in the protobuf
+// format if its extension is ".pb", and JSONL otherwise.
+func ReadFile(path string, fn func(Record) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	format := JSONL
+	if strings.HasSuffix(path, extension(Protobuf)) {
+		format = Protobuf
+	}
+	if err := Read(f, format, fn); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LabelsFile is the name of the file of the labels, in the directory of
+// the recorded files
+const LabelsFile = "labels.jsonl"
+
+// Label is a label given to a transaction after it was closed (eg: by
+// an analyst reporting a false positive).
+type Label struct {
+	TransactionID string    `json:"transaction_id"`
+	Time          time.Time `json:"time"`
+	// Label is Attack or Benign
+	Label   string `json:"label"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// Check verifies the label.
+func (l Label) Check() error {
+	switch l.Label {
+	case Attack, Benign:
+		return nil
+	}
+	return fmt.Errorf("invalid label %q, expected %s or %s", l.Label, Attack, Benign)
+}
+
+// RecordLabel appends the label to the labels file of the directory of
+// the recorded files. The labels are written right away, without
+// sampling, as the transaction may have been recorded.
+func (r *Recorder) RecordLabel(l Label) error {
+	if err := l.Check(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	r.labelsMutex.Lock()
+	defer r.labelsMutex.Unlock()
+	f, err := os.OpenFile(filepath.Join(r.conf.Dir, LabelsFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadLabels returns the labels of the labels file of the directory,
+// keyed by transaction ID. The last label of a transaction replaces the
+// previous ones. A directory without labels file has no labels.
+func ReadLabels(dir string) (map[string]Label, error) {
+	labels := make(map[string]Label)
+	path := filepath.Join(dir, LabelsFile)
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return labels, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var l Label
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, line, err)
+		}
+		if err := l.Check(); err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, line, err)
+		}
+		labels[l.TransactionID] = l
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return labels, nil
+}
@@ -0,0 +1,460 @@
+/*
+Package recorder records the transactions analyzed by WACE to disk:
+their payloads, model results, WAF params and verdicts, so they can
+be replayed offline, used to build training datasets, or used to
+reproduce false positives.
+
+The records are written to rotating files in JSONL or protobuf format
+(see record.proto), sampled by verdict, and with the sensitive
+headers and the fragments matching the redaction patterns (in the
+request and status lines, headers, payloads and model results)
+replaced by Redacted. The labels given to the transactions once
+closed are written to the LabelsFile of the same directory.
+*/
+package recorder
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"wace/transaction"
+
+	lpm "github.com/tilsor/ModSecIntl_wace_lib/pluginmanager"
+
+	lg "github.com/tilsor/ModSecIntl_logging/logging"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// Formats of the recorded files.
+const (
+	// JSONL writes a JSON object per line
+	JSONL = "jsonl"
+	// Protobuf writes size-delimited TransactionRecord messages
+	Protobuf = "protobuf"
+)
+
+// Redacted replaces the redacted values.
+const Redacted = "[REDACTED]"
+
+// Labels of the transactions of a dataset.
+const (
+	// Attack is a transaction that must be blocked
+	Attack = "attack"
+	// Benign is a transaction that must be allowed
+	Benign = "benign"
+)
+
+// queueLength is the number of records waiting to be written. Records
+// are dropped when the queue is full, so the recording never slows the
+// analysis down.
+const queueLength = 1024
+
+// phases is the order of the phases in the records
+var phases = []string{"RequestHeaders", "RequestBody", "AllRequest", "ResponseHeaders", "ResponseBody", "AllResponse"}
+
+// Record is a recorded transaction.
+type Record struct {
+	TransactionID string    `json:"transaction_id"`
+	Time          time.Time `json:"time"`
+	ClientIP      string    `json:"client_ip,omitempty"`
+	// Variant is the canary variant of the transaction
+	Variant        string      `json:"variant,omitempty"`
+	RequestLine    string      `json:"request_line,omitempty"`
+	RequestHeader  http.Header `json:"request_header,omitempty"`
+	StatusLine     string      `json:"status_line,omitempty"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	// Phases are the payloads sent by the WAF, in the order of the
+	// phases
+	Phases []Phase `json:"phases,omitempty"`
+	// Models are the executions and results of the model plugins,
+	// keyed by model ID
+	Models map[string]Model `json:"models,omitempty"`
+	// Verdicts are keyed by direction (inbound or outbound)
+	Verdicts map[string]Verdict `json:"verdicts,omitempty"`
+	// Label is Attack or Benign for the records labelled to evaluate
+	// the models, and empty otherwise
+	Label string `json:"label,omitempty"`
+}
+
+// Phase is a payload sent by the WAF. In JSON, the payload is a string,
+// base64 encoded if it is not valid UTF-8.
+type Phase struct {
+	// Phase is the model plugin type (eg: RequestBody)
+	Phase       string
+	Payload     []byte
+	ContentType string
+	Charset     string
+}
+
+// Model is the execution and result of a model plugin.
+type Model struct {
+	Phase      string                 `json:"phase"`
+	Status     string                 `json:"status"`
+	Latency    time.Duration          `json:"latency_ns"`
+	ProbAttack float64                `json:"prob_attack"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+	Err        string                 `json:"error,omitempty"`
+	Shadow     bool                   `json:"shadow,omitempty"`
+}
+
+// Verdict is the verdict of a decision.
+type Verdict struct {
+	Decision  string            `json:"decision"`
+	Block     bool              `json:"block"`
+	WAFParams map[string]string `json:"waf_params,omitempty"`
+}
+
+// Blocked returns true if any verdict of the record blocks the
+// transaction.
+func (r Record) Blocked() bool {
+	for _, verdict := range r.Verdicts {
+		if verdict.Block {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckLabel verifies the label of the record.
+func (r Record) CheckLabel() error {
+	switch r.Label {
+	case "", Attack, Benign:
+		return nil
+	}
+	return fmt.Errorf("transaction %s: invalid label %s", r.TransactionID, r.Label)
+}
+
+// FromTransaction returns the record of the transaction, with the
+// results of its model plugins.
+func FromTransaction(tx *transaction.Transaction, results map[string]lpm.ModelResults, variant string) Record {
+	rec := Record{
+		TransactionID: tx.ID,
+		Time:          tx.Start(),
+		ClientIP:      tx.ClientIP(),
+		Variant:       variant,
+		Models:        make(map[string]Model),
+		Verdicts:      make(map[string]Verdict),
+	}
+	if req := tx.Request(); req.Method != "" {
+		rec.RequestLine = strings.TrimSpace(req.Method + " " + req.URI + " " + req.Protocol)
+		rec.RequestHeader = req.Header.Clone()
+	}
+	if resp := tx.Response(); resp.Status != 0 {
+		rec.StatusLine = strings.TrimSpace(resp.Protocol + " " + strconv.Itoa(resp.Status) + " " + http.StatusText(resp.Status))
+		rec.ResponseHeader = resp.Header.Clone()
+	}
+	payloads := tx.Payloads()
+	for _, phase := range phases {
+		if p, ok := payloads[phase]; ok {
+			rec.Phases = append(rec.Phases, Phase{
+				Phase:       phase,
+				Payload:     append([]byte{}, p.Data...),
+				ContentType: p.ContentType,
+				Charset:     p.Charset,
+			})
+		}
+	}
+	for modelID, execution := range tx.ModelExecutions() {
+		res := results[modelID]
+		rec.Models[modelID] = Model{
+			Phase:      execution.Phase,
+			Status:     execution.Status,
+			Latency:    execution.Latency,
+			ProbAttack: res.ProbAttack,
+			Data:       res.Data,
+			Err:        execution.Err,
+			Shadow:     execution.Shadow,
+		}
+	}
+	for direction, verdict := range tx.Verdicts() {
+		rec.Verdicts[direction] = Verdict(verdict)
+	}
+	return rec
+}
+
+// Config holds the configuration of the recorder.
+type Config struct {
+	// Dir is the directory of the recorded files
+	Dir string
+	// Format is JSONL (default) or Protobuf
+	Format string
+	// MaxSize is the size in bytes from which the file is rotated.
+	// Zero means no rotation.
+	MaxSize int64
+	// MaxFiles is the number of files kept, removing the oldest ones.
+	// Zero means all the files are kept.
+	MaxFiles int
+	// SampleRate is the probability of recording a transaction not
+	// blocked, from 0 to 1
+	SampleRate float64
+	// BlockSampleRate is the probability of recording a blocked
+	// transaction, from 0 to 1
+	BlockSampleRate float64
+	// RedactHeaders are the headers whose values are redacted, in the
+	// headers and in the payloads holding them
+	RedactHeaders []string
+	// RedactPatterns are regular expressions whose matches are redacted
+	// in the payloads and header values
+	RedactPatterns []string
+}
+
+// Check verifies the configuration.
+func (c Config) Check() error {
+	if c.Dir == "" {
+		return fmt.Errorf("recorder directory needed")
+	}
+	switch c.Format {
+	case "", JSONL, Protobuf:
+	default:
+		return fmt.Errorf("invalid recorder format %s", c.Format)
+	}
+	if c.MaxSize < 0 || c.MaxFiles < 0 {
+		return fmt.Errorf("recorder limits cannot be negative")
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 || c.BlockSampleRate < 0 || c.BlockSampleRate > 1 {
+		return fmt.Errorf("recorder sample rates must be between 0 and 1")
+	}
+	for _, pattern := range c.RedactPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid redaction pattern %s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Recorder writes the sampled records to the files, in the background.
+type Recorder struct {
+	conf     Config
+	headers  map[string]bool
+	patterns []*regexp.Regexp
+	out      *rotatingFile
+	records  chan Record
+	done     chan struct{}
+	recorded metric.Int64Counter
+	dropped  metric.Int64Counter
+	// closedMutex guards the queue against the records sent after
+	// closing the recorder
+	closedMutex sync.RWMutex
+	closed      bool
+	// labelsMutex serializes the writes of the labels file
+	labelsMutex sync.Mutex
+}
+
+// New creates a recorder writing to the directory of the configuration.
+func New(conf Config, meter metric.Meter) (*Recorder, error) {
+	if err := conf.Check(); err != nil {
+		return nil, err
+	}
+	if conf.Format == "" {
+		conf.Format = JSONL
+	}
+	r := &Recorder{
+		conf:    conf,
+		headers: make(map[string]bool),
+		records: make(chan Record, queueLength),
+		done:    make(chan struct{}),
+	}
+	for _, header := range conf.RedactHeaders {
+		r.headers[http.CanonicalHeaderKey(header)] = true
+	}
+	for _, pattern := range conf.RedactPatterns {
+		r.patterns = append(r.patterns, regexp.MustCompile(pattern))
+	}
+	var err error
+	r.out, err = newRotatingFile(conf.Dir, extension(conf.Format), conf.MaxSize, conf.MaxFiles)
+	if err != nil {
+		return nil, err
+	}
+	r.recorded, err = meter.Int64Counter("wace.recorder.recorded.total")
+	if err != nil {
+		return nil, err
+	}
+	r.dropped, err = meter.Int64Counter("wace.recorder.dropped.total")
+	if err != nil {
+		return nil, err
+	}
+	go r.write()
+	return r, nil
+}
+
+// sampled returns true if the record must be recorded, according to
+// its verdict.
+func (r *Recorder) sampled(rec Record) bool {
+	rate := r.conf.SampleRate
+	if rec.Blocked() {
+		rate = r.conf.BlockSampleRate
+	}
+	return rate >= 1 || rand.Float64() < rate
+}
+
+// Record queues the record for writing, if it is sampled. It is
+// redacted in the background, before writing it. The record is dropped
+// if the queue is full or the recorder is closed.
+func (r *Recorder) Record(rec Record) {
+	if !r.sampled(rec) {
+		return
+	}
+	r.closedMutex.RLock()
+	defer r.closedMutex.RUnlock()
+	if r.closed {
+		r.dropped.Add(context.Background(), 1)
+		return
+	}
+	select {
+	case r.records <- rec:
+	default:
+		r.dropped.Add(context.Background(), 1)
+	}
+}
+
+// write writes the queued records until the recorder is closed.
+func (r *Recorder) write() {
+	logger := lg.Get()
+	defer close(r.done)
+	for rec := range r.records {
+		r.Redact(&rec)
+		data, err := encode(r.conf.Format, rec)
+		if err == nil {
+			err = r.out.Write(data)
+		}
+		if err != nil {
+			// The transaction is closed, so it has no logging buffer
+			logger.Printf(lg.WARN, "| %s | recorder | cannot record transaction: %v", rec.TransactionID, err)
+			r.dropped.Add(context.Background(), 1)
+			continue
+		}
+		r.recorded.Add(context.Background(), 1)
+	}
+}
+
+// Close writes the queued records and closes the file. The records
+// sent after closing the recorder are dropped.
+func (r *Recorder) Close() error {
+	r.closedMutex.Lock()
+	if r.closed {
+		r.closedMutex.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.records)
+	r.closedMutex.Unlock()
+	<-r.done
+	return r.out.Close()
+}
+
+// Redact redacts the headers and patterns of the configuration in the
+// record: in the request and status lines, the headers, the payloads
+// and the data and errors of the models. The phases and models are
+// copied, so the ones of other copies of the record are not redacted.
+func (r *Recorder) Redact(rec *Record) {
+	rec.RequestLine = r.redactString(rec.RequestLine)
+	rec.StatusLine = r.redactString(rec.StatusLine)
+	rec.RequestHeader = r.redactHeader(rec.RequestHeader)
+	rec.ResponseHeader = r.redactHeader(rec.ResponseHeader)
+	rec.Phases = append([]Phase(nil), rec.Phases...)
+	for i := range rec.Phases {
+		payload := r.redactHeaderLines(rec.Phases[i].Payload)
+		for _, re := range r.patterns {
+			payload = re.ReplaceAllLiteral(payload, []byte(Redacted))
+		}
+		rec.Phases[i].Payload = payload
+	}
+	if rec.Models != nil {
+		models := make(map[string]Model, len(rec.Models))
+		for modelID, m := range rec.Models {
+			if m.Data != nil {
+				m.Data = r.redactValue(m.Data).(map[string]interface{})
+			}
+			m.Err = r.redactString(m.Err)
+			models[modelID] = m
+		}
+		rec.Models = models
+	}
+}
+
+// redactString returns the string with the matches of the patterns
+// redacted.
+func (r *Recorder) redactString(s string) string {
+	for _, re := range r.patterns {
+		s = re.ReplaceAllLiteralString(s, Redacted)
+	}
+	return s
+}
+
+// redactValue returns a copy of the JSON value with the matches of the
+// patterns redacted in its strings.
+func (r *Recorder) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return r.redactString(v)
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			redacted[key] = r.redactValue(item)
+		}
+		return redacted
+	case []interface{}:
+		redacted := make([]interface{}, len(v))
+		for i, item := range v {
+			redacted[i] = r.redactValue(item)
+		}
+		return redacted
+	default:
+		return value
+	}
+}
+
+// redactHeader returns the header with the values of the redacted
+// headers, and the matches of the patterns, redacted.
+func (r *Recorder) redactHeader(header http.Header) http.Header {
+	if header == nil {
+		return nil
+	}
+	redacted := make(http.Header, len(header))
+	for name, values := range header {
+		redactedValues := make([]string, len(values))
+		for i, value := range values {
+			if r.headers[http.CanonicalHeaderKey(name)] {
+				value = Redacted
+			}
+			redactedValues[i] = r.redactString(value)
+		}
+		redacted[name] = redactedValues
+	}
+	return redacted
+}
+
+// redactHeaderLines redacts the values of the redacted headers in the
+// "Name: value" lines of the head of the payload, if it has one: the
+// lines up to the first empty line. Payloads without a head are
+// returned unchanged.
+func (r *Recorder) redactHeaderLines(payload []byte) []byte {
+	if len(r.headers) == 0 {
+		return payload
+	}
+	lines := strings.SplitAfter(string(payload), "\n")
+	changed := false
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, "\r\n")
+		if trimmed == "" {
+			break
+		}
+		name, _, found := strings.Cut(trimmed, ":")
+		if !found || !r.headers[http.CanonicalHeaderKey(strings.TrimSpace(name))] {
+			continue
+		}
+		lines[i] = name + ": " + Redacted + line[len(trimmed):]
+		changed = true
+	}
+	if !changed {
+		return payload
+	}
+	return []byte(strings.Join(lines, ""))
+}
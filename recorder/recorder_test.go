@@ -0,0 +1,258 @@
+package recorder
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"wace/transaction"
+
+	lpm "github.com/tilsor/ModSecIntl_wace_lib/pluginmanager"
+
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// testRecord returns the record of a test transaction.
+func testRecord(t *testing.T, id string, block bool) Record {
+	tx := transaction.New(id)
+	defer transaction.Delete(id)
+	tx.SetClientIP("192.0.2.1")
+	tx.SetRequestHead("POST /login?next=%2F HTTP/1.1", http.Header{
+		"Cookie":       {"session=secret"},
+		"Content-Type": {"application/x-www-form-urlencoded"},
+	})
+	tx.SetPayload("RequestHeaders", transaction.Payload{Data: []byte("POST /login?next=%2F HTTP/1.1")})
+	tx.SetPayload("RequestBody", transaction.Payload{Data: []byte("user=admin&password=hunter2"), ContentType: "application/x-www-form-urlencoded"})
+	tx.SetPayload("ResponseBody", transaction.Payload{Data: []byte{0xff, 0xfe, 0x00}})
+	tx.SetModelExecution("trivial", transaction.ModelExecution{Phase: "RequestBody", Status: transaction.ModelDone, Latency: time.Millisecond})
+	tx.SetModelExecution("shadow", transaction.ModelExecution{Phase: "RequestBody", Status: transaction.ModelFailed, Err: "failed", Shadow: true})
+	tx.SetVerdict("inbound", transaction.Verdict{Decision: "simple", Block: block, WAFParams: map[string]string{"inbound_blocking": "5"}})
+
+	results := map[string]lpm.ModelResults{
+		"trivial": {ProbAttack: 0.75, Data: map[string]interface{}{"rule": "sqli"}},
+	}
+	return FromTransaction(tx, results, "control")
+}
+
+func TestFromTransaction(t *testing.T) {
+	rec := testRecord(t, "rec1", true)
+	if rec.TransactionID != "rec1" || rec.ClientIP != "192.0.2.1" || rec.Variant != "control" {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	if rec.RequestLine != "POST /login?next=%2F HTTP/1.1" || rec.RequestHeader.Get("Cookie") != "session=secret" {
+		t.Errorf("unexpected request head %q %v", rec.RequestLine, rec.RequestHeader)
+	}
+	var phases []string
+	for _, p := range rec.Phases {
+		phases = append(phases, p.Phase)
+	}
+	if strings.Join(phases, ",") != "RequestHeaders,RequestBody,ResponseBody" {
+		t.Errorf("unexpected phases %v", phases)
+	}
+	if m := rec.Models["trivial"]; m.ProbAttack != 0.75 || m.Data["rule"] != "sqli" || m.Latency != time.Millisecond {
+		t.Errorf("unexpected model %+v", m)
+	}
+	if m := rec.Models["shadow"]; !m.Shadow || m.Err != "failed" {
+		t.Errorf("unexpected shadow model %+v", m)
+	}
+	if !rec.Blocked() || rec.Verdicts["inbound"].WAFParams["inbound_blocking"] != "5" {
+		t.Errorf("unexpected verdicts %+v", rec.Verdicts)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	r := &Recorder{headers: map[string]bool{"Cookie": true}}
+	r.patterns = append(r.patterns, regexp.MustCompile(`password=[^&]*`))
+	rec := Record{
+		RequestLine:   "GET /login?password=hunter2&x=1 HTTP/1.1",
+		RequestHeader: http.Header{"Cookie": {"session=secret"}, "Accept": {"*/*"}},
+		Phases: []Phase{
+			{Phase: "AllRequest", Payload: []byte("GET / HTTP/1.1\r\ncookie: session=secret\r\nAccept: */*\r\n\r\nCookie: body")},
+			{Phase: "RequestBody", Payload: []byte("user=admin&password=hunter2&x=1")},
+		},
+		Models: map[string]Model{
+			"trivial": {Data: map[string]interface{}{"match": []interface{}{"password=hunter2", 1.0}}, Err: "invalid password=hunter2"},
+		},
+	}
+	original := rec
+	r.Redact(&rec)
+	if string(original.Phases[1].Payload) != "user=admin&password=hunter2&x=1" || original.Models["trivial"].Err != "invalid password=hunter2" {
+		t.Errorf("the original record was redacted")
+	}
+	if rec.RequestLine != "GET /login?"+Redacted+"&x=1 HTTP/1.1" {
+		t.Errorf("unexpected redacted request line %q", rec.RequestLine)
+	}
+	if rec.RequestHeader.Get("Cookie") != Redacted || rec.RequestHeader.Get("Accept") != "*/*" {
+		t.Errorf("unexpected redacted header %v", rec.RequestHeader)
+	}
+	expected := "GET / HTTP/1.1\r\ncookie: " + Redacted + "\r\nAccept: */*\r\n\r\nCookie: body"
+	if string(rec.Phases[0].Payload) != expected {
+		t.Errorf("unexpected redacted head %q", rec.Phases[0].Payload)
+	}
+	if string(rec.Phases[1].Payload) != "user=admin&"+Redacted+"&x=1" {
+		t.Errorf("unexpected redacted body %q", rec.Phases[1].Payload)
+	}
+	m := rec.Models["trivial"]
+	if match := m.Data["match"].([]interface{}); match[0] != Redacted || match[1] != 1.0 || m.Err != "invalid "+Redacted {
+		t.Errorf("unexpected redacted model %+v", m)
+	}
+}
+
+func TestRecordFormats(t *testing.T) {
+	for _, format := range []string{JSONL, Protobuf} {
+		dir := t.TempDir()
+		r, err := New(Config{Dir: dir, Format: format, SampleRate: 1, BlockSampleRate: 1, RedactHeaders: []string{"cookie"}}, noop.NewMeterProvider().Meter("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := testRecord(t, "rec2", false)
+		rec.Label = Attack
+		r.Record(rec)
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		files, _ := filepath.Glob(filepath.Join(dir, "*"+extension(format)))
+		if len(files) != 1 {
+			t.Fatalf("%s: expected 1 file, got %v", format, files)
+		}
+		var read []Record
+		err = ReadFile(files[0], func(rec Record) error {
+			read = append(read, rec)
+			return nil
+		})
+		if err != nil || len(read) != 1 {
+			t.Fatalf("%s: read %d records: %v", format, len(read), err)
+		}
+		got := read[0]
+		if !got.Time.Equal(rec.Time) {
+			t.Errorf("%s: time %v, expected %v", format, got.Time, rec.Time)
+		}
+		got.Time = rec.Time
+		rec.RequestHeader.Set("Cookie", Redacted)
+		if !reflect.DeepEqual(got, rec) {
+			t.Errorf("%s: read record\n%+v\nexpected\n%+v", format, got, rec)
+		}
+	}
+}
+
+func TestSampling(t *testing.T) {
+	dir := t.TempDir()
+	r, err := New(Config{Dir: dir, SampleRate: 0, BlockSampleRate: 1}, noop.NewMeterProvider().Meter("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Record(testRecord(t, "allowed", false))
+	r.Record(testRecord(t, "blocked", true))
+	r.Close()
+	// The records of the transactions closed after the recorder are
+	// dropped
+	r.Record(testRecord(t, "late", true))
+	if err := r.Close(); err != nil {
+		t.Errorf("closing twice: %v", err)
+	}
+
+	var ids []string
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	for _, file := range files {
+		ReadFile(file, func(rec Record) error {
+			ids = append(ids, rec.TransactionID)
+			return nil
+		})
+	}
+	if len(ids) != 1 || ids[0] != "blocked" {
+		t.Errorf("expected only the blocked transaction, got %v", ids)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	f, err := newRotatingFile(dir, ".jsonl", 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := f.Write([]byte(fmt.Sprintf("record %d\n", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	names, err := f.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("expected 2 files, got %v", names)
+	}
+	last, _ := os.ReadFile(filepath.Join(dir, names[1]))
+	if string(last) != "record 4\n" {
+		t.Errorf("unexpected last file %q", last)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		conf  Config
+		valid bool
+	}{
+		{Config{Dir: "/tmp", SampleRate: 0.5, BlockSampleRate: 1}, true},
+		{Config{SampleRate: 1}, false},
+		{Config{Dir: "/tmp", Format: "xml"}, false},
+		{Config{Dir: "/tmp", SampleRate: 2}, false},
+		{Config{Dir: "/tmp", MaxFiles: -1}, false},
+		{Config{Dir: "/tmp", RedactPatterns: []string{"("}}, false},
+	}
+	for _, test := range tests {
+		if err := test.conf.Check(); (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid %t, got %v", test.conf, test.valid, err)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	dir := t.TempDir()
+	r, err := New(Config{Dir: dir, SampleRate: 1, BlockSampleRate: 1}, noop.NewMeterProvider().Meter("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	labels, err := ReadLabels(dir)
+	if err != nil || len(labels) != 0 {
+		t.Fatalf("expected no labels, got %v (%v)", labels, err)
+	}
+	for _, l := range []Label{
+		{TransactionID: "tx1", Label: Benign, Comment: "search form"},
+		{TransactionID: "tx2", Label: Attack},
+		{TransactionID: "tx1", Label: Attack, Comment: "relabelled"},
+	} {
+		if err := r.RecordLabel(l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.RecordLabel(Label{TransactionID: "tx3", Label: "maybe"}); err == nil {
+		t.Errorf("invalid label recorded")
+	}
+
+	labels, err = ReadLabels(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 2 || labels["tx1"].Label != Attack || labels["tx1"].Comment != "relabelled" || labels["tx2"].Label != Attack {
+		t.Errorf("unexpected labels %+v", labels)
+	}
+	// The labels file is not one of the recorded files
+	names, _ := r.out.files()
+	for _, name := range names {
+		if name == LabelsFile {
+			t.Errorf("labels file listed as a recorded file")
+		}
+	}
+}
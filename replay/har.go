@@ -0,0 +1,202 @@
+package replay
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"wace/recorder"
+)
+
+// harExtension is the extension of the HAR files
+const harExtension = ".har"
+
+// harFile is the part of a HAR (HTTP Archive) file holding the
+// transactions.
+type harFile struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+// harEntry is a transaction of a HAR file. The label is the custom
+// "_label" field of the entry.
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Label           string      `json:"_label"`
+}
+
+type harRequest struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []harHeader `json:"headers"`
+	PostData    *harContent `json:"postData"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Headers     []harHeader `json:"headers"`
+	Content     *harContent `json:"content"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// harContent is the body of a request (postData) or a response
+// (content).
+type harContent struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding"`
+}
+
+// body returns the decoded body.
+func (c *harContent) body() ([]byte, error) {
+	if c == nil || c.Text == "" {
+		return nil, nil
+	}
+	if c.Encoding == "base64" {
+		return base64.StdEncoding.DecodeString(c.Text)
+	}
+	return []byte(c.Text), nil
+}
+
+// harHeaderOf returns the HAR headers as an http.Header, without the
+// HTTP/2 pseudo headers.
+func harHeaderOf(headers []harHeader) http.Header {
+	header := make(http.Header)
+	for _, h := range headers {
+		if strings.HasPrefix(h.Name, ":") {
+			continue
+		}
+		header.Add(h.Name, h.Value)
+	}
+	return header
+}
+
+// readHAR calls fn with the record of each entry of the HAR file. The
+// transaction IDs are the name of the file and the index of the entry.
+func readHAR(r io.Reader, name string, fn func(recorder.Record) error) error {
+	var har harFile
+	if err := json.NewDecoder(r).Decode(&har); err != nil {
+		return err
+	}
+	for i, entry := range har.Log.Entries {
+		rec, err := entry.record(fmt.Sprintf("%s-%d", name, i))
+		if err != nil {
+			return fmt.Errorf("entry %d: %v", i, err)
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record returns the record of the entry, with all the phases a WAF
+// can send: the request line, the request body and the whole request,
+// and the response headers, the response body and the whole response.
+// As each model plugin analyzes only the phase of its type, a WAF
+// sending the split or the whole messages is replayed the same.
+func (e harEntry) record(transactionID string) (recorder.Record, error) {
+	u, err := url.Parse(e.Request.URL)
+	if err != nil {
+		return recorder.Record{}, err
+	}
+	rec := recorder.Record{
+		TransactionID: transactionID,
+		RequestLine:   strings.TrimSpace(e.Request.Method + " " + u.RequestURI() + " " + e.Request.HTTPVersion),
+		RequestHeader: harHeaderOf(e.Request.Headers),
+		Label:         e.Label,
+	}
+	rec.Time, _ = time.Parse(time.RFC3339Nano, e.StartedDateTime)
+	body, err := e.Request.PostData.body()
+	if err != nil {
+		return rec, fmt.Errorf("request body: %v", err)
+	}
+	rec.Phases = append(rec.Phases, recorder.Phase{Phase: "RequestHeaders", Payload: []byte(rec.RequestLine)})
+	if body != nil {
+		rec.Phases = append(rec.Phases, recorder.Phase{Phase: "RequestBody", Payload: body, ContentType: e.Request.PostData.MimeType})
+	}
+	rec.Phases = append(rec.Phases, recorder.Phase{Phase: "AllRequest", Payload: message(rec.RequestLine, rec.RequestHeader, body)})
+
+	// Entries without response (eg: blocked requests) have status 0
+	if e.Response.Status == 0 {
+		return rec, nil
+	}
+	rec.StatusLine = strings.TrimSpace(e.Response.HTTPVersion + " " + strconv.Itoa(e.Response.Status) + " " + e.Response.StatusText)
+	rec.ResponseHeader = harHeaderOf(e.Response.Headers)
+	body, err = e.Response.Content.body()
+	if err != nil {
+		return rec, fmt.Errorf("response body: %v", err)
+	}
+	rec.Phases = append(rec.Phases, recorder.Phase{Phase: "ResponseHeaders", Payload: headerLines(rec.ResponseHeader)})
+	if body != nil {
+		rec.Phases = append(rec.Phases, recorder.Phase{Phase: "ResponseBody", Payload: body, ContentType: e.Response.Content.MimeType})
+	}
+	rec.Phases = append(rec.Phases, recorder.Phase{Phase: "AllResponse", Payload: message(rec.StatusLine, rec.ResponseHeader, body)})
+	return rec, nil
+}
+
+// message returns the HTTP message with the start line, header and
+// body.
+func message(startLine string, header http.Header, body []byte) []byte {
+	msg := []byte(startLine + "\r\n")
+	msg = append(msg, headerLines(header)...)
+	msg = append(msg, "\r\n"...)
+	return append(msg, body...)
+}
+
+// Read calls fn with each transaction of the file: the entries of a
+// HAR file, if its extension is ".har", or the records of a file of
+// the recorder otherwise. The records are labelled with the labels
+// given to them once recorded (see recorder.ReadLabels), if any. The
+// labels file itself has no transactions.
+func Read(path string, fn func(recorder.Record) error) error {
+	if filepath.Base(path) == recorder.LabelsFile {
+		return nil
+	}
+	check := func(rec recorder.Record) error {
+		if err := rec.CheckLabel(); err != nil {
+			return err
+		}
+		return fn(rec)
+	}
+	if !strings.HasSuffix(path, harExtension) {
+		labels, err := recorder.ReadLabels(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		return recorder.ReadFile(path, func(rec recorder.Record) error {
+			if l, ok := labels[rec.TransactionID]; ok {
+				rec.Label = l.Label
+			}
+			return check(rec)
+		})
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	name := strings.TrimSuffix(filepath.Base(path), harExtension)
+	if err := readHAR(f, name, check); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+/*
+Package replay replays recorded transactions through the handlers of
+the WACE server, without gRPC, to re-score them with the current model
+and decision plugins and compare the verdicts with the recorded ones
+or with the labels of the transactions.
+
+The transactions are read from the files of the recorder, or from HAR
+files.
+*/
+package replay
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"wace/comm"
+	pm "wace/pluginmanager"
+	"wace/recorder"
+	"wace/transaction"
+
+	cf "github.com/tilsor/ModSecIntl_wace_lib/configstore"
+)
+
+// Options configures the replay.
+type Options struct {
+	// Models are the model plugins analyzing each phase (model plugin
+	// type). The phases missing from the map are analyzed by the model
+	// plugins recorded for them.
+	Models map[string][]string
+	// Decision is the decision asked for the verdicts. If empty, the
+	// recorded decision of each direction is used.
+	Decision string
+	// Params are WAF params sent with the verdict requests, replacing
+	// the recorded ones with the same name
+	Params map[string]string
+	// Concurrency is the number of transactions replayed at the same
+	// time (one if zero)
+	Concurrency int
+}
+
+// Result is the result of the replay of a transaction.
+type Result struct {
+	TransactionID string `json:"transaction_id"`
+	Label         string `json:"label,omitempty"`
+	Block         bool   `json:"block"`
+	// Verdicts are the verdicts asked, keyed by direction
+	Verdicts map[string]bool `json:"verdicts"`
+	// Recorded is the recorded verdict, if the transaction has one
+	Recorded *bool `json:"recorded_block,omitempty"`
+	// Latency is the time from the start of the transaction until
+	// its last verdict
+	Latency time.Duration `json:"latency_ns"`
+	Err     string        `json:"error,omitempty"`
+}
+
+// String returns the result as a tab separated line: the transaction
+// ID, the verdict, the label and the latency (or the error).
+func (r Result) String() string {
+	verdict := "allow"
+	if r.Block {
+		verdict = "block"
+	}
+	label := r.Label
+	if label == "" {
+		label = "-"
+	}
+	if r.Err != "" {
+		return fmt.Sprintf("%s\terror\t%s\t%s", r.TransactionID, label, r.Err)
+	}
+	return fmt.Sprintf("%s\t%s\t%s\t%v", r.TransactionID, verdict, label, r.Latency)
+}
+
+// Replayer replays the transactions with the handlers of the server.
+type Replayer struct {
+	handlers comm.Handlers
+	opts     Options
+}
+
+// New creates a replayer calling the handlers as the gRPC server
+// does.
+func New(handlers comm.Handlers, opts Options) *Replayer {
+	return &Replayer{handlers: handlers, opts: opts}
+}
+
+// Replay replays the transaction as the WAF would: it sends the request
+// phases and asks for the inbound verdict and, if the transaction is
+// not blocked, it sends the response phases and asks for the outbound
+// verdict. The directions without recorded phases are not checked.
+func (r *Replayer) Replay(rec recorder.Record) Result {
+	res := Result{TransactionID: rec.TransactionID, Label: rec.Label, Verdicts: make(map[string]bool)}
+	if len(rec.Verdicts) > 0 {
+		recorded := rec.Blocked()
+		res.Recorded = &recorded
+	}
+	start := time.Now()
+	r.handlers.Init(rec.TransactionID, rec.ClientIP)
+	defer r.handlers.Close(rec.TransactionID, nil)
+
+	for _, direction := range []string{pm.Inbound, pm.Outbound} {
+		analyzed := false
+		for _, p := range rec.Phases {
+			t, err := cf.StringToPluginType(p.Phase)
+			if err != nil {
+				res.Err = err.Error()
+				return res
+			}
+			if pm.PhaseDirection(t) != direction {
+				continue
+			}
+			if err := r.analyze(rec, p); err != nil {
+				res.Err = err.Error()
+				return res
+			}
+			analyzed = true
+		}
+		if !analyzed {
+			continue
+		}
+		block, err := r.check(rec, direction)
+		if err != nil {
+			res.Err = err.Error()
+			return res
+		}
+		res.Verdicts[direction] = block
+		if block {
+			res.Block = true
+			break
+		}
+	}
+	res.Latency = time.Since(start)
+	return res
+}
+
+// models returns the model plugins analyzing the phase of the record.
+func (r *Replayer) models(rec recorder.Record, phase string) []string {
+	if models, ok := r.opts.Models[phase]; ok {
+		return models
+	}
+	models := []string{}
+	for modelID, m := range rec.Models {
+		if m.Phase == phase && !m.Shadow {
+			models = append(models, modelID)
+		}
+	}
+	sort.Strings(models)
+	return models
+}
+
+// analyze sends the payload of the phase to the handler of the phase.
+func (r *Replayer) analyze(rec recorder.Record, p recorder.Phase) error {
+	models := r.models(rec, p.Phase)
+	payload := transaction.Payload{Data: p.Payload, ContentType: p.ContentType, Charset: p.Charset}
+	var status int32
+	switch p.Phase {
+	case "RequestHeaders":
+		// The payload of the phase is the request line
+		headers := transaction.Payload{Data: headerLines(rec.RequestHeader)}
+		status = r.handlers.SendReqLineAndHeadersBytes(rec.TransactionID, payload, headers, models)
+	case "RequestBody":
+		status = r.handlers.SendRequestBodyBytes(rec.TransactionID, payload, models)
+	case "AllRequest":
+		status = r.handlers.SendRequestBytes(rec.TransactionID, payload, models)
+	case "ResponseHeaders":
+		// The payload of the phase is the response headers
+		statusLine := transaction.Payload{Data: []byte(rec.StatusLine)}
+		status = r.handlers.SendRespLineAndHeadersBytes(rec.TransactionID, statusLine, payload, models)
+	case "ResponseBody":
+		status = r.handlers.SendResponseBodyBytes(rec.TransactionID, payload, models)
+	case "AllResponse":
+		status = r.handlers.SendResponseBytes(rec.TransactionID, payload, models)
+	default:
+		return fmt.Errorf("phase %s cannot be replayed", p.Phase)
+	}
+	if status != 0 {
+		return fmt.Errorf("%s payload rejected", p.Phase)
+	}
+	return nil
+}
+
+// check asks for the verdict of the direction, with the recorded WAF
+// params and the ones of the options.
+func (r *Replayer) check(rec recorder.Record, direction string) (bool, error) {
+	recorded := rec.Verdicts[direction]
+	decision := r.opts.Decision
+	if decision == "" {
+		decision = recorded.Decision
+	}
+	if decision == "" {
+		return false, fmt.Errorf("no decision for the %s verdict", direction)
+	}
+	params := make(map[string]string)
+	for name, value := range recorded.WAFParams {
+		params[name] = value
+	}
+	for name, value := range r.opts.Params {
+		params[name] = value
+	}
+	return r.handlers.Check(rec.TransactionID, decision, direction, params)
+}
+
+// headerLines returns the header as "Name: value" lines, sorted by
+// name, as sent by the WAF.
+func headerLines(header http.Header) []byte {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		for _, value := range header[name] {
+			b.WriteString(name + ": " + value + "\r\n")
+		}
+	}
+	return []byte(b.String())
+}
+
+// ReplayFiles replays the transactions of the files, and calls fn with
+// their results in the order of the files. It returns an error if a
+// file cannot be read, after calling fn with the results of the
+// transactions read.
+func (r *Replayer) ReplayFiles(paths []string, fn func(Result)) error {
+	type job struct {
+		index int
+		rec   recorder.Record
+	}
+	type done struct {
+		index int
+		res   Result
+	}
+	jobs := make(chan job)
+	results := make(chan done)
+
+	var readErr error
+	go func() {
+		defer close(jobs)
+		index := 0
+		for _, path := range paths {
+			readErr = Read(path, func(rec recorder.Record) error {
+				jobs <- job{index, rec}
+				index++
+				return nil
+			})
+			if readErr != nil {
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < max(r.opts.Concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				results <- done{j.index, r.Replay(j.rec)}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// The results are passed to fn in order, keeping the ones that
+	// finish before the previous transactions
+	pending := make(map[int]Result)
+	next := 0
+	for d := range results {
+		pending[d.index] = d.res
+		for res, ok := pending[next]; ok; res, ok = pending[next] {
+			fn(res)
+			delete(pending, next)
+			next++
+		}
+	}
+	return readErr
+}
@@ -0,0 +1,341 @@
+package replay
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"wace/comm"
+	"wace/recorder"
+	"wace/transaction"
+)
+
+// fakeServer records the calls to its handlers, and blocks the
+// transactions whose payloads hold "attack".
+type fakeServer struct {
+	mutex  sync.Mutex
+	calls  map[string][]string
+	params map[string]map[string]string
+	attack map[string]bool
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{
+		calls:  make(map[string][]string),
+		params: make(map[string]map[string]string),
+		attack: make(map[string]bool),
+	}
+}
+
+func (s *fakeServer) call(transactionID, call string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls[transactionID] = append(s.calls[transactionID], call)
+}
+
+func (s *fakeServer) analyze(phase string) func(string, transaction.Payload, []string) int32 {
+	return func(transactionID string, p transaction.Payload, models []string) int32 {
+		s.call(transactionID, fmt.Sprintf("%s %q %v", phase, p.Data, models))
+		if strings.Contains(string(p.Data), "reject") {
+			return 1
+		}
+		if strings.Contains(string(p.Data), "attack") {
+			s.mutex.Lock()
+			s.attack[transactionID] = true
+			s.mutex.Unlock()
+		}
+		return 0
+	}
+}
+
+func (s *fakeServer) analyzeHead(phase string) func(string, transaction.Payload, transaction.Payload, []string) int32 {
+	return func(transactionID string, line, headers transaction.Payload, models []string) int32 {
+		s.call(transactionID, fmt.Sprintf("%s %q %q %v", phase, line.Data, headers.Data, models))
+		return 0
+	}
+}
+
+func (s *fakeServer) handlers() comm.Handlers {
+	return comm.Handlers{
+		SendRequestBytes:            s.analyze("AllRequest"),
+		SendReqLineAndHeadersBytes:  s.analyzeHead("RequestHeaders"),
+		SendRequestBodyBytes:        s.analyze("RequestBody"),
+		SendResponseBytes:           s.analyze("AllResponse"),
+		SendRespLineAndHeadersBytes: s.analyzeHead("ResponseHeaders"),
+		SendResponseBodyBytes:       s.analyze("ResponseBody"),
+		Check: func(transactionID, decision, direction string, params map[string]string) (bool, error) {
+			s.call(transactionID, "Check "+decision+" "+direction)
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			s.params[transactionID+" "+direction] = params
+			if decision == "failing" {
+				return false, fmt.Errorf("decision failed")
+			}
+			return s.attack[transactionID], nil
+		},
+		Init: func(transactionID, clientIP string) int32 {
+			s.call(transactionID, "Init "+clientIP)
+			return 0
+		},
+		Close: func(transactionID string, _ map[string]string) int32 {
+			s.call(transactionID, "Close")
+			return 0
+		},
+	}
+}
+
+func testRecord(id, body string) recorder.Record {
+	return recorder.Record{
+		TransactionID:  id,
+		ClientIP:       "192.0.2.1",
+		RequestLine:    "POST /login HTTP/1.1",
+		RequestHeader:  http.Header{"Host": {"example.com"}, "Accept": {"*/*"}},
+		StatusLine:     "HTTP/1.1 200 OK",
+		ResponseHeader: http.Header{"Content-Type": {"text/html"}},
+		Phases: []recorder.Phase{
+			{Phase: "RequestHeaders", Payload: []byte("POST /login HTTP/1.1")},
+			{Phase: "RequestBody", Payload: []byte(body)},
+			{Phase: "ResponseHeaders", Payload: []byte("Content-Type: text/html\r\n")},
+			{Phase: "ResponseBody", Payload: []byte("<html></html>")},
+		},
+		Models: map[string]recorder.Model{
+			"trivial": {Phase: "RequestBody"},
+			"shadow":  {Phase: "RequestBody", Shadow: true},
+		},
+		Verdicts: map[string]recorder.Verdict{
+			"inbound":  {Decision: "simple", WAFParams: map[string]string{"inbound_blocking": "5", "inbound_threshold": "5"}},
+			"outbound": {Decision: "simple"},
+		},
+	}
+}
+
+func TestReplay(t *testing.T) {
+	s := newFakeServer()
+	r := New(s.handlers(), Options{
+		Models: map[string][]string{"RequestHeaders": {"headers"}},
+		Params: map[string]string{"inbound_threshold": "10"},
+	})
+
+	res := r.Replay(testRecord("allowed", "user=admin"))
+	expected := []string{
+		"Init 192.0.2.1",
+		`RequestHeaders "POST /login HTTP/1.1" "Accept: */*\r\nHost: example.com\r\n" [headers]`,
+		`RequestBody "user=admin" [trivial]`,
+		"Check simple inbound",
+		`ResponseHeaders "HTTP/1.1 200 OK" "Content-Type: text/html\r\n" []`,
+		`ResponseBody "<html></html>" []`,
+		"Check simple outbound",
+		"Close",
+	}
+	if !reflect.DeepEqual(s.calls["allowed"], expected) {
+		t.Errorf("unexpected calls\n%q\nexpected\n%q", s.calls["allowed"], expected)
+	}
+	if res.Err != "" || res.Block || !reflect.DeepEqual(res.Verdicts, map[string]bool{"inbound": false, "outbound": false}) {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if res.Recorded == nil || *res.Recorded {
+		t.Errorf("expected recorded verdict allow, got %v", res.Recorded)
+	}
+	params := map[string]string{"inbound_blocking": "5", "inbound_threshold": "10"}
+	if !reflect.DeepEqual(s.params["allowed inbound"], params) {
+		t.Errorf("unexpected params %v, expected %v", s.params["allowed inbound"], params)
+	}
+
+	// Blocked transactions do not send the response phases
+	res = r.Replay(testRecord("blocked", "attack"))
+	if !res.Block || len(res.Verdicts) != 1 || res.Err != "" {
+		t.Errorf("unexpected result %+v", res)
+	}
+	calls := s.calls["blocked"]
+	if len(calls) != 5 || calls[3] != "Check simple inbound" || calls[4] != "Close" {
+		t.Errorf("unexpected calls %q", calls)
+	}
+}
+
+func TestReplayErrors(t *testing.T) {
+	s := newFakeServer()
+	tests := []struct {
+		name     string
+		opts     Options
+		modify   func(*recorder.Record)
+		expected string
+	}{
+		{"rejected", Options{}, func(rec *recorder.Record) { rec.Phases[1].Payload = []byte("reject") }, "RequestBody payload rejected"},
+		{"no decision", Options{}, func(rec *recorder.Record) { rec.Verdicts = nil }, "no decision for the inbound verdict"},
+		{"failing", Options{Decision: "failing"}, func(rec *recorder.Record) {}, "decision failed"},
+		{"invalid phase", Options{}, func(rec *recorder.Record) { rec.Phases[0].Phase = "Body" }, "Body"},
+	}
+	for _, test := range tests {
+		rec := testRecord(test.name, "user=admin")
+		test.modify(&rec)
+		res := New(s.handlers(), test.opts).Replay(rec)
+		if !strings.Contains(res.Err, test.expected) {
+			t.Errorf("%s: expected error %q, got %q", test.name, test.expected, res.Err)
+		}
+		calls := s.calls[test.name]
+		if len(calls) == 0 || calls[len(calls)-1] != "Close" {
+			t.Errorf("%s: transaction not closed: %q", test.name, calls)
+		}
+	}
+}
+
+const testHAR = `{"log": {"entries": [
+  {
+    "startedDateTime": "2024-05-01T10:00:00.000Z",
+    "_label": "attack",
+    "request": {
+      "method": "POST", "url": "https://example.com/search?q=1", "httpVersion": "HTTP/1.1",
+      "headers": [{"name": ":authority", "value": "example.com"}, {"name": "Content-Type", "value": "application/x-www-form-urlencoded"}],
+      "postData": {"mimeType": "application/x-www-form-urlencoded", "text": "q=attack"}
+    },
+    "response": {
+      "status": 200, "statusText": "OK", "httpVersion": "HTTP/1.1",
+      "headers": [{"name": "Content-Type", "value": "image/png"}],
+      "content": {"mimeType": "image/png", "text": "iVBORw==", "encoding": "base64"}
+    }
+  },
+  {
+    "_label": "benign",
+    "request": {"method": "GET", "url": "https://example.com/", "httpVersion": "HTTP/2.0", "headers": []},
+    "response": {"status": 0}
+  }
+]}}`
+
+func TestReadHAR(t *testing.T) {
+	var recs []recorder.Record
+	err := readHAR(strings.NewReader(testHAR), "test", func(rec recorder.Record) error {
+		recs = append(recs, rec)
+		return nil
+	})
+	if err != nil || len(recs) != 2 {
+		t.Fatalf("read %d records: %v", len(recs), err)
+	}
+
+	rec := recs[0]
+	if rec.TransactionID != "test-0" || rec.Label != recorder.Attack || rec.Time.Year() != 2024 {
+		t.Errorf("unexpected record %+v", rec)
+	}
+	if rec.RequestLine != "POST /search?q=1 HTTP/1.1" || rec.StatusLine != "HTTP/1.1 200 OK" {
+		t.Errorf("unexpected start lines %q %q", rec.RequestLine, rec.StatusLine)
+	}
+	if _, ok := rec.RequestHeader[":authority"]; ok {
+		t.Errorf("pseudo header not removed: %v", rec.RequestHeader)
+	}
+	var phases []string
+	for _, p := range rec.Phases {
+		phases = append(phases, p.Phase+"="+string(p.Payload))
+	}
+	expected := []string{
+		"RequestHeaders=POST /search?q=1 HTTP/1.1",
+		"RequestBody=q=attack",
+		"AllRequest=POST /search?q=1 HTTP/1.1\r\nContent-Type: application/x-www-form-urlencoded\r\n\r\nq=attack",
+		"ResponseHeaders=Content-Type: image/png\r\n",
+		"ResponseBody=\x89PNG",
+		"AllResponse=HTTP/1.1 200 OK\r\nContent-Type: image/png\r\n\r\n\x89PNG",
+	}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Errorf("unexpected phases %q, expected %q", phases, expected)
+	}
+
+	if len(recs[1].Phases) != 2 || recs[1].StatusLine != "" || recs[1].RequestLine != "GET / HTTP/2.0" {
+		t.Errorf("unexpected record without response %+v", recs[1])
+	}
+}
+
+func TestReplayFiles(t *testing.T) {
+	dir := t.TempDir()
+	harPath := filepath.Join(dir, "traffic.har")
+	if err := os.WriteFile(harPath, []byte(testHAR), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for i := 0; i < 20; i++ {
+		body := "user=admin"
+		if i%4 == 0 {
+			body = "attack"
+		}
+		lines = append(lines, fmt.Sprintf(`{"transaction_id":"rec-%d","phases":[{"phase":"AllRequest","payload":"%s"}]}`, i, body))
+	}
+	jsonlPath := filepath.Join(dir, "records.jsonl")
+	if err := os.WriteFile(jsonlPath, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	labels := `{"transaction_id":"rec-0","label":"attack"}` + "\n" + `{"transaction_id":"rec-1","label":"benign","comment":"false positive"}`
+	labelsPath := filepath.Join(dir, recorder.LabelsFile)
+	if err := os.WriteFile(labelsPath, []byte(labels), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newFakeServer()
+	r := New(s.handlers(), Options{Decision: "simple", Concurrency: 4})
+	var ids []string
+	var results []Result
+	// The labels file has no transactions, eg: when the files are
+	// given as dir/*.jsonl
+	err := r.ReplayFiles([]string{harPath, jsonlPath, labelsPath}, func(res Result) {
+		ids = append(ids, res.TransactionID)
+		results = append(results, res)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 22 || ids[0] != "traffic-0" || ids[1] != "traffic-1" || ids[2] != "rec-0" || ids[21] != "rec-19" {
+		t.Errorf("results out of order: %v", ids)
+	}
+	if !results[0].Block || results[1].Block || !results[2].Block || results[3].Block {
+		t.Errorf("unexpected verdicts %+v", results[:4])
+	}
+	if results[2].Label != recorder.Attack || results[3].Label != recorder.Benign || results[4].Label != "" {
+		t.Errorf("recorded labels not applied: %+v", results[2:5])
+	}
+
+	badPath := filepath.Join(dir, "bad.jsonl")
+	os.WriteFile(badPath, []byte(`{"transaction_id":"bad","label":"evil"}`), 0644)
+	err = r.ReplayFiles([]string{badPath}, func(Result) {})
+	if err == nil || !strings.Contains(err.Error(), "invalid label") {
+		t.Errorf("expected invalid label error, got %v", err)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	yes, no := true, false
+	results := []Result{
+		{Label: recorder.Attack, Block: true, Recorded: &no, Latency: 1 * time.Millisecond},
+		{Label: recorder.Attack, Block: false, Recorded: &no, Latency: 2 * time.Millisecond},
+		{Label: recorder.Benign, Block: true, Recorded: &yes, Latency: 3 * time.Millisecond},
+		{Label: recorder.Benign, Block: false, Latency: 4 * time.Millisecond},
+		{Block: true, Latency: 5 * time.Millisecond},
+		{Label: recorder.Attack, Err: "rejected"},
+	}
+	s := Summarize(results)
+	expected := Summary{
+		Transactions:   6,
+		Errors:         1,
+		Blocked:        3,
+		BlockRate:      0.6,
+		Changed:        1,
+		Labelled:       4,
+		TruePositives:  1,
+		FalsePositives: 1,
+		TrueNegatives:  1,
+		FalseNegatives: 1,
+		Precision:      0.5,
+		Recall:         0.5,
+		LatencyP50:     3 * time.Millisecond,
+		LatencyP90:     5 * time.Millisecond,
+		LatencyP99:     5 * time.Millisecond,
+		LatencyMax:     5 * time.Millisecond,
+	}
+	if s != expected {
+		t.Errorf("unexpected summary\n%+v\nexpected\n%+v", s, expected)
+	}
+	if s := Summarize(nil); s != (Summary{}) {
+		t.Errorf("unexpected empty summary %+v", s)
+	}
+}
@@ -0,0 +1,114 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"wace/recorder"
+)
+
+// Summary aggregates the results of the replayed transactions. The
+// transactions that could not be replayed are only counted in Errors.
+type Summary struct {
+	Transactions int     `json:"transactions"`
+	Errors       int     `json:"errors"`
+	Blocked      int     `json:"blocked"`
+	BlockRate    float64 `json:"block_rate"`
+	// Changed is the number of transactions whose verdict differs from
+	// the recorded one
+	Changed int `json:"changed"`
+	// Labelled is the number of transactions labelled as attacks or
+	// benign, which are the ones counted in the confusion matrix
+	Labelled       int     `json:"labelled"`
+	TruePositives  int     `json:"true_positives"`
+	FalsePositives int     `json:"false_positives"`
+	TrueNegatives  int     `json:"true_negatives"`
+	FalseNegatives int     `json:"false_negatives"`
+	Precision      float64 `json:"precision"`
+	Recall         float64 `json:"recall"`
+	// Latency percentiles of the verdicts
+	LatencyP50 time.Duration `json:"latency_p50_ns"`
+	LatencyP90 time.Duration `json:"latency_p90_ns"`
+	LatencyP99 time.Duration `json:"latency_p99_ns"`
+	LatencyMax time.Duration `json:"latency_max_ns"`
+}
+
+// Summarize returns the summary of the results.
+func Summarize(results []Result) Summary {
+	var s Summary
+	var latencies []time.Duration
+	for _, res := range results {
+		s.Transactions++
+		if res.Err != "" {
+			s.Errors++
+			continue
+		}
+		latencies = append(latencies, res.Latency)
+		if res.Block {
+			s.Blocked++
+		}
+		if res.Recorded != nil && *res.Recorded != res.Block {
+			s.Changed++
+		}
+		switch {
+		case res.Label == recorder.Attack && res.Block:
+			s.TruePositives++
+		case res.Label == recorder.Attack:
+			s.FalseNegatives++
+		case res.Label == recorder.Benign && res.Block:
+			s.FalsePositives++
+		case res.Label == recorder.Benign:
+			s.TrueNegatives++
+		default:
+			continue
+		}
+		s.Labelled++
+	}
+	s.BlockRate = ratio(s.Blocked, len(latencies))
+	s.Precision = ratio(s.TruePositives, s.TruePositives+s.FalsePositives)
+	s.Recall = ratio(s.TruePositives, s.TruePositives+s.FalseNegatives)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	s.LatencyP50 = percentile(latencies, 0.5)
+	s.LatencyP90 = percentile(latencies, 0.9)
+	s.LatencyP99 = percentile(latencies, 0.99)
+	s.LatencyMax = percentile(latencies, 1)
+	return s
+}
+
+// ratio returns n/total, or zero if total is zero.
+func ratio(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) / float64(total)
+}
+
+// percentile returns the nearest-rank percentile p (from 0 to 1) of the
+// sorted latencies, or zero if there are none.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Print writes the summary in text form.
+func (s Summary) Print(w io.Writer) {
+	fmt.Fprintf(w, "transactions: %d (%d errors)\n", s.Transactions, s.Errors)
+	fmt.Fprintf(w, "blocked: %d (block rate %.4f)\n", s.Blocked, s.BlockRate)
+	fmt.Fprintf(w, "changed verdicts: %d\n", s.Changed)
+	if s.Labelled > 0 {
+		fmt.Fprintf(w, "labelled: %d (TP %d, FP %d, TN %d, FN %d)\n", s.Labelled, s.TruePositives, s.FalsePositives, s.TrueNegatives, s.FalseNegatives)
+		fmt.Fprintf(w, "precision: %.4f\n", s.Precision)
+		fmt.Fprintf(w, "recall: %.4f\n", s.Recall)
+	}
+	fmt.Fprintf(w, "latency: p50 %v, p90 %v, p99 %v, max %v\n", s.LatencyP50, s.LatencyP90, s.LatencyP99, s.LatencyMax)
+}
@@ -0,0 +1,195 @@
+/*
+Package resultcache implements a least recently used cache of the
+results of a model plugin, keyed by the SHA-256 hash of the analyzed
+payloads and whether they were truncated, so identical payloads reuse
+the previous results instead of being analyzed again.
+*/
+package resultcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+
+	lpm "github.com/tilsor/ModSecIntl_wace_lib/pluginmanager"
+)
+
+// DefaultSize is the size of the caches enabled without a size.
+const DefaultSize = 1000
+
+// Config holds the limits of a cache. A zero Size disables the cache,
+// and a zero TTL means the results never expire.
+type Config struct {
+	Size int
+	TTL  time.Duration
+}
+
+// Check verifies that the limits are valid.
+func (c Config) Check() error {
+	if c.Size < 0 {
+		return fmt.Errorf("cache size cannot be negative")
+	}
+	if c.TTL < 0 {
+		return fmt.Errorf("cache TTL cannot be negative")
+	}
+	return nil
+}
+
+// Key is the hash of a payload.
+type Key [sha256.Size]byte
+
+// KeyOf returns the key of the payload. A truncated payload has another
+// key than the same complete one, as the model plugins can score them
+// differently.
+func KeyOf(payload string, truncated bool) Key {
+	h := sha256.New()
+	if truncated {
+		h.Write([]byte{1})
+	} else {
+		h.Write([]byte{0})
+	}
+	io.WriteString(h, payload)
+	var key Key
+	h.Sum(key[:0])
+	return key
+}
+
+// entry is a cached result
+type entry struct {
+	key     Key
+	res     lpm.ModelResults
+	expires time.Time
+}
+
+// Cache is a LRU cache of model results, safe for concurrent use.
+type Cache struct {
+	conf    Config
+	mutex   sync.Mutex
+	entries map[Key]*list.Element
+	// order has the most recently used entries first
+	order *list.List
+	// now returns the current time, replaced in the tests
+	now func() time.Time
+}
+
+// New creates a new cache with the given limits.
+func New(conf Config) *Cache {
+	return &Cache{
+		conf:    conf,
+		entries: make(map[Key]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// Get returns the result cached for the payload key, and whether it
+// was found. Expired results are removed and not returned.
+func (c *Cache) Get(key Key) (lpm.ModelResults, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return lpm.ModelResults{}, false
+	}
+	e := elem.Value.(*entry)
+	if c.conf.TTL > 0 && !c.now().Before(e.expires) {
+		c.remove(elem)
+		return lpm.ModelResults{}, false
+	}
+	c.order.MoveToFront(elem)
+	return copyResults(e.res), true
+}
+
+// Add caches the result for the payload key, evicting the least
+// recently used result if the cache is full.
+func (c *Cache) Add(key Key, res lpm.ModelResults) {
+	if c.conf.Size <= 0 {
+		return
+	}
+	res = copyResults(res)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var expires time.Time
+	if c.conf.TTL > 0 {
+		expires = c.now().Add(c.conf.TTL)
+	}
+	if elem, ok := c.entries[key]; ok {
+		e := elem.Value.(*entry)
+		e.res = res
+		e.expires = expires
+		c.order.MoveToFront(elem)
+		return
+	}
+	if c.order.Len() >= c.conf.Size {
+		c.remove(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&entry{key: key, res: res, expires: expires})
+}
+
+// Len returns the number of cached results, including the expired
+// ones not removed yet.
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
+
+// copyResults returns a deep copy of the results, so the caller and
+// the cache do not share the data maps of the results. Maps and slices
+// are copied at every level; pointers are shared.
+func copyResults(res lpm.ModelResults) lpm.ModelResults {
+	if res.Data != nil {
+		res.Data = copyValue(reflect.ValueOf(res.Data)).Interface().(map[string]interface{})
+	}
+	return res
+}
+
+// copyValue returns a deep copy of the maps and slices in v.
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		elem := copyValue(v.Elem())
+		out := reflect.New(v.Type()).Elem()
+		out.Set(elem)
+		return out
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out.SetMapIndex(iter.Key(), copyValue(iter.Value()))
+		}
+		return out
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		out := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return out
+	case reflect.Array:
+		out := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			out.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return out
+	}
+	return v
+}
+
+// remove removes the entry from the cache.
+func (c *Cache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*entry).key)
+}
@@ -0,0 +1,119 @@
+package resultcache
+
+import (
+	"testing"
+	"time"
+
+	lpm "github.com/tilsor/ModSecIntl_wace_lib/pluginmanager"
+)
+
+func TestGetAdd(t *testing.T) {
+	c := New(Config{Size: 2})
+	if _, ok := c.Get(KeyOf("a", false)); ok {
+		t.Errorf("empty cache returned a result")
+	}
+	c.Add(KeyOf("a", false), lpm.ModelResults{ProbAttack: 0.5})
+	res, ok := c.Get(KeyOf("a", false))
+	if !ok || res.ProbAttack != 0.5 {
+		t.Errorf("expected cached result 0.5, got %v (found %t)", res.ProbAttack, ok)
+	}
+	if _, ok := c.Get(KeyOf("b", false)); ok {
+		t.Errorf("result returned for another payload")
+	}
+	if _, ok := c.Get(KeyOf("a", true)); ok {
+		t.Errorf("result returned for the truncated payload")
+	}
+
+	c.Add(KeyOf("a", false), lpm.ModelResults{ProbAttack: 1})
+	if res, _ := c.Get(KeyOf("a", false)); res.ProbAttack != 1 {
+		t.Errorf("expected updated result 1, got %v", res.ProbAttack)
+	}
+	if c.Len() != 1 {
+		t.Errorf("expected 1 cached result, got %d", c.Len())
+	}
+}
+
+func TestCopies(t *testing.T) {
+	c := New(Config{Size: 2})
+	res := lpm.ModelResults{Data: map[string]interface{}{
+		"labels": []interface{}{"sqli"},
+		"scores": map[string]interface{}{"sqli": 0.9},
+	}}
+	c.Add(KeyOf("a", false), res)
+	// Changing the added results does not change the cached ones
+	res.Data["labels"].([]interface{})[0] = "xss"
+	res.Data["extra"] = true
+
+	cached, _ := c.Get(KeyOf("a", false))
+	if len(cached.Data) != 2 || cached.Data["labels"].([]interface{})[0] != "sqli" {
+		t.Errorf("cached results changed by the caller: %v", cached.Data)
+	}
+	// Neither does changing the returned results
+	cached.Data["scores"].(map[string]interface{})["sqli"] = 0.1
+	cached, _ = c.Get(KeyOf("a", false))
+	if cached.Data["scores"].(map[string]interface{})["sqli"] != 0.9 {
+		t.Errorf("cached results changed by a hit: %v", cached.Data)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c := New(Config{Size: 2})
+	c.Add(KeyOf("a", false), lpm.ModelResults{})
+	c.Add(KeyOf("b", false), lpm.ModelResults{})
+	// a becomes the most recently used, so b is evicted
+	c.Get(KeyOf("a", false))
+	c.Add(KeyOf("c", false), lpm.ModelResults{})
+
+	if c.Len() != 2 {
+		t.Errorf("expected 2 cached results, got %d", c.Len())
+	}
+	for payload, cached := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.Get(KeyOf(payload, false)); ok != cached {
+			t.Errorf("payload %s: expected cached %t, got %t", payload, cached, ok)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	now := time.Now()
+	c := New(Config{Size: 2, TTL: time.Minute})
+	c.now = func() time.Time { return now }
+	c.Add(KeyOf("a", false), lpm.ModelResults{})
+
+	now = now.Add(59 * time.Second)
+	if _, ok := c.Get(KeyOf("a", false)); !ok {
+		t.Errorf("result expired before its TTL")
+	}
+	now = now.Add(time.Second)
+	if _, ok := c.Get(KeyOf("a", false)); ok {
+		t.Errorf("expired result returned")
+	}
+	if c.Len() != 0 {
+		t.Errorf("expired result not removed")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	c := New(Config{})
+	c.Add(KeyOf("a", false), lpm.ModelResults{})
+	if _, ok := c.Get(KeyOf("a", false)); ok {
+		t.Errorf("disabled cache returned a result")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		conf  Config
+		valid bool
+	}{
+		{Config{}, true},
+		{Config{Size: 100, TTL: time.Minute}, true},
+		{Config{Size: -1}, false},
+		{Config{Size: 1, TTL: -time.Second}, false},
+	}
+	for _, test := range tests {
+		if err := test.conf.Check(); (err == nil) != test.valid {
+			t.Errorf("%+v: expected valid %t, got %v", test.conf, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,745 @@
+package rules
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Value is the value of an expression: a float64, a bool or a string.
+type Value interface{}
+
+// valueType is the static type of an expression, used to reject the
+// expressions that would always fail when compiling them.
+type valueType int
+
+const (
+	// typeAny is the type of the values only known when evaluating
+	// the expression
+	typeAny valueType = iota
+	typeBool
+	typeNumber
+	typeString
+)
+
+func (t valueType) String() string {
+	switch t {
+	case typeBool:
+		return "boolean"
+	case typeNumber:
+		return "number"
+	case typeString:
+		return "string"
+	}
+	return "any"
+}
+
+// anyType is the type of every variable when it is not known.
+func anyType(string) valueType {
+	return typeAny
+}
+
+// Env resolves the variables of an expression.
+type Env interface {
+	// Lookup returns the value of the variable, and false if it is
+	// not defined
+	Lookup(name string) (Value, bool)
+}
+
+// Expr is a compiled expression.
+type Expr struct {
+	source string
+	root   node
+	names  []string
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.source
+}
+
+// Names returns the names of the variables used in the expression.
+func (e *Expr) Names() []string {
+	return e.names
+}
+
+// Eval evaluates the expression in the environment.
+func (e *Expr) Eval(env Env) (Value, error) {
+	return e.root.eval(env)
+}
+
+// EvalBool evaluates the expression in the environment, which must
+// result in a boolean.
+func (e *Expr) EvalBool(env Env) (bool, error) {
+	v, err := e.Eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression %q is not boolean", e.source)
+	}
+	return b, nil
+}
+
+// Compile parses an expression. Expressions have boolean (||, &&, !),
+// comparison (==, !=, <, <=, >, >=) and arithmetic (+, -, *, /)
+// operators over numbers, strings ("..." or '...'), true, false,
+// variables (eg: model.trivial or model["my-model"]) and function
+// calls.
+func Compile(source string) (*Expr, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, names: make(map[string]bool)}
+	root, err := p.parseBinary(1)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+	}
+	e := &Expr{source: source, root: root}
+	for name := range p.names {
+		e.names = append(e.names, name)
+	}
+	if _, err := e.check(anyType); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// check returns the type of the expression with the given types of the
+// variables, or an error if the types of its operands or arguments are
+// not compatible.
+func (e *Expr) check(types func(name string) valueType) (valueType, error) {
+	return e.root.check(types)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var operators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "!", "(", ")", "[", "]", ","}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func lex(source string) ([]token, error) {
+	var tokens []token
+	runes := []rune(source)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokenNumber, string(runes[start:i]), start})
+		case r == '"' || r == '\'':
+			start := i
+			var b strings.Builder
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, token{tokenString, b.String(), start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && isIdentRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, string(runes[start:i]), start})
+		default:
+			found := false
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, token{tokenOp, op, i})
+					i += len([]rune(op))
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+			}
+		}
+	}
+	return append(tokens, token{tokenEOF, "end of expression", len(runes)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+	names  map[string]bool
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(op string) error {
+	if t := p.next(); t.kind != tokenOp || t.text != op {
+		return fmt.Errorf("expected %q at position %d, found %q", op, t.pos, t.text)
+	}
+	return nil
+}
+
+// precedence returns the precedence of the binary operator, or 0 if
+// the token is not one.
+func precedence(t token) int {
+	if t.kind != tokenOp {
+		return 0
+	}
+	switch t.text {
+	case "||":
+		return 1
+	case "&&":
+		return 2
+	case "==", "!=":
+		return 3
+	case "<", "<=", ">", ">=":
+		return 4
+	case "+", "-":
+		return 5
+	case "*", "/":
+		return 6
+	}
+	return 0
+}
+
+func (p *parser) parseBinary(minPrecedence int) (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		prec := precedence(t)
+		if prec == 0 || prec < minPrecedence {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: t.text, left: left, right: right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if t := p.peek(); t.kind == tokenOp && (t.text == "!" || t.text == "-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op: t.text, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", t.text, t.pos)
+		}
+		return &literalNode{f}, nil
+	case tokenString:
+		return &literalNode{t.text}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		}
+		if next := p.peek(); next.kind == tokenOp && next.text == "(" {
+			return p.parseCall(t)
+		}
+		name := t.text
+		for next := p.peek(); next.kind == tokenOp && next.text == "["; next = p.peek() {
+			p.next()
+			key := p.next()
+			if key.kind != tokenString {
+				return nil, fmt.Errorf("expected string at position %d, found %q", key.pos, key.text)
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			name += "." + key.text
+		}
+		p.names[name] = true
+		return &variableNode{name}, nil
+	case tokenOp:
+		if t.text == "(" {
+			n, err := p.parseBinary(1)
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+}
+
+func (p *parser) parseCall(name token) (node, error) {
+	f, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s at position %d", name.text, name.pos)
+	}
+	p.next() // (
+	var args []node
+	if t := p.peek(); t.kind == tokenOp && t.text == ")" {
+		p.next()
+	} else {
+		for {
+			arg, err := p.parseBinary(1)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			t := p.next()
+			if t.kind == tokenOp && t.text == ")" {
+				break
+			}
+			if t.kind != tokenOp || t.text != "," {
+				return nil, fmt.Errorf("expected \",\" or \")\" at position %d, found %q", t.pos, t.text)
+			}
+		}
+	}
+	if f.args >= 0 && len(args) != f.args {
+		return nil, fmt.Errorf("function %s takes %d arguments, %d given", name.text, f.args, len(args))
+	}
+	if f.args < 0 && len(args) == 0 {
+		return nil, fmt.Errorf("function %s takes at least 1 argument", name.text)
+	}
+	if name.text == "matches" {
+		n, err := matchesLiteral(args)
+		if err != nil {
+			return nil, fmt.Errorf("function %s at position %d: %v", name.text, name.pos, err)
+		}
+		if n != nil {
+			return n, nil
+		}
+	}
+	return &callNode{name: name.text, f: f.call, args: args, arg: f.arg, result: f.result}, nil
+}
+
+// matchesLiteral returns the call of matches with its pattern compiled,
+// if the pattern is a literal. Patterns resulting from variables are
+// compiled on each call instead.
+func matchesLiteral(args []node) (node, error) {
+	lit, ok := args[1].(*literalNode)
+	if !ok {
+		return nil, nil
+	}
+	pattern, ok := lit.value.(string)
+	if !ok {
+		return nil, fmt.Errorf("argument %v is not a string", lit.value)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &callNode{name: "matches", args: args[:1], arg: typeString, result: typeBool, f: func(args []Value) (Value, error) {
+		s, err := stringArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(s[0]), nil
+	}}, nil
+}
+
+type node interface {
+	eval(env Env) (Value, error)
+	check(types func(name string) valueType) (valueType, error)
+}
+
+type literalNode struct {
+	value Value
+}
+
+func (n *literalNode) eval(Env) (Value, error) {
+	return n.value, nil
+}
+
+func (n *literalNode) check(func(string) valueType) (valueType, error) {
+	switch n.value.(type) {
+	case bool:
+		return typeBool, nil
+	case float64:
+		return typeNumber, nil
+	case string:
+		return typeString, nil
+	}
+	return typeAny, nil
+}
+
+type variableNode struct {
+	name string
+}
+
+func (n *variableNode) check(types func(string) valueType) (valueType, error) {
+	return types(n.name), nil
+}
+
+func (n *variableNode) eval(env Env) (Value, error) {
+	v, ok := env.Lookup(n.name)
+	if !ok {
+		return nil, fmt.Errorf("undefined variable %s", n.name)
+	}
+	return v, nil
+}
+
+type unaryNode struct {
+	op      string
+	operand node
+}
+
+func (n *unaryNode) check(types func(string) valueType) (valueType, error) {
+	t, err := n.operand.check(types)
+	if err != nil {
+		return typeAny, err
+	}
+	expected := typeNumber
+	if n.op == "!" {
+		expected = typeBool
+	}
+	if t != typeAny && t != expected {
+		return typeAny, fmt.Errorf("operator %s needs a %s, got a %s", n.op, expected, t)
+	}
+	return expected, nil
+}
+
+func (n *unaryNode) eval(env Env) (Value, error) {
+	v, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		b, ok := v.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operator ! needs a boolean, got %v", v)
+		}
+		return !b, nil
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("operator - needs a number, got %v", v)
+	}
+	return -f, nil
+}
+
+type binaryNode struct {
+	op          string
+	left, right node
+}
+
+func (n *binaryNode) check(types func(string) valueType) (valueType, error) {
+	left, err := n.left.check(types)
+	if err != nil {
+		return typeAny, err
+	}
+	right, err := n.right.check(types)
+	if err != nil {
+		return typeAny, err
+	}
+	known := left
+	if known == typeAny {
+		known = right
+	}
+	if left != typeAny && right != typeAny && left != right {
+		return typeAny, fmt.Errorf("operator %s needs values of the same type, got a %s and a %s", n.op, left, right)
+	}
+	switch n.op {
+	case "&&", "||":
+		if known != typeAny && known != typeBool {
+			return typeAny, fmt.Errorf("operator %s needs booleans, got a %s", n.op, known)
+		}
+		return typeBool, nil
+	case "==", "!=":
+		return typeBool, nil
+	case "<", "<=", ">", ">=":
+		if known == typeBool {
+			return typeAny, fmt.Errorf("operator %s cannot be applied to booleans", n.op)
+		}
+		return typeBool, nil
+	case "+":
+		if known == typeBool {
+			return typeAny, fmt.Errorf("operator %s cannot be applied to booleans", n.op)
+		}
+		return known, nil
+	}
+	if known != typeAny && known != typeNumber {
+		return typeAny, fmt.Errorf("operator %s needs numbers, got a %s", n.op, known)
+	}
+	return typeNumber, nil
+}
+
+func (n *binaryNode) eval(env Env) (Value, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	// Short-circuit evaluation of the boolean operators
+	if n.op == "&&" || n.op == "||" {
+		l, ok := left.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operator %s needs booleans, got %v", n.op, left)
+		}
+		if (n.op == "&&" && !l) || (n.op == "||" && l) {
+			return l, nil
+		}
+		right, err := n.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := right.(bool)
+		if !ok {
+			return nil, fmt.Errorf("operator %s needs booleans, got %v", n.op, right)
+		}
+		return r, nil
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	}
+
+	if l, ok := left.(string); ok {
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("operator %s needs values of the same type, got %v and %v", n.op, left, right)
+		}
+		switch n.op {
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		case ">=":
+			return l >= r, nil
+		case "+":
+			return l + r, nil
+		}
+		return nil, fmt.Errorf("operator %s cannot be applied to strings", n.op)
+	}
+
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if !lok || !rok {
+		return nil, fmt.Errorf("operator %s needs numbers, got %v and %v", n.op, left, right)
+	}
+	switch n.op {
+	case "<":
+		return l < r, nil
+	case "<=":
+		return l <= r, nil
+	case ">":
+		return l > r, nil
+	case ">=":
+		return l >= r, nil
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s", n.op)
+}
+
+type callNode struct {
+	name string
+	f    func([]Value) (Value, error)
+	args []node
+	// arg is the type of the arguments, and result the one of the
+	// result
+	arg, result valueType
+}
+
+func (n *callNode) check(types func(string) valueType) (valueType, error) {
+	for _, arg := range n.args {
+		t, err := arg.check(types)
+		if err != nil {
+			return typeAny, err
+		}
+		if n.arg != typeAny && t != typeAny && t != n.arg {
+			return typeAny, fmt.Errorf("function %s needs %s arguments, got a %s", n.name, n.arg, t)
+		}
+	}
+	return n.result, nil
+}
+
+func (n *callNode) eval(env Env) (Value, error) {
+	args := make([]Value, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	v, err := n.f(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", n.name, err)
+	}
+	return v, nil
+}
+
+type function struct {
+	// args is the number of arguments, or -1 for a variable number
+	args int
+	// arg is the type of the arguments, and result the one of the
+	// result
+	arg, result valueType
+	call        func([]Value) (Value, error)
+}
+
+func stringArgs(args []Value) ([]string, error) {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("argument %v is not a string", arg)
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+func numberArgs(args []Value) ([]float64, error) {
+	nums := make([]float64, len(args))
+	for i, arg := range args {
+		f, ok := arg.(float64)
+		if !ok {
+			return nil, fmt.Errorf("argument %v is not a number", arg)
+		}
+		nums[i] = f
+	}
+	return nums, nil
+}
+
+var functions = map[string]function{
+	"contains": {2, typeString, typeBool, func(args []Value) (Value, error) {
+		s, err := stringArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Contains(s[0], s[1]), nil
+	}},
+	"startsWith": {2, typeString, typeBool, func(args []Value) (Value, error) {
+		s, err := stringArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return strings.HasPrefix(s[0], s[1]), nil
+	}},
+	"endsWith": {2, typeString, typeBool, func(args []Value) (Value, error) {
+		s, err := stringArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return strings.HasSuffix(s[0], s[1]), nil
+	}},
+	"lower": {1, typeString, typeString, func(args []Value) (Value, error) {
+		s, err := stringArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		return strings.ToLower(s[0]), nil
+	}},
+	"matches": {2, typeString, typeBool, func(args []Value) (Value, error) {
+		s, err := stringArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(s[1])
+		if err != nil {
+			return nil, err
+		}
+		return re.MatchString(s[0]), nil
+	}},
+	"min": {-1, typeNumber, typeNumber, func(args []Value) (Value, error) {
+		n, err := numberArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		m := math.Inf(1)
+		for _, f := range n {
+			m = math.Min(m, f)
+		}
+		return m, nil
+	}},
+	"max": {-1, typeNumber, typeNumber, func(args []Value) (Value, error) {
+		n, err := numberArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		m := math.Inf(-1)
+		for _, f := range n {
+			m = math.Max(m, f)
+		}
+		return m, nil
+	}},
+	"number": {1, typeAny, typeNumber, func(args []Value) (Value, error) {
+		switch v := args[0].(type) {
+		case float64:
+			return v, nil
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(v), 64)
+		}
+		return nil, fmt.Errorf("cannot convert %v to a number", args[0])
+	}},
+}
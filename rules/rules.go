@@ -0,0 +1,313 @@
+// Package rules implements the declarative decision rules: a built-in
+// decision engine configured with expressions in the configuration
+// file, instead of a decision plugin.
+package rules
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"wace/decoding"
+	pm "wace/pluginmanager"
+
+	cf "github.com/tilsor/ModSecIntl_wace_lib/configstore"
+)
+
+// Verdicts of the rules
+const (
+	Block = "block"
+	Allow = "allow"
+)
+
+// CheckVerdict verifies that the verdict is valid.
+func CheckVerdict(verdict string) error {
+	switch verdict {
+	case Block, Allow:
+		return nil
+	}
+	return fmt.Errorf("invalid verdict %s", verdict)
+}
+
+// Rule is a decision rule: when its expression is true, the verdict of
+// the transaction is the one of the rule.
+type Rule struct {
+	Name    string
+	When    *Expr
+	Verdict string
+}
+
+// RuleSet is an ordered list of rules, used as a decision. The verdict
+// is the one of the first rule matching the transaction, or the
+// default verdict if none does.
+type RuleSet struct {
+	ID      string
+	Rules   []Rule
+	Default string
+}
+
+// Definition is a rule as written in the configuration file.
+type Definition struct {
+	Name    string
+	When    string
+	Verdict string
+}
+
+// New compiles the rule definitions into a rule set. Every variable of
+// the expressions must be valid, the model variables can only refer to
+// the given models, and the expressions must be boolean, with operands
+// of compatible types. An empty default verdict means allow.
+func New(id string, defs []Definition, defaultVerdict string, models []string) (*RuleSet, error) {
+	if defaultVerdict == "" {
+		defaultVerdict = Allow
+	}
+	if err := CheckVerdict(defaultVerdict); err != nil {
+		return nil, fmt.Errorf("default verdict: %v", err)
+	}
+	known := make(map[string]bool)
+	for _, modelID := range models {
+		known[modelID] = true
+	}
+	rs := &RuleSet{ID: id, Default: defaultVerdict}
+	for i, def := range defs {
+		name := def.Name
+		if name == "" {
+			name = strconv.Itoa(i + 1)
+		}
+		if err := CheckVerdict(def.Verdict); err != nil {
+			return nil, fmt.Errorf("rule %s: %v", name, err)
+		}
+		when, err := Compile(def.When)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", name, err)
+		}
+		types := make(map[string]valueType)
+		for _, v := range when.Names() {
+			t, err := checkVariable(v, known)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %v", name, err)
+			}
+			types[v] = t
+		}
+		t, err := when.check(func(name string) valueType { return types[name] })
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", name, err)
+		}
+		if t != typeBool {
+			return nil, fmt.Errorf("rule %s: expression %q is not boolean", name, def.When)
+		}
+		rs.Rules = append(rs.Rules, Rule{Name: name, When: when, Verdict: def.Verdict})
+	}
+	return rs, nil
+}
+
+// variables are the variables without a key, with their types
+var variables = map[string]valueType{
+	"direction":        typeString,
+	"client.ip":        typeString,
+	"request.method":   typeString,
+	"request.uri":      typeString,
+	"request.path":     typeString,
+	"request.protocol": typeString,
+	"response.status":  typeNumber,
+	"score.weighted":   typeNumber,
+	"score.max":        typeNumber,
+	"score.count":      typeNumber,
+}
+
+// modelNamespaces are the namespaces of the variables keyed by model
+// ID, with their types
+var modelNamespaces = map[string]valueType{
+	"model":   typeNumber,
+	"weight":  typeNumber,
+	"status":  typeString,
+	"latency": typeNumber,
+}
+
+// namespaces are the namespaces of the variables keyed by a name, with
+// their types. The WAF parameters are numbers or strings, depending on
+// their values.
+var namespaces = map[string]valueType{
+	"waf":             typeAny,
+	"request.header":  typeString,
+	"request.arg":     typeString,
+	"request.cookie":  typeString,
+	"response.header": typeString,
+	"response.arg":    typeString,
+}
+
+// checkVariable verifies that the variable is valid, and returns its
+// type.
+func checkVariable(name string, models map[string]bool) (valueType, error) {
+	if t, ok := variables[name]; ok {
+		return t, nil
+	}
+	for ns, t := range modelNamespaces {
+		if modelID, ok := strings.CutPrefix(name, ns+"."); ok {
+			if !models[modelID] {
+				return typeAny, fmt.Errorf("model plugin %s not defined", modelID)
+			}
+			return t, nil
+		}
+	}
+	for ns, t := range namespaces {
+		if key, ok := strings.CutPrefix(name, ns+"."); ok && key != "" {
+			return t, nil
+		}
+	}
+	return typeAny, fmt.Errorf("unknown variable %s", name)
+}
+
+// Decide returns the verdict of the transaction: the one of the first
+// matching rule, or the default one, and the name of the matching rule
+// (empty for the default verdict).
+func (rs *RuleSet) Decide(input pm.TransactionInput) (string, string, error) {
+	env := &transactionEnv{input: input}
+	for _, rule := range rs.Rules {
+		match, err := rule.When.EvalBool(env)
+		if err != nil {
+			return "", rule.Name, fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+		if match {
+			return rule.Verdict, rule.Name, nil
+		}
+	}
+	return rs.Default, "", nil
+}
+
+// CheckTransaction is the decision function of the rule set, returning
+// true if the transaction must be blocked.
+func (rs *RuleSet) CheckTransaction(input pm.TransactionInput) (bool, error) {
+	verdict, _, err := rs.Decide(input)
+	if err != nil {
+		return false, err
+	}
+	return verdict == Block, nil
+}
+
+// transactionEnv resolves the variables of the expressions from the
+// input of a decision.
+type transactionEnv struct {
+	input pm.TransactionInput
+}
+
+// numberOrString returns the value as a number if it is one, or as a
+// string otherwise.
+func numberOrString(value string) Value {
+	if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+		return f
+	}
+	return value
+}
+
+// firstArg returns the value of the first argument with the name, or
+// an empty string.
+func firstArg(name string, args ...[]decoding.Arg) Value {
+	for _, list := range args {
+		for _, arg := range list {
+			if arg.Name == name {
+				return arg.Value
+			}
+		}
+	}
+	return ""
+}
+
+// result returns the result of the model plugin in any phase.
+func (e *transactionEnv) result(modelID string) (pm.ModelResults, bool) {
+	for _, results := range e.input.PhaseResults {
+		if res, ok := results[modelID]; ok {
+			return res, true
+		}
+	}
+	res, ok := e.input.Results[modelID]
+	return res, ok
+}
+
+// score returns the aggregated scores of the model plugins of the
+// direction of the decision.
+func (e *transactionEnv) score(kind string) float64 {
+	var weighted, weights float64
+	maxScore := 0.0
+	for modelID, res := range e.input.Results {
+		w := e.input.ModelWeight[modelID]
+		weighted += res.ProbAttack * w
+		weights += w
+		maxScore = math.Max(maxScore, res.ProbAttack)
+	}
+	switch kind {
+	case "max":
+		return maxScore
+	case "count":
+		return float64(len(e.input.Results))
+	}
+	if weights == 0 {
+		return 0
+	}
+	return weighted / weights
+}
+
+// Lookup returns the value of the variable. Missing model results,
+// weights and WAF parameters are 0, and missing headers, arguments,
+// cookies and statuses are empty strings.
+func (e *transactionEnv) Lookup(name string) (Value, bool) {
+	req := e.input.Request
+	resp := e.input.Response
+	switch name {
+	case "direction":
+		return e.input.Direction, true
+	case "client.ip":
+		return e.input.ClientIP, true
+	case "request.method":
+		return req.Method, true
+	case "request.uri":
+		return req.URI, true
+	case "request.path":
+		return req.Path, true
+	case "request.protocol":
+		return req.Protocol, true
+	case "response.status":
+		return float64(resp.Status), true
+	case "score.weighted", "score.max", "score.count":
+		return e.score(strings.TrimPrefix(name, "score.")), true
+	}
+
+	ns, key, _ := strings.Cut(name, ".")
+	switch ns {
+	case "model":
+		res, _ := e.result(key)
+		return res.ProbAttack, true
+	case "weight":
+		if w, ok := e.input.ModelWeight[key]; ok {
+			return w, true
+		}
+		return cf.Get().ModelPlugins[key].Weight, true
+	case "status":
+		return e.input.Executions[key].Status, true
+	case "latency":
+		return float64(e.input.Executions[key].Latency.Milliseconds()), true
+	case "waf":
+		if value, ok := e.input.WAFdata[key]; ok {
+			return numberOrString(value), true
+		}
+		return 0.0, true
+	}
+
+	if field, ok := strings.CutPrefix(name, "request.header."); ok {
+		return req.Header.Get(field), true
+	}
+	if field, ok := strings.CutPrefix(name, "response.header."); ok {
+		return resp.Header.Get(field), true
+	}
+	if field, ok := strings.CutPrefix(name, "request.arg."); ok {
+		return firstArg(field, req.QueryArgs, req.BodyArgs), true
+	}
+	if field, ok := strings.CutPrefix(name, "response.arg."); ok {
+		return firstArg(field, resp.BodyArgs), true
+	}
+	if field, ok := strings.CutPrefix(name, "request.cookie."); ok {
+		return firstArg(field, req.Cookies), true
+	}
+	return nil, false
+}
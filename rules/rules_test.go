@@ -0,0 +1,230 @@
+package rules
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"wace/decoding"
+	pm "wace/pluginmanager"
+	"wace/transaction"
+)
+
+type mapEnv map[string]Value
+
+func (m mapEnv) Lookup(name string) (Value, bool) {
+	v, ok := m[name]
+	return v, ok
+}
+
+func TestEval(t *testing.T) {
+	env := mapEnv{"a": 2.0, "b": 3.0, "s": "POST", "model.x-1": 0.5, "t": true}
+	tests := []struct {
+		expr     string
+		expected Value
+	}{
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"-a + b / 2", -0.5},
+		{"a < b && b <= 3 && !(a > b)", true},
+		{"a == 2 || undefined", true},
+		{"t && a >= 3", false},
+		{`s == "POST" && s != 'GET'`, true},
+		{`s == 2`, false},
+		{`s + "/x"`, "POST/x"},
+		{`model["x-1"] > 0.4`, true},
+		{`contains("/login?x", "login") && startsWith(s, "PO") && endsWith(s, "ST")`, true},
+		{`matches(lower(s), "^po")`, true},
+		{`matches(s, "^" + lower(s))`, false},
+		{`max(a, b, 1) - min(a, b)`, 1.0},
+		{`number("4") > a`, true},
+	}
+	for _, test := range tests {
+		e, err := Compile(test.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.expr, err)
+			continue
+		}
+		v, err := e.Eval(env)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.expr, err)
+			continue
+		}
+		if v != test.expected {
+			t.Errorf("%s = %v, expected %v", test.expr, v, test.expected)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	env := mapEnv{"a": 2.0, "s": "x"}
+	for _, expr := range []string{"undefined", "a / 0", "a && true", "!a", "-s", "s < a", "s * s", `matches(s, s + "(")`, `matches(a, "x")`} {
+		e, err := Compile(expr)
+		if err != nil {
+			t.Errorf("%s: unexpected compile error %v", expr, err)
+			continue
+		}
+		if _, err := e.Eval(env); err == nil {
+			t.Errorf("%s: evaluation did not fail", expr)
+		}
+	}
+	e, _ := Compile("a + 1")
+	if _, err := e.EvalBool(env); err == nil {
+		t.Errorf("non boolean expression accepted")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, expr := range []string{"", "1 +", "(1", `"abc`, "a $ b", "unknown(1)", "contains(1)", "max()", "a[1]", "1 2", `matches(s, "(")`, `matches(s, 1)`,
+		`1 + "a"`, "!1", `-"a"`, "true < false", "1 && a", `"a" * a`, `a == 1 && 1 == "1"`, `contains(a, 1)`, `max(a, "1")`, `lower(s) - 1`} {
+		if _, err := Compile(expr); err == nil {
+			t.Errorf("%q: invalid expression compiled", expr)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	e, err := Compile(`model.a > 0.5 && model["b-c"] > 0.5 || model.a < 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, name := range e.Names() {
+		names[name] = true
+	}
+	if len(names) != 2 || !names["model.a"] || !names["model.b-c"] {
+		t.Errorf("wrong names %v", e.Names())
+	}
+}
+
+func TestNew(t *testing.T) {
+	models := []string{"trivial"}
+	valid := []Definition{
+		{When: "model.trivial > 0.5 && weight.trivial > 0 && status.trivial == \"done\" && latency.trivial < 100", Verdict: Block},
+		{When: `waf.inbound_blocking >= 5 || request.header["User-Agent"] == "" || request.arg.id == "1"`, Verdict: Block},
+		{When: `request.cookie.session == "" && response.status >= 500 && response.header.Server != "" && response.arg.x == ""`, Verdict: Allow},
+		{When: `score.weighted > 0.5 || score.max > 0.9 || score.count == 0 || direction == "outbound" || client.ip == ""`, Verdict: Block},
+	}
+	if _, err := New("rules", valid, "", models); err != nil {
+		t.Errorf("valid rules rejected: %v", err)
+	}
+
+	invalid := [][]Definition{
+		{{When: "model.missing > 0.5", Verdict: Block}},
+		{{When: "request.unknown == 1", Verdict: Block}},
+		{{When: "waf. > 1", Verdict: Block}},
+		{{When: "true", Verdict: "drop"}},
+		{{When: "true &&", Verdict: Block}},
+		{{When: "model.trivial + 1", Verdict: Block}},
+		{{When: "waf.score", Verdict: Block}},
+		{{When: `model.trivial > "a"`, Verdict: Block}},
+		{{When: `status.trivial == 1 || request.arg.id > 1`, Verdict: Block}},
+		{{When: `latency.trivial && true`, Verdict: Block}},
+		{{When: `contains(response.status, "5")`, Verdict: Block}},
+	}
+	for _, defs := range invalid {
+		if _, err := New("rules", defs, "", models); err == nil {
+			t.Errorf("invalid rules accepted: %v", defs)
+		}
+	}
+	if _, err := New("rules", nil, "drop", models); err == nil {
+		t.Errorf("invalid default verdict accepted")
+	}
+}
+
+func testInput() pm.TransactionInput {
+	return pm.TransactionInput{
+		DecisionInput: pm.DecisionInput{
+			TransactionId: "tx",
+			Results:       map[string]pm.ModelResults{"body": {ProbAttack: 0.8}, "head": {ProbAttack: 0.2}},
+			ModelWeight:   map[string]float64{"body": 3, "head": 1},
+			WAFdata:       map[string]string{"inbound_blocking": "5", "mode": "strict"},
+		},
+		Direction: pm.Inbound,
+		PhaseResults: map[string]map[string]pm.ModelResults{
+			"RequestBody":    {"body": {ProbAttack: 0.8}},
+			"RequestHeaders": {"head": {ProbAttack: 0.2}},
+		},
+		Executions: map[string]transaction.ModelExecution{
+			"body": {Phase: "RequestBody", Status: transaction.ModelDone, Latency: 20 * time.Millisecond},
+		},
+		ClientIP: "192.0.2.1",
+		Request: transaction.Request{
+			Method:    "POST",
+			Path:      "/login",
+			Header:    http.Header{"User-Agent": {"curl"}},
+			QueryArgs: []decoding.Arg{{Name: "next", Value: "/"}},
+			BodyArgs:  []decoding.Arg{{Name: "user", Value: "admin"}},
+			Cookies:   []decoding.Arg{{Name: "session", Value: "abc"}},
+		},
+	}
+}
+
+func TestDecide(t *testing.T) {
+	models := []string{"body", "head"}
+	tests := []struct {
+		when    string
+		verdict string
+	}{
+		{`request.method == "POST" && request.path == "/login" && model.body > 0.5`, Block},
+		{`waf.inbound_blocking >= 5 && waf.mode == "strict" && waf.missing == 0`, Block},
+		{`score.weighted > 0.64 && score.weighted < 0.66 && score.max == 0.8 && score.count == 2`, Block},
+		{`weight.body == 3 && status.body == "done" && latency.body == 20 && status.head == ""`, Block},
+		{`request.arg.user == "admin" && request.arg.next == "/" && request.cookie.session == "abc"`, Block},
+		{`request.header["user-agent"] == "curl" && client.ip == "192.0.2.1" && direction == "inbound"`, Block},
+		{`model.head > 0.5`, Allow},
+	}
+	for _, test := range tests {
+		rs, err := New("rules", []Definition{{Name: "test", When: test.when, Verdict: Block}}, "", models)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.when, err)
+			continue
+		}
+		verdict, _, err := rs.Decide(testInput())
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.when, err)
+			continue
+		}
+		if verdict != test.verdict {
+			t.Errorf("%s: got verdict %s, expected %s", test.when, verdict, test.verdict)
+		}
+	}
+}
+
+func TestFirstMatch(t *testing.T) {
+	rs, err := New("rules", []Definition{
+		{Name: "trusted", When: `client.ip == "192.0.2.1"`, Verdict: Allow},
+		{Name: "attack", When: "model.body > 0.5", Verdict: Block},
+	}, Block, []string{"body"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verdict, name, err := rs.Decide(testInput())
+	if err != nil || verdict != Allow || name != "trusted" {
+		t.Errorf("first matching rule not applied: %s %s %v", verdict, name, err)
+	}
+
+	input := testInput()
+	input.ClientIP = "198.51.100.1"
+	block, err := rs.CheckTransaction(input)
+	if err != nil || !block {
+		t.Errorf("second rule not applied: %v", err)
+	}
+
+	input.Results = nil
+	input.PhaseResults = nil
+	verdict, name, err = rs.Decide(input)
+	if err != nil || verdict != Block || name != "" {
+		t.Errorf("default verdict not applied: %s %s %v", verdict, name, err)
+	}
+}
+
+func TestDecideError(t *testing.T) {
+	rs, err := New("rules", []Definition{{When: "waf.mode > 1", Verdict: Block}}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rs.CheckTransaction(testInput()); err == nil {
+		t.Errorf("evaluation error not returned")
+	}
+}
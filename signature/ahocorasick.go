@@ -0,0 +1,82 @@
+package signature
+
+// automaton is an Aho-Corasick automaton, finding all the literals in
+// a text with a single pass over it.
+type automaton struct {
+	// next are the transitions of each state, by byte
+	next []map[byte]int
+	// fail is the state of the longest proper suffix of each state
+	// that is a prefix of a literal
+	fail []int
+	// out are the literals (by index) ending in each state, including
+	// the ones of its suffixes
+	out [][]int
+}
+
+// newAutomaton builds the automaton of the literals.
+func newAutomaton(literals []string) *automaton {
+	a := &automaton{next: []map[byte]int{{}}, fail: []int{0}, out: [][]int{nil}}
+	for i, literal := range literals {
+		state := 0
+		for j := 0; j < len(literal); j++ {
+			next, ok := a.next[state][literal[j]]
+			if !ok {
+				next = len(a.next)
+				a.next = append(a.next, map[byte]int{})
+				a.fail = append(a.fail, 0)
+				a.out = append(a.out, nil)
+				a.next[state][literal[j]] = next
+			}
+			state = next
+		}
+		a.out[state] = append(a.out[state], i)
+	}
+
+	// Breadth first, so the failure state of the parent is set
+	queue := make([]int, 0, len(a.next))
+	for _, child := range a.next[0] {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for b, child := range a.next[state] {
+			queue = append(queue, child)
+			fail := a.fail[state]
+			for {
+				if next, ok := a.next[fail][b]; ok {
+					a.fail[child] = next
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = a.fail[fail]
+			}
+			a.out[child] = append(a.out[child], a.out[a.fail[child]]...)
+		}
+	}
+	return a
+}
+
+// match calls found with the index of each literal in the text, once
+// per occurrence.
+func (a *automaton) match(text string, found func(int)) {
+	state := 0
+	for i := 0; i < len(text); i++ {
+		b := text[i]
+		for {
+			if next, ok := a.next[state][b]; ok {
+				state = next
+				break
+			}
+			if state == 0 {
+				break
+			}
+			state = a.fail[state]
+		}
+		for _, literal := range a.out[state] {
+			found(literal)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+/*
+Package signature scores payloads against a file of weighted
+signatures, literals (matched with an Aho-Corasick automaton) or RE2
+regular expressions, filling the gap between the WAF rules and the ML
+models. The signature file is reloaded when it changes, without
+restarting WACE.
+*/
+package signature
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pm "wace/pluginmanager"
+
+	lg "github.com/tilsor/ModSecIntl_logging/logging"
+	"gopkg.in/yaml.v3"
+)
+
+// Signature is a signature of the signature file, with a literal or a
+// pattern.
+type Signature struct {
+	ID      string  `yaml:"id"`
+	Literal string  `yaml:"literal"`
+	Pattern string  `yaml:"pattern"`
+	Weight  float64 `yaml:"weight"`
+	// NoCase matches the signature ignoring the case
+	NoCase bool `yaml:"nocase"`
+}
+
+// fileData is the signature file
+type fileData struct {
+	Signatures []Signature `yaml:"signatures"`
+}
+
+// Set is a compiled set of signatures.
+type Set struct {
+	signatures []Signature
+	// literals and their signatures (by index), matched as is or in
+	// lower case
+	literals       *automaton
+	literalIDs     []int
+	nocaseLiterals *automaton
+	nocaseIDs      []int
+	// patterns and their signatures
+	patterns   []*regexp.Regexp
+	patternIDs []int
+}
+
+// NewSet compiles the signatures. The IDs must be unique, the weights
+// between 0 and 1, and each signature must have either a literal or a
+// pattern.
+func NewSet(signatures []Signature) (*Set, error) {
+	s := &Set{signatures: signatures}
+	ids := make(map[string]bool)
+	var literals, nocaseLiterals []string
+	for i, sig := range signatures {
+		if sig.ID == "" {
+			return nil, fmt.Errorf("signature %d without id", i)
+		}
+		if ids[sig.ID] {
+			return nil, fmt.Errorf("signature %s defined twice", sig.ID)
+		}
+		ids[sig.ID] = true
+		if sig.Weight < 0 || sig.Weight > 1 {
+			return nil, fmt.Errorf("signature %s: weight must be between 0 and 1", sig.ID)
+		}
+		switch {
+		case (sig.Literal == "") == (sig.Pattern == ""):
+			return nil, fmt.Errorf("signature %s: needs either a literal or a pattern", sig.ID)
+		case sig.Literal != "" && sig.NoCase:
+			nocaseLiterals = append(nocaseLiterals, strings.ToLower(sig.Literal))
+			s.nocaseIDs = append(s.nocaseIDs, i)
+		case sig.Literal != "":
+			literals = append(literals, sig.Literal)
+			s.literalIDs = append(s.literalIDs, i)
+		default:
+			pattern := sig.Pattern
+			if sig.NoCase {
+				pattern = "(?i)" + pattern
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("signature %s: %v", sig.ID, err)
+			}
+			s.patterns = append(s.patterns, re)
+			s.patternIDs = append(s.patternIDs, i)
+		}
+	}
+	s.literals = newAutomaton(literals)
+	s.nocaseLiterals = newAutomaton(nocaseLiterals)
+	return s, nil
+}
+
+// Parse parses a signature file, in YAML, eg:
+//
+//	signatures:
+//	  - id: "sqli-union"
+//	    literal: "union select"
+//	    nocase: true
+//	    weight: 0.8
+//	  - id: "xss-script"
+//	    pattern: "<script[^>]*>"
+//	    nocase: true
+//	    weight: 0.9
+func Parse(data []byte) (*Set, error) {
+	var in fileData
+	if err := yaml.Unmarshal(data, &in); err != nil {
+		return nil, err
+	}
+	return NewSet(in.Signatures)
+}
+
+// Load loads the signature file.
+func Load(path string) (*Set, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Match returns the IDs of the signatures found in the payload, in the
+// order of the signature file, and the score of the payload: the
+// probability that at least one of them is an attack, taking each
+// weight as an independent probability (1 - the product of 1 - weight).
+func (s *Set) Match(payload string) ([]string, float64) {
+	found := make(map[int]bool)
+	s.literals.match(payload, func(i int) {
+		found[s.literalIDs[i]] = true
+	})
+	if len(s.nocaseIDs) > 0 {
+		s.nocaseLiterals.match(strings.ToLower(payload), func(i int) {
+			found[s.nocaseIDs[i]] = true
+		})
+	}
+	for i, re := range s.patterns {
+		if re.MatchString(payload) {
+			found[s.patternIDs[i]] = true
+		}
+	}
+
+	indexes := make([]int, 0, len(found))
+	for i := range found {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	ids := make([]string, len(indexes))
+	benign := 1.0
+	for j, i := range indexes {
+		ids[j] = s.signatures[i].ID
+		benign *= 1 - s.signatures[i].Weight
+	}
+	return ids, 1 - benign
+}
+
+// Len returns the number of signatures of the set.
+func (s *Set) Len() int {
+	return len(s.signatures)
+}
+
+// Model is a model plugin scoring the payloads with the signatures of
+// a file, which it reloads when the file changes.
+type Model struct {
+	path    string
+	set     atomic.Pointer[Set]
+	modTime time.Time
+	size    int64
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewModel loads the signature file, and checks every interval if it
+// changed, to reload it (a zero interval disables the reloads). If the
+// new file is invalid, the previous signatures are kept.
+func NewModel(path string, interval time.Duration) (*Model, error) {
+	m := &Model{path: path, done: make(chan struct{})}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	set, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	m.set.Store(set)
+	m.modTime, m.size = info.ModTime(), info.Size()
+	if interval > 0 {
+		go m.watch(interval)
+	}
+	return m, nil
+}
+
+// watch reloads the signature file when its modification time or size
+// change.
+func (m *Model) watch(interval time.Duration) {
+	logger := lg.Get()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.done:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(m.path)
+		if err != nil {
+			logger.Printf(lg.ERROR, "signature | cannot check %s: %v", m.path, err)
+			continue
+		}
+		if info.ModTime().Equal(m.modTime) && info.Size() == m.size {
+			continue
+		}
+		m.modTime, m.size = info.ModTime(), info.Size()
+		if err := m.Reload(); err != nil {
+			logger.Printf(lg.ERROR, "signature | cannot reload %s, keeping the previous signatures: %v", m.path, err)
+			continue
+		}
+		logger.Printf(lg.INFO, "signature | %s reloaded", m.path)
+	}
+}
+
+// Reload loads the signature file again, keeping the previous
+// signatures if it is invalid.
+func (m *Model) Reload() error {
+	set, err := Load(m.path)
+	if err != nil {
+		return err
+	}
+	m.set.Store(set)
+	return nil
+}
+
+// Close stops checking if the signature file changes.
+func (m *Model) Close() {
+	m.once.Do(func() { close(m.done) })
+}
+
+// Process returns the score of the payload, with the IDs of the
+// matched signatures in the "signatures" data.
+func (m *Model) Process(input pm.ModelInput) (pm.ModelResults, error) {
+	ids, score := m.set.Load().Match(input.Payload)
+	return pm.ModelResults{
+		ProbAttack: score,
+		Data:       map[string]interface{}{"signatures": ids},
+	}, nil
+}
@@ -0,0 +1,140 @@
+package signature
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	pm "wace/pluginmanager"
+)
+
+func TestAutomaton(t *testing.T) {
+	literals := []string{"he", "she", "his", "hers", "s"}
+	a := newAutomaton(literals)
+	var found []string
+	a.match("ushers", func(i int) {
+		found = append(found, literals[i])
+	})
+	sort.Strings(found)
+	expected := []string{"he", "hers", "s", "s", "she"}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("got %v, expected %v", found, expected)
+	}
+
+	a = newAutomaton([]string{"aab", "ab"})
+	count := 0
+	a.match("aaab aab", func(int) { count++ })
+	if count != 4 {
+		t.Errorf("got %d matches, expected 4", count)
+	}
+}
+
+const signatures = `
+signatures:
+  - id: "sqli-union"
+    literal: "union select"
+    nocase: true
+    weight: 0.8
+  - id: "traversal"
+    literal: "../"
+    weight: 0.5
+  - id: "xss-script"
+    pattern: "<script[^>]*>"
+    nocase: true
+    weight: 0.9
+  - id: "passwd"
+    literal: "/etc/passwd"
+    weight: 0.5
+`
+
+func TestMatch(t *testing.T) {
+	s, err := Parse([]byte(signatures))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		payload string
+		ids     []string
+		score   float64
+	}{
+		{"GET /index.html", []string{}, 0},
+		{"id=1 UNION SELECT password", []string{"sqli-union"}, 0.8},
+		{"file=../../etc/passwd", []string{"traversal", "passwd"}, 0.75},
+		{"q=<SCRIPT src=x> union select", []string{"sqli-union", "xss-script"}, 0.98},
+		{"file=../../ETC/PASSWD", []string{"traversal"}, 0.5},
+	}
+	for _, test := range tests {
+		ids, score := s.Match(test.payload)
+		if !reflect.DeepEqual(ids, test.ids) || math.Abs(score-test.score) > 1e-9 {
+			t.Errorf("Match(%q) = %v %v, expected %v %v", test.payload, ids, score, test.ids, test.score)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	invalid := []string{
+		`signatures: [{literal: "a", weight: 0.5}]`,
+		`signatures: [{id: "a", literal: "a", weight: 0.5}, {id: "a", literal: "b", weight: 0.5}]`,
+		`signatures: [{id: "a", literal: "a", weight: 1.5}]`,
+		`signatures: [{id: "a", weight: 0.5}]`,
+		`signatures: [{id: "a", literal: "a", pattern: "a", weight: 0.5}]`,
+		`signatures: [{id: "a", pattern: "a(", weight: 0.5}]`,
+		`signatures: {}`,
+	}
+	for _, data := range invalid {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("invalid signatures %s accepted", data)
+		}
+	}
+}
+
+func TestModelReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signatures.yaml")
+	if err := os.WriteFile(path, []byte(signatures), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewModel(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	res, err := m.Process(pm.ModelInput{Payload: "cat /etc/passwd"})
+	if err != nil || res.ProbAttack != 0.5 || !reflect.DeepEqual(res.Data["signatures"], []string{"passwd"}) {
+		t.Errorf("got %+v (%v), expected the passwd signature", res, err)
+	}
+
+	// An invalid file keeps the previous signatures
+	if err := os.WriteFile(path, []byte("signatures: [{id: \"a\"}]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if m.set.Load().Len() != 4 {
+		t.Errorf("invalid signature file loaded")
+	}
+
+	updated := strings.Replace(signatures, "weight: 0.5\n", "weight: 0.25\n", -1)
+	if err := os.WriteFile(path, []byte(updated+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		res, _ := m.Process(pm.ModelInput{Payload: "cat /etc/passwd"})
+		if res.ProbAttack == 0.25 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("signature file not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := NewModel(filepath.Join(t.TempDir(), "missing.yaml"), 0); err == nil {
+		t.Errorf("missing signature file accepted")
+	}
+}
@@ -0,0 +1,375 @@
+// Package strategy implements the built-in decision strategies, used
+// as decision plugins configured by params, without building a Go
+// plugin.
+package strategy
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	pm "wace/pluginmanager"
+)
+
+// Names of the built-in strategies
+const (
+	MajorityVote = "majority_vote"
+	AnyAbove     = "any_above_threshold"
+	MaxScore     = "max_score"
+	Logistic     = "logistic"
+	CRSOverride  = "crs_override"
+)
+
+// Modes of the CRS-override strategy
+const (
+	// Downgrade lets the models only turn a CRS block into an allow
+	Downgrade = "downgrade"
+	// Upgrade lets the models only turn a CRS allow into a block
+	Upgrade = "upgrade"
+)
+
+// Decision decides if a transaction must be blocked.
+type Decision func(pm.TransactionInput) (bool, error)
+
+// constructors create the strategies from their params and the
+// thresholds configured for each model plugin.
+var constructors = map[string]func(params, map[string]float64) (Decision, error){
+	MajorityVote: newMajorityVote,
+	AnyAbove:     newAnyAbove,
+	MaxScore:     newMaxScore,
+	Logistic:     newLogistic,
+	CRSOverride:  newCRSOverride,
+}
+
+// Names returns the names of the built-in strategies.
+func Names() []string {
+	var names []string
+	for name := range constructors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the strategy with the given params. The thresholds are
+// the ones of the model plugins in the configuration file, used when
+// the params do not set a threshold for the model ("threshold.<id>").
+// The params are validated, so the errors are reported when the
+// configuration is loaded.
+func New(name string, p map[string]string, thresholds map[string]float64) (Decision, error) {
+	constructor, ok := constructors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %s, valid ones are %s", name, strings.Join(Names(), ", "))
+	}
+	return constructor(params(p), thresholds)
+}
+
+// params are the params of a strategy.
+type params map[string]string
+
+// float returns the float param, or the default value if it is not set.
+func (p params) float(name string, def float64) (float64, error) {
+	value, ok := p[name]
+	if !ok {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %s parameter: %v", name, err)
+	}
+	return f, nil
+}
+
+// bool returns the boolean param, or false if it is not set.
+func (p params) bool(name string) (bool, error) {
+	value, ok := p[name]
+	if !ok {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("error parsing %s parameter: %v", name, err)
+	}
+	return b, nil
+}
+
+// modelFloats returns the float params with the prefix, keyed by the
+// model ID after it (eg: "threshold.trivial").
+func (p params) modelFloats(prefix string) (map[string]float64, error) {
+	values := make(map[string]float64)
+	for name := range p {
+		modelID, ok := strings.CutPrefix(name, prefix+".")
+		if !ok {
+			continue
+		}
+		f, err := p.float(name, 0)
+		if err != nil {
+			return nil, err
+		}
+		values[modelID] = f
+	}
+	return values, nil
+}
+
+// thresholds are the thresholds of the models: the one of the
+// "threshold.<id>" param, or the one of the model configuration if it
+// is set, or the default "threshold" param (0.5 if not set).
+type thresholds struct {
+	def    float64
+	models map[string]float64
+}
+
+func newThresholds(p params, configured map[string]float64) (thresholds, error) {
+	def, err := p.float("threshold", 0.5)
+	if err != nil {
+		return thresholds{}, err
+	}
+	models, err := p.modelFloats("threshold")
+	if err != nil {
+		return thresholds{}, err
+	}
+	for modelID, threshold := range configured {
+		if _, ok := models[modelID]; !ok && threshold > 0 {
+			models[modelID] = threshold
+		}
+	}
+	return thresholds{def: def, models: models}, nil
+}
+
+func (t thresholds) of(modelID string) float64 {
+	if threshold, ok := t.models[modelID]; ok {
+		return threshold
+	}
+	return t.def
+}
+
+// crsScore returns the anomaly score of the direction sent by the WAF,
+// divided by its threshold.
+func crsScore(input pm.TransactionInput) (float64, error) {
+	direction := input.Direction
+	if direction == "" {
+		direction = pm.Inbound
+	}
+	stringBlocking, ok := input.WAFdata[direction+"_blocking"]
+	if !ok {
+		return 0, fmt.Errorf("%s_blocking parameter not found", direction)
+	}
+	stringThreshold, ok := input.WAFdata[direction+"_threshold"]
+	if !ok {
+		return 0, fmt.Errorf("%s_threshold parameter not found", direction)
+	}
+	as, err := strconv.ParseFloat(stringBlocking, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing anomaly score: %v", err)
+	}
+	it, err := strconv.ParseFloat(stringThreshold, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing anomaly score threshold: %v", err)
+	}
+	if it <= 0 {
+		return 0, fmt.Errorf("invalid anomaly score threshold %v", it)
+	}
+	return as / it, nil
+}
+
+// weightedScore returns the weighted average of the model results, and
+// false if there are none.
+func weightedScore(input pm.TransactionInput) (float64, bool) {
+	var weightedSum, weightsSum float64
+	for modelID, res := range input.Results {
+		weightedSum += res.ProbAttack * input.ModelWeight[modelID]
+		weightsSum += input.ModelWeight[modelID]
+	}
+	if weightsSum == 0 {
+		return 0, false
+	}
+	return weightedSum / weightsSum, true
+}
+
+// newMajorityVote blocks when the votes for attack (models over their
+// threshold) are more than the "quorum" fraction (0.5 by default) of
+// the votes. With "weighted", each vote counts as the weight of the
+// model, and with "waf_vote", the CRS verdict is also a vote, with the
+// "waf_weight" weight (1 by default).
+func newMajorityVote(p params, configured map[string]float64) (Decision, error) {
+	t, err := newThresholds(p, configured)
+	if err != nil {
+		return nil, err
+	}
+	quorum, err := p.float("quorum", 0.5)
+	if err != nil {
+		return nil, err
+	}
+	if quorum < 0 || quorum >= 1 {
+		return nil, fmt.Errorf("quorum must be between 0 and 1")
+	}
+	weighted, err := p.bool("weighted")
+	if err != nil {
+		return nil, err
+	}
+	wafVote, err := p.bool("waf_vote")
+	if err != nil {
+		return nil, err
+	}
+	wafWeight, err := p.float("waf_weight", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(input pm.TransactionInput) (bool, error) {
+		var votes, attackVotes float64
+		for modelID, res := range input.Results {
+			vote := 1.0
+			if weighted {
+				vote = input.ModelWeight[modelID]
+			}
+			votes += vote
+			if res.ProbAttack >= t.of(modelID) {
+				attackVotes += vote
+			}
+		}
+		if wafVote {
+			score, err := crsScore(input)
+			if err != nil {
+				return false, err
+			}
+			votes += wafWeight
+			if score >= 1 {
+				attackVotes += wafWeight
+			}
+		}
+		if votes == 0 {
+			return false, nil
+		}
+		return attackVotes/votes > quorum, nil
+	}, nil
+}
+
+// newAnyAbove blocks when at least "min_models" models (1 by default)
+// are over their threshold.
+func newAnyAbove(p params, configured map[string]float64) (Decision, error) {
+	t, err := newThresholds(p, configured)
+	if err != nil {
+		return nil, err
+	}
+	minModels, err := p.float("min_models", 1)
+	if err != nil {
+		return nil, err
+	}
+	if minModels < 1 {
+		return nil, fmt.Errorf("min_models must be at least 1")
+	}
+
+	return func(input pm.TransactionInput) (bool, error) {
+		count := 0
+		for modelID, res := range input.Results {
+			if res.ProbAttack >= t.of(modelID) {
+				count++
+			}
+		}
+		return float64(count) >= minModels, nil
+	}, nil
+}
+
+// newMaxScore blocks when the highest model result is over the
+// "threshold" param (0.5 by default).
+func newMaxScore(p params, _ map[string]float64) (Decision, error) {
+	threshold, err := p.float("threshold", 0.5)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(input pm.TransactionInput) (bool, error) {
+		if len(input.Results) == 0 {
+			return false, nil
+		}
+		maxScore := math.Inf(-1)
+		for _, res := range input.Results {
+			maxScore = math.Max(maxScore, res.ProbAttack)
+		}
+		return maxScore >= threshold, nil
+	}, nil
+}
+
+// newLogistic stacks the model results with a logistic regression:
+// it blocks when sigmoid(intercept + sum(coef.<id> * result of <id>) +
+// waf_coef * CRS score) is over the "threshold" param (0.5 by
+// default). The CRS score is the anomaly score divided by its
+// threshold, and is only used if waf_coef is set. Models without a
+// coefficient are ignored.
+func newLogistic(p params, _ map[string]float64) (Decision, error) {
+	intercept, err := p.float("intercept", 0)
+	if err != nil {
+		return nil, err
+	}
+	coefs, err := p.modelFloats("coef")
+	if err != nil {
+		return nil, err
+	}
+	if len(coefs) == 0 {
+		return nil, fmt.Errorf("no coef.<model> parameter found")
+	}
+	_, useWAF := p["waf_coef"]
+	wafCoef, err := p.float("waf_coef", 0)
+	if err != nil {
+		return nil, err
+	}
+	threshold, err := p.float("threshold", 0.5)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(input pm.TransactionInput) (bool, error) {
+		z := intercept
+		for modelID, res := range input.Results {
+			z += coefs[modelID] * res.ProbAttack
+		}
+		if useWAF {
+			score, err := crsScore(input)
+			if err != nil {
+				return false, err
+			}
+			z += wafCoef * score
+		}
+		return 1/(1+math.Exp(-z)) >= threshold, nil
+	}, nil
+}
+
+// newCRSOverride starts from the CRS verdict (the anomaly score over
+// its threshold), and lets the models change it in only one way,
+// according to the "mode" param: with "downgrade" (the default), a CRS
+// block is allowed when the weighted score of the models is below the
+// "threshold" param (0.5 by default), and with "upgrade", a CRS allow
+// is blocked when the weighted score is over it. Without model
+// results, the CRS verdict is kept.
+func newCRSOverride(p params, _ map[string]float64) (Decision, error) {
+	mode, ok := p["mode"]
+	if !ok {
+		mode = Downgrade
+	}
+	if mode != Downgrade && mode != Upgrade {
+		return nil, fmt.Errorf("invalid mode %s", mode)
+	}
+	threshold, err := p.float("threshold", 0.5)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(input pm.TransactionInput) (bool, error) {
+		score, err := crsScore(input)
+		if err != nil {
+			return false, err
+		}
+		crsBlock := score >= 1
+		mlScore, ok := weightedScore(input)
+		if !ok {
+			return crsBlock, nil
+		}
+		if mode == Downgrade {
+			return crsBlock && mlScore >= threshold, nil
+		}
+		return crsBlock || mlScore >= threshold, nil
+	}, nil
+}
@@ -0,0 +1,170 @@
+package strategy
+
+import (
+	"testing"
+
+	pm "wace/pluginmanager"
+)
+
+// fixture builds a decision input with the results of the models a
+// (weight 1), b (weight 1) and c (weight 2), and the inbound anomaly
+// score of the WAF (threshold 5). A negative result means the model has
+// no result.
+func fixture(a, b, c float64, anomalyScore string) pm.TransactionInput {
+	results := make(map[string]pm.ModelResults)
+	weights := make(map[string]float64)
+	for modelID, res := range map[string]float64{"a": a, "b": b, "c": c} {
+		if res < 0 {
+			continue
+		}
+		results[modelID] = pm.ModelResults{ProbAttack: res}
+	}
+	for modelID, w := range map[string]float64{"a": 1, "b": 1, "c": 2} {
+		if _, ok := results[modelID]; ok {
+			weights[modelID] = w
+		}
+	}
+	return pm.TransactionInput{
+		DecisionInput: pm.DecisionInput{
+			TransactionId: "tx",
+			Results:       results,
+			ModelWeight:   weights,
+			WAFdata:       map[string]string{"inbound_blocking": anomalyScore, "inbound_threshold": "5"},
+		},
+		Direction: pm.Inbound,
+	}
+}
+
+// fixtures are shared by the tests of every strategy.
+var fixtures = map[string]pm.TransactionInput{
+	"benign":   fixture(0.1, 0.2, 0.3, "0"),
+	"attack":   fixture(0.9, 0.8, 0.95, "10"),
+	"split":    fixture(0.9, 0.7, 0.1, "5"),
+	"crs_only": fixture(0.1, 0.1, 0.1, "15"),
+	"ml_only":  fixture(0.9, 0.9, 0.9, "0"),
+	"empty":    fixture(-1, -1, -1, "10"),
+}
+
+func testStrategy(t *testing.T, name string, p map[string]string, thresholds map[string]float64, expected map[string]bool) {
+	t.Helper()
+	decide, err := New(name, p, thresholds)
+	if err != nil {
+		t.Fatalf("%s %v: %v", name, p, err)
+	}
+	for fixtureName, input := range fixtures {
+		block, err := decide(input)
+		if err != nil {
+			t.Errorf("%s %v on %s: unexpected error %v", name, p, fixtureName, err)
+			continue
+		}
+		if block != expected[fixtureName] {
+			t.Errorf("%s %v on %s: got %t, expected %t", name, p, fixtureName, block, expected[fixtureName])
+		}
+	}
+}
+
+func TestMajorityVote(t *testing.T) {
+	testStrategy(t, MajorityVote, nil, nil, map[string]bool{
+		"attack": true, "split": true, "ml_only": true,
+	})
+	// a and b weigh 2 of 4, which is not a majority
+	testStrategy(t, MajorityVote, map[string]string{"weighted": "true"}, nil, map[string]bool{
+		"attack": true, "ml_only": true,
+	})
+	// Only a votes for attack with the threshold of b raised
+	testStrategy(t, MajorityVote, nil, map[string]float64{"b": 0.75}, map[string]bool{
+		"attack": true, "ml_only": true,
+	})
+	testStrategy(t, MajorityVote, map[string]string{"threshold.b": "0.6"}, map[string]float64{"b": 0.75}, map[string]bool{
+		"attack": true, "split": true, "ml_only": true,
+	})
+	testStrategy(t, MajorityVote, map[string]string{"waf_vote": "true", "waf_weight": "4"}, nil, map[string]bool{
+		"attack": true, "split": true, "crs_only": true, "empty": true,
+	})
+}
+
+func TestAnyAbove(t *testing.T) {
+	testStrategy(t, AnyAbove, nil, nil, map[string]bool{
+		"attack": true, "split": true, "ml_only": true,
+	})
+	testStrategy(t, AnyAbove, map[string]string{"min_models": "3"}, nil, map[string]bool{
+		"attack": true, "ml_only": true,
+	})
+	testStrategy(t, AnyAbove, map[string]string{"threshold": "0.95"}, map[string]float64{"a": 0.05}, map[string]bool{
+		"benign": true, "attack": true, "split": true, "crs_only": true, "ml_only": true,
+	})
+}
+
+func TestMaxScore(t *testing.T) {
+	testStrategy(t, MaxScore, nil, nil, map[string]bool{
+		"attack": true, "split": true, "ml_only": true,
+	})
+	testStrategy(t, MaxScore, map[string]string{"threshold": "0.95"}, nil, map[string]bool{
+		"attack": true,
+	})
+}
+
+func TestLogistic(t *testing.T) {
+	p := map[string]string{"intercept": "-6", "coef.a": "4", "coef.b": "4", "coef.c": "4"}
+	testStrategy(t, Logistic, p, nil, map[string]bool{
+		"attack": true, "split": true, "ml_only": true,
+	})
+	p["waf_coef"] = "4"
+	testStrategy(t, Logistic, p, nil, map[string]bool{
+		"attack": true, "split": true, "crs_only": true, "ml_only": true, "empty": true,
+	})
+}
+
+func TestCRSOverride(t *testing.T) {
+	testStrategy(t, CRSOverride, nil, nil, map[string]bool{
+		"attack": true, "empty": true,
+	})
+	testStrategy(t, CRSOverride, map[string]string{"mode": Upgrade}, nil, map[string]bool{
+		"attack": true, "split": true, "crs_only": true, "ml_only": true, "empty": true,
+	})
+	testStrategy(t, CRSOverride, map[string]string{"mode": Downgrade, "threshold": "0.4"}, nil, map[string]bool{
+		"attack": true, "split": true, "empty": true,
+	})
+}
+
+func TestMissingWAFData(t *testing.T) {
+	input := fixtures["attack"]
+	input.WAFdata = map[string]string{"inbound_blocking": "5"}
+	for _, name := range []string{CRSOverride, MajorityVote} {
+		decide, err := New(name, map[string]string{"waf_vote": "true"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decide(input); err == nil {
+			t.Errorf("%s: missing WAF data did not fail", name)
+		}
+	}
+	input.Direction = pm.Outbound
+	input.WAFdata = map[string]string{"outbound_blocking": "5", "outbound_threshold": "4"}
+	decide, _ := New(CRSOverride, nil, nil)
+	if block, err := decide(input); err != nil || !block {
+		t.Errorf("outbound anomaly score not used: %v", err)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		p    map[string]string
+	}{
+		{"unknown", nil},
+		{MajorityVote, map[string]string{"quorum": "1"}},
+		{MajorityVote, map[string]string{"weighted": "maybe"}},
+		{AnyAbove, map[string]string{"min_models": "0"}},
+		{AnyAbove, map[string]string{"threshold.a": "high"}},
+		{MaxScore, map[string]string{"threshold": ""}},
+		{Logistic, map[string]string{"intercept": "1"}},
+		{Logistic, map[string]string{"coef.a": "1", "waf_coef": "x"}},
+		{CRSOverride, map[string]string{"mode": "both"}},
+	}
+	for _, test := range tests {
+		if _, err := New(test.name, test.p, nil); err == nil {
+			t.Errorf("%s %v: invalid strategy accepted", test.name, test.p)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Package tenant handles the isolation of the transactions of the
+different tenants (customers) served by a single WACE instance.
+
+A tenant is identified by a string sent by the WAF, either in the
+gRPC metadata of each call or in the Init call parameters. Transaction
+IDs are scoped per tenant by prefixing them with the tenant ID, so two
+WAFs of different tenants can use the same transaction ID without
+clashing.
+*/
+package tenant
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/metadata"
+)
+
+// MetadataKey is the gRPC metadata key holding the tenant ID.
+const MetadataKey = "wace-tenant"
+
+// separator splits the tenant ID and the transaction ID in a scoped
+// transaction ID. Neither tenant nor transaction IDs can contain it.
+const separator = "/"
+
+// AttributeKey is the key of the tenant attribute added to metrics.
+const AttributeKey = "tenant"
+
+// ScopeID returns the transaction ID scoped to the given tenant. If
+// the tenant is empty (default tenant), the transaction ID is returned
+// unchanged.
+func ScopeID(tenantID, transactionID string) string {
+	if tenantID == "" {
+		return transactionID
+	}
+	return tenantID + separator + transactionID
+}
+
+// CheckID returns an error if the tenant or transaction ID contains
+// the separator, which would make the scoped transaction ID ambiguous
+// (eg: the transaction "acme/1" of the default tenant would be the
+// transaction "1" of the "acme" tenant).
+func CheckID(id string) error {
+	if strings.Contains(id, separator) {
+		return fmt.Errorf("invalid id %q: it contains %q", id, separator)
+	}
+	return nil
+}
+
+// SplitID returns the tenant ID and the original transaction ID of a
+// scoped transaction ID.
+func SplitID(scopedID string) (string, string) {
+	tenantID, transactionID, found := strings.Cut(scopedID, separator)
+	if !found {
+		return "", scopedID
+	}
+	return tenantID, transactionID
+}
+
+// FromContext returns the tenant ID sent in the gRPC metadata of the
+// call, or the empty string if there is none.
+func FromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(MetadataKey)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Attribute returns the metric attribute for the tenant of the given
+// scoped transaction ID.
+func Attribute(scopedID string) attribute.KeyValue {
+	tenantID, _ := SplitID(scopedID)
+	return attribute.String(AttributeKey, tenantID)
+}
+
+// Bindings binds the transactions initialized with a tenant in the Init
+// parameters to that tenant, for the clients that do not send the
+// tenant in the metadata of every call. It keeps at most size bindings,
+// forgetting the oldest ones, so the bindings of the transactions that
+// are never closed do not pile up. It is safe for concurrent use.
+type Bindings struct {
+	size    int
+	mutex   sync.Mutex
+	tenants map[string]*list.Element
+	// order has the oldest bindings first
+	order *list.List
+}
+
+type binding struct {
+	transactionID string
+	tenantID      string
+}
+
+// NewBindings creates a Bindings keeping at most size bindings.
+func NewBindings(size int) *Bindings {
+	return &Bindings{size: size, tenants: make(map[string]*list.Element), order: list.New()}
+}
+
+// Bind binds the transaction to the tenant.
+func (b *Bindings) Bind(transactionID, tenantID string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if elem, ok := b.tenants[transactionID]; ok {
+		b.order.Remove(elem)
+	}
+	b.tenants[transactionID] = b.order.PushBack(&binding{transactionID, tenantID})
+	for b.order.Len() > b.size {
+		oldest := b.order.Front()
+		b.order.Remove(oldest)
+		delete(b.tenants, oldest.Value.(*binding).transactionID)
+	}
+}
+
+// Tenant returns the tenant the transaction is bound to, or the empty
+// string if it is not bound.
+func (b *Bindings) Tenant(transactionID string) string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if elem, ok := b.tenants[transactionID]; ok {
+		return elem.Value.(*binding).tenantID
+	}
+	return ""
+}
+
+// Unbind forgets the tenant of the transaction.
+func (b *Bindings) Unbind(transactionID string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if elem, ok := b.tenants[transactionID]; ok {
+		b.order.Remove(elem)
+		delete(b.tenants, transactionID)
+	}
+}
+
+// Len returns the number of bound transactions.
+func (b *Bindings) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.order.Len()
+}
+
+// LogWriter is an io.Writer that sends the log lines of transactions
+// belonging to a tenant with its own log file to that file, and every
+// other line to the main log.
+type LogWriter struct {
+	main    io.Writer
+	tenants map[string]io.Writer
+	mutex   sync.Mutex
+}
+
+// NewLogWriter creates a LogWriter writing to main by default, and to
+// the writer of the tenant in tenants otherwise.
+func NewLogWriter(main io.Writer, tenants map[string]io.Writer) *LogWriter {
+	return &LogWriter{main: main, tenants: tenants}
+}
+
+// Write writes a log line to the corresponding writer. Transaction log
+// lines have the form "<date> | <transaction id> | <message>".
+func (w *LogWriter) Write(p []byte) (int, error) {
+	out := w.main
+	if _, rest, found := bytes.Cut(p, []byte("| ")); found {
+		if scopedID, _, found := bytes.Cut(rest, []byte(" |")); found {
+			tenantID, _ := SplitID(string(scopedID))
+			if tw, ok := w.tenants[tenantID]; ok {
+				out = tw
+			}
+		}
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return out.Write(p)
+}
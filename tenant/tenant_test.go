@@ -0,0 +1,88 @@
+package tenant
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestScopeID(t *testing.T) {
+	if id := ScopeID("", "1234"); id != "1234" {
+		t.Errorf("default tenant scoped id is %s, expected 1234", id)
+	}
+	id := ScopeID("acme", "1234")
+	if id != "acme/1234" {
+		t.Errorf("scoped id is %s, expected acme/1234", id)
+	}
+	tenantID, transactionID := SplitID(id)
+	if tenantID != "acme" || transactionID != "1234" {
+		t.Errorf("SplitID returned %s, %s", tenantID, transactionID)
+	}
+	tenantID, transactionID = SplitID("1234")
+	if tenantID != "" || transactionID != "1234" {
+		t.Errorf("SplitID of unscoped id returned %s, %s", tenantID, transactionID)
+	}
+}
+
+func TestCheckID(t *testing.T) {
+	for _, id := range []string{"", "1234", "acme"} {
+		if err := CheckID(id); err != nil {
+			t.Errorf("valid id %q rejected: %v", id, err)
+		}
+	}
+	if err := CheckID("acme/1234"); err == nil {
+		t.Errorf("id with the separator accepted")
+	}
+}
+
+func TestBindings(t *testing.T) {
+	b := NewBindings(2)
+	b.Bind("1", "acme")
+	b.Bind("2", "other")
+	if id := b.Tenant("1"); id != "acme" {
+		t.Errorf("transaction 1 bound to %q, expected acme", id)
+	}
+	b.Unbind("1")
+	if id := b.Tenant("1"); id != "" {
+		t.Errorf("unbound transaction bound to %q", id)
+	}
+
+	// The oldest bindings are forgotten once full
+	b.Bind("3", "acme")
+	b.Bind("4", "acme")
+	if b.Len() != 2 || b.Tenant("2") != "" || b.Tenant("4") != "acme" {
+		t.Errorf("oldest binding not forgotten (%d bindings)", b.Len())
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if tenantID := FromContext(context.Background()); tenantID != "" {
+		t.Errorf("tenant without metadata is %s", tenantID)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(MetadataKey, "acme"))
+	if tenantID := FromContext(ctx); tenantID != "acme" {
+		t.Errorf("tenant from metadata is %s, expected acme", tenantID)
+	}
+}
+
+func TestLogWriter(t *testing.T) {
+	var mainBuf, acmeBuf bytes.Buffer
+	w := NewLogWriter(&mainBuf, map[string]io.Writer{"acme": &acmeBuf})
+
+	w.Write([]byte("2024/01/01 00:00:00 | acme/1 | core | analyzing\n"))
+	w.Write([]byte("2024/01/01 00:00:00 | other/1 | core | analyzing\n"))
+	w.Write([]byte("2024/01/01 00:00:00 Server started\n"))
+
+	if acmeBuf.String() != "2024/01/01 00:00:00 | acme/1 | core | analyzing\n" {
+		t.Errorf("unexpected tenant log: %q", acmeBuf.String())
+	}
+	if bytes.Contains(mainBuf.Bytes(), []byte("acme")) {
+		t.Errorf("tenant line written to the main log: %q", mainBuf.String())
+	}
+	if !bytes.Contains(mainBuf.Bytes(), []byte("other/1")) || !bytes.Contains(mainBuf.Bytes(), []byte("Server started")) {
+		t.Errorf("missing lines in the main log: %q", mainBuf.String())
+	}
+}
@@ -0,0 +1,145 @@
+package transaction
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"wace/decoding"
+)
+
+// Request is the HTTP request of a transaction, parsed once by WACE
+// from the payloads sent by the WAF, so the plugins do not need to
+// parse it again. It is built up across the phases: the request line
+// and headers are set in the RequestHeaders phase, and the body
+// arguments in the RequestBody one (or all of them in the AllRequest
+// phase).
+type Request struct {
+	Method   string
+	URI      string
+	Path     string
+	Protocol string
+	// QueryArgs are the URL decoded arguments of the query string
+	QueryArgs []decoding.Arg
+	Cookies   []decoding.Arg
+	Header    http.Header
+	// BodyArgs are the arguments parsed from the body, for
+	// url-encoded, multipart, JSON and XML bodies. The body is only
+	// parsed if a model plugin with normalized input analyzes it.
+	BodyArgs []decoding.Arg
+	// Files are the files uploaded in a multipart body
+	Files []decoding.File
+}
+
+// Response is the HTTP response of a transaction, built up as the
+// Request.
+type Response struct {
+	Protocol string
+	Status   int
+	Header   http.Header
+	// BodyArgs are the arguments parsed from the body, for JSON and
+	// XML bodies, if a model plugin with normalized input analyzes it
+	BodyArgs []decoding.Arg
+}
+
+// parseCookies parses the Cookie headers. Unlike http.Request.Cookies,
+// it keeps the cookies with invalid names or values.
+func parseCookies(header http.Header) []decoding.Arg {
+	var cookies []decoding.Arg
+	for _, line := range header.Values("Cookie") {
+		for _, part := range strings.Split(line, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+			cookies = append(cookies, decoding.Arg{Name: name, Value: value})
+		}
+	}
+	return cookies
+}
+
+// SetRequestHead sets the request line and headers of the request of
+// the transaction.
+func (t *Transaction) SetRequestHead(line string, header http.Header) {
+	var method, uri, protocol string
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		method = fields[0]
+	}
+	if len(fields) > 1 {
+		uri = fields[1]
+	}
+	if len(fields) > 2 {
+		protocol = fields[2]
+	}
+	path, query, _ := strings.Cut(uri, "?")
+	if header == nil {
+		header = http.Header{}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.request.Method = method
+	t.request.URI = uri
+	t.request.Path = path
+	t.request.Protocol = protocol
+	t.request.QueryArgs = decoding.ParseQuery(query)
+	t.request.Cookies = parseCookies(header)
+	t.request.Header = header
+}
+
+// SetRequestBody sets the body arguments and files of the request of
+// the transaction from its decoded body.
+func (t *Transaction) SetRequestBody(body *decoding.Result) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.request.BodyArgs = body.Args
+	t.request.Files = body.Files
+}
+
+// SetResponseHead sets the status line and headers of the response of
+// the transaction.
+func (t *Transaction) SetResponseHead(line string, header http.Header) {
+	var protocol string
+	var status int
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		protocol = fields[0]
+	}
+	if len(fields) > 1 {
+		status, _ = strconv.Atoi(fields[1])
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.response.Protocol = protocol
+	t.response.Status = status
+	t.response.Header = header
+}
+
+// SetResponseBody sets the body arguments of the response of the
+// transaction from its decoded body.
+func (t *Transaction) SetResponseBody(body *decoding.Result) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.response.BodyArgs = body.Args
+}
+
+// Request returns the HTTP request of the transaction. It must not be
+// modified.
+func (t *Transaction) Request() Request {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.request
+}
+
+// Response returns the HTTP response of the transaction. It must not
+// be modified.
+func (t *Transaction) Response() Response {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.response
+}
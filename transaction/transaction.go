@@ -0,0 +1,284 @@
+/*
+Package transaction stores the information WACE keeps about each
+transaction being analyzed: the payloads sent by the WAF, and the HTTP
+request and response parsed from them. Model and decision plugins can
+get it from the transaction ID of their input, to learn more about the
+transaction they are analyzing without parsing it again.
+*/
+package transaction
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+	"time"
+
+	"wace/decoding"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Transaction holds the information of a transaction.
+type Transaction struct {
+	ID string
+
+	mutex     sync.RWMutex
+	truncated map[string]bool
+	payloads  map[string]Payload
+	decoded   map[string]*decoding.Result
+	request   Request
+	response  Response
+	clientIP  string
+	models    map[string]ModelExecution
+	verdicts  map[string]Verdict
+	start     time.Time
+}
+
+// Execution statuses of the model plugins.
+const (
+	// ModelPending is a model plugin still analyzing the transaction
+	ModelPending = "pending"
+	// ModelDone is a model plugin that analyzed the transaction
+	ModelDone = "done"
+	// ModelFailed is a model plugin that failed to analyze the
+	// transaction
+	ModelFailed = "error"
+	// ModelRejected is a model plugin whose execution was rejected by
+	// its worker pool or payload limit
+	ModelRejected = "rejected"
+	// ModelTimeout is a model plugin whose execution timed out waiting
+	// in the queue of its worker pool
+	ModelTimeout = "timeout"
+	// ModelSkipped is a model plugin that skipped the payload, as it
+	// exceeded its payload limit
+	ModelSkipped = "skipped"
+)
+
+// ModelExecution is the execution of a model plugin for the
+// transaction.
+type ModelExecution struct {
+	// Phase is the phase (model plugin type) the model analyzed
+	Phase  string
+	Status string
+	// Latency is the time from the start of the analysis of the phase
+	// until the model finished
+	Latency time.Duration
+	// Err is the error of the model, if any
+	Err string
+	// Shadow is true for the shadow model plugins, whose results are
+	// not considered by the active decision
+	Shadow bool
+}
+
+// Verdict is the verdict of a decision for the transaction.
+type Verdict struct {
+	// Decision is the ID of the decision plugin
+	Decision string
+	Block    bool
+	// WAFParams are the params sent by the WAF with the verdict
+	// request (eg: the CRS anomaly scores)
+	WAFParams map[string]string
+}
+
+// Payload is the payload of a phase as sent by the WAF. The data is
+// kept as raw bytes, so binary payloads (file uploads, compressed
+// bodies, non UTF-8 forms) reach the plugins unchanged.
+type Payload struct {
+	Data []byte
+	// ContentType is the media type of the payload (eg: the
+	// Content-Type header of the body), if known
+	ContentType string
+	// Charset is the character encoding of the payload, if known. If
+	// empty, the charset parameter of the content type is used.
+	Charset string
+}
+
+// charset returns the character encoding of the payload, defaulting to
+// UTF-8.
+func (p Payload) charset() string {
+	if p.Charset != "" {
+		return p.Charset
+	}
+	if _, params, err := mime.ParseMediaType(p.ContentType); err == nil && params["charset"] != "" {
+		return params["charset"]
+	}
+	return "utf-8"
+}
+
+// Text returns the payload decoded as UTF-8 text from its charset.
+// Invalid byte sequences are replaced by the Unicode replacement
+// character. It fails if the charset is not known.
+func (p Payload) Text() (string, error) {
+	charset := p.charset()
+	enc, err := htmlindex.Get(strings.TrimSpace(charset))
+	if err != nil {
+		return "", fmt.Errorf("unknown charset %s", charset)
+	}
+	text, err := enc.NewDecoder().Bytes(p.Data)
+	if err != nil {
+		return "", fmt.Errorf("decoding payload from %s: %v", charset, err)
+	}
+	return string(text), nil
+}
+
+var transactions sync.Map
+
+// New creates and stores the transaction with the given ID. If the
+// transaction already exists, it is returned instead.
+func New(transactionID string) *Transaction {
+	t := &Transaction{
+		ID:        transactionID,
+		truncated: make(map[string]bool),
+		payloads:  make(map[string]Payload),
+		decoded:   make(map[string]*decoding.Result),
+		models:    make(map[string]ModelExecution),
+		verdicts:  make(map[string]Verdict),
+		start:     time.Now(),
+	}
+	value, _ := transactions.LoadOrStore(transactionID, t)
+	return value.(*Transaction)
+}
+
+// Get returns the transaction with the given ID.
+func Get(transactionID string) (*Transaction, bool) {
+	value, ok := transactions.Load(transactionID)
+	if !ok {
+		return nil, false
+	}
+	return value.(*Transaction), true
+}
+
+// Delete removes the transaction with the given ID.
+func Delete(transactionID string) {
+	transactions.Delete(transactionID)
+}
+
+// truncatedKey returns the key of the truncated map for the phase
+// (model plugin type) and model.
+func truncatedKey(phase, modelID string) string {
+	return phase + "|" + modelID
+}
+
+// SetTruncated records that the payload of the phase was truncated for
+// the given model, or for all the models if modelID is empty.
+func (t *Transaction) SetTruncated(phase, modelID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.truncated[truncatedKey(phase, modelID)] = true
+}
+
+// Truncated returns true if the payload of the phase analyzed by the
+// given model was truncated. If modelID is empty, it only reports
+// whether the payload was truncated for all the models.
+func (t *Transaction) Truncated(phase, modelID string) bool {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.truncated[truncatedKey(phase, "")] || t.truncated[truncatedKey(phase, modelID)]
+}
+
+// SetPayload stores the payload sent by the WAF for the phase (model
+// plugin type).
+func (t *Transaction) SetPayload(phase string, payload Payload) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.payloads[phase] = payload
+}
+
+// Payload returns the payload sent by the WAF for the phase (model
+// plugin type). Its data is not truncated by the payload limits. The
+// core only stores the payloads consumed when the transaction is
+// closed (by the recorder or the feedback).
+func (t *Transaction) Payload(phase string) (Payload, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	payload, ok := t.payloads[phase]
+	return payload, ok
+}
+
+// SetDecoded stores the decoded payload of the phase (model plugin
+// type).
+func (t *Transaction) SetDecoded(phase string, res *decoding.Result) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.decoded[phase] = res
+}
+
+// Decoded returns the decoded payload of the phase (model plugin type).
+// Payloads are only decoded when a model plugin of the phase analyzes
+// the normalized payload.
+func (t *Transaction) Decoded(phase string) (*decoding.Result, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	res, ok := t.decoded[phase]
+	return res, ok
+}
+
+// SetClientIP sets the IP address of the client of the transaction.
+func (t *Transaction) SetClientIP(ip string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.clientIP = ip
+}
+
+// ClientIP returns the IP address of the client of the transaction, if
+// the WAF sent it.
+func (t *Transaction) ClientIP() string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.clientIP
+}
+
+// SetModelExecution records the execution of the model plugin.
+func (t *Transaction) SetModelExecution(modelID string, execution ModelExecution) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.models[modelID] = execution
+}
+
+// ModelExecutions returns the executions of the model plugins, keyed by
+// model ID.
+func (t *Transaction) ModelExecutions() map[string]ModelExecution {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	executions := make(map[string]ModelExecution, len(t.models))
+	for modelID, execution := range t.models {
+		executions[modelID] = execution
+	}
+	return executions
+}
+
+// SetVerdict records the verdict of the direction (inbound or
+// outbound).
+func (t *Transaction) SetVerdict(direction string, verdict Verdict) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.verdicts[direction] = verdict
+}
+
+// Verdicts returns the verdicts of the transaction, keyed by direction.
+func (t *Transaction) Verdicts() map[string]Verdict {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	verdicts := make(map[string]Verdict, len(t.verdicts))
+	for direction, verdict := range t.verdicts {
+		verdicts[direction] = verdict
+	}
+	return verdicts
+}
+
+// Payloads returns the payloads of the transaction, keyed by phase.
+func (t *Transaction) Payloads() map[string]Payload {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	payloads := make(map[string]Payload, len(t.payloads))
+	for phase, payload := range t.payloads {
+		payloads[phase] = payload
+	}
+	return payloads
+}
+
+// Start returns the time the transaction was created.
+func (t *Transaction) Start() time.Time {
+	return t.start
+}
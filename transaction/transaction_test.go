@@ -0,0 +1,185 @@
+package transaction
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"wace/decoding"
+)
+
+func TestStore(t *testing.T) {
+	tx := New("1")
+	if again := New("1"); again != tx {
+		t.Errorf("New replaced an existing transaction")
+	}
+	if got, ok := Get("1"); !ok || got != tx {
+		t.Errorf("Get did not return the stored transaction")
+	}
+	Delete("1")
+	if _, ok := Get("1"); ok {
+		t.Errorf("transaction not deleted")
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	tx := New("2")
+	defer Delete("2")
+
+	tx.SetTruncated("RequestBody", "model1")
+	if !tx.Truncated("RequestBody", "model1") {
+		t.Errorf("model payload not truncated")
+	}
+	if tx.Truncated("RequestBody", "model2") || tx.Truncated("RequestBody", "") {
+		t.Errorf("truncation of a model payload applied to other models")
+	}
+
+	tx.SetTruncated("AllRequest", "")
+	if !tx.Truncated("AllRequest", "model2") || !tx.Truncated("AllRequest", "") {
+		t.Errorf("phase truncation not applied to all models")
+	}
+}
+
+func TestPayload(t *testing.T) {
+	tx := New("3")
+	defer Delete("3")
+
+	if _, ok := tx.Payload("RequestBody"); ok {
+		t.Errorf("payload found before being set")
+	}
+	raw := []byte{'c', 'a', 'f', 0xe9, 0x00, 0xff}
+	tx.SetPayload("RequestBody", Payload{Data: raw, ContentType: "application/octet-stream"})
+	p, ok := tx.Payload("RequestBody")
+	if !ok || string(p.Data) != string(raw) {
+		t.Errorf("raw payload not preserved: %v", p.Data)
+	}
+}
+
+func TestPayloadText(t *testing.T) {
+	tests := []struct {
+		payload  Payload
+		expected string
+		fails    bool
+	}{
+		{Payload{Data: []byte("a=caf\xc3\xa9")}, "a=caf\u00e9", false},
+		{Payload{Data: []byte("a=caf\xe9"), Charset: "ISO-8859-1"}, "a=caf\u00e9", false},
+		{Payload{Data: []byte("a=caf\xe9"), ContentType: "application/x-www-form-urlencoded; charset=latin1"}, "a=caf\u00e9", false},
+		{Payload{Data: []byte("a=caf\xe9"), ContentType: "text/plain; charset=utf-8", Charset: "windows-1252"}, "a=caf\u00e9", false},
+		{Payload{Data: []byte("a=caf\xe9")}, "a=caf\ufffd", false},
+		{Payload{Data: []byte("a"), Charset: "no-such-charset"}, "", true},
+	}
+	for _, test := range tests {
+		text, err := test.payload.Text()
+		if (err != nil) != test.fails {
+			t.Errorf("%+v: unexpected error %v", test.payload, err)
+		}
+		if text != test.expected {
+			t.Errorf("%+v: got %q, expected %q", test.payload, text, test.expected)
+		}
+	}
+}
+
+func TestRequest(t *testing.T) {
+	tx := New("4")
+	defer Delete("4")
+
+	tx.SetRequestHead("POST /login.php?user=admin&q=%27or HTTP/1.1", http.Header{
+		"Host":   {"example.com"},
+		"Cookie": {"session=abc; theme=dark", "bad"},
+	})
+	tx.SetRequestBody(&decoding.Result{
+		Args:  []decoding.Arg{{Name: "password", Value: "x"}},
+		Files: []decoding.File{{Field: "f", Filename: "a.txt"}},
+	})
+
+	req := tx.Request()
+	if req.Method != "POST" || req.URI != "/login.php?user=admin&q=%27or" || req.Path != "/login.php" || req.Protocol != "HTTP/1.1" {
+		t.Errorf("wrong request line %+v", req)
+	}
+	if len(req.QueryArgs) != 2 || req.QueryArgs[1] != (decoding.Arg{Name: "q", Value: "'or"}) {
+		t.Errorf("wrong query args %v", req.QueryArgs)
+	}
+	expectedCookies := []decoding.Arg{{Name: "session", Value: "abc"}, {Name: "theme", Value: "dark"}, {Name: "bad", Value: ""}}
+	if len(req.Cookies) != len(expectedCookies) {
+		t.Fatalf("wrong cookies %v", req.Cookies)
+	}
+	for i := range expectedCookies {
+		if req.Cookies[i] != expectedCookies[i] {
+			t.Errorf("got cookie %v, expected %v", req.Cookies[i], expectedCookies[i])
+		}
+	}
+	if req.Header.Get("Host") != "example.com" {
+		t.Errorf("wrong headers %v", req.Header)
+	}
+	if len(req.BodyArgs) != 1 || len(req.Files) != 1 {
+		t.Errorf("wrong body %v %v", req.BodyArgs, req.Files)
+	}
+}
+
+func TestResponse(t *testing.T) {
+	tx := New("5")
+	defer Delete("5")
+
+	tx.SetResponseHead("HTTP/1.1 404 Not Found", http.Header{"Content-Type": {"application/json"}})
+	tx.SetResponseBody(&decoding.Result{Args: []decoding.Arg{{Name: "error", Value: "not found"}}})
+
+	res := tx.Response()
+	if res.Protocol != "HTTP/1.1" || res.Status != 404 || res.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("wrong status line %+v", res)
+	}
+	if len(res.BodyArgs) != 1 {
+		t.Errorf("wrong body args %v", res.BodyArgs)
+	}
+
+	// Partial lines are accepted
+	tx.SetResponseHead("", nil)
+	if res := tx.Response(); res.Status != 0 || res.Header == nil {
+		t.Errorf("wrong empty response %+v", res)
+	}
+}
+
+func TestModelExecutions(t *testing.T) {
+	tx := New("6")
+	defer Delete("6")
+
+	tx.SetClientIP("192.0.2.1")
+	if tx.ClientIP() != "192.0.2.1" {
+		t.Errorf("wrong client IP %s", tx.ClientIP())
+	}
+
+	tx.SetModelExecution("model1", ModelExecution{Phase: "RequestBody", Status: ModelPending})
+	tx.SetModelExecution("model1", ModelExecution{Phase: "RequestBody", Status: ModelDone, Latency: time.Millisecond})
+	tx.SetModelExecution("model2", ModelExecution{Phase: "AllRequest", Status: ModelTimeout, Err: "timeout"})
+
+	executions := tx.ModelExecutions()
+	if len(executions) != 2 {
+		t.Fatalf("wrong executions %v", executions)
+	}
+	if e := executions["model1"]; e.Status != ModelDone || e.Latency != time.Millisecond {
+		t.Errorf("wrong model1 execution %+v", e)
+	}
+	executions["model3"] = ModelExecution{}
+	if len(tx.ModelExecutions()) != 2 {
+		t.Errorf("executions modified through the returned map")
+	}
+}
+
+func TestVerdicts(t *testing.T) {
+	tx := New("7")
+	defer Delete("7")
+
+	tx.SetVerdict("inbound", Verdict{Decision: "simple", Block: false})
+	tx.SetVerdict("inbound", Verdict{Decision: "simple", Block: true, WAFParams: map[string]string{"inbound_blocking": "5"}})
+	tx.SetVerdict("outbound", Verdict{Decision: "simple"})
+
+	verdicts := tx.Verdicts()
+	if len(verdicts) != 2 {
+		t.Fatalf("wrong verdicts %v", verdicts)
+	}
+	if v := verdicts["inbound"]; !v.Block || v.WAFParams["inbound_blocking"] != "5" {
+		t.Errorf("wrong inbound verdict %+v", v)
+	}
+	if tx.Start().IsZero() || time.Since(tx.Start()) < 0 {
+		t.Errorf("wrong start time %v", tx.Start())
+	}
+}
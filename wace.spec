@@ -46,6 +46,9 @@ go build -v -o %{name}
 
 %install
 install -Dpm 0755 %{name} %{buildroot}%{_bindir}/%{name}
+ln -s %{name} %{buildroot}%{_bindir}/%{name}-replay
+%{_bindir}/%{name}-eval
+ln -s %{name} %{buildroot}%{_bindir}/%{name}-eval
 install -Dpm 0644 waceconfig.yaml %{buildroot}%{_sysconfdir}/%{name}/waceconfig.yaml
 install -Dpm 644 %{name}.service %{buildroot}%{_unitdir}/%{name}.service
 install -Dpm 644 _plugins/model/trivial.so %{buildroot}%{_libdir}/%{name}/plugins/model/trivial.so
@@ -65,6 +68,8 @@ install -Dpm 644 _plugins/decision/weighted_sum.so %{buildroot}%{_libdir}/%{name
 %files
 %dir %{_sysconfdir}/%{name}
 %{_bindir}/%{name}
+%{_bindir}/%{name}-replay
+%{_bindir}/%{name}-eval
 %{_unitdir}/%{name}.service
 %config(noreplace) %{_sysconfdir}/%{name}/waceconfig.yaml
 %{_libdir}/%{name}/plugins/model/trivial.so
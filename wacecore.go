@@ -9,26 +9,42 @@ import (
 	// "runtime/debug" // DEBUG
 
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	// "runtime"
 	"strconv"
 	"time"
 
 	"strings"
 	// "sync"
+	"wace/admission"
+	"wace/canary"
 	comm "wace/comm"
+	"wace/decoding"
+	"wace/feedback"
+	"wace/payloadlimit"
+	"wace/recorder"
+	"wace/rules"
+	"wace/strategy"
+	pm "wace/pluginmanager"
 	// cf "wace/configstore"
 	cf "github.com/tilsor/ModSecIntl_wace_lib/configstore"
 
-	wace "github.com/tilsor/ModSecIntl_wace_lib"
+	wace "wace/core"
+	"wace/tenant"
+	"wace/transaction"
 
 	lg "github.com/tilsor/ModSecIntl_logging/logging"
 
 	"gopkg.in/yaml.v3"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 
 	// "go.opentelemetry.io/otel"
@@ -66,6 +82,22 @@ type generalConfig struct {
 	listenAddress        string
 	listenPort           string
 	histogramType		 string
+	tenants              map[string]WaceAppConfigFileData
+	admission            admission.Config
+	tlsCertFile          string
+	tlsKeyFile           string
+	tlsClientCAFile      string
+	modelOptions         map[string]pm.ModelOptions
+	payloadLimits        map[string]payloadlimit.Limit
+	maxMessageSize       int
+	maxDecodedSize       int
+	decisionRules        map[string]*rules.RuleSet
+	decisionStrategies   map[string]strategy.Decision
+	shadowDecisions      []string
+	shadowTimeout        time.Duration
+	canary               *canary.Router
+	recorder             *recorder.Config
+	feedbackTransactions int
 }
 
 // WaceGeneralConfigFileData holds the general configuration data from the config file
@@ -73,13 +105,127 @@ type WaceGeneralConfigFileData struct {
 	cf.ConfigFileData    `yaml:",inline"`
 	Options              map[string]string `yaml:"options"`
 	RuleIdsForExceptions map[string]int    `yaml:"ruleidsforexceptions"`
+	Tenants              map[string]WaceAppConfigFileData `yaml:"tenants"`
+	PayloadLimits        map[string]WacePayloadLimitFileData `yaml:"payloadlimits"`
+	DecisionRules        []WaceDecisionRulesFileData `yaml:"decisionrules"`
+	DecisionStrategies   []WaceDecisionStrategyFileData `yaml:"decisionstrategies"`
+	Canary               WaceCanaryFileData `yaml:"canary"`
+	Recorder             *WaceRecorderFileData `yaml:"recorder"`
+}
+
+// WaceRecorderFileData holds the configuration of the transaction
+// recorder. The sample rates default to 1, and the rate of the blocked
+// transactions to the one of the others.
+type WaceRecorderFileData struct {
+	Dir             string   `yaml:"dir"`
+	Format          string   `yaml:"format"`
+	MaxSize         int64    `yaml:"maxsize"`
+	MaxFiles        int      `yaml:"maxfiles"`
+	SampleRate      *float64 `yaml:"samplerate"`
+	BlockSampleRate *float64 `yaml:"blocksamplerate"`
+	RedactHeaders   []string `yaml:"redactheaders"`
+	RedactPatterns  []string `yaml:"redactpatterns"`
+}
+
+// WaceCanaryFileData holds the configuration of the variants receiving
+// a percentage of the transactions
+type WaceCanaryFileData struct {
+	Sticky   string                `yaml:"sticky"`
+	Variants []WaceVariantFileData `yaml:"variants"`
+}
+
+// WaceVariantFileData holds the configuration of a variant: the model
+// plugins it replaces, keyed by the replaced model ID, and its decision
+type WaceVariantFileData struct {
+	ID         string
+	Percentage float64           `yaml:"percentage"`
+	Models     map[string]string `yaml:"models"`
+	DecisionId string            `yaml:"decisionid"`
+}
+
+// WaceDecisionStrategyFileData holds the configuration of a built-in
+// decision strategy
+type WaceDecisionStrategyFileData struct {
+	ID       string
+	Strategy string
+	Params   map[string]string
+}
+
+// WaceDecisionRulesFileData holds the configuration of a declarative
+// decision: its rules, evaluated in order, and the verdict if none
+// matches
+type WaceDecisionRulesFileData struct {
+	ID      string
+	Default string `yaml:"default"`
+	Rules   []WaceRuleFileData
+}
+
+// WaceRuleFileData holds the configuration of a decision rule
+type WaceRuleFileData struct {
+	Name    string
+	When    string
+	Verdict string
+}
+
+// WacePayloadLimitFileData holds the payload size limit of a phase
+type WacePayloadLimitFileData struct {
+	MaxSize int    `yaml:"maxsize"`
+	Policy  string `yaml:"policy"`
+}
+
+// WaceModelPluginFileData holds the model plugin configuration
+// handled by WACE itself, on top of the one of the configstore
+type WaceModelPluginFileData struct {
+	ID             string
+	MaxConcurrency int    `yaml:"maxconcurrency"`
+	QueueLength    int    `yaml:"queuelength"`
+	QueueTimeout   string `yaml:"queuetimeout"`
+	RejectPolicy   string `yaml:"rejectpolicy"`
+	MaxPayloadSize int    `yaml:"maxpayloadsize"`
+	PayloadPolicy  string `yaml:"payloadpolicy"`
+	Input          string `yaml:"input"`
+	// Options of the model plugins in grpc mode
+	Address        string   `yaml:"address"`
+	Args           []string `yaml:"args"`
+	Timeout        string   `yaml:"timeout"`
+	HealthInterval string   `yaml:"healthinterval"`
+	StartTimeout   string   `yaml:"starttimeout"`
+	// Options of the result cache
+	CacheSize int    `yaml:"cachesize"`
+	CacheTTL  string `yaml:"cachettl"`
+	Cache     *bool  `yaml:"cache"`
+	Shadow    bool   `yaml:"shadow"`
+	Feedback  bool   `yaml:"feedback"`
+}
+
+// WaceDecisionPluginFileData holds the decision plugin configuration
+// handled by WACE itself, on top of the one of the configstore
+type WaceDecisionPluginFileData struct {
+	ID     string
+	Shadow bool `yaml:"shadow"`
+}
+
+// WacePluginsConfigFileData holds the plugins configuration handled by
+// WACE itself from the config file
+type WacePluginsConfigFileData struct {
+	Modelplugins    []WaceModelPluginFileData
+	Decisionplugins []WaceDecisionPluginFileData
+	// CachePhases are the phases whose model results are cached
+	CachePhases []string `yaml:"cachephases"`
+	// ShadowTimeout is the maximum time the shadow model plugins are
+	// awaited
+	ShadowTimeout string `yaml:"shadowtimeout"`
 }
 
 // WaceAppConfigFileData holds the application configuration data from the config file
 type WaceAppConfigFileData struct {
 	ModelIds   []string `yaml:"modelids"`
 	DecisionId string   `yaml:"decisionid"`
+	Logpath    string   `yaml:"logpath"`
 	Options    map[string]string
+	// Params override the params of the model and decision plugins for
+	// the tenant, keyed by plugin ID
+	Params map[string]map[string]string `yaml:"params"`
 }
 
 // LoadConfig loads the general configuration from the config file to memory
@@ -99,6 +245,7 @@ func (g *generalConfig) LoadGeneralConfigYaml(config []byte) error {
 	if err != nil {
 		return err
 	}
+	g.feedbackTransactions = feedback.DefaultMaxTransactions
 	for key, value := range inConf.Options {
 		if key == "early_blocking" {
 			g.earlyBlocking = value == "true"
@@ -112,7 +259,45 @@ func (g *generalConfig) LoadGeneralConfigYaml(config []byte) error {
 			g.listenPort = value
 		} else if key == "histogram_kind" {
 			g.histogramType = value
+		} else if key == "max_transactions" {
+			g.admission.MaxTransactions, err = strconv.Atoi(value)
+		} else if key == "max_client_transactions" {
+			g.admission.MaxClientTransactions, err = strconv.Atoi(value)
+		} else if key == "rate_limit" {
+			g.admission.RequestsPerSecond, err = strconv.ParseFloat(value, 64)
+		} else if key == "client_rate_limit" {
+			g.admission.ClientRequestsPerSecond, err = strconv.ParseFloat(value, 64)
+		} else if key == "rate_limit_burst" {
+			g.admission.Burst, err = strconv.Atoi(value)
+		} else if key == "client_key" {
+			g.admission.ClientKey = value
+		} else if key == "fallback_verdict" {
+			g.admission.FallbackVerdict = value
+		} else if key == "transaction_timeout" {
+			g.admission.TransactionTimeout, err = time.ParseDuration(value)
+		} else if key == "tls_cert_file" {
+			g.tlsCertFile = value
+		} else if key == "tls_key_file" {
+			g.tlsKeyFile = value
+		} else if key == "tls_client_ca_file" {
+			g.tlsClientCAFile = value
+		} else if key == "max_message_size" {
+			g.maxMessageSize, err = strconv.Atoi(value)
+		} else if key == "max_decoded_size" {
+			g.maxDecodedSize, err = strconv.Atoi(value)
+		} else if key == "feedback_transactions" {
+			g.feedbackTransactions, err = strconv.Atoi(value)
+			if err == nil && g.feedbackTransactions < 0 {
+				err = fmt.Errorf("it cannot be negative")
+			}
 		}
+		if err != nil {
+			return fmt.Errorf("invalid value %s for option %s: %v", value, key, err)
+		}
+	}
+	err = g.admission.Check()
+	if err != nil {
+		return err
 	}
 	if g.ruleIdsForExceptions == nil {
 		g.ruleIdsForExceptions = make(map[string]int)
@@ -120,8 +305,38 @@ func (g *generalConfig) LoadGeneralConfigYaml(config []byte) error {
 	for key, value := range inConf.RuleIdsForExceptions {
 		g.ruleIdsForExceptions[key] = value
 	}
+	g.tenants = make(map[string]WaceAppConfigFileData)
+	for tenantID, tenantConf := range inConf.Tenants {
+		if strings.Contains(tenantID, "/") {
+			return fmt.Errorf("invalid tenant id %s: it cannot contain '/'", tenantID)
+		}
+		for _, modelID := range tenantConf.ModelIds {
+			if !hasModelPlugin(inConf.ConfigFileData, modelID) {
+				return fmt.Errorf("tenant %s: model plugin %s not defined", tenantID, modelID)
+			}
+		}
+		g.tenants[tenantID] = tenantConf
+	}
+	pluginsConf, err := tenantPlugins(inConf.ConfigFileData, g.tenants)
+	if err != nil {
+		return err
+	}
 
-	err = cf.Get().SetConfig(inConf.ConfigFileData)
+	g.payloadLimits = make(map[string]payloadlimit.Limit)
+	for phase, limitConf := range inConf.PayloadLimits {
+		_, err = cf.StringToPluginType(phase)
+		if err != nil {
+			return fmt.Errorf("invalid payload limit phase: %v", err)
+		}
+		limit := payloadlimit.Limit{MaxSize: limitConf.MaxSize, Policy: limitConf.Policy}
+		err = limit.Check()
+		if err != nil {
+			return fmt.Errorf("%s payload limit: %v", phase, err)
+		}
+		g.payloadLimits[phase] = limit
+	}
+
+	err = cf.Get().SetConfig(pluginsConf)
 	if err != nil {
 		return err
 	}
@@ -132,14 +347,468 @@ func (g *generalConfig) LoadGeneralConfigYaml(config []byte) error {
 		return err
 	}
 
+	err = g.loadPluginsConfigYaml(config)
+	if err != nil {
+		return err
+	}
+
 	g.waceModels = NewWaceDefaultModelsConfig()
 	for _, decision := range inConf.Decisionplugins {
 		g.waceDecisions = append(g.waceDecisions, decision.ID)
 	}
 
+	g.decisionRules = make(map[string]*rules.RuleSet)
+	g.decisionStrategies = make(map[string]strategy.Decision)
+	err = g.loadDecisionRules(inConf)
+	if err != nil {
+		return err
+	}
+	err = g.loadDecisionStrategies(inConf)
+	if err != nil {
+		return err
+	}
+	err = g.loadCanary(inConf)
+	if err != nil {
+		return err
+	}
+	err = g.loadRecorder(inConf)
+	if err != nil {
+		return err
+	}
+
 	return err
 }
 
+// loadPluginsConfigYaml loads the plugins configuration handled by
+// WACE itself
+func (g *generalConfig) loadPluginsConfigYaml(config []byte) error {
+	var inConf WacePluginsConfigFileData
+	err := yaml.Unmarshal(config, &inConf)
+	if err != nil {
+		return err
+	}
+
+	for _, phase := range inConf.CachePhases {
+		_, err = cf.StringToPluginType(phase)
+		if err != nil {
+			return fmt.Errorf("invalid cache phase: %v", err)
+		}
+	}
+
+	g.modelOptions = make(map[string]pm.ModelOptions)
+	for _, modelP := range inConf.Modelplugins {
+		var opts pm.ModelOptions
+		if modelP.MaxConcurrency < 0 || modelP.QueueLength < 0 {
+			return fmt.Errorf("%s plugin worker pool limits cannot be negative", modelP.ID)
+		}
+		opts.Pool.MaxConcurrency = modelP.MaxConcurrency
+		opts.Pool.QueueLength = modelP.QueueLength
+		if modelP.QueueTimeout != "" {
+			opts.Pool.QueueTimeout, err = time.ParseDuration(modelP.QueueTimeout)
+			if err != nil {
+				return fmt.Errorf("%s plugin invalid queue timeout: %v", modelP.ID, err)
+			}
+		}
+		err = pm.CheckRejectPolicy(modelP.RejectPolicy)
+		if err != nil {
+			return fmt.Errorf("%s plugin: %v", modelP.ID, err)
+		}
+		opts.RejectPolicy = modelP.RejectPolicy
+		opts.PayloadLimit = payloadlimit.Limit{MaxSize: modelP.MaxPayloadSize, Policy: modelP.PayloadPolicy}
+		err = opts.PayloadLimit.Check()
+		if err != nil {
+			return fmt.Errorf("%s plugin payload limit: %v", modelP.ID, err)
+		}
+		err = decoding.CheckInput(modelP.Input)
+		if err != nil {
+			return fmt.Errorf("%s plugin: %v", modelP.ID, err)
+		}
+		opts.Input = modelP.Input
+		opts.GRPC.Address = modelP.Address
+		opts.GRPC.Args = modelP.Args
+		durations := []struct {
+			name  string
+			value string
+			out   *time.Duration
+		}{
+			{"timeout", modelP.Timeout, &opts.GRPC.Timeout},
+			{"health interval", modelP.HealthInterval, &opts.GRPC.HealthInterval},
+			{"start timeout", modelP.StartTimeout, &opts.GRPC.StartTimeout},
+			{"cache TTL", modelP.CacheTTL, &opts.Cache.TTL},
+		}
+		for _, d := range durations {
+			if d.value == "" {
+				continue
+			}
+			*d.out, err = time.ParseDuration(d.value)
+			if err != nil || *d.out <= 0 {
+				return fmt.Errorf("%s plugin invalid %s %s", modelP.ID, d.name, d.value)
+			}
+		}
+		opts.Cache.Size = modelP.CacheSize
+		err = opts.Cache.Check()
+		if err != nil {
+			return fmt.Errorf("%s plugin: %v", modelP.ID, err)
+		}
+		opts.CachePhases = inConf.CachePhases
+		opts.CacheResults = modelP.Cache
+		opts.Shadow = modelP.Shadow
+		opts.Feedback = modelP.Feedback
+		g.modelOptions[modelP.ID] = opts
+	}
+	// The tenant instances of the model plugins have the options of the
+	// plugin, but they are run in its place, not as shadow models
+	for tenantID, tenantConf := range g.tenants {
+		for pluginID := range tenantConf.Params {
+			if opts, ok := g.modelOptions[pluginID]; ok {
+				opts.Shadow = false
+				g.modelOptions[tenant.ScopeID(tenantID, pluginID)] = opts
+			}
+		}
+	}
+
+	g.shadowTimeout = 0
+	if inConf.ShadowTimeout != "" {
+		g.shadowTimeout, err = time.ParseDuration(inConf.ShadowTimeout)
+		if err != nil || g.shadowTimeout <= 0 {
+			return fmt.Errorf("invalid shadow timeout %s", inConf.ShadowTimeout)
+		}
+	}
+	g.shadowDecisions = nil
+	for _, decisionP := range inConf.Decisionplugins {
+		if decisionP.Shadow {
+			g.shadowDecisions = append(g.shadowDecisions, decisionP.ID)
+		}
+	}
+	return nil
+}
+
+// checkDecisionID verifies that the ID of a built-in decision is not
+// empty, nor the one of another decision
+func (g *generalConfig) checkDecisionID(inConf WaceGeneralConfigFileData, decisionID string) error {
+	if decisionID == "" {
+		return fmt.Errorf("decision without id")
+	}
+	_, isRules := g.decisionRules[decisionID]
+	_, isStrategy := g.decisionStrategies[decisionID]
+	if isRules || isStrategy {
+		return fmt.Errorf("decision %s defined twice", decisionID)
+	}
+	for _, decisionP := range inConf.Decisionplugins {
+		if decisionP.ID == decisionID {
+			return fmt.Errorf("decision %s: there is a decision plugin with the same id", decisionID)
+		}
+	}
+	return nil
+}
+
+// loadDecisionRules compiles the declarative decisions, so invalid
+// expressions are reported when the configuration is loaded
+func (g *generalConfig) loadDecisionRules(inConf WaceGeneralConfigFileData) error {
+	var models []string
+	for _, modelP := range inConf.Modelplugins {
+		models = append(models, modelP.ID)
+	}
+	for _, decision := range inConf.DecisionRules {
+		err := g.checkDecisionID(inConf, decision.ID)
+		if err != nil {
+			return err
+		}
+		var defs []rules.Definition
+		for _, rule := range decision.Rules {
+			defs = append(defs, rules.Definition{Name: rule.Name, When: rule.When, Verdict: rule.Verdict})
+		}
+		rs, err := rules.New(decision.ID, defs, decision.Default, models)
+		if err != nil {
+			return fmt.Errorf("decision rules %s: %v", decision.ID, err)
+		}
+		g.decisionRules[decision.ID] = rs
+		g.waceDecisions = append(g.waceDecisions, decision.ID)
+	}
+	return nil
+}
+
+// loadDecisionStrategies creates the built-in decision strategies,
+// validating their params
+func (g *generalConfig) loadDecisionStrategies(inConf WaceGeneralConfigFileData) error {
+	thresholds := make(map[string]float64)
+	for _, modelP := range inConf.Modelplugins {
+		thresholds[modelP.ID] = modelP.Threshold
+	}
+	for _, decision := range inConf.DecisionStrategies {
+		err := g.checkDecisionID(inConf, decision.ID)
+		if err != nil {
+			return err
+		}
+		decide, err := strategy.New(decision.Strategy, decision.Params, thresholds)
+		if err != nil {
+			return fmt.Errorf("decision strategy %s: %v", decision.ID, err)
+		}
+		g.decisionStrategies[decision.ID] = decide
+		g.waceDecisions = append(g.waceDecisions, decision.ID)
+	}
+	return nil
+}
+
+// loadCanary creates the router of the variants, verifying that their
+// models and decisions exist, and that each model is replaced by one
+// of the same type
+func (g *generalConfig) loadCanary(inConf WaceGeneralConfigFileData) error {
+	conf := cf.Get()
+	var variants []canary.Variant
+	for _, variantConf := range inConf.Canary.Variants {
+		for modelID, replacement := range variantConf.Models {
+			model, ok := conf.ModelPlugins[modelID]
+			if !ok {
+				return fmt.Errorf("variant %s: model plugin %s not defined", variantConf.ID, modelID)
+			}
+			replacementModel, ok := conf.ModelPlugins[replacement]
+			if !ok {
+				return fmt.Errorf("variant %s: model plugin %s not defined", variantConf.ID, replacement)
+			}
+			if model.PluginType != replacementModel.PluginType {
+				return fmt.Errorf("variant %s: model plugin %s of type %s cannot replace %s of type %s",
+					variantConf.ID, replacement, replacementModel.PluginType, modelID, model.PluginType)
+			}
+		}
+		if variantConf.DecisionId != "" {
+			found := false
+			for _, decisionID := range g.waceDecisions {
+				if decisionID == variantConf.DecisionId {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("variant %s: decision %s not defined", variantConf.ID, variantConf.DecisionId)
+			}
+		}
+		variants = append(variants, canary.Variant{
+			ID:         variantConf.ID,
+			Percentage: variantConf.Percentage,
+			Models:     variantConf.Models,
+			Decision:   variantConf.DecisionId,
+		})
+	}
+	var err error
+	g.canary, err = canary.New(variants, inConf.Canary.Sticky)
+	if err != nil {
+		return fmt.Errorf("canary: %v", err)
+	}
+	return nil
+}
+
+// loadRecorder verifies the configuration of the transaction recorder,
+// which is created once the metrics are initialized
+func (g *generalConfig) loadRecorder(inConf WaceGeneralConfigFileData) error {
+	g.recorder = nil
+	if inConf.Recorder == nil {
+		return nil
+	}
+	recConf := recorder.Config{
+		Dir:            inConf.Recorder.Dir,
+		Format:         inConf.Recorder.Format,
+		MaxSize:        inConf.Recorder.MaxSize,
+		MaxFiles:       inConf.Recorder.MaxFiles,
+		SampleRate:     1,
+		RedactHeaders:  inConf.Recorder.RedactHeaders,
+		RedactPatterns: inConf.Recorder.RedactPatterns,
+	}
+	if inConf.Recorder.SampleRate != nil {
+		recConf.SampleRate = *inConf.Recorder.SampleRate
+	}
+	recConf.BlockSampleRate = recConf.SampleRate
+	if inConf.Recorder.BlockSampleRate != nil {
+		recConf.BlockSampleRate = *inConf.Recorder.BlockSampleRate
+	}
+	err := recConf.Check()
+	if err != nil {
+		return err
+	}
+	g.recorder = &recConf
+	return nil
+}
+
+// decisions returns the built-in decisions, keyed by decision ID
+func (g *generalConfig) decisions() map[string]func(pm.TransactionInput) (bool, error) {
+	decisions := make(map[string]func(pm.TransactionInput) (bool, error))
+	for decisionID, rs := range g.decisionRules {
+		decisions[decisionID] = rs.CheckTransaction
+	}
+	for decisionID, decide := range g.decisionStrategies {
+		decisions[decisionID] = decide
+	}
+	return decisions
+}
+
+// hasModelPlugin returns true if the model plugin is defined in the
+// configuration file
+func hasModelPlugin(inConf cf.ConfigFileData, modelID string) bool {
+	for _, modelP := range inConf.Modelplugins {
+		if modelP.ID == modelID {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantPlugins returns the plugins configuration with an instance of
+// each plugin whose params are overridden by a tenant, identified by
+// the plugin ID scoped to the tenant, with the params of the plugin
+// merged with the ones of the tenant. The params of the async and
+// remote model plugins cannot be overridden, as their results are
+// received by plugin ID.
+func tenantPlugins(inConf cf.ConfigFileData, tenants map[string]WaceAppConfigFileData) (cf.ConfigFileData, error) {
+	out := inConf
+	out.Modelplugins = append(inConf.Modelplugins[:0:0], inConf.Modelplugins...)
+	out.Decisionplugins = append(inConf.Decisionplugins[:0:0], inConf.Decisionplugins...)
+	for _, modelP := range inConf.Modelplugins {
+		if err := tenant.CheckID(modelP.ID); err != nil {
+			return out, fmt.Errorf("model plugin: %v", err)
+		}
+	}
+	for _, decisionP := range inConf.Decisionplugins {
+		if err := tenant.CheckID(decisionP.ID); err != nil {
+			return out, fmt.Errorf("decision plugin: %v", err)
+		}
+	}
+	for tenantID, tenantConf := range tenants {
+		for pluginID, params := range tenantConf.Params {
+			found := false
+			for _, modelP := range inConf.Modelplugins {
+				if modelP.ID != pluginID {
+					continue
+				}
+				if modelP.Mode == "async" || modelP.Remote {
+					return out, fmt.Errorf("tenant %s: the params of the async or remote model plugin %s cannot be overridden", tenantID, pluginID)
+				}
+				modelP.ID = tenant.ScopeID(tenantID, pluginID)
+				modelP.Params = mergeParams(modelP.Params, params)
+				out.Modelplugins = append(out.Modelplugins, modelP)
+				found = true
+			}
+			for _, decisionP := range inConf.Decisionplugins {
+				if decisionP.ID != pluginID {
+					continue
+				}
+				decisionP.ID = tenant.ScopeID(tenantID, pluginID)
+				decisionP.Params = mergeParams(decisionP.Params, params)
+				out.Decisionplugins = append(out.Decisionplugins, decisionP)
+				found = true
+			}
+			if !found {
+				return out, fmt.Errorf("tenant %s: plugin %s not defined", tenantID, pluginID)
+			}
+		}
+	}
+	return out, nil
+}
+
+// mergeParams returns the params with the overrides.
+func mergeParams(params, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(params)+len(overrides))
+	for key, value := range params {
+		merged[key] = value
+	}
+	for key, value := range overrides {
+		merged[key] = value
+	}
+	return merged
+}
+
+// tenantModels returns the models of the list that the tenant of the
+// transaction is allowed to use. If the tenant has no model list
+// configured, all the models are allowed.
+func (g *generalConfig) tenantModels(transactionID string, models []string) []string {
+	tenantID, _ := tenant.SplitID(transactionID)
+	tenantConf, ok := g.tenants[tenantID]
+	if !ok || len(tenantConf.ModelIds) == 0 {
+		return models
+	}
+	allowed := []string{}
+	for _, modelID := range models {
+		found := false
+		for _, tenantModelID := range tenantConf.ModelIds {
+			if modelID == tenantModelID {
+				found = true
+				break
+			}
+		}
+		if found {
+			allowed = append(allowed, modelID)
+		} else {
+			logger.TPrintf(lg.WARN, transactionID, "core | model plugin %s not enabled for tenant %s", modelID, tenantID)
+		}
+	}
+	return allowed
+}
+
+// tenantDecision returns the decision plugin configured for the tenant
+// of the transaction, or the given one if the tenant has none.
+func (g *generalConfig) tenantDecision(transactionID, decisionPlugin string) string {
+	tenantID, _ := tenant.SplitID(transactionID)
+	if tenantConf, ok := g.tenants[tenantID]; ok && tenantConf.DecisionId != "" {
+		return tenantConf.DecisionId
+	}
+	return decisionPlugin
+}
+
+// tenantLogWriter returns a writer sending the logs to the main log
+// file, except for the tenants having their own log file.
+func (g *generalConfig) tenantLogWriter() (io.Writer, error) {
+	mainLog, err := os.OpenFile(g.logPath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	tenantLogs := make(map[string]io.Writer)
+	for tenantID, tenantConf := range g.tenants {
+		if tenantConf.Logpath == "" {
+			continue
+		}
+		tenantLog, err := os.OpenFile(tenantConf.Logpath, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %v", tenantID, err)
+		}
+		tenantLogs[tenantID] = tenantLog
+	}
+	return tenant.NewLogWriter(mainLog, tenantLogs), nil
+}
+
+// serverOptions returns the gRPC server options: TLS credentials, if
+// configured, and the admission control interceptor.
+func (g *generalConfig) serverOptions(meter metric.Meter) ([]grpc.ServerOption, error) {
+	opts := []grpc.ServerOption{}
+	if g.maxMessageSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(g.maxMessageSize))
+	}
+	if g.tlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(g.tlsCertFile, g.tlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load TLS certificate: %v", err)
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if g.tlsClientCAFile != "" {
+			ca, err := os.ReadFile(g.tlsClientCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not load TLS client CA: %v", err)
+			}
+			tlsConfig.ClientCAs = x509.NewCertPool()
+			if !tlsConfig.ClientCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("invalid TLS client CA file %s", g.tlsClientCAFile)
+			}
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	controller, err := admission.New(g.admission, meter)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, grpc.ChainUnaryInterceptor(controller.UnaryServerInterceptor()))
+	return opts, nil
+}
+
 // NewWaceDefaultModelsConfig creates the default WaceModels with the models stored in the WACE ConfigStore
 func NewWaceDefaultModelsConfig() *WaceModels {
 	conf := cf.Get()
@@ -150,6 +819,10 @@ func NewWaceDefaultModelsConfig() *WaceModels {
 	respBodyModelIDs := []string{}
 	respModelIDs := []string{}
 	for _, model := range conf.ModelPlugins {
+		// The tenant instances are only run in place of their plugin
+		if tenantID, _ := tenant.SplitID(model.ID); tenantID != "" {
+			continue
+		}
 		if model.PluginType.String() == "RequestHeaders" {
 			reqHeadModelIDs = append(reqHeadModelIDs, model.ID)
 		} else if model.PluginType.String() == "RequestBody" {
@@ -167,43 +840,113 @@ func NewWaceDefaultModelsConfig() *WaceModels {
 	return &WaceModels{reqHeadModelIDs, reqBodyModelIDs, reqModelIDs, respHeadModelIDs, respBodyModelIDs, respModelIDs}
 }
 
-func initTransaction(transactionID string) int32 {
-	wace.InitTransaction(transactionID)
+func initTransaction(transactionID, clientIP string) int32 {
+	wace.InitTransaction(transactionID, clientIP)
 	return 0
 }
 
 func analyzeRequest(transactionID, request string, models []string) int32 {
-	wace.Analyze("AllRequest", transactionID, request, models)
+	err := wace.Analyze("AllRequest", transactionID, request, gConfig.tenantModels(transactionID, models))
+	if err != nil {
+		return 1
+	}
 	return 0
 }
 
 func analyzeReqLineAndHeaders(transactionID, requestLine, requestHeaders string, models []string) int32 {
-	wace.Analyze("RequestHeaders", transactionID, requestLine, models)
+	wace.SetRequestHead(transactionID, requestLine, requestHeaders)
+	err := wace.Analyze("RequestHeaders", transactionID, requestLine, gConfig.tenantModels(transactionID, models))
+	if err != nil {
+		return 1
+	}
 	return 0
 }
 
 func analyzeRequestBody(transactionID, requestBody string, models []string) int32 {
-	wace.Analyze("RequestBody", transactionID, requestBody, models)
+	err := wace.Analyze("RequestBody", transactionID, requestBody, gConfig.tenantModels(transactionID, models))
+	if err != nil {
+		return 1
+	}
 	return 0
 }
 
 func analyzeResponse(transactionID, response string, models []string) int32 {
-	wace.Analyze("AllResponse", transactionID, response, models)
+	err := wace.Analyze("AllResponse", transactionID, response, gConfig.tenantModels(transactionID, models))
+	if err != nil {
+		return 1
+	}
 	return 0
 }
 
 func analyzeRespLineAndHeaders(transactionID, statusLine, responseHeaders string, models []string) int32 {
-	wace.Analyze("ResponseHeaders", transactionID, responseHeaders, models)
+	wace.SetResponseHead(transactionID, statusLine, responseHeaders)
+	err := wace.Analyze("ResponseHeaders", transactionID, responseHeaders, gConfig.tenantModels(transactionID, models))
+	if err != nil {
+		return 1
+	}
 	return 0
 }
 
 func analyzeResponseBody(transactionID, responseBody string, models []string) int32 {
-	wace.Analyze("ResponseBody", transactionID, responseBody, models)
+	err := wace.Analyze("ResponseBody", transactionID, responseBody, gConfig.tenantModels(transactionID, models))
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func analyzeRequestBytes(transactionID string, request transaction.Payload, models []string) int32 {
+	err := wace.AnalyzePayload("AllRequest", transactionID, request, gConfig.tenantModels(transactionID, models))
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func analyzeReqLineAndHeadersBytes(transactionID string, requestLine, requestHeaders transaction.Payload, models []string) int32 {
+	wace.SetRequestHead(transactionID, string(requestLine.Data), string(requestHeaders.Data))
+	err := wace.AnalyzePayload("RequestHeaders", transactionID, requestLine, gConfig.tenantModels(transactionID, models))
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func analyzeRequestBodyBytes(transactionID string, requestBody transaction.Payload, models []string) int32 {
+	err := wace.AnalyzePayload("RequestBody", transactionID, requestBody, gConfig.tenantModels(transactionID, models))
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func analyzeResponseBytes(transactionID string, response transaction.Payload, models []string) int32 {
+	err := wace.AnalyzePayload("AllResponse", transactionID, response, gConfig.tenantModels(transactionID, models))
+	if err != nil {
+		return 1
+	}
 	return 0
 }
 
-func checkTransaction(transactionID, decisionPlugin string, wafParams map[string]string) (bool, error) {
-	return wace.CheckTransaction(transactionID, decisionPlugin, wafParams)
+func analyzeRespLineAndHeadersBytes(transactionID string, statusLine, responseHeaders transaction.Payload, models []string) int32 {
+	wace.SetResponseHead(transactionID, string(statusLine.Data), string(responseHeaders.Data))
+	err := wace.AnalyzePayload("ResponseHeaders", transactionID, responseHeaders, gConfig.tenantModels(transactionID, models))
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func analyzeResponseBodyBytes(transactionID string, responseBody transaction.Payload, models []string) int32 {
+	err := wace.AnalyzePayload("ResponseBody", transactionID, responseBody, gConfig.tenantModels(transactionID, models))
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func checkTransaction(transactionID, decisionPlugin, direction string, wafParams map[string]string) (bool, error) {
+	return wace.CheckTransaction(transactionID, gConfig.tenantDecision(transactionID, decisionPlugin), direction, wafParams)
 }
 
 func closeTransaction(transactionID string, metrics map[string]string) int32 {
@@ -217,7 +960,7 @@ func closeTransaction(transactionID string, metrics map[string]string) int32 {
 				if err != nil {
 					logger.TPrintln(lg.ERROR, transactionID, "Error getting response code: "+err.Error())
 				} else {
-					processed.Add(ctx, 1, metric.WithAttributes(semconv.HTTPResponseStatusCode(int(vInt))))
+					processed.Add(ctx, 1, metric.WithAttributes(semconv.HTTPResponseStatusCode(int(vInt)), tenant.Attribute(transactionID)))
 					
 					logger.TPrintln(lg.DEBUG, transactionID, "Metric "+i+" : "+v)
 				}
@@ -228,7 +971,7 @@ func closeTransaction(transactionID string, metrics map[string]string) int32 {
 				logger.TPrintln(lg.ERROR, transactionID, "Error getting request histogram: "+err.Error())
 			} else {
 				if s, err := strconv.ParseFloat(v, 64); err == nil {
-					duration.Record(ctx, s/1000)
+					duration.Record(ctx, s/1000, metric.WithAttributes(tenant.Attribute(transactionID)))
 					logger.TPrintln(lg.DEBUG, transactionID, "Metric "+i+" : "+v)
 				}
 			}
@@ -248,6 +991,28 @@ func closeTransaction(transactionID string, metrics map[string]string) int32 {
 	return 0
 }
 
+// newHandlers returns the handlers of the calls of the WAFs
+func newHandlers() comm.Handlers {
+	return comm.Handlers{
+		SendRequest:                 analyzeRequest,
+		SendReqLineAndHeaders:       analyzeReqLineAndHeaders,
+		SendRequestBody:             analyzeRequestBody,
+		SendResponse:                analyzeResponse,
+		SendRespLineAndHeaders:      analyzeRespLineAndHeaders,
+		SendResponseBody:            analyzeResponseBody,
+		SendRequestBytes:            analyzeRequestBytes,
+		SendReqLineAndHeadersBytes:  analyzeReqLineAndHeadersBytes,
+		SendRequestBodyBytes:        analyzeRequestBodyBytes,
+		SendResponseBytes:           analyzeResponseBytes,
+		SendRespLineAndHeadersBytes: analyzeRespLineAndHeadersBytes,
+		SendResponseBodyBytes:       analyzeResponseBodyBytes,
+		Check:                       checkTransaction,
+		Init:                        initTransaction,
+		Close:                       closeTransaction,
+		ReportFeedback:              wace.ReportFeedback,
+	}
+}
+
 var gConfig *generalConfig
 var ctx = context.Background()
 var meter metric.Meter
@@ -282,19 +1047,22 @@ func main() {
 	// 	}
 	// } ()
 
-	flag.Parse()
-	handlers := comm.Handlers{
-		SendRequest:            analyzeRequest,
-		SendReqLineAndHeaders:  analyzeReqLineAndHeaders,
-		SendRequestBody:        analyzeRequestBody,
-		SendResponse:           analyzeResponse,
-		SendRespLineAndHeaders: analyzeRespLineAndHeaders,
-		SendResponseBody:       analyzeResponseBody,
-		Check:                  checkTransaction,
-		Init:                   initTransaction,
-		Close:                  closeTransaction,
+	if filepath.Base(os.Args[0]) == "wace-replay" {
+		os.Exit(replayMain(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(replayMain(os.Args[2:]))
+	}
+	if filepath.Base(os.Args[0]) == "wace-eval" {
+		os.Exit(evalMain(os.Args[1:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "eval" {
+		os.Exit(evalMain(os.Args[2:]))
 	}
 
+	flag.Parse()
+	handlers := newHandlers()
+
 	logger.Println(lg.DEBUG, "Opening wace configuration file...")
 	// Load the configuration
 	configFilePath := flag.Arg(0)
@@ -307,20 +1075,58 @@ func main() {
 	}
 
 	InitMetrics(ctx, gConfig.otelURL, gConfig.histogramType)
-	wace.Init(getWaceMeter())
 
-	err = logger.LoadLogger(gConfig.logPath, gConfig.logLevel)
+	logWriter, err := gConfig.tenantLogWriter()
+	if err != nil {
+		logger.Printf(lg.ERROR, "ERROR: could not open wace log file: %v", err)
+		os.Exit(1)
+	}
+	err = logger.LoadLoggerWriter(logWriter, gConfig.logLevel)
 	if err != nil {
 		logger.Printf(lg.ERROR, "ERROR: could not open wace log file: %v", err)
 		os.Exit(1)
 	}
 	logger.Printf(lg.DEBUG, "Writing logs to %s from now", gConfig.logPath)
 
+	var transactionRecorder *recorder.Recorder
+	if gConfig.recorder != nil {
+		transactionRecorder, err = recorder.New(*gConfig.recorder, getWaceMeter())
+		if err != nil {
+			logger.Printf(lg.ERROR, "ERROR: could not create transaction recorder: %v", err)
+			os.Exit(1)
+		}
+		logger.Printf(lg.INFO, "Recording transactions to %s", gConfig.recorder.Dir)
+	}
+
+	wace.Init(getWaceMeter(), wace.Options{
+		ModelOptions:         gConfig.modelOptions,
+		PayloadLimits:        gConfig.payloadLimits,
+		MaxDecodedSize:       gConfig.maxDecodedSize,
+		Decisions:            gConfig.decisions(),
+		ShadowDecisions:      gConfig.shadowDecisions,
+		ShadowTimeout:        gConfig.shadowTimeout,
+		Canary:               gConfig.canary,
+		Recorder:             transactionRecorder,
+		FeedbackTransactions: gConfig.feedbackTransactions,
+		TransactionTimeout:   gConfig.admission.TransactionTimeout,
+	})
+
 	logger.Println(lg.DEBUG, "Server started, listening for connections...")
-	err = comm.Listen(handlers, gConfig.listenAddress, gConfig.listenPort)
+	serverOpts, err := gConfig.serverOptions(meter)
+	if err != nil {
+		logger.Printf(lg.ERROR, "ERROR: could not configure wace server: %v", err)
+		os.Exit(1)
+	}
+	err = comm.Listen(handlers, gConfig.listenAddress, gConfig.listenPort, serverOpts...)
 	if err != nil {
 		logger.Printf(lg.ERROR, "ERROR: wace server failed: %v", err)
 	}
+	wace.Close()
+	if transactionRecorder != nil {
+		if err := transactionRecorder.Close(); err != nil {
+			logger.Printf(lg.ERROR, "ERROR: could not close transaction recorder: %v", err)
+		}
+	}
 }
 
 var serviceName = semconv.ServiceNameKey.String("wace-modsec-service")
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"wace/evaluation"
+	pm "wace/pluginmanager"
+	"wace/replay"
+
+	lg "github.com/tilsor/ModSecIntl_logging/logging"
+	cf "github.com/tilsor/ModSecIntl_wace_lib/configstore"
+)
+
+// evalUsage is the usage of the wace-eval command
+const evalUsage = `Usage: wace-eval [options] config.yaml [file...]
+
+Evaluates the weighted_sum decision plugin of the configuration on the
+labelled transactions of the files (recorded by WACE, or HAR files
+with the ".har" extension): the model plugins analyze each transaction
+once, and the WAF weight and the weights of the models are swept on
+their scores. It reports the ROC AUC, the average precision and the
+best threshold for the target false positive rate of each combination
+of weights, and writes the configuration of the best one.
+
+Options:
+`
+
+// collectorID is the decision collecting the scores of the models
+const collectorID = "wace_eval_collector"
+
+// floatsFlag is a flag of comma separated numbers
+type floatsFlag []float64
+
+func (f *floatsFlag) String() string {
+	values := make([]string, len(*f))
+	for i, v := range *f {
+		values[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return strings.Join(values, ",")
+}
+
+func (f *floatsFlag) Set(list string) error {
+	*f = nil
+	for _, value := range strings.Split(list, ",") {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid weight %s", value)
+		}
+		*f = append(*f, v)
+	}
+	return nil
+}
+
+// evalOptions are the options of the wace-eval command
+type evalOptions struct {
+	decision    string
+	scores      string
+	params      paramsFlag
+	concurrency int
+	grid        evaluation.Grid
+	targetFPR   float64
+	top         int
+	curve       string
+	snippet     string
+}
+
+// evalMain runs the wace-eval command (also run as "wace eval") with the
+// given arguments, and returns its exit status.
+func evalMain(args []string) int {
+	opts := evalOptions{params: paramsFlag{}}
+	wafWeights := floatsFlag{0, 0.25, 0.5, 0.75, 1}
+	var modelWeights floatsFlag
+	fs := flag.NewFlagSet("wace-eval", flag.ContinueOnError)
+	fs.StringVar(&opts.decision, "decision", "weighted_sum", "weighted_sum decision plugin evaluated")
+	fs.StringVar(&opts.scores, "scores", "", "file caching the scores of the models: they are read from it if it exists, and written to it otherwise")
+	fs.Var(opts.params, "param", "WAF param sent with the verdict requests, as name=value, replacing the recorded one (can be repeated)")
+	fs.IntVar(&opts.concurrency, "concurrency", 1, "number of transactions analyzed at the same time")
+	fs.Var(&wafWeights, "waf-weights", "comma separated WAF weights swept (empty for the configured one)")
+	fs.Var(&modelWeights, "model-weights", "comma separated weights swept for each model plugin (default: the configured ones)")
+	fs.Float64Var(&opts.targetFPR, "target-fpr", 0.01, "maximum false positive rate of the best thresholds")
+	fs.IntVar(&opts.top, "top", 5, "number of combinations of weights reported")
+	fs.StringVar(&opts.curve, "curve", "", "CSV file for the ROC and precision-recall curve of the best combination")
+	fs.StringVar(&opts.snippet, "snippet", "", "file for the configuration snippet of the best combination (default: the standard output)")
+	logPath := fs.String("log", "", "log file (default: the one of the configuration)")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), evalUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+	opts.grid = evaluation.Grid{WAFWeights: wafWeights, ModelWeights: modelWeights}
+
+	err := loadOffline(fs.Arg(0), *logPath)
+	if err == nil {
+		err = evaluate(opts, fs.Args()[1:], os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// evaluate evaluates the decision plugin on the samples of the files
+// (or the cached ones), and writes the report to w.
+func evaluate(opts evalOptions, paths []string, w io.Writer) error {
+	decisionConf, ok := cf.Get().DecisionPlugins[opts.decision]
+	if !ok {
+		return fmt.Errorf("decision plugin %s not defined", opts.decision)
+	}
+	weights := make(map[string]float64)
+	thresholds := make(map[string]float64)
+	for modelID, modelConf := range cf.Get().ModelPlugins {
+		weights[modelID] = modelConf.Weight
+		thresholds[modelID] = modelConf.Threshold
+	}
+	ws, err := evaluation.NewWeightedSum(decisionConf.Params, thresholds)
+	if err != nil {
+		return fmt.Errorf("decision plugin %s: %v", opts.decision, err)
+	}
+
+	samples, err := evalSamples(opts, paths)
+	if err != nil {
+		return err
+	}
+	attacks := 0
+	for _, s := range samples {
+		if s.Attack() {
+			attacks++
+		}
+	}
+	if attacks == 0 || attacks == len(samples) {
+		return fmt.Errorf("the dataset needs attack and benign transactions, it has %d attacks out of %d", attacks, len(samples))
+	}
+	fmt.Fprintf(w, "dataset: %d transactions (%d attacks, %d benign)\n", len(samples), attacks, len(samples)-attacks)
+
+	current := ws.Evaluate(samples, weights, ws.WAFWeight)
+	currentCurve := ws.Curve(samples, weights, ws.WAFWeight)
+	fmt.Fprintf(w, "current: waf_weight %g%s, threshold %g: TPR %.4f, FPR %.4f, precision %.4f, ROC AUC %.4f, average precision %.4f\n",
+		ws.WAFWeight, modelWeightsText(evaluation.Models(samples), weights), ws.Threshold,
+		current.TPR, current.FPR, current.Precision, currentCurve.ROCAUC, currentCurve.AveragePrecision)
+
+	candidates, err := ws.Sweep(samples, weights, opts.grid, opts.targetFPR)
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no combination of weights to evaluate")
+	}
+	fmt.Fprintf(w, "best for FPR <= %g (%d combinations):\n", opts.targetFPR, len(candidates))
+	for i, c := range candidates[:min(opts.top, len(candidates))] {
+		fmt.Fprintf(w, "%3d. waf_weight %g%s, threshold %g: TPR %.4f, FPR %.4f, precision %.4f, ROC AUC %.4f, average precision %.4f\n",
+			i+1, c.WAFWeight, modelWeightsText(evaluation.Models(samples), c.ModelWeights), c.Best.Threshold,
+			c.Best.TPR, c.Best.FPR, c.Best.Precision, c.ROCAUC, c.AveragePrecision)
+	}
+
+	best := candidates[0]
+	if opts.curve != "" {
+		f, err := os.Create(opts.curve)
+		if err != nil {
+			return err
+		}
+		err = ws.Curve(samples, best.ModelWeights, best.WAFWeight).WriteCSV(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("could not write curve: %v", err)
+		}
+	}
+
+	snippet, err := best.Snippet(opts.decision, decisionConf.Params)
+	if err != nil {
+		return err
+	}
+	header := fmt.Sprintf("# Suggested by wace-eval for a false positive rate up to %g, on %d transactions:\n# TPR %.4f, FPR %.4f, precision %.4f\n",
+		opts.targetFPR, len(samples), best.Best.TPR, best.Best.FPR, best.Best.Precision)
+	snippet = append([]byte(header), snippet...)
+	if opts.snippet != "" {
+		return os.WriteFile(opts.snippet, snippet, 0644)
+	}
+	fmt.Fprintf(w, "\n%s", snippet)
+	return nil
+}
+
+// evalSamples returns the cached samples, if the scores file exists, or
+// the samples of the labelled transactions of the files, analyzed by
+// all the model plugins of the configuration.
+func evalSamples(opts evalOptions, paths []string) ([]evaluation.Sample, error) {
+	if opts.scores != "" {
+		samples, err := evaluation.ReadSamplesFile(opts.scores)
+		if err == nil {
+			if len(paths) > 0 {
+				fmt.Fprintf(os.Stderr, "Using the cached scores of %s, the files are not analyzed\n", opts.scores)
+			}
+			return samples, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no dataset files, nor cached scores")
+	}
+
+	collector := evaluation.NewCollector()
+	initOffline(map[string]func(pm.TransactionInput) (bool, error){collectorID: collector.Decide})
+	logger.Printf(lg.INFO, "Evaluating transactions of %s", strings.Join(paths, ", "))
+	replayer := replay.New(newHandlers(), replay.Options{
+		Models:      gConfig.waceModels.byPhase(),
+		Decision:    collectorID,
+		Params:      opts.params,
+		Concurrency: opts.concurrency,
+	})
+	var samples []evaluation.Sample
+	unlabelled, failed := 0, 0
+	firstErr := ""
+	err := replayer.ReplayFiles(paths, func(res replay.Result) {
+		s, ok := collector.Sample(res.TransactionID, res.Label)
+		switch {
+		case res.Err != "":
+			failed++
+			if firstErr == "" {
+				firstErr = res.TransactionID + ": " + res.Err
+			}
+		case res.Label == "":
+			unlabelled++
+		case ok:
+			samples = append(samples, s)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read transactions: %v", err)
+	}
+	if unlabelled > 0 {
+		fmt.Fprintf(os.Stderr, "%d transactions without label skipped\n", unlabelled)
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d transactions failed (eg: %s)\n", failed, firstErr)
+	}
+	if opts.scores != "" {
+		if err := evaluation.WriteSamplesFile(opts.scores, samples); err != nil {
+			return nil, fmt.Errorf("could not write scores: %v", err)
+		}
+	}
+	return samples, nil
+}
+
+// modelWeightsText returns the weights of the models, as ", id=weight"
+// for each model.
+func modelWeightsText(models []string, weights map[string]float64) string {
+	sorted := append([]string{}, models...)
+	sort.Strings(sorted)
+	var b strings.Builder
+	for _, modelID := range sorted {
+		fmt.Fprintf(&b, ", %s=%g", modelID, weights[modelID])
+	}
+	return b.String()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	wace "wace/core"
+	pm "wace/pluginmanager"
+	"wace/replay"
+
+	lg "github.com/tilsor/ModSecIntl_logging/logging"
+
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// replayUsage is the usage of the wace-replay command
+const replayUsage = `Usage: wace-replay [options] config.yaml file...
+
+Replays the transactions of the files (recorded by WACE, or HAR files
+with the ".har" extension) through the model and decision plugins of
+the configuration, and writes the verdict of each transaction and a
+summary: block rate, precision and recall against the labels of the
+transactions, and latency percentiles.
+
+Options:
+`
+
+// paramsFlag is a repeatable flag of name=value params
+type paramsFlag map[string]string
+
+func (p paramsFlag) String() string {
+	params := make([]string, 0, len(p))
+	for name, value := range p {
+		params = append(params, name+"="+value)
+	}
+	sort.Strings(params)
+	return strings.Join(params, ",")
+}
+
+func (p paramsFlag) Set(param string) error {
+	name, value, found := strings.Cut(param, "=")
+	if !found || name == "" {
+		return fmt.Errorf("expected name=value")
+	}
+	p[name] = value
+	return nil
+}
+
+// byPhase returns the model IDs keyed by phase (model plugin type)
+func (w *WaceModels) byPhase() map[string][]string {
+	return map[string][]string{
+		"RequestHeaders":  w.reqHeadModelIDs,
+		"RequestBody":     w.reqBodyModelIDs,
+		"AllRequest":      w.reqModelIDs,
+		"ResponseHeaders": w.respHeadModelIDs,
+		"ResponseBody":    w.respBodyModelIDs,
+		"AllResponse":     w.respModelIDs,
+	}
+}
+
+// loadOffline loads the configuration of the offline commands, and
+// the logger writing to logPath, or the log file of the configuration
+// if empty.
+func loadOffline(configPath, logPath string) error {
+	gConfig = new(generalConfig)
+	err := gConfig.LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("could not load general config: %v", err)
+	}
+	if logPath != "" {
+		gConfig.logPath = logPath
+	}
+	logWriter, err := gConfig.tenantLogWriter()
+	if err == nil {
+		err = logger.LoadLoggerWriter(logWriter, gConfig.logLevel)
+	}
+	if err != nil {
+		return fmt.Errorf("could not open wace log file: %v", err)
+	}
+	return nil
+}
+
+// initOffline initializes the WACE core to analyze the transactions
+// in-process, without metrics nor recording, with the built-in
+// decisions of the configuration and the given ones.
+func initOffline(decisions map[string]func(pm.TransactionInput) (bool, error)) {
+	all := gConfig.decisions()
+	for decisionID, decide := range decisions {
+		all[decisionID] = decide
+	}
+	meter = noop.NewMeterProvider().Meter("wace-offline")
+	wace.Init(meter, wace.Options{
+		ModelOptions:    gConfig.modelOptions,
+		PayloadLimits:   gConfig.payloadLimits,
+		MaxDecodedSize:  gConfig.maxDecodedSize,
+		Decisions:       all,
+		ShadowDecisions: gConfig.shadowDecisions,
+		Canary:          gConfig.canary,
+	})
+}
+
+// replayMain runs the wace-replay command (also run as "wace replay")
+// with the given arguments, and returns its exit status. The
+// transactions go through the same handlers as the calls of the WAFs,
+// without metrics nor recording.
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("wace-replay", flag.ContinueOnError)
+	decision := fs.String("decision", "", "decision asked for the verdicts (default: the recorded one)")
+	recordedModels := fs.Bool("recorded-models", false, "analyze each phase with the recorded model plugins, instead of all the configured ones")
+	concurrency := fs.Int("concurrency", 1, "number of transactions replayed at the same time")
+	jsonOutput := fs.Bool("json", false, "write the results and the summary as JSON lines")
+	logPath := fs.String("log", "", "log file (default: the one of the configuration)")
+	params := paramsFlag{}
+	fs.Var(params, "param", "WAF param sent with the verdict requests, as name=value, replacing the recorded one (can be repeated)")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), replayUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return 2
+	}
+
+	err := loadOffline(fs.Arg(0), *logPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	initOffline(nil)
+	logger.Printf(lg.INFO, "Replaying transactions of %s", strings.Join(fs.Args()[1:], ", "))
+
+	opts := replay.Options{Decision: *decision, Params: params, Concurrency: *concurrency}
+	if !*recordedModels {
+		opts.Models = gConfig.waceModels.byPhase()
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	var results []replay.Result
+	err = replay.New(newHandlers(), opts).ReplayFiles(fs.Args()[1:], func(res replay.Result) {
+		results = append(results, res)
+		if *jsonOutput {
+			encoder.Encode(res)
+		} else {
+			fmt.Println(res)
+		}
+	})
+
+	summary := replay.Summarize(results)
+	if *jsonOutput {
+		encoder.Encode(map[string]replay.Summary{"summary": summary})
+	} else {
+		fmt.Println()
+		summary.Print(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: could not read transactions: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,100 @@
+/*
+Package workerpool implements a bounded pool of workers with a
+bounded waiting queue, used to limit the number of concurrent
+executions of a model plugin.
+*/
+package workerpool
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when the task cannot wait for a worker
+	// because the queue is full.
+	ErrQueueFull = errors.New("worker pool queue is full")
+	// ErrQueueTimeout is returned when the task waited for a worker for
+	// longer than the queue timeout.
+	ErrQueueTimeout = errors.New("worker pool queue timeout")
+)
+
+// Config holds the limits of a worker pool. A zero MaxConcurrency
+// means unlimited concurrency, and a zero QueueTimeout means tasks wait
+// in the queue as long as needed.
+type Config struct {
+	MaxConcurrency int
+	QueueLength    int
+	QueueTimeout   time.Duration
+}
+
+// Pool is a bounded worker pool.
+type Pool struct {
+	conf    Config
+	workers chan struct{}
+	queued  int64
+	running int64
+}
+
+// New creates a new worker pool with the given limits.
+func New(conf Config) *Pool {
+	p := &Pool{conf: conf}
+	if conf.MaxConcurrency > 0 {
+		p.workers = make(chan struct{}, conf.MaxConcurrency)
+	}
+	return p
+}
+
+// Run executes the task once there is a free worker, waiting in the
+// queue if needed. It returns ErrQueueFull or ErrQueueTimeout if the
+// task was rejected, without executing it.
+func (p *Pool) Run(task func()) error {
+	if p.workers != nil {
+		select {
+		case p.workers <- struct{}{}:
+		default:
+			if atomic.AddInt64(&p.queued, 1) > int64(p.conf.QueueLength) {
+				atomic.AddInt64(&p.queued, -1)
+				return ErrQueueFull
+			}
+			err := p.wait()
+			atomic.AddInt64(&p.queued, -1)
+			if err != nil {
+				return err
+			}
+		}
+		defer func() { <-p.workers }()
+	}
+
+	atomic.AddInt64(&p.running, 1)
+	defer atomic.AddInt64(&p.running, -1)
+	task()
+	return nil
+}
+
+// wait waits for a free worker in the queue.
+func (p *Pool) wait() error {
+	if p.conf.QueueTimeout == 0 {
+		p.workers <- struct{}{}
+		return nil
+	}
+	timer := time.NewTimer(p.conf.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case p.workers <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrQueueTimeout
+	}
+}
+
+// QueueDepth returns the number of tasks waiting for a worker.
+func (p *Pool) QueueDepth() int64 {
+	return atomic.LoadInt64(&p.queued)
+}
+
+// Running returns the number of tasks being executed.
+func (p *Pool) Running() int64 {
+	return atomic.LoadInt64(&p.running)
+}
@@ -0,0 +1,77 @@
+package workerpool
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUnlimited(t *testing.T) {
+	p := New(Config{})
+	executed := false
+	if err := p.Run(func() { executed = true }); err != nil {
+		t.Errorf("unlimited pool rejected a task: %v", err)
+	}
+	if !executed {
+		t.Errorf("task not executed")
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	p := New(Config{MaxConcurrency: 1, QueueLength: 1})
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.Run(func() {
+			close(started)
+			<-release
+		})
+	}()
+	<-started
+	go func() {
+		defer wg.Done()
+		if err := p.Run(func() {}); err != nil {
+			t.Errorf("queued task rejected: %v", err)
+		}
+	}()
+	for p.QueueDepth() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := p.Run(func() {}); err != ErrQueueFull {
+		t.Errorf("expected ErrQueueFull, got %v", err)
+	}
+	if p.Running() != 1 {
+		t.Errorf("expected 1 running task, got %d", p.Running())
+	}
+
+	close(release)
+	wg.Wait()
+	if p.QueueDepth() != 0 {
+		t.Errorf("queue not empty after all tasks finished")
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	p := New(Config{MaxConcurrency: 1, QueueLength: 1, QueueTimeout: 10 * time.Millisecond})
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go p.Run(func() {
+		close(started)
+		<-release
+	})
+	<-started
+	defer close(release)
+
+	executed := false
+	if err := p.Run(func() { executed = true }); err != ErrQueueTimeout {
+		t.Errorf("expected ErrQueueTimeout, got %v", err)
+	}
+	if executed {
+		t.Errorf("rejected task executed")
+	}
+}